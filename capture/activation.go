@@ -0,0 +1,98 @@
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Common failures of PcapHandle and SocketHandle, the errors they return match them with errors.Is
+var (
+	ErrPermission    = errors.New("permission denied")
+	ErrDeviceBusy    = errors.New("device busy")
+	ErrNoDevice      = errors.New("no such device")
+	ErrTimestampType = errors.New("unsupported timestamp type")
+)
+
+// FilterError is the failure of the filter of an interface. a filter can compile for some link types and not for
+// others, e.g a filter on the ethernet headers is rejected by the interfaces without link headers
+type FilterError struct {
+	Interface string
+	LinkType  layers.LinkType
+	Filter    string
+	Err       error
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("%v, interface: %q, link type: %s", e.Err, e.Interface, e.LinkType)
+}
+
+func (e *FilterError) Unwrap() error {
+	return e.Err
+}
+
+// activationHints tell the operators how to fix the failures
+var activationHints = map[error]string{
+	ErrPermission:    "Capturing requires root, or the CAP_NET_RAW and CAP_NET_ADMIN capabilities: sudo setcap cap_net_raw,cap_net_admin+eip $(which gor)",
+	ErrDeviceBusy:    "Another process holds the device, e.g a capture in monitor mode, stop it or capture another interface",
+	ErrNoDevice:      "The interface doesn't exist or was removed, check its name with `ip link` or `ifconfig`",
+	ErrTimestampType: "Pick one of the supported timestamp types with --input-raw-timestamp-type, or leave it unset",
+}
+
+// activationError is a failure to open a handle of a known kind, it unwraps to its cause
+type activationError struct {
+	kind  error
+	msg   string
+	cause error
+}
+
+func (e *activationError) Error() string {
+	return fmt.Sprintf("%s. %s", e.msg, activationHints[e.kind])
+}
+
+func (e *activationError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *activationError) Unwrap() error {
+	return e.cause
+}
+
+// activationFailed returns err, the error describing the failure of an operation on a handle, along with
+// the remediation of its cause when the kind of the cause is known
+func activationFailed(err, cause error) error {
+	kind := activationKind(cause)
+	if kind == nil {
+		return err
+	}
+	return &activationError{kind: kind, msg: err.Error(), cause: cause}
+}
+
+// activationKind classifies the errors of the syscalls, or the messages of libpcap
+func activationKind(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrTimestampType):
+		return ErrTimestampType
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return ErrPermission
+	case errors.Is(err, syscall.EBUSY):
+		return ErrDeviceBusy
+	case errors.Is(err, syscall.ENODEV), errors.Is(err, syscall.ENXIO):
+		return ErrNoDevice
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "permission"), strings.Contains(msg, "not permitted"):
+		return ErrPermission
+	case strings.Contains(msg, "busy"):
+		return ErrDeviceBusy
+	case strings.Contains(msg, "no such device"):
+		return ErrNoDevice
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func TestActivationErrors(t *testing.T) {
+	tests := []struct {
+		cause error
+		kind  error
+	}{
+		{syscall.EPERM, ErrPermission},
+		{os.NewSyscallError("socket", syscall.EPERM), ErrPermission},
+		{errors.New("Permission Denied"), ErrPermission}, // libpcap activation
+		{syscall.EBUSY, ErrDeviceBusy},
+		{errors.New("No Such Device"), ErrNoDevice},
+		{fmt.Errorf("Can't find matching interface: %w", syscall.ENODEV), ErrNoDevice},
+		{fmt.Errorf("%w: %v", ErrTimestampType, "adapter"), ErrTimestampType},
+	}
+	for _, tt := range tests {
+		err := activationFailed(fmt.Errorf("sock raw error: %q, interface: %q", tt.cause, "eth0"), tt.cause)
+		if !errors.Is(err, tt.kind) {
+			t.Errorf("expected %v to be %v", err, tt.kind)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "sock raw error: ") || !strings.HasSuffix(err.Error(), activationHints[tt.kind]) {
+			t.Errorf("expected the error along with its hint, got %q", err)
+		}
+	}
+	err := activationFailed(fmt.Errorf("sock raw error: %q", syscall.EPERM), syscall.EPERM)
+	if !errors.Is(err, syscall.EPERM) || !strings.Contains(err.Error(), "setcap") {
+		t.Errorf("expected the syscall error to be wrapped, got %q", err)
+	}
+	cause := errors.New("invalid snapshot length")
+	if err = activationFailed(cause, cause); err != cause {
+		t.Errorf("expected the unknown errors to be left untouched, got %q", err)
+	}
+}
+
+func TestFilterError(t *testing.T) {
+	defer func(f func(pcap.Interface) (Socket, error)) { newSocket = f }(newSocket)
+	newSocket = func(ifi pcap.Interface) (Socket, error) {
+		sock := new(fakeSocket)
+		if ifi.Name == "mock1" {
+			sock.filter = errors.New("invalid argument")
+		}
+		return sock, nil
+	}
+	l := &Listener{Transport: "tcp", ports: []uint16{8000}, Handles: make(map[string]gopacket.ZeroCopyPacketDataSource)}
+	l.Engine = EngineRawSocket
+	l.SetDebugLevel(DebugSilent)
+	l.Interfaces = []pcap.Interface{{Name: "mock0"}, {Name: "mock1"}}
+	var stopped []CaptureEvent
+	l.EventHandler = func(e CaptureEvent) { stopped = append(stopped, e) }
+	// the interface rejecting the filter is skipped
+	if err := l.activateRawSocket(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.Handles["mock0"]; !ok || len(l.Handles) != 1 {
+		t.Errorf("expected mock0 to be captured, got %v", l.Handles)
+	}
+	var filterErr *FilterError
+	if len(stopped) != 1 || !errors.As(stopped[0].Err, &filterErr) {
+		t.Fatalf("expected the filter error of mock1, got %+v", stopped)
+	}
+	if filterErr.Interface != "mock1" || filterErr.LinkType != layers.LinkTypeEthernet || filterErr.Filter == "" {
+		t.Errorf("expected the interface and the link type of the error, got %+v", filterErr)
+	}
+	if !strings.Contains(filterErr.Error(), `interface: "mock1", link type: Ethernet`) {
+		t.Errorf("expected the error to name the interface, got %q", filterErr)
+	}
+
+	// a filter that doesn't compile is rejected before opening the socket
+	l.ExcludeHosts = []string{"foo"}
+	if _, err := l.SocketHandle(pcap.Interface{Name: "mock0"}); !errors.As(err, &filterErr) || filterErr.Interface != "mock0" {
+		t.Errorf("expected a filter error, got %v", err)
+	}
+}
@@ -0,0 +1,30 @@
+package capture
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// pinReader locks the calling goroutine to its thread, and the thread to the index-th CPU the process
+// is allowed to run on, round-robin. it returns the CPU, the thread is released when the goroutine exits
+func pinReader(index int) (int, error) {
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return -1, err
+	}
+	cpus := make([]int, 0, set.Count())
+	for cpu := 0; len(cpus) < cap(cpus); cpu++ {
+		if set.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+	if len(cpus) == 0 {
+		return -1, nil
+	}
+	cpu := cpus[index%len(cpus)]
+	set.Zero()
+	set.Set(cpu)
+	return cpu, unix.SchedSetaffinity(0, &set)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package capture
+
+import "runtime"
+
+// pinReader locks the calling goroutine to its thread, the CPU affinity of the threads is only set on linux
+func pinReader(index int) (int, error) {
+	runtime.LockOSThread()
+	return -1, nil
+}
@@ -0,0 +1,219 @@
+package capture
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// errTruncatedIP is returned for the packets whose addresses were not captured
+var errTruncatedIP = errors.New("truncated IP header")
+
+// maxAnonymizedAddrs bounds the addresses whose pseudonym is cached
+const maxAnonymizedAddrs = 1 << 16
+
+// IPAnonymizer pseudonymizes the IPv4 and IPv6 addresses of the packets with Crypto-PAn, the addresses
+// sharing a prefix are mapped to addresses sharing a prefix of the same length. the mapping only depends
+// on the secret, so that the captures anonymized with the same secret stay consistent with each other
+type IPAnonymizer struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+// NewIPAnonymizer returns an IPAnonymizer keyed by secret, a secret of 32 bytes is used as the key
+// of Crypto-PAn as is, the others are hashed into one
+func NewIPAnonymizer(secret []byte) *IPAnonymizer {
+	key := secret
+	if len(key) != 32 {
+		sum := sha256.Sum256(secret)
+		key = sum[:]
+	}
+	a := &IPAnonymizer{cache: make(map[string]string)}
+	a.block, _ = aes.NewCipher(key[:16]) // the key is always 16 bytes long
+	a.block.Encrypt(a.pad[:], key[16:])
+	return a
+}
+
+// Anonymize returns the pseudonym of an IPv4 or IPv6 address
+func (a *IPAnonymizer) Anonymize(ip []byte) []byte {
+	if len(ip) == 16 && isIPv4Mapped(ip) {
+		ip = ip[12:] // anonymized as an IPv4 address
+	}
+	anon := append([]byte(nil), ip...)
+	a.anonymize(anon)
+	return anon
+}
+
+// anonymize replaces the address ip by its pseudonym
+func (a *IPAnonymizer) anonymize(ip []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if anon, ok := a.cache[string(ip)]; ok {
+		copy(ip, anon)
+		return
+	}
+	if len(a.cache) >= maxAnonymizedAddrs {
+		a.cache = make(map[string]string)
+	}
+	orig := string(ip)
+	// the n-th bit of the pseudonym is flipped by the first bit of the encryption of the pad,
+	// whose first n bits are replaced by the first n bits of the address
+	var block, out [aes.BlockSize]byte
+	var flips [16]byte
+	for pos := 0; pos < len(ip)*8; pos++ {
+		block = a.pad
+		full := pos / 8
+		copy(block[:full], orig[:full])
+		if rem := pos % 8; rem != 0 {
+			mask := byte(0xFF << (8 - rem))
+			block[full] = orig[full]&mask | a.pad[full]&^mask
+		}
+		a.block.Encrypt(out[:], block[:])
+		flips[full] |= (out[0] >> 7) << (7 - pos%8)
+	}
+	for i := range ip {
+		ip[i] ^= flips[i]
+	}
+	a.cache[orig] = string(ip)
+}
+
+// Transform is the IPTransform replacing the source and destination addresses of an IP packet by their
+// pseudonyms. the checksums covering the addresses are updated, they stay invalid when they were invalid.
+// the addresses of the packets quoted by ICMP errors are not replaced
+func (a *IPAnonymizer) Transform(ip []byte) error {
+	s, err := parseIPSegment(ip)
+	if err != nil {
+		return err
+	}
+	old := append([]byte(nil), s.addrs...)
+	half := len(s.addrs) / 2
+	a.anonymize(s.addrs[:half])
+	a.anonymize(s.addrs[half:])
+	if half == 4 {
+		binary.BigEndian.PutUint16(ip[10:], updateChecksum(binary.BigEndian.Uint16(ip[10:]), old, s.addrs))
+	}
+	if field := s.checksumField(); field != -1 {
+		checksum := binary.BigEndian.Uint16(s.transport[field:])
+		// an offloaded checksum only holds the sum of the pseudo header
+		if pseudo := uint32(s.proto) + uint32(s.length); checksum == fold(sum(pseudo, old)) {
+			checksum = fold(sum(pseudo, s.addrs))
+		} else {
+			checksum = s.updateChecksum(checksum, old, s.addrs)
+		}
+		binary.BigEndian.PutUint16(s.transport[field:], checksum)
+	}
+	return nil
+}
+
+// ipSegment is the transport segment of an IP packet
+type ipSegment struct {
+	addrs     []byte // source and destination addresses
+	proto     byte
+	transport []byte // nil when the packet is not the first fragment or its transport header was not captured
+	length    int    // of the segment, as told by the IP header
+}
+
+// parseIPSegment locates the addresses and the transport segment of an IPv4 or IPv6 packet
+func parseIPSegment(ip []byte) (s ipSegment, err error) {
+	if len(ip) == 0 {
+		return s, errTruncatedIP
+	}
+	switch ip[0] >> 4 {
+	case 4:
+		ihl := int(ip[0]&0x0F) * 4
+		if ihl < 20 || len(ip) < ihl {
+			return s, errTruncatedIP
+		}
+		s.addrs, s.proto = ip[12:20], ip[9]
+		if binary.BigEndian.Uint16(ip[6:8])&0x1FFF == 0 { // the transport header is in the first fragment
+			s.transport, s.length = ip[ihl:], int(binary.BigEndian.Uint16(ip[2:4]))-ihl
+		}
+	case 6:
+		if len(ip) < 40 {
+			return s, errTruncatedIP
+		}
+		var offset int
+		s.addrs = ip[8:40]
+		if s.proto, offset = ipv6Transport(ip); offset != 0 && offset <= len(ip) {
+			s.transport, s.length = ip[offset:], 40+int(binary.BigEndian.Uint16(ip[4:6]))-offset
+		}
+	default:
+		return s, errNotIP
+	}
+	return s, nil
+}
+
+// checksumField returns the offset of the TCP or UDP checksum in the segment, it is -1 for the other
+// protocols, the truncated headers and the IPv4 datagrams without UDP checksum
+func (s ipSegment) checksumField() int {
+	switch {
+	case s.proto == tcp.ProtoTCP && len(s.transport) >= 18:
+		return 16
+	case s.proto == tcp.ProtoUDP && len(s.transport) >= 8:
+		if binary.BigEndian.Uint16(s.transport[6:]) == 0 && len(s.addrs) == 8 {
+			return -1 // no checksum
+		}
+		return 6
+	}
+	return -1
+}
+
+// updateChecksum returns the checksum of the segment updated for the words old replaced by new
+func (s ipSegment) updateChecksum(checksum uint16, old, new []byte) uint16 {
+	checksum = updateChecksum(checksum, old, new)
+	if checksum == 0 && s.proto == tcp.ProtoUDP {
+		checksum = 0xFFFF // 0 means no checksum
+	}
+	return checksum
+}
+
+// ipv6Transport skips the extension headers of an IPv6 packet, it returns the protocol and the offset
+// of the transport header. the offset is 0 when the transport header is not in the packet
+func ipv6Transport(ip []byte) (byte, int) {
+	next, offset := ip[6], 40
+	for {
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing and destination options
+			if len(ip) < offset+2 {
+				return next, 0
+			}
+			next, offset = ip[offset], offset+(int(ip[offset+1])+1)*8
+		case 44: // fragment
+			if len(ip) < offset+8 || binary.BigEndian.Uint16(ip[offset+2:])&0xFFF8 != 0 {
+				return next, 0
+			}
+			next, offset = ip[offset], offset+8
+		default:
+			return next, offset
+		}
+	}
+}
+
+// updateChecksum returns checksum updated for the words old replaced by the words new, see RFC 1624
+func updateChecksum(checksum uint16, old, new []byte) uint16 {
+	s := uint32(^checksum)
+	n := len(old) &^ 1
+	for i := 0; i < n; i += 2 {
+		s += uint32(^binary.BigEndian.Uint16(old[i:]))
+	}
+	if n != len(old) {
+		s += uint32(^(uint16(old[n]) << 8)) // padded with a zero byte
+	}
+	return ^fold(sum(s, new))
+}
+
+func isIPv4Mapped(ip []byte) bool {
+	for _, b := range ip[:10] {
+		if b != 0 {
+			return false
+		}
+	}
+	return ip[10] == 0xFF && ip[11] == 0xFF
+}
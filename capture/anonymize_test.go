@@ -0,0 +1,82 @@
+package capture
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// the key and the addresses of the sample of the reference implementation of Crypto-PAn
+var cryptoPAnKey = []byte{21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+	216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2}
+
+func TestIPAnonymizer(t *testing.T) {
+	a := NewIPAnonymizer(cryptoPAnKey)
+	for orig, want := range map[string]string{
+		"128.11.68.132":   "135.242.180.132",
+		"129.118.74.4":    "134.136.186.123",
+		"130.132.252.244": "133.68.164.234",
+		"141.223.7.43":    "141.167.8.160",
+	} {
+		if anon := net.IP(a.Anonymize(net.ParseIP(orig))).String(); anon != want {
+			t.Errorf("%s: expected %s, got %s", orig, want, anon)
+		}
+	}
+	x := a.Anonymize(net.ParseIP("2001:db8::1"))
+	y := a.Anonymize(net.ParseIP("2001:db8::2"))
+	if len(x) != 16 || string(x[:15]) != string(y[:15]) || x[15] == y[15] {
+		t.Errorf("expected the prefix of the IPv6 addresses to be preserved, got %s and %s", net.IP(x), net.IP(y))
+	}
+}
+
+func TestAnonymizeChecksums(t *testing.T) {
+	a := NewIPAnonymizer([]byte("secret"))
+	v := &checksumValidator{}
+	pckt := checksummed(rawPackets(1, 1, 10, 4)[0], [4]byte{192, 0, 2, 1}, [4]byte{10, 0, 0, 1})
+	if err := a.Transform(pckt[4:]); err != nil {
+		t.Fatal(err)
+	}
+	if src := net.IP(pckt[4+12 : 4+16]); src.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("expected the source address to be replaced")
+	}
+	if !v.valid(pckt[4:]) {
+		t.Error("expected the checksums to be updated")
+	}
+	pckt = checksummed(rawPackets(1, 1, 10, 4)[0], [4]byte{192, 0, 2, 1}, [4]byte{10, 0, 0, 1})
+	pckt[len(pckt)-1] ^= 0xFF
+	if err := a.Transform(pckt[4:]); err != nil || v.valid(pckt[4:]) {
+		t.Errorf("expected an invalid checksum to stay invalid, %v", err)
+	}
+	if err := a.Transform([]byte{0x45, 0}); err != errTruncatedIP {
+		t.Errorf("expected a truncated header to be rejected, got %v", err)
+	}
+}
+
+func TestListenerTransform(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.AnonymizeKey = "secret"
+	var dumped []net.IP
+	l.DumpHandler = func(_ string, data []byte, _ *gopacket.CaptureInfo, _ layers.LinkType) error {
+		dumped = append(dumped, append(net.IP(nil), data[4+12:4+16]...))
+		return nil
+	}
+	for _, data := range rawPackets(1, 2, 10, 4) {
+		h.packets <- data
+	}
+	h.packets <- []byte{2, 0, 0, 0, 0x45}
+	close(h.packets)
+	var handled []*tcp.Packet
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) { handled = append(handled, pckt) })
+	if len(dumped) != 2 || len(handled) != 2 || l.Untransformed() != 1 {
+		t.Fatalf("expected 2 packets dumped and handled and 1 dropped, got %d %d %d", len(dumped), len(handled), l.Untransformed())
+	}
+	anon := net.IP(NewIPAnonymizer([]byte("secret")).Anonymize(net.IPv4(127, 0, 0, 1)))
+	if !dumped[0].Equal(anon) || !handled[0].SrcIP.Equal(anon) {
+		t.Errorf("expected the address to be anonymized as %s, got %s and %s", anon, dumped[0], handled[0].SrcIP)
+	}
+}
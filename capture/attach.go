@@ -0,0 +1,40 @@
+package capture
+
+import (
+	"fmt"
+)
+
+// AttachPoint is where the packets are captured on their way through the network stack
+type AttachPoint uint8
+
+// Available attach points
+const (
+	// PointDefault captures the packets received and sent by the interfaces
+	PointDefault AttachPoint = iota
+	// PointEgress only captures the packets sent by the host. on linux the packet taps see them once
+	// the qdisc released them to the driver, so they are timed after the tc shaping
+	PointEgress
+)
+
+// Set is here so that AttachPoint can implement flag.Var
+func (p *AttachPoint) Set(v string) error {
+	switch v {
+	case "", "default":
+		*p = PointDefault
+	case "egress":
+		*p = PointEgress
+	default:
+		return fmt.Errorf("invalid attach point %s", v)
+	}
+	return nil
+}
+
+func (p *AttachPoint) String() string {
+	switch *p {
+	case PointDefault:
+		return "default"
+	case PointEgress:
+		return "egress"
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package capture
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// default limits of a batch, see PcapOptions.BatchSize and PcapOptions.BatchTimeout
+const (
+	defaultBatchSize    = 64
+	defaultBatchTimeout = 10 * time.Millisecond
+)
+
+// BatchHandler is called with the packets read in the order they were handled, the slice and the packets
+// belong to the handler, they are not reused by the listener
+type BatchHandler func([]*tcp.Packet)
+
+// batcher accumulates the packets of all the handles, a batch is flushed once it is full or once its first
+// packet is older than timeout. the batches are delivered one at a time
+type batcher struct {
+	sync.Mutex
+	handler BatchHandler
+	size    int
+	timeout time.Duration
+	pckts   []*tcp.Packet
+	timer   *time.Timer
+	gen     uint64 // of the batch being accumulated, a timer of a batch already flushed is ignored
+	stopped bool
+}
+
+func newBatcher(handler BatchHandler, size int, timeout time.Duration) *batcher {
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	if timeout <= 0 {
+		timeout = defaultBatchTimeout
+	}
+	return &batcher{handler: handler, size: size, timeout: timeout}
+}
+
+// add appends a copy of a packet to the batch, the addresses of a parsed packet point to the data of the
+// handle which is reused by the next read
+func (b *batcher) add(pckt *tcp.Packet, _ PacketMeta) {
+	cp := *pckt
+	cp.SrcIP = append(net.IP(nil), pckt.SrcIP...)
+	cp.DstIP = append(net.IP(nil), pckt.DstIP...)
+	b.Lock()
+	defer b.Unlock()
+	if b.stopped {
+		return
+	}
+	if b.pckts == nil {
+		b.pckts = make([]*tcp.Packet, 0, b.size)
+		gen := b.gen
+		b.timer = time.AfterFunc(b.timeout, func() { b.expire(gen) })
+	}
+	b.pckts = append(b.pckts, &cp)
+	if len(b.pckts) >= b.size {
+		b.flush()
+	}
+}
+
+// expire flushes the batch gen if it wasn't flushed yet
+func (b *batcher) expire(gen uint64) {
+	b.Lock()
+	defer b.Unlock()
+	if gen == b.gen && !b.stopped {
+		b.flush()
+	}
+}
+
+// flush delivers the batch being accumulated, b must be locked
+func (b *batcher) flush() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	pckts := b.pckts
+	b.pckts = nil
+	b.gen++
+	if len(pckts) != 0 {
+		b.handler(pckts)
+	}
+}
+
+// stop delivers the partial batch, the packets added later are dropped
+func (b *batcher) stop() {
+	b.Lock()
+	defer b.Unlock()
+	if !b.stopped {
+		b.flush()
+		b.stopped = true
+	}
+}
+
+// ListenBatch is Listen with a handler called with batches of up to BatchSize packets, a partial batch is
+// delivered once its first packet was read BatchTimeout ago, and when the listener stops
+func (l *Listener) ListenBatch(ctx context.Context, handler BatchHandler) (err error) {
+	b := newBatcher(handler, l.BatchSize, l.BatchTimeout)
+	// the handles are all closed when ListenWithMeta returns, no packet is added past it
+	defer b.stop()
+	return l.ListenWithMeta(ctx, b.add)
+}
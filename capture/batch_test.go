@@ -0,0 +1,133 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket/layers"
+)
+
+func TestBatcher(t *testing.T) {
+	var batches [][]*tcp.Packet
+	b := newBatcher(func(pckts []*tcp.Packet) { batches = append(batches, pckts) }, 3, time.Hour)
+	data := []byte{10, 0, 0, 1, 10, 0, 0, 2}
+	for i := 0; i < 4; i++ {
+		b.add(&tcp.Packet{SrcIP: data[:4], DstIP: data[4:], Seq: uint32(i)}, PacketMeta{})
+	}
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("expected a batch of 3 packets, got %v", batches)
+	}
+	// the addresses don't share the data they were parsed from
+	data[0] = 99
+	if !batches[0][0].SrcIP.Equal(net.IP{10, 0, 0, 1}) || !batches[0][2].DstIP.Equal(net.IP{10, 0, 0, 2}) {
+		t.Errorf("expected the addresses to be copied, got %s %s", batches[0][0].SrcIP, batches[0][2].DstIP)
+	}
+	b.stop()
+	if len(batches) != 2 || len(batches[1]) != 1 || batches[1][0].Seq != 3 {
+		t.Fatalf("expected the partial batch to be delivered on stop, got %v", batches)
+	}
+	b.add(&tcp.Packet{}, PacketMeta{})
+	b.stop()
+	if len(batches) != 2 {
+		t.Errorf("expected no batch past stop, got %d", len(batches))
+	}
+}
+
+func TestBatcherTimeout(t *testing.T) {
+	flushed := make(chan []*tcp.Packet, 1)
+	b := newBatcher(func(pckts []*tcp.Packet) { flushed <- pckts }, 100, 10*time.Millisecond)
+	b.add(&tcp.Packet{}, PacketMeta{})
+	b.add(&tcp.Packet{}, PacketMeta{})
+	select {
+	case pckts := <-flushed:
+		if len(pckts) != 2 {
+			t.Errorf("expected 2 packets, got %d", len(pckts))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the partial batch to be delivered after the timeout")
+	}
+	b.stop()
+}
+
+func TestListenBatch(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.BatchSize, l.BatchTimeout = 4, time.Hour
+	var (
+		mu    sync.Mutex
+		sizes []int
+		seqs  []uint32
+	)
+	done := make(chan error, 1)
+	go func() {
+		done <- l.ListenBatch(context.Background(), func(pckts []*tcp.Packet) {
+			mu.Lock()
+			defer mu.Unlock()
+			sizes = append(sizes, len(pckts))
+			for _, pckt := range pckts {
+				if !pckt.SrcIP.Equal(net.IP{127, 0, 0, 1}) {
+					t.Errorf("expected the source 127.0.0.1, got %s", pckt.SrcIP)
+				}
+				seqs = append(seqs, pckt.Seq)
+			}
+		})
+	}()
+	for _, data := range rawPackets(1, 6, 10, 4) {
+		h.packets <- data
+	}
+	close(h.packets)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(sizes) != "[4 2]" {
+		t.Errorf("expected batches of 4 and 2 packets, got %v", sizes)
+	}
+	if fmt.Sprint(seqs) != "[1 2 3 4 5 6]" {
+		t.Errorf("expected the packets in order, got %v", seqs)
+	}
+}
+
+// BenchmarkBatchHandler compares a handler with a per-call cost called on every packet to the same handler
+// called on batches, the setup is a lock and a short spin, like starting a transaction
+func BenchmarkBatchHandler(b *testing.B) {
+	var mu sync.Mutex
+	setup := func() {
+		mu.Lock()
+		spin(time.Microsecond)
+		mu.Unlock()
+	}
+	b.Run("packet", func(b *testing.B) {
+		l := newFakeListener()
+		l.SetDebugLevel(DebugSilent)
+		if err := l.AddPacketSource("generator", newPacketGenerator(512, 1024, 0, b.N), layers.LinkTypeLoop); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		if err := l.Listen(context.Background(), func(*tcp.Packet) { setup() }); err != nil {
+			b.Fatal(err)
+		}
+	})
+	for _, size := range []int{16, 64, 256} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			l := newFakeListener()
+			l.SetDebugLevel(DebugSilent)
+			l.BatchSize = size
+			if err := l.AddPacketSource("generator", newPacketGenerator(512, 1024, 0, b.N), layers.LinkTypeLoop); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			if err := l.ListenBatch(context.Background(), func([]*tcp.Packet) { setup() }); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packetGenerator is a packet source of loopback TCP packets carrying size bytes of payload, spread over
+// flows connections and sent at rate packets per second, or as fast as they are read when rate is 0.
+// the packets sent while the reader is behind are buffered up to buffer packets, the next ones are
+// dropped the way the kernel drops them. it returns io.EOF once count packets were sent
+type packetGenerator struct {
+	rate, buffer, count int
+	packets             [][]byte // of every flow
+	start               time.Time
+	read, dropped       int
+}
+
+func newPacketGenerator(size, flows, rate, count int) *packetGenerator {
+	g := &packetGenerator{rate: rate, buffer: 4096, count: count, packets: make([][]byte, flows)}
+	for i := range g.packets {
+		data := append(generateHeader4(1, uint16(size)), make([]byte, size)...)
+		// a flow by source port and address
+		binary.BigEndian.PutUint16(data[4+24:], uint16(1024+i%60000))
+		data[4+12+2] = byte(i / 60000)
+		g.packets[i] = data
+	}
+	return g
+}
+
+func (g *packetGenerator) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	now := time.Now()
+	if g.start.IsZero() {
+		g.start = now
+	}
+	if g.rate > 0 {
+		sent := int(now.Sub(g.start).Seconds() * float64(g.rate))
+		if sent > g.count {
+			sent = g.count
+		}
+		if queued := sent - g.read - g.dropped; queued > g.buffer {
+			g.dropped += queued - g.buffer
+		}
+		if next := g.read + g.dropped; next < g.count && next >= sent {
+			// waiting for the next packet
+			time.Sleep(g.start.Add(time.Duration(next+1) * time.Second / time.Duration(g.rate)).Sub(now))
+			now = time.Now()
+		}
+	}
+	n := g.read + g.dropped
+	if n >= g.count {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := g.packets[n%len(g.packets)]
+	binary.BigEndian.PutUint32(data[4+24+4:], uint32(n/len(g.packets)+1)) // sequence number
+	g.read++
+	return data, gopacket.CaptureInfo{Timestamp: now, CaptureLength: len(data), Length: len(data)}, nil
+}
+
+// spin keeps the CPU busy for d, sleeping is too coarse to mimic the handlers
+func spin(d time.Duration) {
+	for start := time.Now(); time.Since(start) < d; {
+	}
+}
+
+// BenchmarkReadLoop reads generated packets through the read loop of a listener, packets/s tells the
+// throughput, and drops/op the share of the packets lost while the handler was too slow for the rate
+func BenchmarkReadLoop(b *testing.B) {
+	for _, bb := range []struct {
+		size, flows, rate int
+		latency           time.Duration
+	}{
+		{64, 1, 0, 0},
+		{1400, 1, 0, 0},
+		{512, 1024, 0, 0},
+		{512, 1024, 100000, 0},
+		{512, 1024, 100000, 5 * time.Microsecond},
+		{512, 1024, 100000, 20 * time.Microsecond},
+	} {
+		name := fmt.Sprintf("size=%d/flows=%d/rate=%d/latency=%s", bb.size, bb.flows, bb.rate, bb.latency)
+		b.Run(name, func(b *testing.B) {
+			g := newPacketGenerator(bb.size, bb.flows, bb.rate, b.N)
+			l := newFakeListener()
+			l.SetDebugLevel(DebugSilent)
+			if err := l.AddPacketSource("generator", g, layers.LinkTypeLoop); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			err := l.Listen(context.Background(), func(*tcp.Packet) { spin(bb.latency) })
+			elapsed := time.Since(start)
+			b.StopTimer()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(g.read)/elapsed.Seconds(), "packets/s")
+			b.ReportMetric(float64(g.dropped)/float64(b.N), "drops/op")
+		})
+	}
+}
+
+// BenchmarkParsePath measures the parsing of the packets of many flows, without the read loop
+func BenchmarkParsePath(b *testing.B) {
+	for _, bb := range []struct {
+		name  string
+		setup func(*Listener)
+	}{
+		{"payload", func(*Listener) {}},
+		{"close-tracking", func(l *Listener) { l.CloseHandler = func(tcp.FlowKey, tcp.CloseReason) {} }},
+		{"flow-budget", func(l *Listener) { l.FlowByteBudget = 64 << 10 }},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			l := newFakeListener()
+			l.SetDebugLevel(DebugSilent)
+			bb.setup(l)
+			l.read(func(*tcp.Packet, PacketMeta) {})
+			g := newPacketGenerator(512, 1024, 0, b.N)
+			meta := PacketMeta{Interface: "generator", LinkType: layers.LinkTypeLoop}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				data, ci, _ := g.ZeroCopyReadPacketData()
+				l.handlePacket(func(*tcp.Packet, PacketMeta) {}, meta, data, 4, &ci)
+			}
+		})
+	}
+}
+
+// BenchmarkTransformPipeline measures the pipeline set with Use on the packets of many flows
+func BenchmarkTransformPipeline(b *testing.B) {
+	rewrite := func(pckt *tcp.Packet) (*tcp.Packet, bool) {
+		pckt.DstPort = 80
+		return pckt, true
+	}
+	for _, bb := range []struct {
+		name       string
+		transforms []PacketTransform
+	}{
+		{"empty", nil},
+		{"sample", []PacketTransform{Sample(4)}},
+		{"chain", []PacketTransform{rewrite, Sample(1), rewrite, Sample(1)}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			l := newFakeListener()
+			l.Use(bb.transforms...)
+			l.read(func(*tcp.Packet, PacketMeta) {})
+			g := newPacketGenerator(512, 1024, 0, b.N)
+			meta := PacketMeta{Interface: "generator", LinkType: layers.LinkTypeLoop}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				data, ci, _ := g.ZeroCopyReadPacketData()
+				l.handlePacket(func(*tcp.Packet, PacketMeta) {}, meta, data, 4, &ci)
+			}
+		})
+	}
+}
+
+// BenchmarkFlowDispatcher dispatches the packets of many flows to workers slower than the dispatch,
+// overflows/op tells the share of the packets that found their queue full
+func BenchmarkFlowDispatcher(b *testing.B) {
+	g := newPacketGenerator(512, 1024, 0, 1024)
+	pckts := make([]*tcp.Packet, 1024)
+	for i := range pckts {
+		data, ci, _ := g.ZeroCopyReadPacketData()
+		pckt, err := tcp.ParsePacket(append([]byte(nil), data...), int(layers.LinkTypeLoop), 4, &ci)
+		if err != nil {
+			b.Fatal(err)
+		}
+		pckts[i] = pckt
+	}
+	for _, policy := range []OverflowPolicy{PolicyBlock, PolicyDropNewest, PolicyDropOldest, PolicyDropFlow} {
+		for _, latency := range []time.Duration{0, 2 * time.Microsecond} {
+			b.Run(fmt.Sprintf("%s/latency=%s", policy.String(), latency), func(b *testing.B) {
+				d := NewFlowDispatcher(4, func(int) PacketHandler {
+					return func(*tcp.Packet) { spin(latency) }
+				})
+				d.Policy = policy
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					d.PacketHandler(pckts[i%len(pckts)])
+				}
+				d.Close()
+				b.StopTimer()
+				var overflows uint64
+				for _, n := range d.Overflows() {
+					overflows += n
+				}
+				b.ReportMetric(float64(overflows)/float64(b.N), "overflows/op")
+			})
+		}
+	}
+}
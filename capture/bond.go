@@ -0,0 +1,47 @@
+package capture
+
+import (
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// setBondMembers replaces the bond and team interfaces selected by their members when BondMembers is set.
+// depending on the driver, capturing a bond may only see the packets of some of its members, e.g with LACP
+// each member carries its share of the flows. the members are filtered with the addresses of their bond,
+// those that are not available are skipped
+func (l *Listener) setBondMembers(avail map[string]pcap.Interface) {
+	l.bondMasters = nil
+	if !l.BondMembers {
+		return
+	}
+	selected := make(map[string]bool, len(l.Interfaces))
+	for _, ifi := range l.Interfaces {
+		selected[ifi.Name] = true
+	}
+	ifis := make([]pcap.Interface, 0, len(l.Interfaces))
+	for _, ifi := range l.Interfaces {
+		var members []pcap.Interface
+		for _, name := range bondMembers(ifi.Name) {
+			if member, ok := avail[name]; ok && !selected[name] {
+				members = append(members, member)
+			}
+		}
+		if len(members) == 0 {
+			ifis = append(ifis, ifi)
+			continue
+		}
+		if l.bondMasters == nil {
+			l.bondMasters = make(map[string]pcap.Interface)
+		}
+		names := make([]string, 0, len(members))
+		for _, member := range members {
+			selected[member.Name] = true
+			l.bondMasters[member.Name] = ifi
+			names = append(names, member.Name)
+		}
+		l.debug(DebugInfo, "Interface: %s. Captured on its members %s\n", ifi.Name, strings.Join(names, ", "))
+		ifis = append(ifis, members...)
+	}
+	l.Interfaces = ifis
+}
@@ -0,0 +1,73 @@
+package capture
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysClassNet is where the kernel lists the network interfaces
+var sysClassNet = "/sys/class/net"
+
+// ethtoolGDrvInfo reads the driver of an interface, see linux/ethtool.h
+const ethtoolGDrvInfo = 0x03
+
+type ethtoolDrvInfo struct {
+	cmd     uint32
+	driver  [32]byte
+	version [32]byte
+	fw      [32]byte
+	bus     [32]byte
+	erom    [32]byte
+	_       [12]byte
+	_       [5]uint32
+}
+
+// bondMembers returns the members of a bond or team interface, sorted by name. it is empty for the other interfaces
+var bondMembers = func(name string) []string {
+	dir := filepath.Join(sysClassNet, name)
+	if _, err := os.Stat(filepath.Join(dir, "bonding")); err == nil {
+		slaves, _ := ioutil.ReadFile(filepath.Join(dir, "bonding", "slaves"))
+		members := strings.Fields(string(slaves))
+		sort.Strings(members)
+		return members
+	}
+	if interfaceDriver(name) != "team" {
+		return nil
+	}
+	lowers, _ := filepath.Glob(filepath.Join(dir, "lower_*"))
+	members := make([]string, 0, len(lowers))
+	for _, lower := range lowers {
+		members = append(members, strings.TrimPrefix(filepath.Base(lower), "lower_"))
+	}
+	sort.Strings(members)
+	return members
+}
+
+// interfaceDriver returns the name of the driver of an interface, empty when it is not known
+func interfaceDriver(name string) string {
+	if len(name) >= unix.IFNAMSIZ {
+		return ""
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return ""
+	}
+	defer unix.Close(fd)
+	info := &ethtoolDrvInfo{cmd: ethtoolGDrvInfo}
+	ifr := &ifreqData{data: uintptr(unsafe.Pointer(info))}
+	copy(ifr.name[:], name)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(ifr)))
+	runtime.KeepAlive(info)
+	if errno != 0 {
+		return ""
+	}
+	return string(bytes.TrimRight(info.driver[:], "\x00"))
+}
@@ -0,0 +1,29 @@
+package capture
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSysfsBondMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(s string) { sysClassNet = s }(sysClassNet)
+	sysClassNet = dir
+	os.MkdirAll(filepath.Join(dir, "mockbond0", "bonding"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "mockbond0", "bonding", "slaves"), []byte("mock1 mock0\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, "mock0"), 0755)
+
+	if members := bondMembers("mockbond0"); !reflect.DeepEqual(members, []string{"mock0", "mock1"}) {
+		t.Errorf("expected the members of the bond, got %v", members)
+	}
+	if members := bondMembers("mock0"); len(members) != 0 {
+		t.Errorf("expected no member, got %v", members)
+	}
+}
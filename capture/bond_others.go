@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package capture
+
+// bondMembers returns the members of a bond or team interface, they are only known on linux
+var bondMembers = func(name string) []string {
+	return nil
+}
@@ -0,0 +1,54 @@
+package capture
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+)
+
+func TestBondMembers(t *testing.T) {
+	defer func(f func() ([]pcap.Interface, error)) { findAllDevs = f }(findAllDevs)
+	defer func(f func(string) []string) { bondMembers = f }(bondMembers)
+	findAllDevs = func() ([]pcap.Interface, error) {
+		return []pcap.Interface{
+			{Name: "mockbond0", Flags: pcapIfUp, Addresses: []pcap.InterfaceAddress{{IP: net.IP{192, 0, 2, 1}}}},
+			{Name: "mock0", Flags: pcapIfUp},
+			{Name: "mock1", Flags: pcapIfUp},
+		}, nil
+	}
+	bondMembers = func(name string) []string {
+		if name == "mockbond0" {
+			return []string{"mock0", "mock1", "mock2"}
+		}
+		return nil
+	}
+
+	l := &Listener{Transport: "tcp", ports: []uint16{8000}, host: "mockbond0"}
+	l.setInterfaces()
+	if len(l.Interfaces) != 1 || l.Interfaces[0].Name != "mockbond0" {
+		t.Errorf("expected the bond to be captured, got %v", l.Interfaces)
+	}
+
+	// the interfaces are selected again
+	l.SetPcapOptions(PcapOptions{BondMembers: true})
+	var names []string
+	for _, ifi := range l.Interfaces {
+		names = append(names, ifi.Name)
+	}
+	// the member that is not available is skipped
+	if got := strings.Join(names, ","); got != "mock0,mock1" {
+		t.Fatalf("expected the members of the bond to be captured, got %v", got)
+	}
+	if filter := l.Filter(l.Interfaces[0]); !strings.Contains(filter, "192.0.2.1") {
+		t.Errorf("expected the members to be filtered with the addresses of the bond, got %q", filter)
+	}
+
+	// the error of selecting the interfaces again is returned
+	findAllDevs = func() ([]pcap.Interface, error) { return nil, errors.New("no devices") }
+	if err := l.SetPcapOptions(PcapOptions{}); err == nil {
+		t.Error("expected the error of selecting the interfaces")
+	}
+}
@@ -0,0 +1,86 @@
+package capture
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// budgetExpire is how long a flow is remembered without packets, it then gets a new budget
+const budgetExpire = 2 * time.Minute
+
+// flowBudget forwards the first bytes of payload of every flow, the packets past the budget are dropped until
+// the connection is closed by FIN or RST, or opened again by a SYN, or is forgotten once idle.
+// the packet reaching the budget is forwarded whole
+type flowBudget struct {
+	truncated uint64 // first field to be 64-bit aligned for atomic operations
+	flowTable        // of *budgetState
+	budget    int
+}
+
+type budgetState struct {
+	forwarded int
+	over      bool
+}
+
+func newFlowBudget(budget int, limits *StateLimits) *flowBudget {
+	b := &flowBudget{budget: budget}
+	b.init(0, budgetExpire)
+	b.limits = limits
+	return b
+}
+
+// allow reports whether a packet carrying payload is within the budget of its flow
+func (b *flowBudget) allow(pckt *tcp.Packet) bool {
+	now := pckt.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+	b.Lock()
+	defer b.Unlock()
+	var state *budgetState
+	if s, ok := b.lookup(pckt.Flow, now); ok {
+		state = s.(*budgetState)
+	} else {
+		state = new(budgetState)
+		b.store(pckt.Flow, state, now)
+	}
+	if state.forwarded >= b.budget {
+		if !state.over {
+			state.over = true
+			atomic.AddUint64(&b.truncated, 1)
+		}
+		return false
+	}
+	state.forwarded += len(pckt.Payload)
+	return true
+}
+
+// track resets the budget of a connection closed or opened again
+func (b *flowBudget) track(sig closeSignal) {
+	b.Lock()
+	defer b.Unlock()
+	if sig.syn {
+		b.remove(sig.key)
+		return
+	}
+	b.closed(sig.key, dirIndex(sig.reversed), &tcp.Packet{FIN: sig.fin, RST: sig.rst})
+}
+
+// stateCloses reports whether the FIN and RST packets, which usually don't carry payload, are to be tracked
+// to reset the budget of the connections, or forget the ones done with MatchOnce
+func (l *Listener) stateCloses() bool {
+	return (l.budget != nil || l.matcher != nil && l.matcher.once) && l.Transport == "tcp"
+}
+
+// TruncatedFlows returns the number of flows whose packets were dropped past FlowByteBudget, a connection
+// opened again on the same addresses and ports is counted again
+func (l *Listener) TruncatedFlows() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	if l.budget == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.budget.truncated)
+}
@@ -0,0 +1,56 @@
+package capture
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestFlowBudget(t *testing.T) {
+	b := newFlowBudget(100, new(StateLimits))
+	now := time.Now()
+	packet := func(srcPort uint16, payload int, at time.Duration) *tcp.Packet {
+		pckt := &tcp.Packet{Payload: make([]byte, payload), Timestamp: now.Add(at)}
+		pckt.Flow, pckt.Reversed = tcp.NewFlowKey(net.IP{10, 0, 0, 1}, srcPort, net.IP{10, 0, 0, 2}, 80)
+		return pckt
+	}
+	// the packet reaching the budget is forwarded whole
+	for i, want := range []bool{true, true, false, false} {
+		if ok := b.allow(packet(5535, 60, 0)); ok != want {
+			t.Errorf("packet %d: expected %v, got %v", i, want, ok)
+		}
+	}
+	if !b.allow(packet(5536, 60, 0)) {
+		t.Error("expected another flow to have its own budget")
+	}
+	if b.truncated != 1 {
+		t.Errorf("expected 1 truncated flow, got %d", b.truncated)
+	}
+
+	// a reset connection gets a new budget
+	first := packet(5535, 0, 0)
+	b.track(closeSignal{key: first.Flow, rst: true})
+	if !b.allow(packet(5535, 60, 0)) {
+		t.Error("expected the budget to be reset by RST")
+	}
+	// so does a connection closed by both sides
+	b.allow(packet(5535, 60, 0))
+	b.track(closeSignal{key: first.Flow, fin: true})
+	if b.allow(packet(5535, 60, 0)) {
+		t.Error("expected a half-closed connection to keep its budget")
+	}
+	b.track(closeSignal{key: first.Flow, reversed: true, fin: true})
+	if !b.allow(packet(5535, 60, 0)) {
+		t.Error("expected the budget to be reset by the FINs")
+	}
+	// or an idle one
+	b.allow(packet(5535, 60, 0))
+	if !b.allow(packet(5535, 60, 2*budgetExpire)) {
+		t.Error("expected an idle flow to be forgotten")
+	}
+	if b.truncated != 2 {
+		t.Errorf("expected 2 truncated flows, got %d", b.truncated)
+	}
+}
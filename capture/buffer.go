@@ -0,0 +1,77 @@
+package capture
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/buger/goreplay/size"
+)
+
+// BufferSize is the size of the OS buffer of a handle
+type BufferSize struct {
+	Requested size.Size // 0 when the system default is used
+	Effective size.Size // 0 when the system does not report it, libpcap does not expose the size of its ring
+}
+
+// InterfaceSizes are sizes set per interface name, it implements flag.Value with "name=size" values
+type InterfaceSizes map[string]size.Size
+
+func (s *InterfaceSizes) String() string {
+	var sizes []string
+	for name, siz := range *s {
+		sizes = append(sizes, fmt.Sprintf("%s=%d", name, siz))
+	}
+	sort.Strings(sizes)
+	return strings.Join(sizes, ",")
+}
+
+// Set parses a "name=size" value, it can be called several times
+func (s *InterfaceSizes) Set(value string) error {
+	i := strings.LastIndexByte(value, '=')
+	if i <= 0 {
+		return fmt.Errorf("expected name=size, got %q", value)
+	}
+	var siz size.Size
+	if err := siz.Set(value[i+1:]); err != nil {
+		return err
+	}
+	if *s == nil {
+		*s = make(InterfaceSizes)
+	}
+	(*s)[value[:i]] = siz
+	return nil
+}
+
+// requestedBufferSize returns the buffer size requested for the interface, InterfaceBufferSize overrides BufferSize
+func (l *Listener) requestedBufferSize(name string) size.Size {
+	if siz, ok := l.InterfaceBufferSize[name]; ok {
+		return siz
+	}
+	return l.BufferSize
+}
+
+// recordBufferSizes records the requested and effective buffer sizes of the handles, by interface name
+func (l *Listener) recordBufferSizes(effective map[string]size.Size) {
+	l.bufferSizes = make(map[string]BufferSize)
+	for name := range l.Handles {
+		bs := BufferSize{Requested: l.requestedBufferSize(name), Effective: effective[name]}
+		l.bufferSizes[name] = bs
+		l.setEffective(name, func(opts *EffectiveOptions) { opts.BufferSize = bs })
+		l.debug(DebugInfo, "Interface: %s. Buffer size: requested %d, effective %d\n", name, bs.Requested, bs.Effective)
+		if bs.Effective != 0 && bs.Effective < bs.Requested {
+			l.debug(DebugWarn, "Interface: %s. The buffer size was clamped from %d to %d bytes\n", name, bs.Requested, bs.Effective)
+		}
+	}
+}
+
+// BufferSizes returns the buffer sizes of the handles once they are activated
+func (l *Listener) BufferSizes() map[string]BufferSize {
+	l.Lock()
+	defer l.Unlock()
+	sizes := make(map[string]BufferSize, len(l.bufferSizes))
+	for name, bs := range l.bufferSizes {
+		sizes[name] = bs
+	}
+	return sizes
+}
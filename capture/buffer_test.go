@@ -0,0 +1,54 @@
+package capture
+
+import (
+	"testing"
+
+	"github.com/buger/goreplay/size"
+
+	"github.com/google/gopacket"
+)
+
+func TestInterfaceSizes(t *testing.T) {
+	var sizes InterfaceSizes
+	for _, v := range []string{"eth0=64mb", "eth1=1024", "eth0=32mb"} {
+		if err := sizes.Set(v); err != nil {
+			t.Errorf("%s: expected error to be nil, got %v", v, err)
+		}
+	}
+	if sizes["eth0"] != 32<<20 || sizes["eth1"] != 1024 {
+		t.Errorf("unexpected sizes %v", sizes)
+	}
+	if s := sizes.String(); s != "eth0=33554432,eth1=1024" {
+		t.Errorf("unexpected string %q", s)
+	}
+	for _, v := range []string{"eth0", "=1mb", "eth0=1zb"} {
+		if err := sizes.Set(v); err == nil {
+			t.Errorf("%s: expected an error", v)
+		}
+	}
+}
+
+func TestRequestedBufferSize(t *testing.T) {
+	l := &Listener{}
+	l.BufferSize = 2 << 20
+	l.InterfaceBufferSize = InterfaceSizes{"eth1": 64 << 20}
+	if siz := l.requestedBufferSize("eth0"); siz != 2<<20 {
+		t.Errorf("expected the default buffer size, got %d", siz)
+	}
+	if siz := l.requestedBufferSize("eth1"); siz != 64<<20 {
+		t.Errorf("expected the interface buffer size, got %d", siz)
+	}
+
+	l.Handles = map[string]gopacket.ZeroCopyPacketDataSource{"eth0": nil, "eth1": nil}
+	l.recordBufferSizes(nil)
+	want := map[string]size.Size{"eth0": 2 << 20, "eth1": 64 << 20}
+	sizes := l.BufferSizes()
+	if len(sizes) != 2 {
+		t.Errorf("expected 2 buffer sizes, got %v", sizes)
+	}
+	for name, bs := range sizes {
+		if bs.Requested != want[name] {
+			t.Errorf("%s: expected requested size %d, got %d", name, want[name], bs.Requested)
+		}
+	}
+}
@@ -1,16 +1,20 @@
 package capture
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -22,9 +26,51 @@ import (
 	"github.com/google/gopacket/pcap"
 )
 
+// findAllDevs lists the devices that can be captured, it is replaced in tests
+var findAllDevs = pcap.FindAllDevs
+
+// netInterfaces lists the network interfaces of the system, it is replaced in tests
+var netInterfaces = net.Interfaces
+
+// newSocket opens the raw socket of an interface, it is replaced in tests
+var newSocket = func(ifi pcap.Interface) (Socket, error) {
+	sock, err := NewSocket(ifi)
+	if err != nil {
+		return nil, err
+	}
+	return sock, nil
+}
+
+// PCAP_IF_LOOPBACK and PCAP_IF_UP flags of pcap.Interface
+const (
+	pcapIfLoopback = 0x1
+	pcapIfUp       = 0x2
+)
+
 // PacketHandler is a function that is used to handle packets
 type PacketHandler func(*tcp.Packet)
 
+// PacketMeta describes where a packet was captured
+type PacketMeta struct {
+	Interface string          // key of the handle the packet was read from in Listener.Handles
+	LinkType  layers.LinkType // link type of that handle
+	// CaptureInfo of the frame the packet was parsed from, as read from the handle, e.g its InterfaceIndex
+	// and the AncillaryData of the raw sockets, see AncillaryPacketType and AncillaryVLAN
+	CaptureInfo gopacket.CaptureInfo
+	TEID        uint32             // tunnel endpoint identifier of the GTP-U packet the packet was carried by, see DecapGTP
+	counters    *interfaceCounters // of the interface, see Stats
+}
+
+// PacketHandlerWithMeta is a PacketHandler also receiving where the packet was captured
+type PacketHandlerWithMeta func(*tcp.Packet, PacketMeta)
+
+// WithMeta adapts a PacketHandler to be used as a PacketHandlerWithMeta
+func (handler PacketHandler) WithMeta() PacketHandlerWithMeta {
+	return func(pckt *tcp.Packet, _ PacketMeta) {
+		handler(pckt)
+	}
+}
+
 // PcapOptions options that can be set on a pcap capture handle,
 // these options take effect on inactive pcap handles
 type PcapOptions struct {
@@ -35,12 +81,96 @@ type PcapOptions struct {
 	Promiscuous   bool          `json:"input-raw-promisc"`
 	Monitor       bool          `json:"input-raw-monitor"`
 	Snaplen       bool          `json:"input-raw-override-snaplen"`
+	ExcludePorts  []uint16      `json:"input-raw-exclude-ports"`
+	ExcludeHosts  []string      `json:"input-raw-exclude-hosts"`
+	Mode          CaptureMode   `json:"input-raw-mode"`
+	SynAck        bool          `json:"input-raw-syn-ack"`       // also capture SYN-ACK packets in ModeConnectionEvents
+	RelativeSeq   bool          `json:"input-raw-relative-seq"`  // set the RelSeq of the packets, see tcp.SeqTracker
+	MaxPPS        int           `json:"input-raw-max-pps"`       // maximum packets per second passed to the handler
+	MaxBPS        size.Size     `json:"input-raw-max-bps"`       // maximum payload bytes per second passed to the handler
+	Immediate     bool          `json:"input-raw-immediate"`     // deliver packets as soon as they arrive, trading throughput for latency
+	QUICPorts     []uint16      `json:"input-raw-quic-ports"`    // UDP ports whose datagrams are grouped by QUIC connection ID
+	Defragment    bool          `json:"input-raw-defragment"`    // reassemble the IP fragments before parsing them
+	DumpBPF       bool          `json:"input-raw-bpf-dump"`      // log the compiled BPF instructions of every interface
+	BPFFilterFile string        `json:"input-raw-filter-file"`   // file of a filter ANDed with the filter of every interface
+	NoFilter      bool          `json:"input-raw-no-filter"`     // capture every packet of the interfaces when no port and host are given
+	MaxDuration   time.Duration `json:"input-raw-max-duration"`  // stop the capture after this duration
+	MaxPackets    uint64        `json:"input-raw-max-packets"`   // stop the capture after reading this number of packets
+	IncludeDown   bool          `json:"input-raw-include-down"`  // also capture the interfaces that are down, once they are up
+	MaxFlows      int           `json:"input-raw-max-flows"`     // maximum number of flows tracked, see StateLimits
+	Heartbeat     time.Duration `json:"input-raw-heartbeat"`     // interval of the calls of HeartbeatHandler
+	FanoutGroup   uint16        `json:"input-raw-fanout-group"`  // raw sockets join this PACKET_FANOUT group, see SockRaw.SetFanout
+	ParseWorkers  int           `json:"input-raw-parse-workers"` // number of goroutines parsing the packets of a pcap file
+	Unordered     bool          `json:"input-raw-unordered"`     // pass the packets of a pcap file to the handler as soon as they are parsed
+	ProgressEvery time.Duration `json:"input-raw-progress"`      // interval of the calls of ProgressHandler while reading a pcap file
+	StartTime     time.Time     `json:"input-raw-start-time"`    // skip the packets of a pcap file older than this time
+	EndTime       time.Time     `json:"input-raw-end-time"`      // stop reading a pcap file at this time
+	PinReaders    bool          `json:"input-raw-pin-readers"`   // lock the read goroutine of every interface to its own CPU
+	ReadBatch     int           `json:"input-raw-read-batch"`    // packets read in a row before the read goroutine yields the CPU
+	// InterfaceBufferSize overrides BufferSize for the given interfaces
+	InterfaceBufferSize InterfaceSizes `json:"input-raw-buffer-size-iface"`
+	// InterfaceSnaplen overrides the snapshot length of the given interfaces, see snaplen
+	InterfaceSnaplen InterfaceSizes `json:"input-raw-snaplen-iface"`
+	// MaxReassemblyBytes bounds the bytes buffered to reassemble the packets, see StateLimits
+	MaxReassemblyBytes size.Size `json:"input-raw-max-reassembly"`
+	// Overflow is what the rate limit of MaxPPS and MaxBPS does with the packets over it, see OverflowPolicy
+	Overflow OverflowPolicy `json:"input-raw-overflow"`
+	// ValidateChecksums drops the packets with invalid checksums, see checksumValidator
+	ValidateChecksums bool `json:"input-raw-validate-checksums"`
+	// ProcessID only captures the packets of the TCP sockets of this process, resolved every ProcessRefresh, linux only
+	ProcessID      int           `json:"input-raw-pid"`
+	ProcessRefresh time.Duration `json:"input-raw-pid-refresh"`
+	// AnonymizeKey pseudonymizes the IP addresses of the packets with this secret, see IPAnonymizer
+	AnonymizeKey string `json:"input-raw-anonymize-key"`
+	// Redact masks the parts of the payloads matching these expressions, see PayloadRedactor
+	Redact RedactRules `json:"input-raw-redact"`
+	// MonotonicTime sets the Monotonic time of the packets, along with their wall clock Timestamp
+	MonotonicTime bool `json:"input-raw-monotonic-time"`
+	// NoHostFilter leaves the hosts out of the generated filter, only the ports of the listener are filtered
+	NoHostFilter bool `json:"input-raw-no-host-filter"`
+	// HealthInterval is the interval of the calls of TCPHealthHandler
+	HealthInterval time.Duration `json:"input-raw-tcp-health"`
+	// BondMembers captures the bond and team interfaces selected on each of their members, see bondMembers
+	BondMembers bool `json:"input-raw-bond-members"`
+	// StrictHostMatch fails the activation when no interface matches the host, instead of capturing every interface
+	StrictHostMatch bool `json:"input-raw-strict-host"`
+	// DecapGTP captures the packets carried by GTP-U, the mobile user plane, the ports and filters apply to them
+	DecapGTP bool `json:"input-raw-decap-gtp"`
+	// DedupWindow drops the copies of the packets seen within this duration on any interface, see deduplicator
+	DedupWindow time.Duration `json:"input-raw-dedup"`
+	// FlowByteBudget forwards only the first bytes of payload of every flow, see flowBudget
+	FlowByteBudget size.Size `json:"input-raw-flow-budget"`
+	// ResponsePorts are the ports the responses are sent from when they are tracked, instead of the captured ports,
+	// e.g the ephemeral ports of the passive FTP data connections or of the SIP media
+	ResponsePorts []PortRange `json:"input-raw-response-ports"`
+	// LocalhostAddresses are the addresses captured for the host localhost, 127.0.0.1 and ::1 by default
+	LocalhostAddresses []string `json:"input-raw-localhost"`
+	// AttachPoint is where the packets are captured, see PointEgress
+	AttachPoint AttachPoint `json:"input-raw-attach-point"`
+	// BatchSize and BatchTimeout are the limits of the batches of ListenBatch, 64 packets and 10ms by default
+	BatchSize    int           `json:"input-raw-batch-size"`
+	BatchTimeout time.Duration `json:"input-raw-batch-timeout"`
+	// LinkLocal keeps the IPv6 link-local addresses of the interfaces in the generated filter, see interfaceAddresses
+	LinkLocal bool `json:"input-raw-link-local"`
+	// Multicast also captures the packets sent to multicast groups and broadcast addresses, see groupAddresses
+	Multicast bool `json:"input-raw-multicast"`
+	// PayloadMatch only forwards the packets whose payload matches one of these expressions, see flowMatcher
+	PayloadMatch MatchRules `json:"input-raw-match"`
+	// MatchOnce drops the next packets of a flow once it matched PayloadMatch, until it is closed
+	MatchOnce bool `json:"input-raw-match-once"`
+	// ResponseHosts are the addresses the responses are sent from when they are tracked, instead of the captured
+	// hosts, e.g the virtual address of a load balancer. addresses and networks in CIDR notation
+	ResponseHosts []string `json:"input-raw-response-hosts"`
+	// Segmentation splits or coalesces the TCP segments captured to match the ones sent on the wire, see segmenter
+	Segmentation Segmentation `json:"input-raw-segmentation"`
+	// SegmentSize is the MSS of the segments split, it is derived from the MTU of the interfaces when it is 0
+	SegmentSize int `json:"input-raw-segment-size"`
 }
 
 // Listener handle traffic capture, this is its representation.
 type Listener struct {
 	sync.Mutex
-	Transport  string       // transport layer default to tcp
+	Transport  string       // transport layer, tcp(default), udp or sctp
 	Activate   func() error // function is used to activate the engine. it must be called before reading packets
 	Handles    map[string]gopacket.ZeroCopyPacketDataSource
 	Interfaces []pcap.Interface
@@ -48,13 +178,73 @@ type Listener struct {
 	Reading    chan bool // this channel is closed when the listener has started reading packets
 	PcapOptions
 	Engine        EngineType
-	ports         []uint16 // src or/and dst ports
+	ports         []uint16    // src or/and dst ports
+	portRanges    []PortRange // src or/and dst port ranges
 	trackResponse bool
 
 	host string // pcap file name or interface (name, hardware addr, index or ip address)
 
+	ConnectionHandler ConnectionHandler // called on every connection event when Mode is ModeConnectionEvents
+	ParseErrorHandler ParseErrorHandler // called with a sample of the packets that can't be parsed
+	CloseHandler      CloseHandler      // called when a connection is closed, it must be set before calling Listen
+	DumpHandler       DumpHandler       // called with every packet read before it is parsed, see RotatingDump
+	DumpCloser        io.Closer         // closed once the handles are closed, before Listen returns, e.g the RotatingDump of DumpHandler
+	ProgressHandler   ProgressHandler   // called every ProgressEvery while the pcap_file engine reads its file
+	HeartbeatHandler  HeartbeatHandler  // called every Heartbeat with the liveness of the handles
+	IPTransform       IPTransform       // rewrites the packets before they are dumped and parsed, see IPTransforms
+	TCPHealthHandler  TCPHealthHandler  // called every HealthInterval with the health of the TCP connections
+	EventHandler      EventHandler      // called when the handles start being read and when they are closed, it must be set before calling Activate
+	FlowHash          FlowHash          // picks the flows of Listener.Sample and Listener.NewFlowDispatcher, DefaultFlowHash when nil
+	closes            *closeTracker
+	health            *healthTracker
+	seqs              *tcp.SeqTracker
+	quic              *quicTracker
+	defrag            *defragmenter
+	limiter           *rateLimiter
+	dedup             *deduplicator
+	budget            *flowBudget
+	matcher           *flowMatcher
+	loss              lossCheck
+	segments          *segmenter
+	limit             *captureLimit
+	limits            *StateLimits
+	fileFilter        atomic.Value              // filter of BPFFilterFile
+	processFilter     atomic.Value              // filter of the sockets of ProcessID
+	flowFilter        atomic.Value              // filter of the connection set by CaptureFlow
+	gtpInner          atomic.Value              // *pcap.BPF of the packets carried by GTP-U, see DecapGTP
+	bondMasters       map[string]pcap.Interface // the bonds captured through their members, by member
+	hostUnmatched     bool                      // no interface matches the host, every interface is captured
+	snaplens          map[string]snaplenInfo
+	mtuChecks         mtuChecks
+	progress          *fileProgress
+	timeRange         *timeRange
+	portStats         *portStats
+	stats             *interfaceStats
+	parseErrors       *parseErrors
+	checksums         *checksumValidator
+	transformer       *ipTransformer
+	pipeline          []PacketTransform // see Use
+	clock             *monotonicClock
+	truncations       *truncations
+	empty             *uint64 // packets without payload, see EmptyPayloads
+	bufferSizes       map[string]BufferSize
+	effective         map[string]EffectiveOptions
+	effectiveMu       sync.Mutex // the handles of the interfaces that are down are activated while reading
+	linkTypes         map[string]layers.LinkType
+	debugLevel        int32
+	handleLocks       map[string]*handleLock
+	readyMu           sync.Mutex
+	ready             chan struct{} // closed when every handle is reading, see Ready
+	startErr          error
+	stopping          sync.WaitGroup // CaptureStopped events being sent
+
 	closeDone chan struct{}
 	quit      chan struct{}
+	// the channels above and Reading and ready are closed at most once
+	quitOnce    sync.Once
+	doneOnce    sync.Once
+	readingOnce sync.Once
+	readyOnce   sync.Once
 }
 
 // EngineType ...
@@ -96,21 +286,27 @@ func (eng *EngineType) String() (e string) {
 	return e
 }
 
-// NewListener creates and initialize a new Listener. if transport or/and engine are invalid/unsupported
-// is "tcp" and "pcap", are assumed. l.Engine and l.Transport can help to get the values used.
-// if there is an error it will be associated with getting network interfaces
+// NewListener creates and initialize a new Listener. if engine is invalid/unsupported "pcap" is assumed,
+// an empty transport is "tcp", and so is an unsupported one, other than "udp" and "sctp", with a warning.
+// l.Engine and l.Transport can help to get the values used.
+// host is an interface name, hardware address or index, or an IP address. an integer host is always
+// the index of an interface, the ports are given separately.
+// otherwise if there is an error it will be associated with getting network interfaces
 func NewListener(host string, ports []uint16, transport string, engine EngineType, trackResponse bool) (l *Listener, err error) {
 	l = &Listener{}
+	l.debugLevel = int32(debugLevelFromEnv())
 
 	l.host = host
-	if l.host == "localhost" {
-		l.host = "127.0.0.1"
-	}
 	l.ports = ports
 
-	l.Transport = "tcp"
-	if transport != "" {
+	switch transport {
+	case "", "tcp":
+		l.Transport = "tcp"
+	case "udp", "sctp":
 		l.Transport = transport
+	default:
+		l.debug(DebugWarn, "unsupported transport %q, expected tcp, udp or sctp, tcp is captured\n", transport)
+		l.Transport = "tcp"
 	}
 	l.Handles = make(map[string]gopacket.ZeroCopyPacketDataSource)
 	l.trackResponse = trackResponse
@@ -137,34 +333,106 @@ func NewListener(host string, ports []uint16, transport string, engine EngineTyp
 	return
 }
 
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Min, Max uint16
+}
+
+// ParsePortRange parses a port range expressed as "min-max", or a single port
+func ParsePortRange(s string) (r PortRange, err error) {
+	min, max := s, s
+	if i := strings.IndexByte(s, '-'); i != -1 {
+		min, max = s[:i], s[i+1:]
+	}
+	var n uint64
+	if n, err = strconv.ParseUint(strings.TrimSpace(min), 10, 16); err != nil {
+		return r, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+	r.Min = uint16(n)
+	if n, err = strconv.ParseUint(strings.TrimSpace(max), 10, 16); err != nil {
+		return r, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+	r.Max = uint16(n)
+	if r.Min > r.Max {
+		return r, fmt.Errorf("invalid port range %q: %d is greater than %d", s, r.Min, r.Max)
+	}
+	return
+}
+
+// AddPortRanges adds port ranges (e.g "8000-8099") to the ports captured by this listener,
+// it must be called before activating the listener
+func (l *Listener) AddPortRanges(ranges ...string) error {
+	for _, s := range ranges {
+		r, err := ParsePortRange(s)
+		if err != nil {
+			return err
+		}
+		l.portRanges = append(l.portRanges, r)
+	}
+	return nil
+}
+
 // SetPcapOptions set pcap options for all yet to be actived pcap handles
-// setting this on already activated handles will not have any effect
-func (l *Listener) SetPcapOptions(opts PcapOptions) {
+// setting this on already activated handles will not have any effect.
+// it returns the error of selecting the interfaces again when the options change them
+func (l *Listener) SetPcapOptions(opts PcapOptions) error {
+	includeDown, bondMembers, localhost := l.IncludeDown, l.BondMembers, l.LocalhostAddresses
 	l.PcapOptions = opts
+	// the interfaces were selected by NewListener
+	changed := l.IncludeDown != includeDown || l.BondMembers != bondMembers || !sameHosts(l.LocalhostAddresses, localhost)
+	if changed && l.Engine != EnginePcapFile {
+		l.Interfaces = nil
+		return l.setInterfaces()
+	}
+	return nil
 }
 
 // Listen listens for packets from the handles, and call handler on every packet received
 // until the context done signal is sent or there is unrecoverable error on all handles.
 // this function must be called after activating pcap handles
 func (l *Listener) Listen(ctx context.Context, handler PacketHandler) (err error) {
+	return l.ListenWithMeta(ctx, handler.WithMeta())
+}
+
+// ListenWithMeta is Listen with a handler also receiving the interface and the link type of every packet
+func (l *Listener) ListenWithMeta(ctx context.Context, handler PacketHandlerWithMeta) (err error) {
 	l.read(handler)
 	done := ctx.Done()
 	select {
 	case <-done:
-		close(l.quit) // signal close on all handles
-		<-l.closeDone // wait all handles to be closed
+		l.Close()
 		err = ctx.Err()
 	case <-l.closeDone: // all handles closed voluntarily
 	}
 	return
 }
 
+// Close stops reading and closes all the handles, it returns once they are all closed.
+// it is safe to call Close several times, before Listen, or after the handles have closed voluntarily,
+// but not from a PacketHandler: a handle is closed once the packet being handled is done with.
+func (l *Listener) Close() error {
+	l.quitOnce.Do(func() { close(l.quit) }) // signal close on all handles
+	l.Lock()
+	keys := make([]string, 0, len(l.Handles))
+	for key := range l.Handles {
+		keys = append(keys, key)
+	}
+	l.Unlock()
+	for _, key := range keys {
+		l.closeHandles(key, captureStop{reason: StopClosed})
+	}
+	l.stopping.Wait()
+	l.done() // in case there was no handle
+	<-l.closeDone
+	return nil
+}
+
 // ListenBackground is like listen but can run concurrently and signal error through channel
 func (l *Listener) ListenBackground(ctx context.Context, handler PacketHandler) chan error {
 	err := make(chan error, 1)
 	go func() {
 		defer close(err)
-		if e := l.Listen(ctx, handler); err != nil {
+		if e := l.Listen(ctx, handler); e != nil {
 			err <- e
 		}
 	}()
@@ -174,36 +442,196 @@ func (l *Listener) ListenBackground(ctx context.Context, handler PacketHandler)
 // Filter returns automatic filter applied by goreplay
 // to a pcap handle of a specific interface
 func (l *Listener) Filter(ifi pcap.Interface) (filter string) {
+	if l.decapGTP() {
+		// the packets carried by GTP-U are filtered once decapsulated
+		return gtpFilter
+	}
+	return l.innerFilter(ifi)
+}
+
+// innerFilter is the filter of the packets of the listener, the filter of the packets carried by GTP-U when DecapGTP is set
+func (l *Listener) innerFilter(ifi pcap.Interface) string {
+	return l.withFlowFilter(l.withFileFilter(l.withProcessFilter(l.generatedFilter(ifi))))
+}
+
+// generatedFilter is the filter of the ports and hosts of the listener, before BPFFilterFile is applied
+func (l *Listener) generatedFilter(ifi pcap.Interface) (filter string) {
 	// https://www.tcpdump.org/manpages/pcap-filter.7.html
 
-	hosts := []string{l.host}
-	if listenAll(l.host) || isDevice(l.host, ifi) {
-		hosts = interfaceAddresses(ifi)
+	if l.NoFilter {
+		if l.unfiltered() {
+			return ""
+		}
+		l.debug(DebugWarn, "the capture is filtered because a port or a host is given, --input-raw-no-filter is ignored\n")
 	}
 
-	filter = portsFilter(l.Transport, "dst", l.ports)
+	hosts := l.filterHosts(ifi)
 
-	if len(hosts) != 0 {
-		filter = fmt.Sprintf("((%s) and (%s))", filter, hostsFilter("dst", hosts))
-	} else {
-		filter = fmt.Sprintf("(%s)", filter)
+	if l.Mode == ModeConnectionEvents {
+		return l.connectionEventsFilter(hosts)
 	}
 
+	// the responses are never sent from a group address
+	dstHosts := hosts
+	if l.Multicast && len(hosts) != 0 {
+		dstHosts = append(append([]string(nil), hosts...), groupAddresses(ifi)...)
+	}
+	filter = l.directionFilter("dst", dstHosts)
+
 	if l.trackResponse {
-		responseFilter := portsFilter(l.Transport, "src", l.ports)
+		filter = fmt.Sprintf("%s or %s", filter, l.directionFilter("src", hosts))
+	}
 
-		if len(hosts) != 0 {
-			responseFilter = fmt.Sprintf("((%s) and (%s))", responseFilter, hostsFilter("src", hosts))
-		} else {
-			responseFilter = fmt.Sprintf("(%s)", responseFilter)
-		}
+	if l.Defragment {
+		filter = fmt.Sprintf("(%s) or %s", filter, l.fragmentsFilter(dstHosts))
+	}
+
+	return
+}
 
-		filter = fmt.Sprintf("%s or %s", filter, responseFilter)
+// directionFilter returns the ports and hosts filter for either requests(dst) or responses(src)
+func (l *Listener) directionFilter(direction string, hosts []string) string {
+	ports := portsFilter(l.Transport, direction, l.ports, l.portRanges)
+	if direction == "src" && len(l.ResponsePorts) != 0 {
+		ports = portsFilter(l.Transport, direction, nil, l.ResponsePorts)
 	}
+	if direction == "src" && len(l.ResponseHosts) != 0 {
+		hosts = l.ResponseHosts
+	}
+	filters := []string{fmt.Sprintf("(%s)", ports)}
+	if len(hosts) != 0 {
+		filters = append(filters, fmt.Sprintf("(%s)", hostsFilter(direction, hosts)))
+	}
+	filters = append(filters, l.exclusionFilters()...)
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return fmt.Sprintf("(%s)", strings.Join(filters, " and "))
+}
 
+// fragmentsFilter returns the filter of the IP fragments of the hosts, the ports of a fragment
+// are only known once its datagram is reassembled
+func (l *Listener) fragmentsFilter(hosts []string) string {
+	filters := []string{fragmentsFilter}
+	if len(hosts) != 0 {
+		direction := "dst"
+		if l.trackResponse {
+			direction = ""
+			hosts = append(append([]string(nil), hosts...), l.ResponseHosts...)
+		}
+		filters = append(filters, fmt.Sprintf("(%s)", hostsFilter(direction, hosts)))
+	}
+	filters = append(filters, l.exclusionFilters()...)
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return fmt.Sprintf("(%s)", strings.Join(filters, " and "))
+}
+
+// exclusionFilters returns the filters of ExcludePorts and ExcludeHosts
+func (l *Listener) exclusionFilters() (filters []string) {
+	if len(l.ExcludePorts) != 0 {
+		filters = append(filters, fmt.Sprintf("not (%s)", portsFilter(l.Transport, "", l.ExcludePorts, nil)))
+	}
+	if len(l.ExcludeHosts) != 0 {
+		filters = append(filters, fmt.Sprintf("not (%s)", hostsFilter("", l.ExcludeHosts)))
+	}
 	return
 }
 
+// unfiltered reports whether the capture accepts every packet, without any BPF filter,
+// the kernel then copies all the traffic of the interfaces to the user space
+func (l *Listener) unfiltered() bool {
+	return l.NoFilter && (len(l.ports) == 0 || l.ports[0] == 0) && len(l.portRanges) == 0 && listenAll(l.host)
+}
+
+// filterHosts returns the addresses the filter of an interface is restricted to, none when the
+// packets are captured whatever their addresses
+func (l *Listener) filterHosts(ifi pcap.Interface) []string {
+	if master, ok := l.bondMasters[ifi.Name]; ok {
+		// the members of a bond have no address of their own
+		ifi = master
+	}
+	if l.NoHostFilter || l.decapGTP() {
+		// e.g the floating addresses assigned after the capture started would be missed,
+		// or the addresses of the mobiles and their servers carried by GTP-U
+		return nil
+	}
+	if listenAll(l.host) || isDevice(l.host, ifi) {
+		return l.interfaceAddresses(ifi)
+	}
+	return l.hostAddresses()
+}
+
+// checkExclusions warns if the exclusions leave nothing to be captured on the interfaces ifis,
+// it is called once by Activate
+func (l *Listener) checkExclusions(ifis []pcap.Interface) {
+	excluded := make(map[uint16]bool, len(l.ExcludePorts))
+	for _, port := range l.ExcludePorts {
+		excluded[port] = true
+	}
+	if allPortsExcluded(excluded, l.ports, l.portRanges) {
+		l.debug(DebugWarn, "all the ports %s are excluded from the capture\n", portsString(l.ports, l.portRanges))
+	}
+	if l.trackResponse && allPortsExcluded(excluded, nil, l.ResponsePorts) {
+		l.debug(DebugWarn, "all the response ports %s are excluded from the capture\n", portsString(nil, l.ResponsePorts))
+	}
+	if len(l.ExcludeHosts) == 0 {
+		return
+	}
+	for _, ifi := range ifis {
+		hosts := l.filterHosts(ifi)
+		if len(hosts) == 0 {
+			continue
+		}
+		excluded := 0
+		for _, host := range hosts {
+			for _, h := range l.ExcludeHosts {
+				if h == host {
+					excluded++
+					break
+				}
+			}
+		}
+		if excluded == len(hosts) {
+			l.debug(DebugWarn, "Interface: %s. All the hosts %v are excluded from the capture\n", ifi.Name, hosts)
+		}
+	}
+}
+
+// allPortsExcluded reports whether every port of ports and ranges is excluded, it is false when
+// they are empty or hold the port 0, which stands for any port
+func allPortsExcluded(excluded map[uint16]bool, ports []uint16, ranges []PortRange) bool {
+	if len(excluded) == 0 || len(ports) == 0 && len(ranges) == 0 {
+		return false
+	}
+	for _, port := range ports {
+		if port == 0 || !excluded[port] {
+			return false
+		}
+	}
+	for _, r := range ranges {
+		for port := int(r.Min); port <= int(r.Max); port++ {
+			if !excluded[uint16(port)] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// portsString returns the ports and port ranges separated by commas, e.g 80,8000-8099
+func portsString(ports []uint16, ranges []PortRange) string {
+	var s []string
+	for _, port := range ports {
+		s = append(s, strconv.Itoa(int(port)))
+	}
+	for _, r := range ranges {
+		s = append(s, fmt.Sprintf("%d-%d", r.Min, r.Max))
+	}
+	return strings.Join(s, ",")
+}
+
 // PcapDumpHandler returns a handler to write packet data in PCAP
 // format, See http://wiki.wireshark.org/Development/LibpcapFileFormathandler.
 // if link layer is invalid Ethernet is assumed
@@ -224,115 +652,429 @@ func (l *Listener) Filter(ifi pcap.Interface) (filter string) {
 // PcapHandle returns new pcap Handle from dev on success.
 // this function should be called after setting all necessary options for this listener
 func (l *Listener) PcapHandle(ifi pcap.Interface) (handle *pcap.Handle, err error) {
+	snap := l.snaplen(ifi)
+	if snap < minSnaplen || snap > maxSnaplen {
+		return nil, fmt.Errorf("snapshot length %d out of the range [%d, %d], interface: %q", snap, minSnaplen, maxSnaplen, ifi.Name)
+	}
+	l.BPFFilter = l.Filter(ifi)
+	// monitor mode changes the link type of the interface, and the link type is only guessed before
+	// the first activation, the filter is then validated again for the link type of the handle
+	expected, known := l.expectedLinkType(ifi), l.knownLinkType(ifi.Name)
+	var filterErr error
+	if !l.Monitor {
+		filterErr = ValidateBPFFilter(l.BPFFilter, expected, snap)
+		if filterErr != nil && known {
+			return nil, &FilterError{Interface: ifi.Name, LinkType: expected, Filter: l.BPFFilter, Err: filterErr}
+		}
+	}
 	var inactive *pcap.InactiveHandle
 	inactive, err = pcap.NewInactiveHandle(ifi.Name)
 	if err != nil {
-		return nil, fmt.Errorf("inactive handle error: %q, interface: %q", err, ifi.Name)
+		return nil, activationFailed(fmt.Errorf("inactive handle error: %q, interface: %q", err, ifi.Name), err)
 	}
 	defer inactive.CleanUp()
 	if l.TimestampType != "" {
 		var ts pcap.TimestampSource
-		ts, err = pcap.TimestampSourceFromString(l.TimestampType)
-		err = inactive.SetTimestampSource(ts)
+		if ts, err = pcap.TimestampSourceFromString(l.TimestampType); err == nil {
+			err = inactive.SetTimestampSource(ts)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("%q: supported timestamps: %q, interface: %q", err, inactive.SupportedTimestamps(), ifi.Name)
+			return nil, activationFailed(fmt.Errorf("%q: supported timestamps: %q, interface: %q", err, inactive.SupportedTimestamps(), ifi.Name),
+				fmt.Errorf("%w: %v", ErrTimestampType, err))
 		}
 	}
 	if l.Promiscuous {
 		if err = inactive.SetPromisc(l.Promiscuous); err != nil {
-			return nil, fmt.Errorf("promiscuous mode error: %q, interface: %q", err, ifi.Name)
+			return nil, activationFailed(fmt.Errorf("promiscuous mode error: %q, interface: %q", err, ifi.Name), err)
 		}
 	}
+	monitor := l.Monitor
 	if l.Monitor {
 		if err = inactive.SetRFMon(l.Monitor); err != nil && !errors.Is(err, pcap.CannotSetRFMon) {
-			return nil, fmt.Errorf("monitor mode error: %q, interface: %q", err, ifi.Name)
-		}
-	}
-
-	var snap int
-
-	if !l.Snaplen {
-		infs, _ := net.Interfaces()
-		for _, i := range infs {
-			if i.Name == ifi.Name {
-				snap = i.MTU + 200
-			}
+			return nil, activationFailed(fmt.Errorf("monitor mode error: %q, interface: %q", err, ifi.Name), err)
 		}
-	}
-
-	if snap == 0 {
-		snap = 64<<10 + 200
+		monitor = err == nil
 	}
 
 	err = inactive.SetSnapLen(snap)
 	if err != nil {
 		return nil, fmt.Errorf("snapshot length error: %q, interface: %q", err, ifi.Name)
 	}
-	if l.BufferSize > 0 {
-		err = inactive.SetBufferSize(int(l.BufferSize))
+	if bufferSize := l.requestedBufferSize(ifi.Name); bufferSize > 0 {
+		err = inactive.SetBufferSize(int(bufferSize))
 		if err != nil {
 			return nil, fmt.Errorf("handle buffer size error: %q, interface: %q", err, ifi.Name)
 		}
 	}
-	if l.BufferTimeout == 0 {
-		l.BufferTimeout = pcap.BlockForever
-	}
+	l.BufferTimeout = l.bufferTimeout(pcap.BlockForever)
 	err = inactive.SetTimeout(l.BufferTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("handle buffer timeout error: %q, interface: %q", err, ifi.Name)
 	}
+	if l.Immediate {
+		if err = inactive.SetImmediateMode(true); err != nil {
+			return nil, fmt.Errorf("immediate mode error: %q, interface: %q", err, ifi.Name)
+		}
+	}
 	handle, err = inactive.Activate()
 	if err != nil {
-		return nil, fmt.Errorf("PCAP Activate device error: %q, interface: %q", err, ifi.Name)
+		return nil, activationFailed(fmt.Errorf("PCAP Activate device error: %q, interface: %q", err, ifi.Name), err)
 	}
-	l.BPFFilter = l.Filter(ifi)
-	fmt.Println("Interface:", ifi.Name, ". BPF Filter:", l.BPFFilter)
+	if l.AttachPoint == PointEgress {
+		if err = handle.SetDirection(pcap.DirectionOut); err != nil {
+			handle.Close()
+			return nil, activationFailed(fmt.Errorf("egress capture error: %q, interface: %q", err, ifi.Name), err)
+		}
+	}
+	l.debug(DebugInfo, "Interface: %s. Snapshot length: requested %d, effective %d\n", ifi.Name, snap, handle.SnapLen())
+	l.setSnaplen(ifi.Name, handle.SnapLen())
+	if l.Monitor || handle.LinkType() != expected {
+		filterErr = ValidateBPFFilter(l.BPFFilter, handle.LinkType(), snap)
+	}
+	if filterErr != nil {
+		handle.Close()
+		return nil, &FilterError{Interface: ifi.Name, LinkType: handle.LinkType(), Filter: l.BPFFilter, Err: filterErr}
+	}
+	filter := l.BPFFilter
+	l.setEffective(ifi.Name, func(opts *EffectiveOptions) {
+		opts.Snaplen, opts.Timestamp, opts.Resolution = handle.SnapLen(), l.TimestampType, handle.Resolution()
+		opts.Promiscuous, opts.Monitor, opts.Immediate = l.Promiscuous, monitor, l.Immediate
+		opts.LinkType, opts.BPFFilter = handle.LinkType(), filter
+		opts.BufferSize.Requested = l.requestedBufferSize(ifi.Name)
+	})
+	if l.BPFFilter == "" {
+		// a handle without filter accepts all the packets
+		l.debug(DebugInfo, "Interface: %s. No BPF Filter, capturing all the packets\n", ifi.Name)
+		return
+	}
+	l.debug(DebugInfo, "Interface: %s. BPF Filter: %s\n", ifi.Name, l.BPFFilter)
 	err = handle.SetBPFFilter(l.BPFFilter)
 	if err != nil {
 		handle.Close()
-		return nil, fmt.Errorf("BPF filter error: %q%s, interface: %q", err, l.BPFFilter, ifi.Name)
+		return nil, &FilterError{Interface: ifi.Name, LinkType: handle.LinkType(), Filter: l.BPFFilter,
+			Err: fmt.Errorf("BPF filter error: %q, filter: %q", err, l.BPFFilter)}
+	}
+	if l.DumpBPF {
+		l.dumpFilter(ifi.Name, handle.LinkType(), snap)
 	}
 	return
 }
 
+// bounds of the snapshot lengths of InterfaceSnaplen, the headers of the packets must fit in the minimum,
+// and libpcap caps the snapshot length to the maximum
+const (
+	minSnaplen = 96
+	maxSnaplen = 256 << 10
+)
+
+// snaplen returns the snapshot length of the handles of an interface, the one of InterfaceSnaplen,
+// or its MTU with room for the headers, or 64k when the interface is unknown or Snaplen is set.
+// the packets aggregated by GRO/TSO exceed the MTU, so 64k is used as well when they are enabled
+func (l *Listener) snaplen(ifi pcap.Interface) int {
+	if siz, ok := l.InterfaceSnaplen[ifi.Name]; ok {
+		return int(siz)
+	}
+	if !l.Snaplen && !interfaceOffloads(ifi.Name) {
+		infs, _ := net.Interfaces()
+		for _, i := range infs {
+			if i.Name == ifi.Name && i.MTU > 0 {
+				return i.MTU + 200
+			}
+		}
+	}
+	return 64<<10 + 200
+}
+
+// CompiledFilter compiles the filter of an interface without activating a handle, it is compiled for
+// the link type detected once Listen has started, or for the expected link type of the interface before that.
+// with the pcap_file engine, it is the filter of the file, compiled for the link type of its header once activated
+func (l *Listener) CompiledFilter(ifi pcap.Interface) ([]pcap.BPFInstruction, error) {
+	if l.Engine == EnginePcapFile {
+		return pcap.CompileBPFFilter(l.expectedLinkType(ifi), l.snaplen(ifi), l.pcapFileFilter())
+	}
+	return pcap.CompileBPFFilter(l.expectedLinkType(ifi), l.snaplen(ifi), l.Filter(ifi))
+}
+
+// knownLinkType reports whether the link type of an interface was detected by an activation
+func (l *Listener) knownLinkType(name string) bool {
+	l.Lock()
+	defer l.Unlock()
+	_, ok := l.linkTypes[name]
+	return ok
+}
+
+// expectedLinkType returns the link type detected for an interface once Listen has started,
+// or the link type it is expected to have before that
+func (l *Listener) expectedLinkType(ifi pcap.Interface) layers.LinkType {
+	l.Lock()
+	linkType, ok := l.linkTypes[ifi.Name]
+	l.Unlock()
+	if ok {
+		return linkType
+	}
+	// the link type of a pcap file is the one of its header, whatever the interface it was recorded on
+	if l.Engine == EnginePcapFile {
+		// once activated, the link type of the capture may be LinkTypeNull
+		if opts, ok := l.EffectiveOptions()["pcap_file"]; ok {
+			return opts.LinkType
+		}
+	}
+	// BSD systems use the null link type on their loopback interfaces
+	if ifi.Flags&pcapIfLoopback != 0 && runtime.GOOS != "linux" {
+		return layers.LinkTypeNull
+	}
+	return layers.LinkTypeEthernet
+}
+
+// ValidateBPFFilter compiles a filter for the given link type and snapshot length, without any handle,
+// so that invalid filters can be reported before activating the handles. an empty filter is valid
+func ValidateBPFFilter(expr string, linkType layers.LinkType, snaplen int) error {
+	if expr == "" {
+		return nil
+	}
+	if _, err := pcap.CompileBPFFilter(linkType, snaplen, expr); err != nil {
+		// libpcap doesn't report where the error is, but it often quotes the offending token
+		if m := quotedToken.FindStringSubmatch(err.Error()); m != nil {
+			if col := strings.Index(expr, m[1]); col != -1 {
+				return fmt.Errorf("BPF filter error: %v, filter: %q, column: %d", err, expr, col+1)
+			}
+		}
+		return fmt.Errorf("BPF filter error: %v, filter: %q", err, expr)
+	}
+	return nil
+}
+
+var quotedToken = regexp.MustCompile(`'([^']+)'`)
+
+// dumpFilter logs the compiled BPF filter of an interface the way tcpdump -d does, the standard
+// output may carry the captured traffic
+func (l *Listener) dumpFilter(iface string, linkType layers.LinkType, snap int) {
+	insts, err := pcap.CompileBPFFilter(linkType, snap, l.BPFFilter)
+	if err != nil {
+		log.Printf("Interface: %s. BPF compile error: %q\n", iface, err)
+		return
+	}
+	log.Printf("Interface: %s. Link type: %s. BPF program (%d instructions):\n%s", iface, linkType, len(insts), formatBPF(insts))
+}
+
+func formatBPF(insts []pcap.BPFInstruction) string {
+	var b strings.Builder
+	for i, ins := range insts {
+		fmt.Fprintf(&b, "(%03d) code 0x%04x jt %d jf %d k 0x%08x\n", i, ins.Code, ins.Jt, ins.Jf, ins.K)
+	}
+	return b.String()
+}
+
 // SocketHandle returns new unix ethernet handle associated with this listener settings
 func (l *Listener) SocketHandle(ifi pcap.Interface) (handle Socket, err error) {
-	handle, err = NewSocket(ifi)
+	l.BPFFilter = l.Filter(ifi)
+	if err = ValidateBPFFilter(l.BPFFilter, layers.LinkTypeEthernet, l.snaplen(ifi)); err != nil {
+		return nil, &FilterError{Interface: ifi.Name, LinkType: layers.LinkTypeEthernet, Filter: l.BPFFilter, Err: err}
+	}
+	handle, err = newSocket(ifi)
 	if err != nil {
-		return nil, fmt.Errorf("sock raw error: %q, interface: %q", err, ifi.Name)
+		return nil, activationFailed(fmt.Errorf("sock raw error: %q, interface: %q", err, ifi.Name), err)
 	}
-	if err = handle.SetPromiscuous(l.Promiscuous || l.Monitor); err != nil {
-		return nil, fmt.Errorf("promiscuous mode error: %q, interface: %q", err, ifi.Name)
+	// a new socket is not promiscuous, it captures the packets sent to and from the addresses of the interface.
+	// the promiscuous mode is a setting of the device shared with the other captures, it is only asked for explicitly
+	if l.Promiscuous {
+		if err = handle.SetPromiscuous(true); err != nil {
+			handle.Close()
+			return nil, activationFailed(fmt.Errorf("promiscuous mode error: %q, interface: %q", err, ifi.Name), err)
+		}
 	}
-	l.BPFFilter = l.Filter(ifi)
-	fmt.Println("BPF Filter: ", l.BPFFilter)
+	if l.Monitor {
+		l.debug(DebugWarn, "monitor mode is not supported by raw sockets, interface: %s\n", ifi.Name)
+	}
+	if l.AttachPoint == PointEgress {
+		egress, ok := handle.(interface{ SetEgress(bool) })
+		if !ok {
+			handle.Close()
+			return nil, fmt.Errorf("egress capture is not supported, interface: %q", ifi.Name)
+		}
+		egress.SetEgress(true)
+	}
+	if requested := l.requestedBufferSize(ifi.Name); requested > 0 {
+		sizer, ok := handle.(interface{ SetBufferSize(int) error })
+		if !ok {
+			handle.Close()
+			return nil, fmt.Errorf("buffer size is not supported, interface: %q", ifi.Name)
+		}
+		if err = sizer.SetBufferSize(int(requested)); err != nil {
+			handle.Close()
+			return nil, activationFailed(fmt.Errorf("buffer size %d error: %q, interface: %q", requested, err, ifi.Name), err)
+		}
+	}
+	if l.BPFFilter == "" {
+		l.debug(DebugInfo, "Interface: %s. No BPF Filter, capturing all the packets\n", ifi.Name)
+	} else {
+		l.debug(DebugInfo, "Interface: %s. BPF Filter: %s\n", ifi.Name, l.BPFFilter)
+	}
+	// an empty filter detaches the filter of the socket
 	if err = handle.SetBPFFilter(l.BPFFilter); err != nil {
 		handle.Close()
-		return nil, fmt.Errorf("BPF filter error: %q%s, interface: %q", err, l.BPFFilter, ifi.Name)
+		return nil, &FilterError{Interface: ifi.Name, LinkType: layers.LinkTypeEthernet, Filter: l.BPFFilter,
+			Err: fmt.Errorf("BPF filter error: %q, filter: %q", err, l.BPFFilter)}
+	}
+	if l.DumpBPF {
+		l.dumpFilter(ifi.Name, layers.LinkTypeEthernet, l.snaplen(ifi))
+	}
+	if l.FanoutGroup != 0 {
+		fanout, ok := handle.(interface{ SetFanout(uint16) error })
+		if !ok {
+			handle.Close()
+			return nil, fmt.Errorf("fanout is not supported, interface: %q", ifi.Name)
+		}
+		if err = fanout.SetFanout(l.FanoutGroup); err != nil {
+			handle.Close()
+			return nil, activationFailed(fmt.Errorf("fanout group %d error: %q, interface: %q", l.FanoutGroup, err, ifi.Name), err)
+		}
 	}
 	handle.SetLoopbackIndex(int32(l.loopIndex))
+	filter := l.BPFFilter
+	l.setEffective(ifi.Name, func(opts *EffectiveOptions) {
+		opts.Snaplen, opts.Resolution = handle.GetSnapLen(), gopacket.TimestampResolutionNanosecond
+		opts.Promiscuous, opts.LinkType, opts.BPFFilter = l.Promiscuous, layers.LinkTypeEthernet, filter
+	})
 	return
 }
 
-func (l *Listener) read(handler PacketHandler) {
+func (l *Listener) read(handler PacketHandlerWithMeta) {
 	l.Lock()
 	defer l.Unlock()
+	if l.limits == nil {
+		l.limits = new(StateLimits)
+	}
+	l.limits.set(l.MaxReassemblyBytes, l.MaxFlows)
+	limits := l.limits
+	// sequence numbers and connection closes only exist in TCP
+	l.seqs, l.closes, l.quic = nil, nil, nil
+	if l.RelativeSeq && l.Transport == "tcp" {
+		l.seqs = tcp.NewSeqTracker(0)
+	}
+	l.quic = nil
+	if len(l.QUICPorts) != 0 && l.Transport == "udp" {
+		l.quic = newQUICTracker(l.QUICPorts)
+		l.quic.limits = limits
+	}
+	l.defrag = nil
+	if l.Defragment {
+		l.defrag = newDefragmenter(limits)
+	}
+	l.portStats = new(portStats)
+	l.stats = new(interfaceStats)
+	stats := l.stats
+	l.parseErrors = new(parseErrors)
+	l.truncations = new(truncations)
+	l.empty = new(uint64)
+	l.transformer = l.newIPTransformer()
+	l.clock = nil
+	if l.MonotonicTime {
+		l.clock = newMonotonicClock(l.progress != nil)
+	}
+	l.checksums = nil
+	if l.ValidateChecksums {
+		l.checksums = newChecksumValidator()
+	}
+	l.limiter = nil
+	if l.MaxPPS > 0 || l.MaxBPS > 0 {
+		l.limiter = newRateLimiter(l.MaxPPS, int(l.MaxBPS), l.Overflow)
+	}
+	if l.CloseHandler != nil && l.Transport == "tcp" {
+		l.closes = newCloseTracker(l.CloseHandler, limits)
+	}
+	l.health = nil
+	if l.HealthInterval > 0 && l.TCPHealthHandler != nil && l.Transport == "tcp" {
+		l.health = newHealthTracker(limits)
+		go l.health.run(l.HealthInterval, l.TCPHealthHandler, l.closeDone)
+	}
+	l.dedup = nil
+	if l.DedupWindow > 0 {
+		l.dedup = newDeduplicator(l.DedupWindow)
+	}
+	l.matcher = nil
+	if len(l.PayloadMatch) != 0 {
+		l.matcher = newFlowMatcher(l.PayloadMatch, l.MatchOnce, limits)
+	}
+	l.segments = nil
+	if l.Segmentation != SegmentOff && l.Transport == "tcp" {
+		l.segments = newSegmenter(l.Segmentation, l.SegmentSize, l.emitSegment)
+	}
+	l.budget = nil
+	if l.FlowByteBudget > 0 {
+		l.budget = newFlowBudget(int(l.FlowByteBudget), limits)
+	}
+	l.limit = nil
+	if l.MaxPackets > 0 || l.MaxDuration > 0 {
+		l.limit = newCaptureLimit(l.MaxPackets, func() { l.Close() })
+		if l.MaxDuration > 0 {
+			go l.limit.wait(l.MaxDuration, l.closeDone)
+		}
+	}
+	state := readState{limit: l.limit, progress: l.progress, timeRange: l.timeRange}
+	if state.progress != nil {
+		state.progress.start()
+		if l.ProgressEvery > 0 && l.ProgressHandler != nil {
+			go state.progress.report(l.ProgressEvery, l.ProgressHandler, l.closeDone)
+		}
+	}
+	var lives map[string]*liveness
+	if l.Heartbeat > 0 && l.HeartbeatHandler != nil {
+		lives = make(map[string]*liveness, len(l.Handles))
+		for key := range l.Handles {
+			lives[key] = new(liveness)
+		}
+		go heartbeats(lives, l.Heartbeat, l.HeartbeatHandler, l.closeDone)
+	}
+	if l.ProcessID != 0 && l.Engine != EnginePcapFile {
+		go l.refreshProcessFilter(l.closeDone)
+	}
+	var started sync.WaitGroup
+	started.Add(len(l.Handles))
+	l.handleLocks = make(map[string]*handleLock, len(l.Handles))
+	l.linkTypes = make(map[string]layers.LinkType, len(l.Handles))
+	index := 0
 	for key, handle := range l.Handles {
-		go func(key string, hndl gopacket.ZeroCopyPacketDataSource) {
-			defer l.closeHandles(key)
-			linkSize := 14
-			linkType := int(layers.LinkTypeEthernet)
-			if _, ok := hndl.(*pcap.Handle); ok {
-				linkType = int(hndl.(*pcap.Handle).LinkType())
-				linkSize, ok = pcapLinkTypeLength(linkType)
-				if !ok {
-					if os.Getenv("GORDEBUG") != "0" {
-						log.Printf("can not identify link type of an interface '%s'\n", key)
-					}
-					return // can't find the linktype size
-				}
+		hl := new(handleLock)
+		l.handleLocks[key] = hl
+		// handles that don't report their link type are assumed to be ethernet
+		l.linkTypes[key] = layers.LinkTypeEthernet
+		if lt, ok := handle.(interface{ LinkType() layers.LinkType }); ok {
+			l.linkTypes[key] = lt.LinkType()
+		}
+		l.debug(DebugInfo, "Interface: %s. Link type: %s\n", key, l.linkTypes[key])
+		go func(key string, index int, hndl gopacket.ZeroCopyPacketDataSource, linkType int, state readState) {
+			var stop captureStop
+			defer func() { l.closeHandles(key, stop) }()
+			if state.live != nil {
+				state.live.setAlive(true)
+				defer state.live.setAlive(false)
 			}
+			linkSize, ok := pcapLinkTypeLength(linkType)
+			if !ok {
+				l.debug(DebugWarn, "can not identify link type of an interface '%s'\n", key)
+				err := fmt.Errorf("can not identify link type %d of interface %q", linkType, key)
+				l.startFailed(err)
+				stop = captureStop{reason: StopError, err: err}
+				started.Done()
+				return // can't find the linktype size
+			}
+			meta := PacketMeta{Interface: key, LinkType: layers.LinkType(linkType), counters: stats.of(key)}
 
+			sched := l.schedule(key, index)
+			// a handle already closed only reports that it stopped
+			hl.Lock()
+			if !hl.closed {
+				l.captureStarted(key, meta)
+			}
+			hl.Unlock()
+			started.Done()
+			if l.parallel() {
+				stop = l.readParallel(hndl, hl, meta, linkSize, handler, state)
+				return
+			}
+			stop.reason = StopClosed
+			var backoff readBackoff
 			for {
 				select {
 				case <-l.quit:
@@ -340,59 +1082,547 @@ func (l *Listener) read(handler PacketHandler) {
 				default:
 					data, ci, err := hndl.ZeroCopyReadPacketData()
 					if err == nil {
-						pckt, err := tcp.ParsePacket(data, linkType, linkSize, &ci)
-						if err == nil {
-							handler(pckt)
+						backoff.reset()
+						hl.Lock()
+						if hl.closed { // data was freed along with the handle
+							hl.Unlock()
+							return
 						}
+						ok, end := l.admit(meta, state, data, &ci)
+						if end {
+							hl.Unlock()
+							stop.reason = StopEnd
+							return
+						}
+						if !ok {
+							hl.Unlock()
+							continue
+						}
+						l.handlePacket(handler, meta, data, linkSize, &ci)
+						hl.Unlock()
+						sched.next()
 						continue
 					}
-					if enext, ok := err.(pcap.NextError); ok && enext == pcap.NextErrorTimeoutExpired {
-						continue
-					}
-					if eno, ok := err.(syscall.Errno); ok && eno.Temporary() {
-						continue
-					}
-					if enet, ok := err.(*net.OpError); ok && (enet.Temporary() || enet.Timeout()) {
+					if temporaryReadError(err) {
+						backoff.timeout()
 						continue
 					}
-					if err == io.EOF || err == io.ErrClosedPipe {
-						log.Printf("stopped reading from %s interface with error %s\n", key, err)
-						return
+					if err == errLinkTypeChanged {
+						if linkSize, ok = l.relink(key, hndl, &meta); ok {
+							continue
+						}
 					}
-
-					log.Printf("stopped reading from %s interface with error %s\n", key, err)
+					l.debug(DebugWarn, "stopped reading from %s interface with error %s\n", key, err)
+					stop = l.readStopped(err)
 					return
 				}
 			}
-		}(key, handle)
+		}(key, index, handle, int(l.linkTypes[key]), state.with(lives[key], l.snaplens[key]))
+		index++
+	}
+	// Listen can be called again once the listener is closed
+	l.readingOnce.Do(func() { close(l.Reading) })
+	l.readyMu.Lock()
+	ready := l.readyChan()
+	l.readyMu.Unlock()
+	go func() {
+		started.Wait()
+		l.readyOnce.Do(func() { close(ready) })
+	}()
+}
+
+// relink reads the link type of a handle again once it changed, meta and the per-interface link types are updated.
+// it returns the length of the new link header, and false when the new link type is not supported
+func (l *Listener) relink(key string, hndl gopacket.ZeroCopyPacketDataSource, meta *PacketMeta) (int, bool) {
+	lt, ok := hndl.(interface{ LinkType() layers.LinkType })
+	if !ok {
+		return 0, false
+	}
+	linkType := lt.LinkType()
+	l.debug(DebugWarn, "Interface: %s. The link type changed from %s to %s\n", key, meta.LinkType, linkType)
+	linkSize, ok := pcapLinkTypeLength(int(linkType))
+	if !ok {
+		return 0, false
+	}
+	l.Lock()
+	l.linkTypes[key] = linkType
+	l.Unlock()
+	l.setEffective(key, func(opts *EffectiveOptions) { opts.LinkType = linkType })
+	meta.LinkType = linkType
+	return linkSize, true
+}
+
+// LinkType returns the link type detected for the handle of an interface once Listen has started,
+// it is kept after the handle is closed. it is 0 for the interfaces that are not read
+func (l *Listener) LinkType(iface string) layers.LinkType {
+	l.Lock()
+	defer l.Unlock()
+	return l.linkTypes[iface]
+}
+
+// Ready returns a channel that is closed once Listen has started the read loop of every handle,
+// or once the handles that failed to start have been closed, see StartErr.
+// Activate opens the handles and attaches their BPF filters, the packets received from then
+// are buffered by the handles, while Ready tells that they are being consumed.
+// Reading is closed earlier, as soon as the handles goroutines are started.
+func (l *Listener) Ready() <-chan struct{} {
+	l.readyMu.Lock()
+	defer l.readyMu.Unlock()
+	return l.readyChan()
+}
+
+// StartErr returns the errors of the handles that failed to start reading, it must be called
+// after Ready is closed
+func (l *Listener) StartErr() error {
+	l.readyMu.Lock()
+	defer l.readyMu.Unlock()
+	return l.startErr
+}
+
+// readState holds the limits shared by the read loops of the handles
+type readState struct {
+	limit     *captureLimit
+	progress  *fileProgress
+	timeRange *timeRange
+	live      *liveness // of the handle, nil when there is no HeartbeatHandler
+	snaplen   snaplenInfo
+}
+
+// with returns the state of the handle of an interface
+func (state readState) with(live *liveness, snaplen snaplenInfo) readState {
+	state.live, state.snaplen = live, snaplen
+	return state
+}
+
+// admit accounts for a packet read from the handle of an interface, and passes it to the DumpHandler.
+// it reports whether the packet is to be handled, and whether the handle must not be read anymore
+func (l *Listener) admit(meta PacketMeta, state readState, data []byte, ci *gopacket.CaptureInfo) (ok, stop bool) {
+	key := meta.Interface
+	meta.counters.read(ci.CaptureLength)
+	if l.clock != nil {
+		l.clock.read(ci)
+	}
+	if state.live != nil {
+		state.live.packet(ci.Timestamp)
+	}
+	if state.progress != nil {
+		state.progress.add(ci.CaptureLength)
+	}
+	if state.timeRange != nil {
+		in, over := state.timeRange.check(ci.Timestamp)
+		if over {
+			l.debug(DebugInfo, "stopped reading from %s at %s, the end of the time range\n", key, ci.Timestamp)
+			return false, true
+		}
+		if !in {
+			return false, false
+		}
+	}
+	if l.dedup != nil && l.dedup.duplicate(meta.LinkType, data, ci) {
+		return false, false
+	}
+	if state.limit != nil && !state.limit.count() {
+		return false, false
+	}
+	if ci.CaptureLength < ci.Length {
+		l.truncated(key, ci)
+	}
+	// some handles report the captured length as the length of the truncated packets
+	if ci.CaptureLength < ci.Length || ci.CaptureLength == state.snaplen.snaplen {
+		l.checkSnaplen(key, state.snaplen, ci)
+	}
+	if l.transformer != nil && !l.transformer.apply(meta.LinkType, data, ci) {
+		return false, false
+	}
+	if l.DumpHandler != nil {
+		if err := l.DumpHandler(key, data, ci, meta.LinkType); err != nil {
+			l.debug(DebugWarn, "%s\n", err)
+		}
+	}
+	return true, false
+}
+
+// temporaryReadError reports whether reading a handle can go on after err
+func temporaryReadError(err error) bool {
+	if enext, ok := err.(pcap.NextError); ok && enext == pcap.NextErrorTimeoutExpired {
+		return true
+	}
+	if eno, ok := err.(syscall.Errno); ok && eno.Temporary() {
+		return true
+	}
+	if enet, ok := err.(*net.OpError); ok && (enet.Temporary() || enet.Timeout()) {
+		return true
+	}
+	return false
+}
+
+func (l *Listener) readyChan() chan struct{} {
+	if l.ready == nil {
+		l.ready = make(chan struct{})
+	}
+	return l.ready
+}
+
+func (l *Listener) startFailed(err error) {
+	l.readyMu.Lock()
+	defer l.readyMu.Unlock()
+	if l.startErr == nil {
+		l.startErr = err
+		return
+	}
+	l.startErr = fmt.Errorf("%v\n%v", l.startErr, err)
+}
+
+// handlePacket parses the data of a captured packet and passes it to the handlers
+func (l *Listener) handlePacket(handler PacketHandlerWithMeta, meta PacketMeta, data []byte, linkSize int, ci *gopacket.CaptureInfo) {
+	linkType := int(meta.LinkType)
+	meta.CaptureInfo = *ci
+	var mono time.Duration
+	if l.clock != nil {
+		mono = l.clock.now(ci)
+	}
+	data, ci, linkSize, err := linkLayer(meta.LinkType, data, linkSize, ci)
+	if err != nil {
+		if err != errNotIP {
+			l.parseFailed(meta.counters, data, ci, err)
+		}
+		return
+	}
+	if l.Mode == ModeConnectionEvents {
+		ev, err := parseConnectionEvent(data, linkType, linkSize, ci)
+		if err != nil {
+			l.parseFailed(meta.counters, data, ci, err)
+			return
+		}
+		if l.ConnectionHandler != nil {
+			l.ConnectionHandler(ev)
+		}
+		return
+	}
+	if !l.validChecksums(data, linkSize) {
+		return
+	}
+	if l.defrag != nil {
+		now := ci.Timestamp
+		if now.IsZero() {
+			now = time.Now()
+		}
+		if packet, fragmented := l.defrag.add(data, linkSize, now); fragmented {
+			if packet == nil {
+				return // waiting for the other fragments
+			}
+			info := *ci
+			info.CaptureLength, info.Length = len(packet), len(packet)
+			data, ci = packet, &info
+		}
+	}
+	if l.decapGTP() {
+		if linkSize, meta.TEID, err = l.decapsulate(data, linkSize, ci); err != nil {
+			if err != errNotIP {
+				l.parseFailed(meta.counters, data, ci, err)
+			}
+			return
+		}
+	}
+	if l.Transport == "sctp" {
+		pckts, err := tcp.ParseSCTPPacket(data, linkType, linkSize, ci)
+		if err != nil {
+			l.parseFailedOrEmpty(meta.counters, data, ci, err)
+			return
+		}
+		// the chunks bundled in a packet are passed on one by one
+		for _, pckt := range pckts {
+			pckt.Monotonic = mono
+			l.emit(handler, meta, pckt, len(data))
+		}
+		return
+	}
+	if l.closes == nil && l.health == nil && !l.stateCloses() {
+		pckt, err := l.parse(data, linkType, linkSize, ci)
+		if err != nil {
+			l.parseFailedOrEmpty(meta.counters, data, ci, err)
+			return
+		}
+		pckt.Monotonic = mono
+		l.emit(handler, meta, pckt, len(data))
+		return
+	}
+	// FIN and RST packets usually don't carry data, neither do the acknowledgments timed by the health tracker
+	pckt, err := tcp.ParsePacketHeaders(data, linkType, linkSize, ci)
+	if err != nil {
+		l.parseFailed(meta.counters, data, ci, err)
+		return
+	}
+	pckt.Monotonic = mono
+	if l.segments != nil {
+		l.segments.add(&segment{handler: handler, meta: meta, pckt: pckt, length: len(data), headers: true})
+		return
+	}
+	l.emitHeaders(handler, meta, pckt, len(data))
+}
+
+// emitHeaders passes on a packet parsed with its headers, to track the connections
+func (l *Listener) emitHeaders(handler PacketHandlerWithMeta, meta PacketMeta, pckt *tcp.Packet, length int) {
+	if len(pckt.Payload) != 0 {
+		l.portStats.add(pckt.DstPort, length)
+	}
+	if l.seqs != nil {
+		l.seqs.Track(pckt)
+	}
+	l.tracePacket(pckt)
+	if l.health != nil {
+		l.health.track(pckt)
+	}
+	sig, closing := newCloseSignal(pckt)
+	if len(pckt.Payload) != 0 {
+		if (l.matcher == nil || l.matcher.allow(pckt)) && (l.budget == nil || l.budget.allow(pckt)) {
+			if pckt, ok := l.runPipeline(pckt); ok && l.allow(meta, pckt) {
+				handler(pckt, meta)
+			}
+		}
+	} else {
+		atomic.AddUint64(l.empty, 1)
+	}
+	if closing && l.closes != nil {
+		l.closes.track(sig)
+	}
+	if closing && l.budget != nil {
+		l.budget.track(sig)
+	}
+	if closing && l.matcher != nil && l.matcher.once {
+		l.matcher.track(sig)
+	}
+}
+
+// linkLayer resolves the link headers of the link types whose length varies, and trims the trailer of their frames
+func linkLayer(linkType layers.LinkType, data []byte, linkSize int, ci *gopacket.CaptureInfo) ([]byte, *gopacket.CaptureInfo, int, error) {
+	if linkSize != variableLinkLength && !(linkType == layers.LinkTypeEthernet && encapsulated(data)) {
+		return data, ci, linkSize, nil
+	}
+	header, trailer, err := linkHeaders(linkType, data)
+	if err != nil {
+		return data, ci, linkSize, err
+	}
+	// the trailer is only captured along with the whole frame
+	if trailer != 0 && ci.CaptureLength == ci.Length {
+		info := *ci
+		info.CaptureLength -= trailer
+		info.Length -= trailer
+		data, ci = data[:len(data)-trailer], &info
+	}
+	return data, ci, header, nil
+}
+
+// parse parses a packet of the transport of the listener
+func (l *Listener) parse(data []byte, linkType, linkSize int, ci *gopacket.CaptureInfo) (*tcp.Packet, error) {
+	if l.Transport == "udp" {
+		return tcp.ParseUDPPacket(data, linkType, linkSize, ci)
+	}
+	return tcp.ParsePacket(data, linkType, linkSize, ci)
+}
+
+// emit passes on a parsed packet, through the segmenter of the TCP segments with Segmentation.
+// length is the length of the frame it was parsed from
+func (l *Listener) emit(handler PacketHandlerWithMeta, meta PacketMeta, pckt *tcp.Packet, length int) {
+	if l.segments != nil && pckt.Proto == tcp.ProtoTCP {
+		l.segments.add(&segment{handler: handler, meta: meta, pckt: pckt, length: length})
+		return
+	}
+	l.emitPacket(handler, meta, pckt, length)
+}
+
+// emitSegment passes on a segment split or coalesced by the segmenter
+func (l *Listener) emitSegment(seg *segment) {
+	if seg.headers {
+		l.emitHeaders(seg.handler, seg.meta, seg.pckt, seg.length)
+		return
+	}
+	l.emitPacket(seg.handler, seg.meta, seg.pckt, seg.length)
+}
+
+// emitPacket tracks a parsed packet and passes it to the handler
+func (l *Listener) emitPacket(handler PacketHandlerWithMeta, meta PacketMeta, pckt *tcp.Packet, length int) {
+	if l.quic != nil {
+		l.quic.track(pckt)
+	}
+	l.portStats.add(pckt.DstPort, length)
+	if l.seqs != nil {
+		l.seqs.Track(pckt)
+	}
+	l.tracePacket(pckt)
+	if l.matcher != nil && !l.matcher.allow(pckt) {
+		return
+	}
+	if l.budget != nil && !l.budget.allow(pckt) {
+		return
+	}
+	if pckt, ok := l.runPipeline(pckt); ok && l.allow(meta, pckt) {
+		handler(pckt, meta)
+	}
+}
+
+// allow reports whether a packet is within MaxPPS and MaxBPS
+func (l *Listener) allow(meta PacketMeta, pckt *tcp.Packet) bool {
+	if l.limiter == nil || l.limiter.allow(pckt) {
+		return true
+	}
+	meta.counters.drop()
+	return false
+}
+
+// truncations counts the packets cut by the snapshot length
+type truncations struct {
+	count uint64
+	warn  sync.Once
+}
+
+func (l *Listener) truncated(key string, ci *gopacket.CaptureInfo) {
+	atomic.AddUint64(&l.truncations.count, 1)
+	l.truncations.warn.Do(func() {
+		l.debug(DebugWarn, "Interface: %s. Packets are truncated by the snapshot length, %d of %d bytes captured. "+
+			"Their payload is incomplete, consider overriding the snapshot length(--input-raw-override-snaplen)\n", key, ci.CaptureLength, ci.Length)
+	})
+}
+
+// Truncated returns the number of packets truncated by the snapshot length, see tcp.Packet.Truncated
+func (l *Listener) Truncated() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	if l.truncations == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.truncations.count)
+}
+
+// EmptyPayloads returns the number of packets without payload, e.g the pure acknowledgments and the keepalives.
+// they are never passed to the handler, the FIN and RST are still tracked when CloseHandler is set
+func (l *Listener) EmptyPayloads() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	if l.empty == nil {
+		return 0
 	}
-	close(l.Reading)
+	return atomic.LoadUint64(l.empty)
 }
 
-func (l *Listener) closeHandles(key string) {
+// RateLimited returns the number of packets dropped because of MaxPPS or MaxBPS
+func (l *Listener) RateLimited() uint64 {
 	l.Lock()
 	defer l.Unlock()
-	if handle, ok := l.Handles[key]; ok {
-		if _, ok = handle.(Socket); ok {
-			handle.(Socket).Close()
-		} else {
-			handle.(*pcap.Handle).Close()
+	if l.limiter == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.limiter.dropped)
+}
+
+// MidStreamFlows returns the number of connections whose handshake wasn't captured, with RelativeSeq,
+// the sequence numbers of their packets flagged MidStream are relative to the first packet captured
+func (l *Listener) MidStreamFlows() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	if l.seqs == nil {
+		return 0
+	}
+	return l.seqs.MidStreamFlows()
+}
+
+// done signals that all the handles are closed
+func (l *Listener) done() {
+	l.doneOnce.Do(func() {
+		if l.DumpCloser != nil {
+			if err := l.DumpCloser.Close(); err != nil {
+				l.debug(DebugWarn, "%s\n", err)
+			}
 		}
-		delete(l.Handles, key)
-		if len(l.Handles) == 0 {
-			close(l.closeDone)
+		l.Lock()
+		segments := l.segments
+		l.Unlock()
+		if segments != nil {
+			// the segments held to be coalesced
+			segments.stop()
 		}
+		close(l.closeDone)
+	})
+}
+
+// handleLock serializes the handling of the packets read from a handle with its closing,
+// since the data returned by ZeroCopyReadPacketData is freed when the handle is closed
+type handleLock struct {
+	sync.Mutex
+	closed bool
+}
+
+// closeHandles closes the handle of an interface, the first call sends its CaptureStopped event with why it stopped
+func (l *Listener) closeHandles(key string, stop captureStop) {
+	l.Lock()
+	hl := l.handleLocks[key]
+	l.Unlock()
+	if hl != nil {
+		hl.Lock()
+		defer hl.Unlock()
+		hl.closed = true
+	}
+	open, last := l.closeHandle(key)
+	if open {
+		l.captureStopped(key, stop)
+		l.stopping.Done()
+	}
+	if last {
+		// Listen returns once every CaptureStopped event was sent
+		l.stopping.Wait()
+		l.done()
 	}
 }
 
+// closeHandle closes the handle of an interface, it reports whether it was open and whether it was the last one
+func (l *Listener) closeHandle(key string) (open, last bool) {
+	l.Lock()
+	defer l.Unlock()
+	handle, open := l.Handles[key]
+	if !open {
+		return
+	}
+	switch h := handle.(type) {
+	case interface{ Close() error }: // Socket
+		h.Close()
+	case interface{ Close() }: // *pcap.Handle
+		h.Close()
+	}
+	delete(l.Handles, key)
+	l.stopping.Add(1)
+	return true, len(l.Handles) == 0
+}
+
 func (l *Listener) activatePcap() error {
 	var e error
 	var msg string
+	if e = l.checkMode(); e != nil {
+		return e
+	}
+	if e = l.checkHostMatch(); e != nil {
+		return e
+	}
+	l.checkExclusions(l.Interfaces)
+	if e = l.loadFilterFile(); e != nil {
+		return e
+	}
+	if _, e = l.loadProcessFilter(); e != nil {
+		return e
+	}
+	if e = l.compileGTPFilter(); e != nil {
+		return e
+	}
 	for _, ifi := range l.Interfaces {
+		if l.IncludeDown && !interfaceUp(ifi.Name) && ifi.Flags&pcapIfLoopback == 0 {
+			l.debug(DebugWarn, "interface %s is down, it will be captured once it is up\n", ifi.Name)
+			l.Handles[ifi.Name] = newDownHandle(ifi, l.expectedLinkType(ifi), l.PcapHandle)
+			continue
+		}
 		var handle *pcap.Handle
 		handle, e = l.PcapHandle(ifi)
 		if e != nil {
 			msg += ("\n" + e.Error())
+			l.captureStopped(ifi.Name, captureStop{reason: StopError, err: e})
 			continue
 		}
 		l.Handles[ifi.Name] = handle
@@ -400,6 +1630,10 @@ func (l *Listener) activatePcap() error {
 	if len(l.Handles) == 0 {
 		return fmt.Errorf("pcap handles error:%s", msg)
 	}
+	if msg != "" {
+		l.debug(DebugWarn, "some interfaces are not captured:%s\n", msg)
+	}
+	l.recordBufferSizes(nil)
 	return nil
 }
 
@@ -409,82 +1643,301 @@ func (l *Listener) activateRawSocket() error {
 	}
 	var msg string
 	var e error
+	if e = l.checkMode(); e != nil {
+		return e
+	}
+	if e = l.checkHostMatch(); e != nil {
+		return e
+	}
+	l.checkExclusions(l.Interfaces)
+	if e = l.loadFilterFile(); e != nil {
+		return e
+	}
+	if _, e = l.loadProcessFilter(); e != nil {
+		return e
+	}
+	if e = l.compileGTPFilter(); e != nil {
+		return e
+	}
+	rings := make(map[string]size.Size)
 	for _, ifi := range l.Interfaces {
 		var handle Socket
 		handle, e = l.SocketHandle(ifi)
 		if e != nil {
 			msg += ("\n" + e.Error())
+			l.captureStopped(ifi.Name, captureStop{reason: StopError, err: e})
 			continue
 		}
 		l.Handles[ifi.Name] = handle
+		if sizes, ok := handle.(interface{ BufferSizes() (int, int) }); ok {
+			ring, rcvbuf := sizes.BufferSizes()
+			rings[ifi.Name] = size.Size(ring)
+			l.debug(DebugInfo, "Interface: %s. SO_RCVBUF: %d\n", ifi.Name, rcvbuf)
+		}
 	}
 	if len(l.Handles) == 0 {
 		return fmt.Errorf("raw socket handles error:%s", msg)
 	}
+	if msg != "" {
+		l.debug(DebugWarn, "some interfaces are not captured:%s\n", msg)
+	}
+	l.recordBufferSizes(rings)
 	return nil
 }
 
 func (l *Listener) activatePcapFile() (err error) {
-	var handle *pcap.Handle
+	return l.activateOffline(func() (offlineHandle, error) {
+		if isNamedPipe(l.host) {
+			// libpcap can't be interrupted while it waits for the writer of the pipe
+			return openPcapPipe(l.host, l.quit)
+		}
+		handle, err := pcap.OpenOffline(l.host)
+		if err != nil {
+			return nil, err
+		}
+		return handle, nil
+	})
+}
+
+// activateOffline opens the handle of the pcap_file engine
+func (l *Listener) activateOffline(open func() (offlineHandle, error)) (err error) {
 	var e error
-	if handle, e = pcap.OpenOffline(l.host); e != nil {
+	if l.AttachPoint != PointDefault {
+		return fmt.Errorf("the attach point %s requires a live capture", &l.AttachPoint)
+	}
+	if e = l.checkMode(); e != nil {
+		return e
+	}
+	// the packets of a file are captured whatever their addresses
+	l.checkExclusions(nil)
+	if e = l.loadFilterFile(); e != nil {
+		return e
+	}
+	if e = l.compileGTPFilter(); e != nil {
+		return e
+	}
+	handle, e := open()
+	if e != nil {
 		return fmt.Errorf("open pcap file error: %q", e)
 	}
 
-	tmp := l.host
-	l.host = ""
-	l.BPFFilter = l.Filter(pcap.Interface{})
-	l.host = tmp
+	l.BPFFilter = l.pcapFileFilter()
 
-	if e = handle.SetBPFFilter(l.BPFFilter); e != nil {
-		handle.Close()
-		return fmt.Errorf("BPF filter error: %q, filter: %s", e, l.BPFFilter)
+	// a handle without filter accepts all the packets
+	if l.BPFFilter != "" {
+		if e = handle.SetBPFFilter(l.BPFFilter); e != nil {
+			handle.Close()
+			return &FilterError{Interface: "pcap_file", LinkType: handle.LinkType(), Filter: l.BPFFilter,
+				Err: fmt.Errorf("BPF filter error: %q, filter: %q", e, l.BPFFilter)}
+		}
+	}
+	if l.DumpBPF && l.BPFFilter != "" {
+		l.dumpFilter("pcap_file", handle.LinkType(), handle.SnapLen())
 	}
 	l.Handles["pcap_file"] = handle
+	l.setEffective("pcap_file", func(opts *EffectiveOptions) {
+		opts.Snaplen, opts.Resolution, opts.LinkType, opts.BPFFilter = handle.SnapLen(), handle.Resolution(), handle.LinkType(), l.BPFFilter
+	})
+	l.progress = newFileProgress(l.host)
+	l.timeRange = newTimeRange(l.StartTime, l.EndTime)
 	return
 }
 
+// pcapFileFilter returns the filter of a pcap file, its packets are captured whatever their addresses
+func (l *Listener) pcapFileFilter() string {
+	tmp := l.host
+	l.host = ""
+	defer func() { l.host = tmp }()
+	return l.Filter(pcap.Interface{})
+}
+
+// checkHostMatch returns an error when StrictHostMatch is set and no interface matches the host
+func (l *Listener) checkHostMatch() error {
+	if l.StrictHostMatch && l.hostUnmatched {
+		return fmt.Errorf("no interface matches the host %q, check its address or name", l.host)
+	}
+	return nil
+}
+
+// setInterfaces selects the interfaces to capture, by priority: the interface named by the host,
+// or every interface having the host address, or the loopback interface for a loopback address,
+// or else every interface with an address. non-loopback interfaces come first, then by name
 func (l *Listener) setInterfaces() (err error) {
 	var pifis []pcap.Interface
-	pifis, err = pcap.FindAllDevs()
-	ifis, _ := net.Interfaces()
+	pifis, err = findAllDevs()
+	ifis, _ := netInterfaces()
 	if err != nil {
 		return
 	}
+	if err = l.resolveInterfaceID(pifis, ifis); err != nil {
+		return
+	}
 
+	l.hostUnmatched = false
+	// candidates by selection priority
+	var named, matched, loopbacks, all []pcap.Interface
+	isLoop := make(map[string]bool)
+	avail := make(map[string]pcap.Interface, len(pifis))
 	for _, pi := range pifis {
-		var ni net.Interface
-		for _, i := range ifis {
-			if i.Name == pi.Name {
-				ni = i
-				break
-			}
+		ni := netInterface(ifis, pi)
+		// on windows the friendly name of the interface is not the name of the Npcap device
+		if ni.Name != "" && ni.Name != pi.Name && l.host == ni.Name {
+			l.host = pi.Name
 		}
 
-		if ni.Flags&net.FlagLoopback != 0 {
+		loopback := ni.Flags&net.FlagLoopback != 0 || pi.Flags&pcapIfLoopback != 0
+		if loopback {
 			l.loopIndex = ni.Index
+			isLoop[pi.Name] = true
 		}
-		if ni.Flags&net.FlagUp == 0 {
+		// libpcap knows the state of the devices that are not network interfaces, e.g on windows
+		up := ni.Flags&net.FlagUp != 0 || ni.Name == "" && pi.Flags&pcapIfUp != 0
+		if !up && !loopback && !l.IncludeDown {
+			if l.hostMatches(pi) {
+				l.debug(DebugWarn, "interface %s is down and is not captured, see --input-raw-include-down\n", pi.Name)
+			}
 			continue
 		}
+		avail[pi.Name] = pi
 
-		if isDevice(l.host, pi) {
-			l.Interfaces = []pcap.Interface{pi}
-			return
+		switch {
+		// a named interface is captured even without addresses, e.g a NIC receiving the traffic of a SPAN port
+		case isDeviceName(l.host, pi):
+			named = append(named, pi)
+		case l.hostMatches(pi):
+			matched = append(matched, pi)
+		// loopback addresses other than 127.0.0.1 are not always assigned to the interface, e.g lo0 on darwin
+		case loopback && l.hostLoopback():
+			loopbacks = append(loopbacks, pi)
+		case len(pi.Addresses) != 0:
+			all = append(all, pi)
 		}
+	}
 
-		if len(pi.Addresses) != 0 {
-			l.Interfaces = append(l.Interfaces, pi)
+	// the order of the devices depends on the OS, the selection must not
+	for _, ifis := range [][]pcap.Interface{named, matched, loopbacks, all} {
+		sort.SliceStable(ifis, func(i, j int) bool {
+			if isLoop[ifis[i].Name] != isLoop[ifis[j].Name] {
+				return !isLoop[ifis[i].Name]
+			}
+			return ifis[i].Name < ifis[j].Name
+		})
+	}
+	switch {
+	case len(named) != 0:
+		// the name of an interface takes precedence over the description of another
+		l.Interfaces = named[:1]
+		for _, ifi := range named {
+			if ifi.Name == l.host {
+				l.Interfaces = []pcap.Interface{ifi}
+			}
 		}
+	case len(matched) != 0:
+		// e.g a bridge and its members, all of them are captured
+		l.Interfaces = matched
+	case len(loopbacks) != 0:
+		l.Interfaces = loopbacks[:1]
+	default:
+		// the host may be mistyped, see StrictHostMatch
+		l.hostUnmatched = !listenAll(l.host)
+		if l.hostUnmatched {
+			l.debug(DebugWarn, "no interface matches the host %s, every interface with an address is captured\n", l.host)
+		}
+		l.Interfaces = append(l.Interfaces, all...)
 	}
+	l.setBondMembers(avail)
 	return
 }
 
+// netInterface returns the network interface of the pcap device, matched by name or else by addresses
+// since Npcap names its devices \Device\NPF_{GUID}
+func netInterface(ifis []net.Interface, pi pcap.Interface) net.Interface {
+	for _, i := range ifis {
+		if i.Name == pi.Name {
+			return i
+		}
+	}
+	for _, i := range ifis {
+		addrs, _ := i.Addrs()
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			for _, pa := range pi.Addresses {
+				if ipnet.IP.Equal(pa.IP) {
+					return i
+				}
+			}
+		}
+	}
+	return net.Interface{}
+}
+
+// npcapGUID returns the GUID of an Npcap device name, e.g \Device\NPF_{GUID}
+func npcapGUID(name string) string {
+	i := strings.Index(name, "NPF_")
+	if i == -1 {
+		return ""
+	}
+	return strings.Trim(name[i+len("NPF_"):], "{}")
+}
+
+// resolveInterfaceID replaces a host that is the hardware address or the index of an interface with its name,
+// such a host matching no interface is an error instead of capturing every interface.
+// interfaces sharing a hardware address, e.g a bond and its members, are ordered by address then by name
+func (l *Listener) resolveInterfaceID(pifis []pcap.Interface, ifis []net.Interface) error {
+	mac, macErr := net.ParseMAC(l.host)
+	index, indexErr := strconv.Atoi(l.host)
+	if macErr != nil && indexErr != nil {
+		return nil
+	}
+	var candidates []pcap.Interface
+	for _, pi := range pifis {
+		ni := netInterface(ifis, pi)
+		if ni.Name == "" {
+			continue
+		}
+		if macErr == nil && bytes.Equal(mac, ni.HardwareAddr) || indexErr == nil && index == ni.Index {
+			candidates = append(candidates, pi)
+		}
+	}
+	if len(candidates) == 0 {
+		if indexErr == nil {
+			return fmt.Errorf("no interface has the index %d", index)
+		}
+		return fmt.Errorf("no interface has the hardware address %s", mac)
+	}
+	// a bond or a bridge has the addresses of its members
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if (len(candidates[i].Addresses) != 0) != (len(candidates[j].Addresses) != 0) {
+			return len(candidates[i].Addresses) != 0
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	l.host = candidates[0].Name
+	return nil
+}
+
+// isDeviceName reports whether addr names the interface, by its name, description or Npcap GUID
+func isDeviceName(addr string, ifi pcap.Interface) bool {
+	if addr == ifi.Name || (addr != "" && addr == ifi.Description) {
+		return true
+	}
+	guid := npcapGUID(ifi.Name)
+	return guid != "" && strings.EqualFold(strings.Trim(addr, "{}"), guid)
+}
+
+// isDevice reports whether addr names the interface or is one of its addresses
 func isDevice(addr string, ifi pcap.Interface) bool {
-	if addr == ifi.Name {
+	if isDeviceName(addr, ifi) {
 		return true
 	}
 
+	addr, zone := splitZone(addr)
+	if zone != "" && !isDeviceName(zone, ifi) {
+		return false
+	}
 	for _, _addr := range ifi.Addresses {
 		if _addr.IP.String() == addr {
 			return true
@@ -494,12 +1947,10 @@ func isDevice(addr string, ifi pcap.Interface) bool {
 	return false
 }
 
-func interfaceAddresses(ifi pcap.Interface) []string {
-	var hosts []string
-	for _, addr := range ifi.Addresses {
-		hosts = append(hosts, addr.IP.String())
-	}
-	return hosts
+// isLoopback reports whether addr is a loopback address
+func isLoopback(addr string) bool {
+	ip := net.ParseIP(strings.Trim(addr, "[]"))
+	return ip != nil && ip.IsLoopback()
 }
 
 func listenAll(addr string) bool {
@@ -510,22 +1961,40 @@ func listenAll(addr string) bool {
 	return false
 }
 
-func portsFilter(transport string, direction string, ports []uint16) string {
-	if len(ports) == 0 || ports[0] == 0 {
-		return fmt.Sprintf("%s %s portrange 0-%d", transport, direction, 1<<16-1)
+// portsFilter returns the filter matching ports and port ranges, an empty direction matches both src and dst
+func portsFilter(transport string, direction string, ports []uint16, ranges []PortRange) string {
+	if direction != "" {
+		transport += " " + direction
+	}
+	if (len(ports) == 0 && len(ranges) == 0) || (len(ports) != 0 && ports[0] == 0) {
+		return fmt.Sprintf("%s portrange 0-%d", transport, 1<<16-1)
 	}
 
 	var filters []string
 	for _, port := range ports {
-		filters = append(filters, fmt.Sprintf("%s %s port %d", transport, direction, port))
+		filters = append(filters, fmt.Sprintf("%s port %d", transport, port))
+	}
+	for _, r := range ranges {
+		if r.Min == r.Max {
+			filters = append(filters, fmt.Sprintf("%s port %d", transport, r.Min))
+			continue
+		}
+		filters = append(filters, fmt.Sprintf("%s portrange %d-%d", transport, r.Min, r.Max))
 	}
 	return strings.Join(filters, " or ")
 }
 
+// hostsFilter returns the filter matching hosts, and networks in CIDR notation, an empty direction matches both src and dst
 func hostsFilter(direction string, hosts []string) string {
 	var hostsFilters []string
 	for _, host := range hosts {
-		hostsFilters = append(hostsFilters, fmt.Sprintf("%s host %s", direction, host))
+		// BPF has no notion of the zone of an address, the interface being captured is its zone
+		host, _ = splitZone(host)
+		kind := " host "
+		if strings.Contains(host, "/") {
+			kind = " net "
+		}
+		hostsFilters = append(hostsFilters, strings.TrimSpace(direction+kind+host))
 	}
 
 	return strings.Join(hostsFilters, " or ")
@@ -549,6 +2018,11 @@ func pcapLinkTypeLength(lType int) (int, bool) {
 	case 226 /*DLT_IPNET*/ :
 		// https://www.tcpdump.org/linktypes/LINKTYPE_IPNET.html
 		return 24, true
+	case layers.LinkTypeIEEE802_11, layers.LinkTypeIEEE80211Radio:
+		// monitor mode, see linkHeaders
+		return variableLinkLength, true
+	case layers.LinkTypePPP, layers.LinkTypePPP_HDLC, layers.LinkTypePPPEthernet:
+		return variableLinkLength, true
 	default:
 		return 0, false
 	}
@@ -0,0 +1,101 @@
+//go:build darwin
+// +build darwin
+
+package capture
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestSetInterfacesLoopbackDarwin(t *testing.T) {
+	for _, host := range []string{"localhost", "127.0.0.1", "127.0.0.2", "::1"} {
+		l, err := NewListener(host, []uint16{8000}, "", EnginePcap, false)
+		if err != nil {
+			t.Errorf("%s: expected error to be nil, got %v", host, err)
+			continue
+		}
+		if len(l.Interfaces) != 1 || l.Interfaces[0].Name != LoopBack.Name {
+			t.Errorf("%s: expected the %s interface, got %v", host, LoopBack.Name, l.Interfaces)
+		}
+	}
+}
+
+func TestLoopbackCaptureDarwin(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64)
+		n, _ := conn.Read(buf)
+		_, _ = conn.Write(buf[:n])
+	}()
+
+	l, err := NewListener("localhost", []uint16{port}, "", EnginePcap, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Activate(); err != nil {
+		t.Skipf("can not capture on %s: %v", LoopBack.Name, err)
+	}
+	if lt := l.Handles[LoopBack.Name].(interface{ LinkType() layers.LinkType }).LinkType(); lt != layers.LinkTypeNull && lt != layers.LinkTypeLoop {
+		t.Errorf("expected NULL or LOOP link type on %s, got %s", LoopBack.Name, lt)
+	}
+
+	var mu sync.Mutex
+	var req, resp bool
+	got := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errCh := l.ListenBackground(ctx, func(pckt *tcp.Packet) {
+		if !bytes.Equal(pckt.Payload, []byte("ping")) {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		req = req || pckt.DstPort == port
+		resp = resp || pckt.SrcPort == port
+		if req && resp {
+			select {
+			case <-got:
+			default:
+				close(got)
+			}
+		}
+	})
+	<-l.Ready()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("ping"))
+	_, _ = conn.Read(make([]byte, 4))
+
+	select {
+	case <-got:
+	case <-ctx.Done():
+		mu.Lock()
+		t.Errorf("expected the request and response to be captured, got request %t response %t", req, resp)
+		mu.Unlock()
+	}
+	cancel()
+	<-errCh
+}
@@ -1,15 +1,21 @@
 package capture
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"io/ioutil"
+	"log"
 	"net"
 	"os"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 )
@@ -43,48 +49,341 @@ func TestSetInterfaces(t *testing.T) {
 	}
 }
 
+func TestSetInterfacesWithoutAddresses(t *testing.T) {
+	defer func(f func() ([]pcap.Interface, error)) { findAllDevs = f }(findAllDevs)
+	findAllDevs = func() ([]pcap.Interface, error) {
+		return []pcap.Interface{
+			{Name: "span0", Flags: pcapIfUp},
+			{Name: "span1"},
+			{Name: "mock0", Flags: pcapIfUp, Addresses: []pcap.InterfaceAddress{{IP: net.IP{192, 0, 2, 1}}}},
+		}, nil
+	}
+	l := &Listener{host: "span0"}
+	if err := l.setInterfaces(); err != nil || len(l.Interfaces) != 1 || l.Interfaces[0].Name != "span0" {
+		t.Errorf("expected the named interface without addresses to be selected, got %v %v", l.Interfaces, err)
+	}
+	l = &Listener{host: "span1"}
+	if l.setInterfaces(); len(l.Interfaces) != 1 || l.Interfaces[0].Name != "mock0" {
+		t.Errorf("expected the interface that is down to be skipped, got %v", l.Interfaces)
+	}
+	l = &Listener{}
+	if l.setInterfaces(); len(l.Interfaces) != 1 || l.Interfaces[0].Name != "mock0" {
+		t.Errorf("expected only the interfaces with addresses to be captured, got %v", l.Interfaces)
+	}
+}
+
 func TestBPFFilter(t *testing.T) {
-	l := &Listener{}
+	ifi := pcap.Interface{
+		Name:      "lo",
+		Addresses: []pcap.InterfaceAddress{{IP: net.IP{127, 0, 0, 1}}},
+	}
+	l := &Listener{Transport: "tcp", host: "127.0.0.1"}
+	filter := l.Filter(ifi)
+	if filter != "((tcp dst portrange 0-65535) and (dst host 127.0.0.1))" {
+		t.Error("wrong filter", filter)
+	}
+	l.ports = []uint16{8000}
+	l.trackResponse = true
+	filter = l.Filter(ifi)
+	if filter != "((tcp dst port 8000) and (dst host 127.0.0.1)) or ((tcp src port 8000) and (src host 127.0.0.1))" {
+		t.Error("wrong filter", filter)
+	}
+}
+
+func TestUDPFilter(t *testing.T) {
+	ifi := pcap.Interface{
+		Name:      "lo",
+		Addresses: []pcap.InterfaceAddress{{IP: net.IP{127, 0, 0, 1}}},
+	}
+	l, err := NewListener("127.0.0.1", []uint16{53}, "udp", EnginePcap, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.ExcludePorts = []uint16{5353}
+	filter := l.Filter(ifi)
+	if filter != "((udp dst port 53) and (dst host 127.0.0.1) and not (udp port 5353)) or ((udp src port 53) and (src host 127.0.0.1) and not (udp port 5353))" {
+		t.Error("wrong filter", filter)
+	}
+	if l, _ = NewListener("", nil, "", EnginePcap, false); l.Transport != "tcp" {
+		t.Errorf("expected the default transport to be tcp, got %s", l.Transport)
+	}
+	if l, err = NewListener("", nil, "dccp", EnginePcap, false); err != nil || l.Transport != "tcp" {
+		t.Errorf("expected an unsupported transport to fall back to tcp, got %v", err)
+	}
+}
+
+func TestPortRangeFilter(t *testing.T) {
+	ifi := pcap.Interface{
+		Name:      "lo",
+		Addresses: []pcap.InterfaceAddress{{IP: net.IP{127, 0, 0, 1}}},
+	}
+	l := &Listener{Transport: "tcp", ports: []uint16{80}}
+	if err := l.AddPortRanges("8000-8099"); err != nil {
+		t.Fatal(err)
+	}
+	filter := l.Filter(ifi)
+	if filter != "((tcp dst port 80 or tcp dst portrange 8000-8099) and (dst host 127.0.0.1))" {
+		t.Error("wrong filter", filter)
+	}
+	l.trackResponse = true
+	filter = l.Filter(ifi)
+	if filter != "((tcp dst port 80 or tcp dst portrange 8000-8099) and (dst host 127.0.0.1)) or ((tcp src port 80 or tcp src portrange 8000-8099) and (src host 127.0.0.1))" {
+		t.Error("wrong filter", filter)
+	}
+	l = &Listener{Transport: "tcp"}
+	if err := l.AddPortRanges("9000-9000"); err != nil {
+		t.Fatal(err)
+	}
+	filter = l.Filter(pcap.Interface{})
+	if filter != "(tcp dst port 9000)" {
+		t.Error("wrong filter", filter)
+	}
+	for _, r := range []string{"8099-8000", "80-", "a-b", "70000"} {
+		if err := l.AddPortRanges(r); err == nil {
+			t.Errorf("expected %q to be an invalid port range", r)
+		}
+	}
+}
+
+func TestNoFilter(t *testing.T) {
+	ifi := pcap.Interface{
+		Name:      "lo",
+		Addresses: []pcap.InterfaceAddress{{IP: net.IP{127, 0, 0, 1}}},
+	}
+	l := &Listener{Transport: "tcp", ports: []uint16{0}}
+	l.NoFilter = true
+	if filter := l.Filter(ifi); filter != "" {
+		t.Errorf("expected no filter, got %q", filter)
+	}
+	l.Defragment = true
+	if filter := l.Filter(ifi); filter != "" {
+		t.Errorf("expected no filter, got %q", filter)
+	}
+	l.ports = []uint16{8000}
+	if filter := l.Filter(ifi); filter == "" {
+		t.Error("expected the ports to be filtered")
+	}
+	l.ports = nil
 	l.host = "127.0.0.1"
-	l.Transport = "tcp"
-	l.setInterfaces()
-	filter := l.Filter(l.Interfaces[0])
-	if filter != "(tcp dst portrange 0-65535 and host 127.0.0.1)" {
+	if filter := l.Filter(ifi); filter == "" {
+		t.Error("expected the host to be filtered")
+	}
+}
+
+func TestNoHostFilter(t *testing.T) {
+	ifi := pcap.Interface{
+		Name:      "lo",
+		Addresses: []pcap.InterfaceAddress{{IP: net.IP{127, 0, 0, 1}}, {IP: net.IP{10, 0, 0, 1}}},
+	}
+	l := &Listener{Transport: "tcp", ports: []uint16{8000}, trackResponse: true}
+	l.NoHostFilter = true
+	if filter := l.Filter(ifi); filter != "(tcp dst port 8000) or (tcp src port 8000)" {
+		t.Error("wrong filter", filter)
+	}
+	l.host = "127.0.0.1"
+	l.ExcludeHosts = []string{"10.0.0.2"}
+	want := "((tcp dst port 8000) and not (host 10.0.0.2)) or ((tcp src port 8000) and not (host 10.0.0.2))"
+	if filter := l.Filter(ifi); filter != want {
+		t.Error("wrong filter", filter)
+	}
+}
+
+func TestExcludeFilter(t *testing.T) {
+	ifi := pcap.Interface{
+		Name:      "lo",
+		Addresses: []pcap.InterfaceAddress{{IP: net.IP{127, 0, 0, 1}}},
+	}
+	l := &Listener{Transport: "tcp", trackResponse: true}
+	l.ExcludePorts = []uint16{22, 9000}
+	l.ExcludeHosts = []string{"10.0.0.1"}
+	filter := l.Filter(ifi)
+	want := "((tcp dst portrange 0-65535) and (dst host 127.0.0.1) and not (tcp port 22 or tcp port 9000) and not (host 10.0.0.1))" +
+		" or ((tcp src portrange 0-65535) and (src host 127.0.0.1) and not (tcp port 22 or tcp port 9000) and not (host 10.0.0.1))"
+	if filter != want {
+		t.Error("wrong filter", filter)
+	}
+	l = &Listener{Transport: "tcp", ports: []uint16{8000}}
+	l.ExcludePorts = []uint16{22}
+	filter = l.Filter(pcap.Interface{})
+	if filter != "((tcp dst port 8000) and not (tcp port 22))" {
+		t.Error("wrong filter", filter)
+	}
+}
+
+func TestCheckExclusions(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	ifi := pcap.Interface{Name: "mock0", Addresses: []pcap.InterfaceAddress{{IP: net.IP{10, 0, 0, 5}}}}
+	l := &Listener{Transport: "tcp", ports: []uint16{8000}, trackResponse: true}
+	l.SetDebugLevel(DebugWarn)
+	l.portRanges = []PortRange{{8080, 8081}}
+	l.ExcludePorts = []uint16{8000, 8080}
+	l.checkExclusions([]pcap.Interface{ifi})
+	if buf.Len() != 0 {
+		t.Errorf("expected the port 8081 to be captured, got %q", buf.String())
+	}
+	l.ExcludePorts = append(l.ExcludePorts, 8081, 20)
+	l.ResponsePorts = []PortRange{{20, 20}}
+	l.ExcludeHosts = []string{"10.0.0.5"}
+	l.checkExclusions([]pcap.Interface{ifi})
+	for _, line := range []string{"all the ports 8000,8080-8081 are excluded", "all the response ports 20-20 are excluded", "Interface: mock0. All the hosts [10.0.0.5] are excluded"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("expected %q to be logged, got %q", line, buf.String())
+		}
+	}
+	// the filter doesn't warn again
+	buf.Reset()
+	l.Filter(ifi)
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be logged by Filter, got %q", buf.String())
+	}
+}
+
+func TestResponsePortsFilter(t *testing.T) {
+	l := &Listener{Transport: "tcp", ports: []uint16{21}, trackResponse: true}
+	l.NoHostFilter = true
+	l.ResponsePorts = []PortRange{{20, 20}, {30000, 31000}}
+	want := "(tcp dst port 21) or (tcp src port 20 or tcp src portrange 30000-31000)"
+	if filter := l.Filter(pcap.Interface{}); filter != want {
+		t.Error("wrong filter", filter)
+	}
+	// the response ports are only captured along with the responses
+	l.trackResponse = false
+	if filter := l.Filter(pcap.Interface{}); filter != "(tcp dst port 21)" {
+		t.Error("wrong filter", filter)
+	}
+}
+
+func TestResponseHostsFilter(t *testing.T) {
+	ifi := pcap.Interface{Name: "mock0", Addresses: []pcap.InterfaceAddress{{IP: net.IP{10, 0, 0, 5}}}}
+	l := &Listener{Transport: "tcp", ports: []uint16{8080}, trackResponse: true}
+	if filter := l.Filter(ifi); filter != "((tcp dst port 8080) and (dst host 10.0.0.5)) or ((tcp src port 8080) and (src host 10.0.0.5))" {
+		t.Error("wrong filter", filter)
+	}
+	l.ResponseHosts = []string{"10.0.1.100", "10.0.2.0/24"}
+	l.ResponsePorts = []PortRange{{443, 443}}
+	want := "((tcp dst port 8080) and (dst host 10.0.0.5)) or ((tcp src port 443) and (src host 10.0.1.100 or src net 10.0.2.0/24))"
+	if filter := l.Filter(ifi); filter != want {
+		t.Error("wrong filter", filter)
+	}
+	// the fragments of the responses too
+	l.Defragment = true
+	want = "(" + want + ") or (" + fragmentsFilter + " and (host 10.0.0.5 or host 10.0.1.100 or net 10.0.2.0/24))"
+	if filter := l.Filter(ifi); filter != want {
+		t.Error("wrong filter", filter)
+	}
+}
+
+func TestDefragmentFilter(t *testing.T) {
+	ifi := pcap.Interface{
+		Name:      "lo",
+		Addresses: []pcap.InterfaceAddress{{IP: net.IP{127, 0, 0, 1}}},
+	}
+	l := &Listener{Transport: "tcp", ports: []uint16{8000}}
+	l.Defragment = true
+	l.ExcludePorts = []uint16{22}
+	l.ExcludeHosts = []string{"10.0.0.1"}
+	filter := l.Filter(ifi)
+	want := "(((tcp dst port 8000) and (dst host 127.0.0.1) and not (tcp port 22) and not (host 10.0.0.1)))" +
+		" or (" + fragmentsFilter + " and (dst host 127.0.0.1) and not (tcp port 22) and not (host 10.0.0.1))"
+	if filter != want {
 		t.Error("wrong filter", filter)
 	}
-	l.port = 8000
 	l.trackResponse = true
-	filter = l.Filter(l.Interfaces[0])
-	if filter != "(tcp port 8000 and host 127.0.0.1)" {
-		t.Error("wrong filter")
+	filter = l.Filter(ifi)
+	if !strings.HasSuffix(filter, " or ("+fragmentsFilter+" and (host 127.0.0.1) and not (tcp port 22) and not (host 10.0.0.1))") {
+		t.Error("wrong filter", filter)
 	}
 }
 
-func TestPcapDump(t *testing.T) {
+// writePcapFile writes the packets to a new pcap file with a loopback link type
+func writePcapFile(packets [][]byte, truncate map[int]int) (string, error) {
 	f, err := ioutil.TempFile("", "pcap_file")
 	if err != nil {
-		t.Error(err)
-	}
-	h, _ := PcapDumpHandler(f, layers.LinkTypeLoop)
-	packets := Packets(1, 5, 5, 4)
-	for i := 0; i < len(packets); i++ {
-		if i == 1 {
-			// change dst port
-			binary.BigEndian.PutUint16(packets[i].TransLayer[2:], 8001)
+		return "", err
+	}
+	defer f.Close()
+	w := NewWriter(f)
+	if err = w.WriteFileHeader(64<<10, layers.LinkTypeLoop); err != nil {
+		return "", err
+	}
+	for i, data := range packets {
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), Length: len(data), CaptureLength: len(data)}
+		if n, ok := truncate[i]; ok {
+			data = data[:n]
+			ci.CaptureLength = n
 		}
-		if i == 4 {
-			packets[i].Info.CaptureLength = 40
+		if err = w.WritePacket(ci, data); err != nil {
+			return "", err
 		}
-		h(packets[i])
 	}
-	name := f.Name()
-	f.Close()
+	return f.Name(), nil
+}
+
+func TestCompiledFilter(t *testing.T) {
+	ifi := pcap.Interface{
+		Name:      "any-unknown",
+		Addresses: []pcap.InterfaceAddress{{IP: net.IP{127, 0, 0, 1}}},
+	}
+	l := &Listener{Transport: "tcp", ports: []uint16{8000}}
+	insts, err := l.CompiledFilter(ifi)
+	if err != nil {
+		t.Fatalf("expected error to be nil, got %v", err)
+	}
+	// the program ends with the instructions returning the snaplen or 0
+	if len(insts) < 2 || insts[len(insts)-1].Code != 0x06 || insts[len(insts)-1].K != 0 {
+		t.Errorf("wrong program %v", insts)
+	}
+	if ret := insts[len(insts)-2]; ret.Code != 0x06 || int(ret.K) != l.snaplen(ifi) {
+		t.Errorf("expected the packets to be accepted up to the snaplen, got %v", ret)
+	}
+}
+
+func TestValidateBPFFilter(t *testing.T) {
+	if err := ValidateBPFFilter("", layers.LinkTypeEthernet, 65535); err != nil {
+		t.Errorf("expected an empty filter to be valid, got %v", err)
+	}
+	if err := ValidateBPFFilter("tcp dst port 80", layers.LinkTypeEthernet, 65535); err != nil {
+		t.Errorf("expected error to be nil, got %v", err)
+	}
+	err := ValidateBPFFilter("tcp dst port", layers.LinkTypeEthernet, 65535)
+	if err == nil || !strings.Contains(err.Error(), `filter: "tcp dst port"`) {
+		t.Errorf("expected the filter to be reported, got %v", err)
+	}
+	err = ValidateBPFFilter("tcp port foo", layers.LinkTypeEthernet, 65535)
+	if err == nil || !strings.HasSuffix(err.Error(), "column: 10") {
+		t.Errorf("expected the column of the offending token, got %v", err)
+	}
+}
+
+func TestFormatBPF(t *testing.T) {
+	insts := []pcap.BPFInstruction{{Code: 0x28, K: 12}, {Code: 0x15, Jt: 0, Jf: 1, K: 0x800}, {Code: 0x06, K: 262144}}
+	want := "(000) code 0x0028 jt 0 jf 0 k 0x0000000c\n" +
+		"(001) code 0x0015 jt 0 jf 1 k 0x00000800\n" +
+		"(002) code 0x0006 jt 0 jf 0 k 0x00040000\n"
+	if got := formatBPF(insts); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestPcapDump(t *testing.T) {
+	packets := rawPackets(1, 5, 5, 4)
+	// change the dst port of the second packet
+	binary.BigEndian.PutUint16(packets[1][4+24+2:], 8001)
+	name, err := writePcapFile(packets, map[int]int{4: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
 	testPcapDumpEngine(name, t)
 }
 
 func testPcapDumpEngine(f string, t *testing.T) {
 	defer os.Remove(f)
-	l, err := NewListener(f, 8000, "", EnginePcapFile, true)
+	l, err := NewListener(f, []uint16{8000}, "", EnginePcapFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
 	err = l.Activate()
 	if err != nil {
 		t.Errorf("expected error to be nil, got %q", err)
@@ -93,9 +392,9 @@ func testPcapDumpEngine(f string, t *testing.T) {
 	pckts := 0
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	err = l.Listen(ctx, func(packet *Packet) {
-		if packet.Info.CaptureLength != 57 {
-			t.Errorf("expected packet length to be %d, got %d", 57, packet.Info.CaptureLength)
+	err = l.Listen(ctx, func(packet *tcp.Packet) {
+		if len(packet.Payload) != 5 || packet.Lost != 0 {
+			t.Errorf("expected a complete packet with %d bytes of payload, got %d lost %d", 5, len(packet.Payload), packet.Lost)
 		}
 		pckts++
 	})
@@ -109,7 +408,7 @@ func testPcapDumpEngine(f string, t *testing.T) {
 }
 
 func TestPcapHandler(t *testing.T) {
-	l, err := NewListener(LoopBack.Name, 8000, "", EnginePcap, true)
+	l, err := NewListener(LoopBack.Name, []uint16{8000}, "", EnginePcap, true)
 	if err != nil {
 		t.Errorf("expected error to be nil, got %v", err)
 		return
@@ -134,7 +433,7 @@ func TestPcapHandler(t *testing.T) {
 }
 
 // func TestSocketHandler(t *testing.T) {
-// 	l, err := NewListener(LoopBack.Name, 8000, "", EngineRawSocket, true)
+// 	l, err := NewListener(LoopBack.Name, []uint16{8000}, "", EngineRawSocket, true)
 // 	err = l.Activate()
 // 	if err != nil {
 // 		return
@@ -154,39 +453,26 @@ func TestPcapHandler(t *testing.T) {
 // }
 
 func BenchmarkPcapDump(b *testing.B) {
-	f, err := ioutil.TempFile("", "pcap_file")
+	packets := rawPackets(1, b.N, 5, 4)
+	now := time.Now()
+	name, err := writePcapFile(packets, nil)
 	if err != nil {
 		b.Error(err)
 		return
 	}
-	now := time.Now()
-	defer os.Remove(f.Name())
-	h, _ := PcapDumpHandler(f, layers.LinkTypeLoop)
-	packets := Packets(1, b.N, 5, 4)
-	for i := 0; i < len(packets); i++ {
-		h(packets[i])
-	}
-	f.Close()
+	defer os.Remove(name)
 	b.Logf("%d packets in %s", b.N, time.Since(now))
 }
 
 func BenchmarkPcapFile(b *testing.B) {
-	f, err := ioutil.TempFile("", "pcap_file")
+	name, err := writePcapFile(rawPackets(1, b.N, 5, 4), nil)
 	if err != nil {
 		b.Error(err)
 		return
 	}
-	defer os.Remove(f.Name())
-	h, _ := PcapDumpHandler(f, layers.LinkTypeLoop)
-	packets := Packets(1, b.N, 5, 4)
-	for i := 0; i < len(packets); i++ {
-		h(packets[i])
-	}
-	name := f.Name()
-	f.Close()
+	defer os.Remove(name)
 	b.ResetTimer()
-	var l *Listener
-	l, err = NewListener(name, 8000, "", EnginePcapFile, true)
+	l, err := NewListener(name, []uint16{8000}, "", EnginePcapFile, true)
 	if err != nil {
 		b.Error(err)
 		return
@@ -200,9 +486,9 @@ func BenchmarkPcapFile(b *testing.B) {
 	pckts := 0
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	if err = l.Listen(ctx, func(packet *Packet) {
-		if packet.Info.CaptureLength != 49 {
-			b.Errorf("expected packet length to be %d, got %d", 49, packet.Info.CaptureLength)
+	if err = l.Listen(ctx, func(packet *tcp.Packet) {
+		if len(packet.Payload) != 5 {
+			b.Errorf("expected payload length to be %d, got %d", 5, len(packet.Payload))
 		}
 		pckts++
 	}); err != nil {
@@ -221,8 +507,8 @@ func init() {
 }
 
 func handler(n, counter *int32) PacketHandler {
-	return func(p *Packet) {
-		nn := int32(len(p.Data))
+	return func(p *tcp.Packet) {
+		nn := int32(len(p.Payload))
 		atomic.AddInt32(n, nn)
 		atomic.AddInt32(counter, 1)
 	}
@@ -232,7 +518,7 @@ func BenchmarkPcap(b *testing.B) {
 	var err error
 	n := new(int32)
 	counter := new(int32)
-	l, err := NewListener(LoopBack.Name, 8000, "", EnginePcap, false)
+	l, err := NewListener(LoopBack.Name, []uint16{8000}, "", EnginePcap, false)
 	if err != nil {
 		b.Error(err)
 		return
@@ -274,7 +560,7 @@ func BenchmarkRawSocket(b *testing.B) {
 	var err error
 	n := new(int32)
 	counter := new(int32)
-	l, err := NewListener(LoopBack.Name, 8000, "", EngineRawSocket, false)
+	l, err := NewListener(LoopBack.Name, []uint16{8000}, "", EngineRawSocket, false)
 	if err != nil {
 		b.Error(err)
 		return
@@ -311,3 +597,369 @@ func BenchmarkRawSocket(b *testing.B) {
 	b.ReportMetric(float64(atomic.LoadInt32(n)), "buf")
 	b.ReportMetric(float64(atomic.LoadInt32(counter)), "packets")
 }
+
+func TestRelativeSeq(t *testing.T) {
+	name, err := writePcapFile(rawPackets(100, 2, 5, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	for _, track := range []bool{false, true} {
+		l, err := NewListener(name, []uint16{8000}, "", EnginePcapFile, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.RelativeSeq = track
+		if err = l.Activate(); err != nil {
+			t.Fatal(err)
+		}
+		var seqs []uint32
+		_ = l.Listen(context.Background(), func(pckt *tcp.Packet) {
+			seqs = append(seqs, pckt.RelSeq)
+		})
+		want := []uint32{0, 0}
+		if track {
+			want = []uint32{0, 1}
+		}
+		if len(seqs) != 2 || seqs[0] != want[0] || seqs[1] != want[1] {
+			t.Errorf("RelativeSeq %t: expected relative seqs %v, got %v", track, want, seqs)
+		}
+		// the handshake wasn't captured
+		if track && l.MidStreamFlows() != 1 {
+			t.Errorf("expected 1 mid-stream flow, got %d", l.MidStreamFlows())
+		}
+	}
+}
+
+func TestPcapImmediateMode(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+
+	latency := func(immediate bool) time.Duration {
+		l, err := NewListener("127.0.0.1", []uint16{port}, "", EnginePcap, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.BufferTimeout = time.Second
+		l.Immediate = immediate
+		if err = l.Activate(); err != nil {
+			t.Fatalf("expected error to be nil, got %v", err)
+		}
+		got := make(chan time.Time, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		errCh := l.ListenBackground(ctx, func(*tcp.Packet) {
+			select {
+			case got <- time.Now():
+			default:
+			}
+		})
+		<-l.Ready()
+		start := time.Now()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		var d time.Duration
+		select {
+		case at := <-got:
+			d = at.Sub(start)
+		case <-ctx.Done():
+			d = time.Since(start)
+		}
+		cancel()
+		<-errCh
+		return d
+	}
+	buffered, immediate := latency(false), latency(true)
+	t.Logf("delivery latency of the SYN packet: buffered %s, immediate %s", buffered, immediate)
+	if immediate >= 100*time.Millisecond {
+		t.Errorf("expected the packet to be delivered immediately, took %s", immediate)
+	}
+}
+
+func TestListenUDP(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.Transport = "udp"
+	l.RelativeSeq = true
+	l.CloseHandler = func(tcp.FlowKey, tcp.CloseReason) {}
+	h.packets <- udpDatagram([]byte("query"))
+	h.packets <- udpDatagram(nil)
+	for _, data := range rawPackets(100, 1, 5, 4) {
+		h.packets <- data
+	}
+	close(h.packets)
+	var pckts []*tcp.Packet
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) {
+		pckts = append(pckts, pckt)
+	})
+	if len(pckts) != 1 {
+		t.Fatalf("expected only the UDP datagram with a payload, got %d packets", len(pckts))
+	}
+	pckt := pckts[0]
+	if pckt.Proto != tcp.ProtoUDP || pckt.Src() != "127.0.0.1:5535" || pckt.Dst() != "127.0.0.1:53" || string(pckt.Payload) != "query" {
+		t.Errorf("wrong UDP packet %+v", pckt)
+	}
+	if l.seqs != nil || l.closes != nil {
+		t.Error("expected the TCP trackers to be disabled for UDP")
+	}
+}
+
+func TestSetInterfacesOrder(t *testing.T) {
+	defer func(f func() ([]pcap.Interface, error)) { findAllDevs = f }(findAllDevs)
+	addr := []pcap.InterfaceAddress{{IP: net.IP{192, 0, 2, 1}}}
+	devs := []pcap.Interface{
+		{Name: "mockbr0", Flags: pcapIfUp, Addresses: addr},
+		{Name: "mock1", Flags: pcapIfUp, Description: "mockbr0"},
+		{Name: "mocklo", Flags: pcapIfUp | pcapIfLoopback, Addresses: addr},
+		{Name: "mock0", Flags: pcapIfUp, Addresses: addr},
+		{Name: "mock2", Flags: pcapIfUp, Addresses: []pcap.InterfaceAddress{{IP: net.IP{192, 0, 2, 2}}}},
+	}
+	names := func(ifis []pcap.Interface) (names []string) {
+		for _, ifi := range ifis {
+			names = append(names, ifi.Name)
+		}
+		return
+	}
+	for i := 0; i < 5; i++ {
+		// every order of the devices selects the same interfaces
+		devs = append(devs[1:], devs[0])
+		findAllDevs = func() ([]pcap.Interface, error) { return devs, nil }
+		l := &Listener{host: "mockbr0"}
+		l.setInterfaces()
+		if got := names(l.Interfaces); len(got) != 1 || got[0] != "mockbr0" {
+			t.Errorf("expected the interface matching by name, got %v", got)
+		}
+		l = &Listener{host: "192.0.2.1"}
+		l.setInterfaces()
+		if got := strings.Join(names(l.Interfaces), ","); got != "mock0,mockbr0,mocklo" {
+			t.Errorf("expected every interface with the address, loopback last, got %v", got)
+		}
+		l = &Listener{}
+		l.setInterfaces()
+		if got := strings.Join(names(l.Interfaces), ","); got != "mock0,mock2,mockbr0,mocklo" {
+			t.Errorf("expected the interfaces with addresses sorted by name, got %v", got)
+		}
+	}
+}
+
+func TestSetInterfacesByID(t *testing.T) {
+	defer func(f func() ([]pcap.Interface, error)) { findAllDevs = f }(findAllDevs)
+	defer func(f func() ([]net.Interface, error)) { netInterfaces = f }(netInterfaces)
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	addr := []pcap.InterfaceAddress{{IP: net.IP{192, 0, 2, 1}}}
+	findAllDevs = func() ([]pcap.Interface, error) {
+		return []pcap.Interface{{Name: "mock1"}, {Name: "mockbond0", Addresses: addr}, {Name: "mock0"}, {Name: "mock2", Addresses: addr}}, nil
+	}
+	netInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Index: 3, Name: "mock1", HardwareAddr: mac, Flags: net.FlagUp},
+			{Index: 4, Name: "mockbond0", HardwareAddr: mac, Flags: net.FlagUp},
+			{Index: 2, Name: "mock0", HardwareAddr: mac, Flags: net.FlagUp},
+			{Index: 5, Name: "mock2", HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}, Flags: net.FlagUp},
+		}, nil
+	}
+	tests := []struct{ host, name string }{
+		{"mock2", "mock2"},
+		{"02:00:00:00:00:02", "mock2"},
+		{"02-00-00-00-00-01", "mockbond0"}, // the bond has the address of its members
+		{"3", "mock1"},
+	}
+	for _, tt := range tests {
+		l := &Listener{host: tt.host}
+		l.setInterfaces()
+		if len(l.Interfaces) != 1 || l.Interfaces[0].Name != tt.name {
+			t.Errorf("%s: expected %s, got %v", tt.host, tt.name, l.Interfaces)
+		}
+	}
+	l := &Listener{host: "02:00:00:00:00:01"}
+	l.setInterfaces()
+	if l.host != "mockbond0" {
+		t.Errorf("expected the host to be the name of the interface, got %s", l.host)
+	}
+}
+
+func TestSetInterfacesByIndex(t *testing.T) {
+	defer func(f func() ([]pcap.Interface, error)) { findAllDevs = f }(findAllDevs)
+	defer func(f func() ([]net.Interface, error)) { netInterfaces = f }(netInterfaces)
+	findAllDevs = func() ([]pcap.Interface, error) {
+		return []pcap.Interface{{Name: "mock0"}, {Name: "mock1", Addresses: []pcap.InterfaceAddress{{IP: net.IP{192, 0, 2, 1}}}}}, nil
+	}
+	netInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Index: 7, Name: "mock0", Flags: net.FlagUp}, {Index: 8, Name: "mock1", Flags: net.FlagUp}}, nil
+	}
+	l := &Listener{host: "7"}
+	if err := l.setInterfaces(); err != nil || len(l.Interfaces) != 1 || l.Interfaces[0].Name != "mock0" {
+		t.Errorf("expected the interface with the index 7, got %v %v", l.Interfaces, err)
+	}
+	// an unknown index doesn't fall back to every interface
+	l = &Listener{host: "9"}
+	if err := l.setInterfaces(); err == nil || len(l.Interfaces) != 0 {
+		t.Errorf("expected an unknown index to be an error, got %v %v", l.Interfaces, err)
+	}
+	l = &Listener{host: "02:00:00:00:00:09"}
+	if err := l.setInterfaces(); err == nil {
+		t.Error("expected an unknown hardware address to be an error")
+	}
+}
+
+func TestInterfaceSnaplen(t *testing.T) {
+	l := &Listener{Transport: "tcp", ports: []uint16{8000}}
+	l.Snaplen = true
+	l.InterfaceSnaplen = InterfaceSizes{"mock0": 128, "mock1": 64}
+	if n := l.snaplen(pcap.Interface{Name: "mock0"}); n != 128 {
+		t.Errorf("expected the snapshot length of the interface, got %d", n)
+	}
+	if n := l.snaplen(pcap.Interface{Name: "mock2"}); n != 64<<10+200 {
+		t.Errorf("expected the default snapshot length, got %d", n)
+	}
+	if _, err := l.PcapHandle(pcap.Interface{Name: "mock1"}); err == nil || !strings.Contains(err.Error(), "snapshot length 64") {
+		t.Errorf("expected a snapshot length out of range to be an error, got %v", err)
+	}
+}
+
+func TestEmptyPayloads(t *testing.T) {
+	ack := generateHeader4(4, 0)
+	ack[4+24+13] = 0x10
+	rst := generateHeader4(4, 0)
+	rst[4+24+13] = 0x04
+	name, err := writePcapFile(append(rawPackets(1, 3, 5, 4), ack, rst), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	for _, closes := range []bool{false, true} {
+		l, err := NewListener(name, []uint16{8000}, "", EnginePcapFile, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var closed int
+		if closes {
+			l.CloseHandler = func(tcp.FlowKey, tcp.CloseReason) { closed++ }
+		}
+		if err = l.Activate(); err != nil {
+			t.Fatal(err)
+		}
+		var handled int
+		_ = l.Listen(context.Background(), func(*tcp.Packet) { handled++ })
+		if handled != 3 || l.EmptyPayloads() != 2 {
+			t.Errorf("CloseHandler %t: expected 3 packets handled and 2 without payload, got %d and %d", closes, handled, l.EmptyPayloads())
+		}
+		if closes && closed != 1 {
+			t.Errorf("expected the reset to close the connection, got %d closes", closed)
+		}
+	}
+}
+
+func TestLocalhost(t *testing.T) {
+	defer func(f func() ([]pcap.Interface, error)) { findAllDevs = f }(findAllDevs)
+	defer func(f func() ([]net.Interface, error)) { netInterfaces = f }(netInterfaces)
+	findAllDevs = func() ([]pcap.Interface, error) {
+		return []pcap.Interface{
+			{Name: "mock0", Addresses: []pcap.InterfaceAddress{{IP: net.IP{192, 0, 2, 1}}}},
+			{Name: "lo", Flags: pcapIfLoopback, Addresses: []pcap.InterfaceAddress{{IP: net.IP{127, 0, 0, 1}}, {IP: net.IPv6loopback}}},
+		}, nil
+	}
+	netInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Index: 1, Name: "lo", Flags: net.FlagUp | net.FlagLoopback}, {Index: 2, Name: "mock0", Flags: net.FlagUp}}, nil
+	}
+	l, err := NewListener("localhost", []uint16{8000}, "", EnginePcap, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Interfaces) != 1 || l.Interfaces[0].Name != "lo" {
+		t.Fatalf("expected the loopback interface, got %v", l.Interfaces)
+	}
+	if filter := l.Filter(l.Interfaces[0]); filter != "((tcp dst port 8000) and (dst host 127.0.0.1 or dst host ::1))" {
+		t.Error("wrong filter", filter)
+	}
+	// the caller resolves localhost
+	l.SetPcapOptions(PcapOptions{LocalhostAddresses: []string{"192.0.2.1"}})
+	if len(l.Interfaces) != 1 || l.Interfaces[0].Name != "mock0" {
+		t.Fatalf("expected the interface of the address, got %v", l.Interfaces)
+	}
+	if filter := l.Filter(l.Interfaces[0]); filter != "((tcp dst port 8000) and (dst host 192.0.2.1))" {
+		t.Error("wrong filter", filter)
+	}
+}
+
+func TestScopedAddresses(t *testing.T) {
+	ifi := pcap.Interface{
+		Name: "mock0",
+		Addresses: []pcap.InterfaceAddress{
+			{IP: net.IP{192, 0, 2, 1}, Broadaddr: net.IP{192, 0, 2, 255}},
+			{IP: net.ParseIP("2001:db8::1")},
+			{IP: net.ParseIP("fe80::1")},
+			{IP: net.ParseIP("ff02::fb")},
+		},
+	}
+	l := &Listener{Transport: "udp", ports: []uint16{5353}}
+	if filter := l.Filter(ifi); filter != "((udp dst port 5353) and (dst host 192.0.2.1 or dst host 2001:db8::1))" {
+		t.Error("wrong filter", filter)
+	}
+	l.LinkLocal = true
+	if filter := l.Filter(ifi); filter != "((udp dst port 5353) and (dst host 192.0.2.1 or dst host 2001:db8::1 or dst host fe80::1))" {
+		t.Error("wrong filter", filter)
+	}
+	// the groups are only destinations
+	l.LinkLocal, l.Multicast, l.trackResponse = false, true, true
+	want := "((udp dst port 5353) and (dst host 192.0.2.1 or dst host 2001:db8::1 or dst net 224.0.0.0/4 or dst net ff00::/8" +
+		" or dst host 255.255.255.255 or dst host 192.0.2.255)) or ((udp src port 5353) and (src host 192.0.2.1 or src host 2001:db8::1))"
+	if filter := l.Filter(ifi); filter != want {
+		t.Error("wrong filter", filter)
+	}
+
+	// an interface with only a link-local address keeps it
+	lonely := pcap.Interface{Name: "mock1", Addresses: []pcap.InterfaceAddress{{IP: net.ParseIP("fe80::2")}}}
+	if hosts := l.interfaceAddresses(lonely); len(hosts) != 1 || hosts[0] != "fe80::2" {
+		t.Errorf("expected the link-local address, got %v", hosts)
+	}
+
+	// a scoped address only matches the interface of its zone, the zone is left out of the filter
+	if !isDevice("fe80::1%mock0", ifi) || isDevice("fe80::1%mock1", ifi) || !isDevice("fe80::1", ifi) {
+		t.Error("wrong match of the scoped addresses")
+	}
+	l = &Listener{Transport: "tcp", ports: []uint16{80}, host: "fe80::9%mock1"}
+	if filter := l.Filter(ifi); filter != "((tcp dst port 80) and (dst host fe80::9))" {
+		t.Error("wrong filter", filter)
+	}
+}
+
+func TestStrictHostMatch(t *testing.T) {
+	defer func(f func() ([]pcap.Interface, error)) { findAllDevs = f }(findAllDevs)
+	findAllDevs = func() ([]pcap.Interface, error) {
+		return []pcap.Interface{
+			{Name: "mock0", Flags: pcapIfUp, Addresses: []pcap.InterfaceAddress{{IP: net.IP{192, 0, 2, 1}}}},
+			{Name: "mock1", Flags: pcapIfUp, Addresses: []pcap.InterfaceAddress{{IP: net.IP{192, 0, 2, 2}}}},
+		}, nil
+	}
+	// a mistyped address selects every interface
+	l, err := NewListener("192.0.2.11", []uint16{8000}, "", EnginePcap, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Interfaces) != 2 {
+		t.Errorf("expected every interface to be selected, got %v", l.Interfaces)
+	}
+	l.SetPcapOptions(PcapOptions{StrictHostMatch: true})
+	if err = l.Activate(); err == nil || !strings.Contains(err.Error(), "192.0.2.11") {
+		t.Errorf("expected the activation to fail, got %v", err)
+	}
+
+	for _, host := range []string{"192.0.2.2", ""} {
+		l, err = NewListener(host, []uint16{8000}, "", EnginePcap, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.SetPcapOptions(PcapOptions{StrictHostMatch: true})
+		if err = l.checkHostMatch(); err != nil {
+			t.Errorf("%q: unexpected error %v", host, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+//go:build windows
+// +build windows
+
+package capture
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+)
+
+func TestIsDeviceNpcap(t *testing.T) {
+	ifi := pcap.Interface{
+		Name:        `\Device\NPF_{4E2F7A1B-0C3D-4E5F-8A9B-0C1D2E3F4A5B}`,
+		Description: "Intel(R) Ethernet Connection",
+		Addresses:   []pcap.InterfaceAddress{{IP: net.ParseIP("10.0.0.5")}},
+	}
+	for _, addr := range []string{
+		ifi.Name,
+		"Intel(R) Ethernet Connection",
+		"{4E2F7A1B-0C3D-4E5F-8A9B-0C1D2E3F4A5B}",
+		"4e2f7a1b-0c3d-4e5f-8a9b-0c1d2e3f4a5b",
+		"10.0.0.5",
+	} {
+		if !isDevice(addr, ifi) {
+			t.Errorf("expected %q to match %q", addr, ifi.Name)
+		}
+	}
+	for _, addr := range []string{"", "Ethernet", "10.0.0.6", "{00000000-0000-0000-0000-000000000000}"} {
+		if isDevice(addr, ifi) {
+			t.Errorf("expected %q not to match %q", addr, ifi.Name)
+		}
+	}
+}
+
+func TestSetInterfacesNpcapLoopback(t *testing.T) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		t.Skipf("Npcap is not available: %v", err)
+	}
+	var lo pcap.Interface
+	for _, dev := range devs {
+		if strings.HasSuffix(dev.Name, "NPF_Loopback") {
+			lo = dev
+			break
+		}
+	}
+	if lo.Name == "" {
+		t.Skip("Npcap loopback adapter is not installed")
+	}
+	for _, host := range []string{lo.Name, lo.Description, npcapGUID(lo.Name)} {
+		l := &Listener{host: host}
+		if err = l.setInterfaces(); err != nil {
+			t.Fatal(err)
+		}
+		if len(l.Interfaces) != 1 || l.Interfaces[0].Name != lo.Name {
+			t.Errorf("%q: expected the %s interface, got %v", host, lo.Name, l.Interfaces)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// errBadChecksum is set on the packets dropped by ValidateChecksums
+var errBadChecksum = errors.New("invalid checksum")
+
+// checksumValidator drops the packets whose IP, TCP or UDP checksum is invalid, e.g the corrupt frames
+// mirrored by a SPAN port. the packets sent by the host itself usually have their checksums left for
+// the NIC to fill, they are not validated: the packets sent from the addresses of the host, and the
+// ones whose checksum field only holds the sum of the pseudo header, as set for the offload
+type checksumValidator struct {
+	bad    uint64 // first field to be 64-bit aligned for atomic operations
+	locals map[string]bool
+}
+
+func newChecksumValidator() *checksumValidator {
+	v := &checksumValidator{locals: make(map[string]bool)}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			v.locals[string(ipnet.IP.To16())] = true
+		}
+	}
+	return v
+}
+
+// valid reports whether the checksums of the IP packet ip are valid, the checksums that can't be computed,
+// e.g of a truncated packet, are deemed valid. the invalid packets are counted
+func (v *checksumValidator) valid(ip []byte) bool {
+	if v.check(ip) {
+		return true
+	}
+	atomic.AddUint64(&v.bad, 1)
+	return false
+}
+
+func (v *checksumValidator) check(ip []byte) bool {
+	if len(ip) == 0 {
+		return true
+	}
+	var src, dst, transport []byte
+	var proto byte
+	switch ip[0] >> 4 {
+	case 4:
+		ihl := int(ip[0]&0x0F) * 4
+		if ihl < 20 || len(ip) < ihl {
+			return true // left for the parser to reject
+		}
+		src, dst = ip[12:16], ip[16:20]
+		if v.local(src) {
+			return true
+		}
+		if fold(sum(0, ip[:ihl])) != 0xFFFF {
+			return false
+		}
+		total := int(binary.BigEndian.Uint16(ip[2:4]))
+		if binary.BigEndian.Uint16(ip[6:8])&0x3FFF != 0 || total < ihl || len(ip) < total {
+			return true // fragmented or truncated
+		}
+		proto, transport = ip[9], ip[ihl:total]
+	case 6:
+		if len(ip) < 40 {
+			return true
+		}
+		src, dst = ip[8:24], ip[24:40]
+		total := 40 + int(binary.BigEndian.Uint16(ip[4:6]))
+		if v.local(src) || total == 40 || len(ip) < total {
+			return true // jumbogram or truncated
+		}
+		// the transport checksums of the packets with extension headers are not validated
+		proto, transport = ip[6], ip[40:total]
+	default:
+		return true
+	}
+	field := 16 // offset of the checksum
+	switch {
+	case proto == tcp.ProtoTCP && len(transport) >= 20:
+	case proto == tcp.ProtoUDP && len(transport) >= 8:
+		field = 6
+		if binary.BigEndian.Uint16(transport[field:]) == 0 && len(src) == 4 {
+			return true // no checksum
+		}
+	default:
+		return true
+	}
+	// pseudo header
+	s := sum(0, src)
+	s = sum(s, dst)
+	s += uint32(proto) + uint32(len(transport))
+	if binary.BigEndian.Uint16(transport[field:]) == fold(s) {
+		return true // offloaded
+	}
+	return fold(sum(s, transport)) == 0xFFFF
+}
+
+// local reports whether ip is an address of the host
+func (v *checksumValidator) local(ip []byte) bool {
+	return v.locals[string(net.IP(ip).To16())]
+}
+
+// sum adds the 16 bits words of data to s, see RFC 1071
+func sum(s uint32, data []byte) uint32 {
+	n := len(data) &^ 1
+	for i := 0; i < n; i += 2 {
+		s += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if n != len(data) {
+		s += uint32(data[n]) << 8
+	}
+	return s
+}
+
+func fold(s uint32) uint16 {
+	for s>>16 != 0 {
+		s = s&0xFFFF + s>>16
+	}
+	return uint16(s)
+}
+
+// validChecksums reports whether the packet can be parsed, its checksums are only validated with ValidateChecksums
+func (l *Listener) validChecksums(data []byte, linkSize int) bool {
+	return l.checksums == nil || len(data) < linkSize || l.checksums.valid(data[linkSize:])
+}
+
+// BadChecksums returns the number of packets dropped because of an invalid checksum, see ValidateChecksums
+func (l *Listener) BadChecksums() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	if l.checksums == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.checksums.bad)
+}
@@ -0,0 +1,80 @@
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket/layers"
+)
+
+// checksummed sets the addresses of a loopback IPv4 packet of rawPackets, and fills its checksums
+func checksummed(data []byte, src, dst [4]byte) []byte {
+	ip := data[4:]
+	copy(ip[12:16], src[:])
+	copy(ip[16:20], dst[:])
+	ihl := int(ip[0]&0x0F) * 4
+	ip[10], ip[11] = 0, 0
+	binary.BigEndian.PutUint16(ip[10:], ^fold(sum(0, ip[:ihl])))
+	segment := ip[ihl:]
+	segment[16], segment[17] = 0, 0
+	s := sum(sum(0, src[:]), dst[:]) + tcp.ProtoTCP + uint32(len(segment))
+	binary.BigEndian.PutUint16(segment[16:], ^fold(sum(s, segment)))
+	return data
+}
+
+func TestChecksumValidator(t *testing.T) {
+	v := &checksumValidator{locals: map[string]bool{string(net.IPv4(10, 0, 0, 1)): true}}
+	remote, local := [4]byte{192, 0, 2, 1}, [4]byte{10, 0, 0, 1}
+	pckt := checksummed(rawPackets(1, 1, 10, 4)[0], remote, local)
+	if !v.valid(pckt[4:]) {
+		t.Fatal("expected the checksums to be valid")
+	}
+	pckt[len(pckt)-1] ^= 0xFF
+	if v.valid(pckt[4:]) {
+		t.Error("expected a corrupt payload to be detected")
+	}
+	// only the pseudo header is summed when the checksum is offloaded
+	pckt = checksummed(rawPackets(1, 1, 10, 4)[0], remote, local)
+	segment := pckt[4+24:]
+	s := sum(sum(0, remote[:]), local[:]) + tcp.ProtoTCP + uint32(len(segment))
+	binary.BigEndian.PutUint16(segment[16:], fold(s))
+	if !v.valid(pckt[4:]) {
+		t.Error("expected an offloaded checksum to be accepted")
+	}
+	// the packets sent by the host are not validated
+	pckt = checksummed(rawPackets(1, 1, 10, 4)[0], local, remote)
+	pckt[len(pckt)-1] ^= 0xFF
+	if !v.valid(pckt[4:]) {
+		t.Error("expected the packets sent from a local address to be accepted")
+	}
+	pckt[4+10] ^= 0xFF
+	if v.valid(pckt[:4+10]) != true {
+		t.Error("expected a truncated header to be left for the parser")
+	}
+	if v.bad != 1 {
+		t.Errorf("expected 1 bad packet, got %d", v.bad)
+	}
+}
+
+func TestValidateChecksums(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.ValidateChecksums = true
+	remote, other := [4]byte{192, 0, 2, 1}, [4]byte{192, 0, 2, 2}
+	for i, data := range rawPackets(1, 4, 10, 4) {
+		data = checksummed(data, remote, other)
+		if i%2 == 1 {
+			data[len(data)-1] ^= 0xFF
+		}
+		h.packets <- data
+	}
+	close(h.packets)
+	n := 0
+	_ = l.Listen(context.Background(), func(*tcp.Packet) { n++ })
+	if n != 2 || l.BadChecksums() != 2 {
+		t.Errorf("expected 2 packets passed and 2 dropped, got %d and %d", n, l.BadChecksums())
+	}
+}
@@ -0,0 +1,139 @@
+package capture
+
+import (
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// CloseHandler is called when a connection is closed, or half-closed
+type CloseHandler func(flow tcp.FlowKey, reason tcp.CloseReason)
+
+// closeExpire is how long a half-closed or closed connection is remembered
+const closeExpire = 2 * time.Minute
+
+// closeTracker detects connections closes from the FIN and RST flags of their packets
+type closeTracker struct {
+	sync.Mutex
+	handler CloseHandler
+	flows   map[tcp.FlowKey]*closeState
+	last    time.Time
+	limits  *StateLimits
+}
+
+type closeState struct {
+	fin    [2]bool // FIN received from A, from B
+	closed bool
+	seen   time.Time
+}
+
+func newCloseTracker(handler CloseHandler, limits *StateLimits) *closeTracker {
+	return &closeTracker{
+		handler: handler,
+		flows:   make(map[tcp.FlowKey]*closeState),
+		limits:  limits,
+	}
+}
+
+// closeSignal holds the close related fields of a packet, so that they can be
+// tracked after the packet has been passed to the packet handler
+type closeSignal struct {
+	key           tcp.FlowKey
+	reversed      bool
+	syn, fin, rst bool
+	timestamp     time.Time
+}
+
+func newCloseSignal(pckt *tcp.Packet) (sig closeSignal, ok bool) {
+	if !(pckt.FIN || pckt.RST || pckt.SYN) {
+		return
+	}
+	sig.key, sig.reversed = pckt.Flow, pckt.Reversed
+	sig.syn, sig.fin, sig.rst = pckt.SYN, pckt.FIN, pckt.RST
+	sig.timestamp = pckt.Timestamp
+	return sig, true
+}
+
+// track calls the handler if the packet closes its connection
+func (t *closeTracker) track(sig closeSignal) {
+	t.Lock()
+	defer t.Unlock()
+	t.evict(sig.timestamp)
+	state, ok := t.flows[sig.key]
+	if sig.syn {
+		// the connection is being reopened
+		t.remove(sig.key)
+		return
+	}
+	if !ok {
+		for !t.limits.reserve(1, 0) {
+			if !t.evictOldest() {
+				t.limits.force(1, 0)
+				break
+			}
+		}
+		state = new(closeState)
+		t.flows[sig.key] = state
+	}
+	state.seen = sig.timestamp
+	if state.closed {
+		// retransmissions or the RST following a close
+		return
+	}
+	if sig.rst {
+		state.closed = true
+		t.handler(sig.key, tcp.CloseRST)
+		return
+	}
+	i := 0
+	if sig.reversed {
+		i = 1
+	}
+	if state.fin[i] {
+		return
+	}
+	state.fin[i] = true
+	if state.fin[1-i] {
+		state.closed = true
+		t.handler(sig.key, tcp.CloseFIN)
+		return
+	}
+	t.handler(sig.key, tcp.CloseHalf)
+}
+
+func (t *closeTracker) evict(now time.Time) {
+	if now.Sub(t.last) < closeExpire {
+		return
+	}
+	t.last = now
+	for key, state := range t.flows {
+		if now.Sub(state.seen) > closeExpire {
+			t.remove(key)
+		}
+	}
+}
+
+func (t *closeTracker) remove(key tcp.FlowKey) {
+	if _, ok := t.flows[key]; ok {
+		delete(t.flows, key)
+		t.limits.release(1, 0)
+	}
+}
+
+// evictOldest evicts the least recently seen connection, it reports false when there is none
+func (t *closeTracker) evictOldest() bool {
+	var oldest *closeState
+	var key tcp.FlowKey
+	for k, state := range t.flows {
+		if oldest == nil || state.seen.Before(oldest.seen) {
+			oldest, key = state, k
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	t.remove(key)
+	t.limits.evicted()
+	return true
+}
@@ -0,0 +1,51 @@
+package capture
+
+import (
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestCloseTracker(t *testing.T) {
+	var reasons []tcp.CloseReason
+	var flows []tcp.FlowKey
+	tracker := newCloseTracker(func(flow tcp.FlowKey, reason tcp.CloseReason) {
+		flows = append(flows, flow)
+		reasons = append(reasons, reason)
+	}, nil)
+	send := func(fromClient bool, set func(*tcp.Packet)) {
+		pckt := wsPacket(fromClient, nil)
+		set(pckt)
+		if sig, ok := newCloseSignal(pckt); ok {
+			tracker.track(sig)
+		}
+	}
+	fin := func(p *tcp.Packet) { p.FIN, p.ACK = true, true }
+	rst := func(p *tcp.Packet) { p.RST = true }
+	syn := func(p *tcp.Packet) { p.SYN = true }
+	ack := func(p *tcp.Packet) { p.ACK = true }
+
+	// graceful close, with a retransmitted FIN
+	send(true, fin)
+	send(true, fin)
+	send(false, ack)
+	send(false, fin)
+	// the RST following a close is ignored
+	send(true, rst)
+	// the connection is reopened and reset
+	send(true, syn)
+	send(false, rst)
+
+	expected := []tcp.CloseReason{tcp.CloseHalf, tcp.CloseFIN, tcp.CloseRST}
+	if len(reasons) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, reasons)
+	}
+	for i := range expected {
+		if reasons[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, reasons)
+		}
+	}
+	if flows[0] != flows[2] || flows[0].String() != "127.0.0.1:5535-127.0.0.1:8000" {
+		t.Errorf("expected the same flow for both directions, got %s and %s", flows[0], flows[2])
+	}
+}
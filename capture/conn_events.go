@@ -0,0 +1,99 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket"
+)
+
+// CaptureMode defines what the listener delivers to its handlers
+type CaptureMode uint8
+
+// Available capture modes
+const (
+	// ModePackets delivers every parsed packet to the PacketHandler
+	ModePackets CaptureMode = iota
+	// ModeConnectionEvents only captures SYN(and optionally SYN-ACK) packets and
+	// delivers them to the ConnectionHandler as lean connection events
+	ModeConnectionEvents
+)
+
+// Set is here so that CaptureMode can implement flag.Var
+func (mode *CaptureMode) Set(v string) error {
+	switch v {
+	case "", "packets":
+		*mode = ModePackets
+	case "connection_events":
+		*mode = ModeConnectionEvents
+	default:
+		return fmt.Errorf("invalid capture mode %s", v)
+	}
+	return nil
+}
+
+func (mode *CaptureMode) String() string {
+	switch *mode {
+	case ModePackets:
+		return "packets"
+	case ModeConnectionEvents:
+		return "connection_events"
+	default:
+		return ""
+	}
+}
+
+// ConnectionEvent is the representation of a connection establishment packet
+type ConnectionEvent struct {
+	SrcIP, DstIP     net.IP
+	SrcPort, DstPort uint16
+	Timestamp        time.Time
+	SYN, ACK         bool
+}
+
+// ConnectionHandler is a function that is used to handle connection events
+type ConnectionHandler func(ConnectionEvent)
+
+// tcp[tcpflags] only matches IPv4 packets, the flags of an IPv6 packet are at the offset 53
+// when the TCP header follows the fixed header
+const (
+	synFilter    = "(tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-syn or (ip6 and ip6[6] == 6 and ip6[53] & 0x12 == 0x02))"
+	synAckFilter = "(tcp[tcpflags] & (tcp-syn|tcp-ack) == (tcp-syn|tcp-ack) or (ip6 and ip6[6] == 6 and ip6[53] & 0x12 == 0x12))"
+)
+
+// checkMode returns an error when the mode can't be used with the transport of the listener
+func (l *Listener) checkMode() error {
+	if l.Mode == ModeConnectionEvents && l.Transport != "tcp" {
+		return fmt.Errorf("the mode %s requires the tcp transport, got %s", &l.Mode, l.Transport)
+	}
+	return nil
+}
+
+// connectionEventsFilter returns the filter selecting only SYN packets to the captured
+// ports, and SYN-ACK packets from them if they are requested
+func (l *Listener) connectionEventsFilter(hosts []string) (filter string) {
+	filter = fmt.Sprintf("(%s and %s)", l.directionFilter("dst", hosts), synFilter)
+	if l.SynAck {
+		filter = fmt.Sprintf("%s or (%s and %s)", filter, l.directionFilter("src", hosts), synAckFilter)
+	}
+	return
+}
+
+// parseConnectionEvent parses the headers of a packet into a connection event
+func parseConnectionEvent(data []byte, linkType, linkSize int, ci *gopacket.CaptureInfo) (ev ConnectionEvent, err error) {
+	var pckt *tcp.Packet
+	if pckt, err = tcp.ParsePacketHeaders(data, linkType, linkSize, ci); err != nil {
+		return
+	}
+	ev.SrcIP = append(net.IP(nil), pckt.SrcIP...)
+	ev.DstIP = append(net.IP(nil), pckt.DstIP...)
+	ev.SrcPort = pckt.SrcPort
+	ev.DstPort = pckt.DstPort
+	ev.Timestamp = pckt.Timestamp
+	ev.SYN = pckt.SYN
+	ev.ACK = pckt.ACK
+	return
+}
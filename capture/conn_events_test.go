@@ -0,0 +1,74 @@
+package capture
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func TestConnectionEventsFilter(t *testing.T) {
+	l := &Listener{Transport: "tcp", ports: []uint16{8000}}
+	l.Mode = ModeConnectionEvents
+	filter := l.Filter(pcap.Interface{})
+	want := "((tcp dst port 8000) and (tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-syn or (ip6 and ip6[6] == 6 and ip6[53] & 0x12 == 0x02)))"
+	if filter != want {
+		t.Error("wrong filter", filter)
+	}
+	l.SynAck = true
+	filter = l.Filter(pcap.Interface{})
+	want += " or ((tcp src port 8000) and (tcp[tcpflags] & (tcp-syn|tcp-ack) == (tcp-syn|tcp-ack) or (ip6 and ip6[6] == 6 and ip6[53] & 0x12 == 0x12)))"
+	if filter != want {
+		t.Error("wrong filter", filter)
+	}
+}
+
+func TestConnectionEventsTransport(t *testing.T) {
+	l, err := NewListener("capture.pcap", []uint16{8000}, "udp", EnginePcapFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Mode = ModeConnectionEvents
+	if err = l.Activate(); err == nil {
+		t.Error("expected the connection events of an udp capture to be rejected")
+	}
+}
+
+func TestParseConnectionEvent(t *testing.T) {
+	data := make([]byte, 4+20+20)
+	binary.BigEndian.PutUint32(data, uint32(layers.ProtocolFamilyIPv4))
+	ip := data[4:]
+	ip[0] = 4<<4 | 5
+	ip[9] = uint8(layers.IPProtocolTCP)
+	copy(ip[12:16], []byte{10, 0, 0, 1})
+	copy(ip[16:20], []byte{10, 0, 0, 2})
+	tcp := ip[20:]
+	binary.BigEndian.PutUint16(tcp, 5535)
+	binary.BigEndian.PutUint16(tcp[2:], 8000)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x02 // SYN
+
+	now := time.Now()
+	ci := gopacket.CaptureInfo{Timestamp: now, Length: len(data), CaptureLength: len(data)}
+	ev, err := parseConnectionEvent(data, int(layers.LinkTypeLoop), 4, &ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ev.SYN || ev.ACK {
+		t.Errorf("expected a SYN event, got %+v", ev)
+	}
+	if ev.SrcIP.String() != "10.0.0.1" || ev.DstIP.String() != "10.0.0.2" || ev.SrcPort != 5535 || ev.DstPort != 8000 {
+		t.Errorf("wrong event addresses %+v", ev)
+	}
+	if !ev.Timestamp.Equal(now) {
+		t.Errorf("expected timestamp %s, got %s", now, ev.Timestamp)
+	}
+	// the event must not share memory with the capture buffer
+	ip[12] = 192
+	if ev.SrcIP.String() != "10.0.0.1" {
+		t.Errorf("event address changed with the capture buffer %s", ev.SrcIP)
+	}
+}
@@ -0,0 +1,126 @@
+package capture
+
+import (
+	"encoding/hex"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket"
+)
+
+// Debug levels of a listener, the default level is read from the GORDEBUG environment variable
+const (
+	DebugSilent = iota // nothing is logged
+	DebugWarn          // errors and warnings, this is the default
+	DebugInfo          // the interfaces being read and the first packets that can not be parsed
+	DebugTrace         // every captured packet
+)
+
+// debugLevelFromEnv parses GORDEBUG, unset or invalid values are DebugWarn
+func debugLevelFromEnv() int {
+	level, err := strconv.Atoi(os.Getenv("GORDEBUG"))
+	if err != nil || level < DebugSilent {
+		return DebugWarn
+	}
+	return level
+}
+
+// SetDebugLevel overrides the debug level set by GORDEBUG
+func (l *Listener) SetDebugLevel(level int) {
+	atomic.StoreInt32(&l.debugLevel, int32(level))
+}
+
+// debugging reports whether messages of this level are logged
+func (l *Listener) debugging(level int) bool {
+	return int(atomic.LoadInt32(&l.debugLevel)) >= level
+}
+
+// debug logs the message if the debug level of the listener is at least level
+func (l *Listener) debug(level int, format string, args ...interface{}) {
+	if l.debugging(level) {
+		log.Printf(format, args...)
+	}
+}
+
+func (l *Listener) tracePacket(pckt *tcp.Packet) {
+	if l.debugging(DebugTrace) {
+		if pckt.Proto == tcp.ProtoUDP {
+			log.Printf("packet %s -> %s udp len %d\n", pckt.Src(), pckt.Dst(), len(pckt.Payload))
+			return
+		}
+		log.Printf("packet %s -> %s seq %d ack %d len %d syn %t fin %t rst %t\n", pckt.Src(), pckt.Dst(),
+			pckt.Seq, pckt.Ack, len(pckt.Payload), pckt.SYN, pckt.FIN, pckt.RST)
+	}
+}
+
+// ParseErrorHandler is called with a packet that can't be parsed, data is only valid during the call
+type ParseErrorHandler func(data []byte, err error)
+
+const (
+	parseErrorDumps   = 10  // failing packets dumped at DebugInfo
+	parseErrorDumpLen = 128 // bytes dumped of each packet
+	parseErrorSamples = 10  // failing packets passed to ParseErrorHandler per second
+)
+
+// parseErrors counts the packets that can't be parsed, packets without payload are not counted
+type parseErrors struct {
+	count   uint64
+	mu      sync.Mutex
+	window  time.Time
+	sampled int
+}
+
+// parseFailed is only called for failing packets, to keep the handling of the others untouched
+func (l *Listener) parseFailed(counters *interfaceCounters, data []byte, ci *gopacket.CaptureInfo, err error) {
+	n := atomic.AddUint64(&l.parseErrors.count, 1)
+	counters.parseFailed()
+	if n <= parseErrorDumps && l.debugging(DebugInfo) {
+		dump := data
+		if len(dump) > parseErrorDumpLen {
+			dump = dump[:parseErrorDumpLen]
+		}
+		log.Printf("can not parse packet of %d bytes: %v\n%s", len(data), err, hex.Dump(dump))
+	}
+	if l.ParseErrorHandler != nil && l.parseErrors.sample(ci.Timestamp) {
+		l.ParseErrorHandler(data, err)
+	}
+}
+
+// parseFailedOrEmpty counts the packets without payload, and handles the other errors with parseFailed
+func (l *Listener) parseFailedOrEmpty(counters *interfaceCounters, data []byte, ci *gopacket.CaptureInfo, err error) {
+	if err == tcp.ErrNoPayload {
+		atomic.AddUint64(l.empty, 1)
+		return
+	}
+	l.parseFailed(counters, data, ci, err)
+}
+
+func (p *parseErrors) sample(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.window) >= time.Second {
+		p.window = now
+		p.sampled = 0
+	}
+	if p.sampled >= parseErrorSamples {
+		return false
+	}
+	p.sampled++
+	return true
+}
+
+// ParseErrors returns the number of captured packets that couldn't be parsed
+func (l *Listener) ParseErrors() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	if l.parseErrors == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.parseErrors.count)
+}
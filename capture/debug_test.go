@@ -0,0 +1,167 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func TestDebugLevel(t *testing.T) {
+	defer os.Setenv("GORDEBUG", os.Getenv("GORDEBUG"))
+	for env, level := range map[string]int{"": DebugWarn, "0": DebugSilent, "2": DebugInfo, "3": DebugTrace, "yes": DebugWarn} {
+		os.Setenv("GORDEBUG", env)
+		if got := debugLevelFromEnv(); got != level {
+			t.Errorf("GORDEBUG=%q: expected level %d, got %d", env, level, got)
+		}
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	l := new(Listener)
+	l.SetDebugLevel(DebugWarn)
+	l.debug(DebugInfo, "info\n")
+	l.debug(DebugWarn, "warning\n")
+	l.tracePacket(wsPacket(true, nil))
+	if out := buf.String(); strings.Contains(out, "info") || !strings.Contains(out, "warning") || strings.Contains(out, "packet") {
+		t.Errorf("unexpected output %q", out)
+	}
+	l.SetDebugLevel(DebugTrace)
+	l.tracePacket(wsPacket(true, nil))
+	if !strings.Contains(buf.String(), "packet 127.0.0.1:5535 -> 127.0.0.1:8000") {
+		t.Errorf("expected a packet trace, got %q", buf.String())
+	}
+}
+
+func TestFilterDebug(t *testing.T) {
+	defer func(f func(pcap.Interface) (Socket, error)) { newSocket = f }(newSocket)
+	newSocket = func(pcap.Interface) (Socket, error) { return new(fakeSocket), nil }
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+
+	filtered := &Listener{Transport: "tcp", ports: []uint16{8000}}
+	unfiltered := &Listener{Transport: "tcp"}
+	unfiltered.NoFilter = true
+	for _, level := range []int{DebugSilent, DebugWarn, DebugInfo} {
+		for _, l := range []*Listener{filtered, unfiltered} {
+			l.SetDebugLevel(level)
+			if _, err = l.SocketHandle(pcap.Interface{Name: "mock0"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if level == DebugWarn {
+			w.Close()
+			printed, _ := ioutil.ReadAll(r)
+			if len(printed) != 0 || buf.Len() != 0 {
+				t.Errorf("expected nothing to be printed below DebugInfo, got %q and %q", printed, buf.String())
+			}
+		}
+	}
+	for _, line := range []string{"Interface: mock0. BPF Filter: (tcp dst port 8000)", "Interface: mock0. No BPF Filter"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("expected %q to be logged, got %q", line, buf.String())
+		}
+	}
+}
+
+func TestDumpFilter(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+
+	l := &Listener{Transport: "tcp"}
+	l.BPFFilter = "tcp dst port 8000"
+	l.dumpFilter("mock0", layers.LinkTypeEthernet, 65535)
+	w.Close()
+	printed, _ := ioutil.ReadAll(r)
+	if len(printed) != 0 {
+		t.Errorf("expected nothing to be printed to the standard output, got %q", printed)
+	}
+	if !strings.Contains(buf.String(), "Interface: mock0. Link type: Ethernet. BPF program") || !strings.Contains(buf.String(), "(000) code") {
+		t.Errorf("expected the BPF program to be logged, got %q", buf.String())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.SetDebugLevel(DebugInfo)
+	var samples int
+	l.ParseErrorHandler = func(data []byte, err error) {
+		if len(data) != 20 || err == nil {
+			t.Errorf("unexpected sample of %d bytes: %v", len(data), err)
+		}
+		samples++
+	}
+	go func() {
+		for i := 0; i < 15; i++ {
+			h.packets <- rawPackets(1, 1, 5, 4)[0][:20]
+		}
+		h.packets <- rawPackets(1, 1, 0, 4)[0] // packets without payload are not failures
+		h.packets <- rawPackets(1, 1, 5, 4)[0]
+		close(h.packets)
+	}()
+	var handled int
+	_ = l.Listen(context.Background(), func(*tcp.Packet) { handled++ })
+	if handled != 1 || l.ParseErrors() != 15 {
+		t.Errorf("expected 1 packet and 15 parse errors, got %d and %d", handled, l.ParseErrors())
+	}
+	if samples != parseErrorSamples {
+		t.Errorf("expected %d samples, got %d", parseErrorSamples, samples)
+	}
+	if dumps := strings.Count(buf.String(), "can not parse packet"); dumps != parseErrorDumps {
+		t.Errorf("expected %d dumps, got %d", parseErrorDumps, dumps)
+	}
+}
+
+func TestTruncatedPackets(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	h := newFakeHandle(layers.LinkTypeLoop)
+	h.lost = 100
+	l := newFakeListener(h)
+	for _, data := range rawPackets(1, 2, 5, 4) {
+		h.packets <- data
+	}
+	close(h.packets)
+	var truncated int
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) {
+		if pckt.Truncated() && pckt.Lost == 100 {
+			truncated++
+		}
+	})
+	if truncated != 2 || l.Truncated() != 2 {
+		t.Errorf("expected 2 truncated packets, got %d handled and %d counted", truncated, l.Truncated())
+	}
+	if warnings := strings.Count(buf.String(), "truncated by the snapshot length"); warnings != 1 {
+		t.Errorf("expected 1 warning, got %d", warnings)
+	}
+}
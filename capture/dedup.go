@@ -0,0 +1,127 @@
+package capture
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	dedupPackets = 64 << 10 // packets remembered at most, the oldest ones are forgotten first
+	dedupPrefix  = 128      // bytes of the IP packets hashed after their addresses
+)
+
+// deduplicator drops the copies of the packets captured at several points, e.g two SPAN ports
+// mirroring both directions of a link. the copies are identical from their IP header on, but
+// for the TTL or the hop limit and the IPv4 checksum, which are not hashed
+type deduplicator struct {
+	dropped uint64 // first field to be 64-bit aligned for atomic operations
+	sync.Mutex
+	window time.Duration
+	seen   map[uint64]struct{}
+	ring   []dedupEntry // in the order the packets were seen
+	head   int
+	n      int
+}
+
+type dedupEntry struct {
+	hash uint64
+	at   time.Time
+}
+
+func newDeduplicator(window time.Duration) *deduplicator {
+	return &deduplicator{
+		window: window,
+		seen:   make(map[uint64]struct{}),
+		ring:   make([]dedupEntry, dedupPackets),
+	}
+}
+
+// duplicate reports whether the IP packet of a frame is a copy of a packet seen within the window
+func (d *deduplicator) duplicate(linkType layers.LinkType, data []byte, ci *gopacket.CaptureInfo) bool {
+	linkSize, _ := pcapLinkTypeLength(int(linkType))
+	_, _, size, err := linkLayer(linkType, data, linkSize, ci)
+	if err != nil || size < 0 || len(data) <= size {
+		return false
+	}
+	hash, ok := ipHash(data[size:])
+	if !ok {
+		return false
+	}
+	now := ci.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+	d.Lock()
+	defer d.Unlock()
+	for d.n > 0 && now.Sub(d.ring[d.head].at) > d.window {
+		d.forget()
+	}
+	if _, ok := d.seen[hash]; ok {
+		atomic.AddUint64(&d.dropped, 1)
+		return true
+	}
+	if d.n == len(d.ring) {
+		d.forget()
+	}
+	d.ring[(d.head+d.n)%len(d.ring)] = dedupEntry{hash: hash, at: now}
+	d.n++
+	d.seen[hash] = struct{}{}
+	return false
+}
+
+// forget forgets the oldest packet
+func (d *deduplicator) forget() {
+	delete(d.seen, d.ring[d.head].hash)
+	d.head = (d.head + 1) % len(d.ring)
+	d.n--
+}
+
+// ipHash returns the FNV-1a hash of an IP packet, without the fields updated by the routers
+func ipHash(ip []byte) (uint64, bool) {
+	h := uint64(14695981039346656037)
+	add := func(b []byte) {
+		for _, c := range b {
+			h ^= uint64(c)
+			h *= 1099511628211
+		}
+	}
+	var fixed, addrsEnd int
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 {
+			return 0, false
+		}
+		// the length, the identification and the fragment offset, the protocol and the addresses
+		add(ip[:8])
+		add(ip[9:10])
+		fixed, addrsEnd = 12, 20
+	case 6:
+		if len(ip) < 40 {
+			return 0, false
+		}
+		add(ip[:7])
+		fixed, addrsEnd = 8, 40
+	default:
+		return 0, false
+	}
+	end := len(ip)
+	if end > addrsEnd+dedupPrefix {
+		end = addrsEnd + dedupPrefix
+	}
+	add(ip[fixed:end])
+	return h, true
+}
+
+// Duplicates returns the number of packets dropped as copies of packets captured at another point, see DedupWindow
+func (l *Listener) Duplicates() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	if l.dedup == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.dedup.dropped)
+}
@@ -0,0 +1,55 @@
+package capture
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestDeduplicator(t *testing.T) {
+	d := newDeduplicator(10 * time.Millisecond)
+	packets := rawPackets(1, 2, 10, 4)
+	start := time.Now()
+	ci := func(at time.Duration) *gopacket.CaptureInfo {
+		return &gopacket.CaptureInfo{Timestamp: start.Add(at)}
+	}
+	if d.duplicate(layers.LinkTypeLoop, packets[0], ci(0)) {
+		t.Error("expected the first packet not to be a duplicate")
+	}
+	// the copy of another capture point went through one more router, with an ethernet header
+	copied := append([]byte{}, packets[0][4:]...)
+	copied[8]--
+	copied[10], copied[11] = 0xAB, 0xCD
+	frame := append(append(make([]byte, 12), 0x08, 0x00), copied...)
+	if !d.duplicate(layers.LinkTypeEthernet, frame, ci(time.Millisecond)) {
+		t.Error("expected the copy to be a duplicate")
+	}
+	if d.duplicate(layers.LinkTypeLoop, packets[1], ci(2*time.Millisecond)) {
+		t.Error("expected another packet not to be a duplicate")
+	}
+	// out of the window
+	if d.duplicate(layers.LinkTypeLoop, packets[0], ci(20*time.Millisecond)) {
+		t.Error("expected the packet seen again after the window not to be a duplicate")
+	}
+	if d.dropped != 1 {
+		t.Errorf("expected 1 duplicate, got %d", d.dropped)
+	}
+}
+
+func TestDeduplicatorBounded(t *testing.T) {
+	d := newDeduplicator(time.Hour)
+	packets := rawPackets(1, dedupPackets+1, 1, 4)
+	now := time.Now()
+	for _, data := range packets {
+		d.duplicate(layers.LinkTypeLoop, data, &gopacket.CaptureInfo{Timestamp: now})
+	}
+	if d.n != dedupPackets || len(d.seen) != dedupPackets {
+		t.Errorf("expected %d packets to be remembered, got %d", dedupPackets, len(d.seen))
+	}
+	// the oldest packet was forgotten
+	if d.duplicate(layers.LinkTypeLoop, packets[0], &gopacket.CaptureInfo{Timestamp: now}) {
+		t.Error("expected the oldest packet to be forgotten")
+	}
+}
@@ -0,0 +1,257 @@
+package capture
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defragExpire     = 30 * time.Second // like the default ipfrag_time of Linux
+	defragMaxSets    = 1024             // datagrams being reassembled at the same time
+	defragMaxLen     = 1<<16 - 1        // length of a reassembled IP payload
+	ipv6FragmentHdr  = 44
+	ipv4MoreFragment = 0x2000
+)
+
+// fragmentsFilter matches the IPv4 fragments that are not the first one, and the IPv6 fragments,
+// the transport filters can't match them because they don't start with the transport header.
+// IPv6 fragments are only matched when the fragment header is the first extension header.
+const fragmentsFilter = "((ip[6:2] & 0x1fff != 0) or (ip6[6] == 44))"
+
+// defragmenter reassembles the IPv4 and IPv6 fragments of the datagrams into complete packets,
+// incomplete datagrams are evicted after defragExpire, or when too many datagrams are in flight.
+type defragmenter struct {
+	sync.Mutex
+	sets   map[fragKey]*fragSet
+	last   time.Time // last time expired sets were evicted
+	limits *StateLimits
+}
+
+type fragKey struct {
+	src, dst [16]byte
+	proto    byte
+	id       uint32
+}
+
+type fragSet struct {
+	header []byte // link and IP headers of the first fragment, without the IPv6 fragment header
+	frags  []fragment
+	length int // length of the IP payload, known once the last fragment is received
+	start  time.Time
+	bytes  int64 // buffered, accounted for in the limits
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+func newDefragmenter(limits *StateLimits) *defragmenter {
+	return &defragmenter{sets: make(map[fragKey]*fragSet), limits: limits}
+}
+
+// fragmentInfo returns the fields of an IP fragment, ok is false for the packets that are not fragments.
+// header is the part of the packet that precedes the fragment data, fragHdr is the offset of the
+// IPv6 fragment header within the IP packet, and 0 for IPv4.
+func fragmentInfo(ip []byte) (key fragKey, offset int, more bool, header, payload int, fragHdr int, ok bool) {
+	if len(ip) < 20 {
+		return
+	}
+	switch ip[0] >> 4 {
+	case 4:
+		flags := binary.BigEndian.Uint16(ip[6:8])
+		if flags&(ipv4MoreFragment|0x1FFF) == 0 {
+			return
+		}
+		ihl := int(ip[0]&0x0F) * 4
+		total := int(binary.BigEndian.Uint16(ip[2:4]))
+		if ihl < 20 || total < ihl || len(ip) < total {
+			return
+		}
+		copy(key.src[:], ip[12:16])
+		copy(key.dst[:], ip[16:20])
+		key.proto = ip[9]
+		key.id = uint32(binary.BigEndian.Uint16(ip[4:6]))
+		return key, int(flags&0x1FFF) * 8, flags&ipv4MoreFragment != 0, ihl, total - ihl, 0, true
+	case 6:
+		if len(ip) < 40 {
+			return
+		}
+		next, off := ip[6], 40
+		for ipv6Extension(next) {
+			if len(ip) < off+8 {
+				return
+			}
+			n := (int(ip[off+1]) + 1) * 8
+			if len(ip) < off+n {
+				return
+			}
+			next, off = ip[off], off+n
+		}
+		total := 40 + int(binary.BigEndian.Uint16(ip[4:6]))
+		if next != ipv6FragmentHdr || len(ip) < off+8 || total < off+8 || len(ip) < total {
+			return
+		}
+		copy(key.src[:], ip[8:24])
+		copy(key.dst[:], ip[24:40])
+		key.proto = ip[off]
+		key.id = binary.BigEndian.Uint32(ip[off+4 : off+8])
+		flags := binary.BigEndian.Uint16(ip[off+2 : off+4])
+		return key, int(flags>>3) * 8, flags&1 != 0, off + 8, total - off - 8, off, true
+	}
+	return
+}
+
+// ipv6Extension reports whether the IPv6 extension header can precede a fragment header
+func ipv6Extension(next byte) bool {
+	return next == 0 || next == 43 || next == 60
+}
+
+// add buffers the fragment of data, a packet whose IP header starts at linkSize, it returns the
+// reassembled packet once all the fragments of its datagram are received, and nil before.
+// fragmented is false for the packets that are not fragments, they are left to the caller
+func (d *defragmenter) add(data []byte, linkSize int, now time.Time) (packet []byte, fragmented bool) {
+	if len(data) < linkSize {
+		return nil, false
+	}
+	ip := data[linkSize:]
+	key, offset, more, header, length, fragHdr, ok := fragmentInfo(ip)
+	if !ok {
+		return nil, false
+	}
+	if offset+length > defragMaxLen {
+		return nil, true
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.evict(now)
+	set, ok := d.sets[key]
+	if !ok {
+		if len(d.sets) >= defragMaxSets {
+			d.evictOldest()
+		}
+		set = &fragSet{start: now}
+		d.sets[key] = set
+		d.limits.force(1, 0)
+	}
+	n := int64(length)
+	if offset == 0 {
+		n += int64(linkSize + header)
+	}
+	// the oldest datagrams are evicted first, the fragment is dropped along with its datagram when
+	// the others are not enough
+	for !d.limits.reserve(0, n) {
+		if !d.evictOldest() || d.sets[key] == nil {
+			d.remove(key)
+			return nil, true
+		}
+	}
+	set.bytes += n
+	set.frags = append(set.frags, fragment{offset, append([]byte{}, ip[header:header+length]...)})
+	if offset == 0 {
+		set.header = append([]byte{}, data[:linkSize+header]...)
+		if fragHdr != 0 {
+			// the fragment header is removed, the previous header points to the next one
+			hdr := set.header[linkSize:]
+			set.header = append(set.header[:linkSize+fragHdr], hdr[header:]...)
+			setIPv6NextHeader(set.header[linkSize:], fragHdr, ip[fragHdr])
+		}
+	}
+	if !more {
+		set.length = offset + length
+	}
+	payload := set.reassemble()
+	if payload == nil {
+		return nil, true
+	}
+	d.remove(key)
+	packet = append(set.header, payload...)
+	ip = packet[linkSize:]
+	if ip[0]>>4 == 4 {
+		binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)))
+		binary.BigEndian.PutUint16(ip[6:8], 0)
+	} else {
+		binary.BigEndian.PutUint16(ip[4:6], uint16(len(ip)-40))
+	}
+	return packet, true
+}
+
+// setIPv6NextHeader sets the next header field of the header preceding the one at off
+func setIPv6NextHeader(ip []byte, off int, next byte) {
+	prev, cur := 6, 40
+	for cur < off && cur+2 <= len(ip) {
+		prev = cur
+		cur += (int(ip[cur+1]) + 1) * 8
+	}
+	ip[prev] = next
+}
+
+// reassemble returns the payload of the datagram, or nil if some fragments are missing
+func (set *fragSet) reassemble() []byte {
+	if set.header == nil || set.length == 0 {
+		return nil
+	}
+	sort.Slice(set.frags, func(i, j int) bool { return set.frags[i].offset < set.frags[j].offset })
+	end := 0
+	for _, f := range set.frags {
+		if f.offset > end {
+			return nil
+		}
+		if e := f.offset + len(f.data); e > end {
+			end = e
+		}
+	}
+	if end < set.length {
+		return nil
+	}
+	payload := make([]byte, set.length)
+	for _, f := range set.frags {
+		copy(payload[f.offset:], f.data)
+	}
+	return payload
+}
+
+func (d *defragmenter) evict(now time.Time) {
+	if now.Sub(d.last) < defragExpire {
+		return
+	}
+	d.last = now
+	for key, set := range d.sets {
+		if now.Sub(set.start) > defragExpire {
+			d.remove(key)
+		}
+	}
+}
+
+// evictOldest evicts the oldest datagram, it reports false when there is none
+func (d *defragmenter) evictOldest() bool {
+	var oldest *fragSet
+	var key fragKey
+	for k, set := range d.sets {
+		if oldest == nil || set.start.Before(oldest.start) {
+			oldest, key = set, k
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	d.remove(key)
+	d.limits.evicted()
+	return true
+}
+
+func (d *defragmenter) remove(key fragKey) {
+	if set, ok := d.sets[key]; ok {
+		delete(d.sets, key)
+		d.limits.release(1, set.bytes)
+	}
+}
+
+// pending returns the number of incomplete datagrams
+func (d *defragmenter) pending() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.sets)
+}
@@ -0,0 +1,118 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestDefragment(t *testing.T) {
+	for _, version := range []byte{4, 6} {
+		data := rawPackets(100, 1, 100, version)[0]
+		payload := data[len(data)-100:]
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		var frags [][]byte
+		if version == 4 {
+			frags = fragments4(data, 48)
+		} else {
+			frags = fragments6(data, 48)
+		}
+		if len(frags) != 3 {
+			t.Fatalf("IPv%d: expected 3 fragments, got %d", version, len(frags))
+		}
+		h := newFakeHandle(layers.LinkTypeLoop)
+		l := newFakeListener(h)
+		l.Defragment = true
+		// out of order, the last fragment first
+		h.packets <- frags[2]
+		h.packets <- frags[0]
+		h.packets <- frags[1]
+		close(h.packets)
+		var pckts []*tcp.Packet
+		_ = l.Listen(context.Background(), func(pckt *tcp.Packet) {
+			pckts = append(pckts, pckt)
+		})
+		if len(pckts) != 1 {
+			t.Fatalf("IPv%d: expected the reassembled packet only, got %d packets", version, len(pckts))
+		}
+		pckt := pckts[0]
+		if pckt.Seq != 100 || pckt.SrcPort != 5535 || pckt.DstPort != 8000 || !bytes.Equal(pckt.Payload, payload) {
+			t.Errorf("IPv%d: wrong reassembled packet %+v", version, pckt)
+		}
+		if n := l.defrag.pending(); n != 0 {
+			t.Errorf("IPv%d: expected no pending datagram, got %d", version, n)
+		}
+	}
+}
+
+func TestDefragmentDisabled(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	for _, frag := range fragments4(rawPackets(100, 1, 100, 4)[0], 48) {
+		h.packets <- frag
+	}
+	close(h.packets)
+	var pckts []*tcp.Packet
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) {
+		pckts = append(pckts, pckt)
+	})
+	if len(pckts) != 1 || len(pckts[0].Payload) == 100 {
+		t.Errorf("expected only the partial first fragment, got %d packets", len(pckts))
+	}
+}
+
+func TestDefragmenterEviction(t *testing.T) {
+	d := newDefragmenter(nil)
+	frags := fragments4(rawPackets(100, 1, 100, 4)[0], 48)
+	now := time.Now()
+	if packet, fragmented := d.add(rawPackets(100, 1, 10, 4)[0], 4, now); packet != nil || fragmented {
+		t.Error("expected a packet that is not a fragment to be left to the caller")
+	}
+	if _, fragmented := d.add(frags[0], 4, now); !fragmented || d.pending() != 1 {
+		t.Fatalf("expected a pending datagram, got %d", d.pending())
+	}
+	// the incomplete datagram expired, the rest of its fragments start a new one
+	if packet, _ := d.add(frags[1], 4, now.Add(2*defragExpire)); packet != nil {
+		t.Error("expected the expired fragments to be evicted")
+	}
+	if packet, _ := d.add(frags[2], 4, now.Add(2*defragExpire)); packet != nil || d.pending() != 1 {
+		t.Errorf("expected an incomplete datagram, got %d pending", d.pending())
+	}
+
+	d = newDefragmenter(nil)
+	for i := 0; i < defragMaxSets+10; i++ {
+		frag := append([]byte{}, frags[0]...)
+		frag[4+4], frag[4+5] = byte(i>>8), byte(i)
+		d.add(frag, 4, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if n := d.pending(); n != defragMaxSets {
+		t.Errorf("expected at most %d pending datagrams, got %d", defragMaxSets, n)
+	}
+}
+
+func TestFragmentInfoExtensionLength(t *testing.T) {
+	frag := fragments6(rawPackets(100, 1, 100, 6)[0], 48)[0]
+	ip := frag[4:]
+	// the length of the first extension header overflows a byte once incremented
+	ip[40+1] = 0xff
+	done := make(chan bool)
+	go func() {
+		_, _, _, _, _, _, ok := fragmentInfo(ip)
+		done <- ok
+	}()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("expected an extension header longer than the packet to be rejected")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected fragmentInfo to return")
+	}
+}
@@ -0,0 +1,254 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// DNS constants https://tools.ietf.org/html/rfc1035#section-4.1
+const (
+	dnsPort        = 53
+	dnsHeaderLen   = 12
+	dnsMaxPointers = 16 // bounds the compression pointers followed while reading a name
+)
+
+// DNSMessage holds the header and the first question of a DNS message
+type DNSMessage struct {
+	ID        uint16
+	Response  bool
+	Opcode    uint8
+	Truncated bool // TC bit, the client is expected to retry over TCP
+	RCode     uint8
+	QName     string
+	QType     uint16
+	Answers   uint16
+}
+
+// DNSEvent is a DNS query paired with its response
+type DNSEvent struct {
+	Client, Server string
+	TCP            bool
+	Query          *DNSMessage
+	Response       *DNSMessage // nil when no response arrived within the timeout
+	Start, End     time.Time   // End is the time of the response, or of the timeout
+	TCPRetry       bool        // the query is a TCP retry of a truncated UDP response
+}
+
+// DNSEmitter is called on every DNS event
+type DNSEmitter func(*DNSEvent)
+
+// DNSParser decodes the DNS messages sent to and from port 53, over UDP or TCP, and pairs the queries
+// with their responses by client, transaction ID and name. A query without response is emitted once
+// timeout is elapsed, events are only emitted while packets are handled.
+type DNSParser struct {
+	flowTable // TCP streams
+	emit      DNSEmitter
+	timeout   time.Duration
+	pending   map[dnsKey]*DNSEvent
+	truncated map[dnsRetryKey]time.Time // UDP responses with the TC bit
+	expired   time.Time                 // last time pending queries were expired
+}
+
+type dnsKey struct {
+	client string
+	id     uint16
+	qname  string
+}
+
+// dnsRetryKey identifies a question of a client host, the TCP retry comes from another port
+type dnsRetryKey struct {
+	host  string
+	qname string
+}
+
+type dnsStream struct {
+	bufs [2][]byte // 0 from client, 1 from server
+}
+
+// NewDNSParser returns a new DNS parser, default timeout is 5 seconds
+func NewDNSParser(timeout time.Duration, emit DNSEmitter) *DNSParser {
+	parser := new(DNSParser)
+	parser.init(0, time.Minute)
+	parser.emit = emit
+	parser.timeout = timeout
+	if parser.timeout <= 0 {
+		parser.timeout = 5 * time.Second
+	}
+	parser.pending = make(map[dnsKey]*DNSEvent)
+	parser.truncated = make(map[dnsRetryKey]time.Time)
+	return parser
+}
+
+// PacketHandler is the handler to be passed to Listener.Listen
+func (parser *DNSParser) PacketHandler(pckt *tcp.Packet) {
+	if pckt.DstPort != dnsPort && pckt.SrcPort != dnsPort {
+		return
+	}
+	parser.Lock()
+	defer parser.Unlock()
+	parser.expireQueries(pckt.Timestamp)
+
+	if pckt.Proto == tcp.ProtoUDP {
+		if msg, err := ParseDNSMessage(pckt.Payload); err == nil {
+			parser.message(msg, pckt, false)
+		}
+		return
+	}
+	v, ok := parser.lookup(pckt.Flow, pckt.Timestamp)
+	stream, _ := v.(*dnsStream)
+	if !ok {
+		stream = new(dnsStream)
+		parser.store(pckt.Flow, stream, pckt.Timestamp)
+	}
+	i := 0
+	if pckt.SrcPort == dnsPort {
+		i = 1
+	}
+	// messages are prefixed with their length https://tools.ietf.org/html/rfc1035#section-4.2.2
+	buf := append(stream.bufs[i], pckt.Payload...)
+	for len(buf) >= 2 {
+		n := int(binary.BigEndian.Uint16(buf))
+		if len(buf) < 2+n {
+			break
+		}
+		if msg, err := ParseDNSMessage(buf[2 : 2+n]); err == nil {
+			parser.message(msg, pckt, true)
+		}
+		buf = buf[2+n:]
+	}
+	stream.bufs[i] = nil
+	if len(buf) != 0 {
+		stream.bufs[i] = append([]byte{}, buf...)
+	}
+	if pckt.FIN || pckt.RST {
+		parser.closed(pckt.Flow, i, pckt)
+	}
+}
+
+func (parser *DNSParser) message(msg *DNSMessage, pckt *tcp.Packet, overTCP bool) {
+	if !msg.Response {
+		ev := &DNSEvent{
+			Client: pckt.Src(),
+			Server: pckt.Dst(),
+			TCP:    overTCP,
+			Query:  msg,
+			Start:  pckt.Timestamp,
+		}
+		retry := dnsRetryKey{pckt.SrcIP.String(), strings.ToLower(msg.QName)}
+		if _, ok := parser.truncated[retry]; ok && overTCP {
+			ev.TCPRetry = true
+			delete(parser.truncated, retry)
+		}
+		parser.pending[dnsKey{ev.Client, msg.ID, strings.ToLower(msg.QName)}] = ev
+		return
+	}
+	key := dnsKey{pckt.Dst(), msg.ID, strings.ToLower(msg.QName)}
+	ev, ok := parser.pending[key]
+	if !ok {
+		return
+	}
+	delete(parser.pending, key)
+	ev.Response = msg
+	ev.End = pckt.Timestamp
+	if msg.Truncated && !overTCP {
+		parser.truncated[dnsRetryKey{pckt.DstIP.String(), key.qname}] = pckt.Timestamp
+	}
+	parser.emit(ev)
+}
+
+// expireQueries emits the queries without response
+func (parser *DNSParser) expireQueries(now time.Time) {
+	if now.Sub(parser.expired) < parser.timeout {
+		return
+	}
+	parser.expired = now
+	for key, ev := range parser.pending {
+		if now.Sub(ev.Start) > parser.timeout {
+			delete(parser.pending, key)
+			ev.End = now
+			parser.emit(ev)
+		}
+	}
+	for key, at := range parser.truncated {
+		if now.Sub(at) > parser.timeout {
+			delete(parser.truncated, key)
+		}
+	}
+}
+
+// Pending returns the number of queries waiting for their response
+func (parser *DNSParser) Pending() int {
+	parser.Lock()
+	defer parser.Unlock()
+	return len(parser.pending)
+}
+
+// ParseDNSMessage parses the header and the first question of a DNS message, without the TCP length prefix
+func ParseDNSMessage(data []byte) (*DNSMessage, error) {
+	if len(data) < dnsHeaderLen {
+		return nil, fmt.Errorf("dns: short header")
+	}
+	msg := new(DNSMessage)
+	msg.ID = binary.BigEndian.Uint16(data)
+	flags := binary.BigEndian.Uint16(data[2:])
+	msg.Response = flags&0x8000 != 0
+	msg.Opcode = uint8(flags>>11) & 0xF
+	msg.Truncated = flags&0x0200 != 0
+	msg.RCode = uint8(flags) & 0xF
+	msg.Answers = binary.BigEndian.Uint16(data[6:])
+	if binary.BigEndian.Uint16(data[4:]) == 0 {
+		return msg, nil
+	}
+	name, off, err := parseDNSName(data, dnsHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < off+4 {
+		return nil, fmt.Errorf("dns: short question")
+	}
+	msg.QName = name
+	msg.QType = binary.BigEndian.Uint16(data[off:])
+	return msg, nil
+}
+
+// parseDNSName reads the name at off, next is the offset following the name in the message
+func parseDNSName(data []byte, off int) (name string, next int, err error) {
+	var labels []string
+	next = -1
+	for pointers := 0; ; {
+		if off >= len(data) {
+			return "", 0, fmt.Errorf("dns: short name")
+		}
+		n := int(data[off])
+		switch {
+		case n == 0:
+			if next == -1 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(data) {
+				return "", 0, fmt.Errorf("dns: short name")
+			}
+			if pointers++; pointers > dnsMaxPointers {
+				return "", 0, fmt.Errorf("dns: too many compression pointers")
+			}
+			if next == -1 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(data[off:]) & 0x3FFF)
+		case n&0xC0 != 0:
+			return "", 0, fmt.Errorf("dns: unsupported label type %#x", n&0xC0)
+		default:
+			if off+1+n > len(data) {
+				return "", 0, fmt.Errorf("dns: short label")
+			}
+			labels = append(labels, string(data[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package capture
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func dnsMessage(id uint16, response, truncated bool, rcode uint8, qname string) []byte {
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg, id)
+	var flags uint16
+	if response {
+		flags |= 0x8000
+	}
+	if truncated {
+		flags |= 0x0200
+	}
+	binary.BigEndian.PutUint16(msg[2:], flags|uint16(rcode))
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(qname, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, 0, 1, 0, 1) // A, IN
+}
+
+func dnsPacket(fromClient, overTCP bool, payload []byte) *tcp.Packet {
+	pckt := wsPacket(fromClient, payload)
+	pckt.Proto = tcp.ProtoUDP
+	if overTCP {
+		pckt.Proto = tcp.ProtoTCP
+	}
+	if fromClient {
+		pckt.DstPort = dnsPort
+	} else {
+		pckt.SrcPort = dnsPort
+	}
+	pckt.Flow, pckt.Reversed = tcp.NewFlowKey(pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort)
+	return pckt
+}
+
+func TestParseDNSMessage(t *testing.T) {
+	msg, err := ParseDNSMessage(dnsMessage(0xbeef, true, true, 3, "www.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 0xbeef || !msg.Response || !msg.Truncated || msg.RCode != 3 || msg.QName != "www.example.com" || msg.QType != 1 {
+		t.Errorf("wrong message %+v", msg)
+	}
+
+	// a name made of a label and a pointer to the name of the question
+	data := dnsMessage(1, false, false, 0, "example.com")
+	binary.BigEndian.PutUint16(data[4:], 2)
+	data = append(data, 3, 'w', 'w', 'w', 0xC0, dnsHeaderLen, 0, 1, 0, 1)
+	if name, _, err := parseDNSName(data, len(data)-10); err != nil || name != "www.example.com" {
+		t.Errorf("expected www.example.com, got %q %v", name, err)
+	}
+	loop := dnsMessage(1, false, false, 0, "a")
+	loop[dnsHeaderLen], loop[dnsHeaderLen+1] = 0xC0, dnsHeaderLen
+	if _, err = ParseDNSMessage(loop); err == nil {
+		t.Error("expected an error for a compression loop")
+	}
+	if _, err = ParseDNSMessage(data[:20]); err == nil {
+		t.Error("expected an error for a truncated question")
+	}
+}
+
+func TestDNSParser(t *testing.T) {
+	var events []*DNSEvent
+	parser := NewDNSParser(time.Second, func(ev *DNSEvent) { events = append(events, ev) })
+
+	query := dnsPacket(true, false, dnsMessage(7, false, false, 0, "example.com"))
+	parser.PacketHandler(query)
+	// another transaction of the same client is not a response to the query
+	parser.PacketHandler(dnsPacket(false, false, dnsMessage(8, true, false, 0, "example.com")))
+	if len(events) != 0 || parser.Pending() != 1 {
+		t.Fatalf("expected 1 pending query, got %d events and %d pending", len(events), parser.Pending())
+	}
+	resp := dnsPacket(false, false, dnsMessage(7, true, true, 0, "EXAMPLE.com"))
+	parser.PacketHandler(resp)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	ev := events[0]
+	if ev.Client != "127.0.0.1:5535" || ev.TCP || ev.Query.ID != 7 || ev.Response == nil || !ev.Response.Truncated {
+		t.Errorf("wrong event %+v", ev)
+	}
+
+	// the TCP retry, split over two segments
+	tcpQuery := append([]byte{0, 0}, dnsMessage(9, false, false, 0, "example.com")...)
+	binary.BigEndian.PutUint16(tcpQuery, uint16(len(tcpQuery)-2))
+	retry := dnsPacket(true, true, tcpQuery[:5])
+	retry.SrcPort = 5536
+	parser.PacketHandler(retry)
+	retry = dnsPacket(true, true, tcpQuery[5:])
+	retry.SrcPort = 5536
+	parser.PacketHandler(retry)
+	tcpResp := append([]byte{0, 0}, dnsMessage(9, true, false, 0, "example.com")...)
+	binary.BigEndian.PutUint16(tcpResp, uint16(len(tcpResp)-2))
+	resp = dnsPacket(false, true, tcpResp)
+	resp.DstPort = 5536
+	parser.PacketHandler(resp)
+	if len(events) != 2 || !events[1].TCP || !events[1].TCPRetry || events[1].Client != "127.0.0.1:5536" {
+		t.Fatalf("expected a TCP retry event, got %d events", len(events))
+	}
+
+	// a query without response
+	query = dnsPacket(true, false, dnsMessage(10, false, false, 0, "lost.example.com"))
+	parser.PacketHandler(query)
+	late := dnsPacket(true, false, dnsMessage(11, false, false, 0, "example.com"))
+	late.Timestamp = query.Timestamp.Add(3 * time.Second)
+	parser.PacketHandler(late)
+	if len(events) != 3 || events[2].Query.QName != "lost.example.com" || events[2].Response != nil {
+		t.Errorf("expected the unanswered query to be emitted, got %d events", len(events))
+	}
+}
+
+func TestDNSParserHalfClose(t *testing.T) {
+	var events []*DNSEvent
+	parser := NewDNSParser(time.Second, func(ev *DNSEvent) { events = append(events, ev) })
+	query := append([]byte{0, 0}, dnsMessage(12, false, false, 0, "example.com")...)
+	binary.BigEndian.PutUint16(query, uint16(len(query)-2))
+	fin := dnsPacket(true, true, query)
+	fin.FIN = true
+	parser.PacketHandler(fin)
+	if parser.Flows() != 1 {
+		t.Fatalf("expected the stream to be kept after a half-close, got %d flows", parser.Flows())
+	}
+	resp := append([]byte{0, 0}, dnsMessage(12, true, false, 0, "example.com")...)
+	binary.BigEndian.PutUint16(resp, uint16(len(resp)-2))
+	parser.PacketHandler(dnsPacket(false, true, resp[:4]))
+	fin = dnsPacket(false, true, resp[4:])
+	fin.FIN = true
+	parser.PacketHandler(fin)
+	if len(events) != 1 || events[0].Response == nil {
+		t.Errorf("expected the response sent after the half-close to be paired, got %d events", len(events))
+	}
+	if parser.Flows() != 0 {
+		t.Errorf("expected the stream to be evicted once both sides closed, got %d flows", parser.Flows())
+	}
+}
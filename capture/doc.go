@@ -9,27 +9,76 @@ example:
 
 // for the transport should be "tcp"
 listener, err := capture.NewListener(host, port, transport, engine, trackResponse)
-if err != nil {
-	// handle error
-}
-listener.SetPcapOptions(opts)
+
+	if err != nil {
+		// handle error
+	}
+
+err = listener.SetPcapOptions(opts)
+
+	if err != nil {
+		// handle error
+	}
+
 err = listner.Activate()
-if err != nil {
-	// handle it
-}
 
-if err := listener.Listen(context.Background(), handler); err != nil {
-	 // handle error
-}
+	if err != nil {
+		// handle it
+	}
+
+	if err := listener.Listen(context.Background(), handler); err != nil {
+		 // handle error
+	}
+
 // or
 errCh := listener.ListenBackground(context.Background(), handler) // runs in the background
 select {
 case err := <- errCh:
+
 	// handle error
+
 case <-quit:
+
 	//
+
 case <- l.Reading: // if we have started reading
 }
 
+// packets can also be read from any source, without libpcap, e.g in tests
+listener, err := capture.NewListener("", ports, "tcp", capture.EnginePcapFile, false)
+err = listener.AddPacketSource("memory", src, layers.LinkTypeEthernet)
+err = listener.Listen(context.Background(), handler)
+
+// or from a pcap or pcapng capture read from any io.Reader, e.g the body of an HTTP response
+listener, err := capture.NewReaderListener(resp.Body, ports, "tcp", false)
+err = listener.Activate() // reads the header of the capture
+err = listener.Listen(context.Background(), handler)
+
+// the payload of every direction of the connections can be read as an io.Reader
+
+	assembler := capture.NewStreamAssembler(time.Minute, 0, func(s *capture.Stream) {
+		req, err := http.ReadRequest(bufio.NewReader(s))
+		...
+	})
+
+listener.CloseHandler = assembler.CloseHandler
+err = listener.Listen(context.Background(), assembler.PacketHandler)
+
+// or parsed as HTTP/1.x requests and responses, correlated by their id
+parser := capture.NewHTTPParser(time.Minute, 1<<20, onRequest, onResponse)
+listener.CloseHandler = parser.CloseHandler
+err = listener.Listen(context.Background(), parser.PacketHandler)
+
+// the packets can be dropped or rewritten before they reach the handler, by transforms run in order
+redactor := capture.NewPayloadRedactor(rules)
+listener.Use(capture.Sample(10), redactor.RedactPacket)
+
+// the flows are sampled and dispatched to workers by their hash, which can be replaced, e.g to tell the tenants apart
+listener.FlowHash = tenantHash
+listener.Use(listener.Sample(10))
+dispatcher := listener.NewFlowDispatcher(4, workerHandler)
+
+// or rewritten in place before they are dumped and parsed
+listener.IPTransform = capture.IPTransforms(capture.NewIPAnonymizer(secret).Transform, redactor.Transform)
 */
 package capture // import github.com/buger/goreplay/capture
@@ -0,0 +1,120 @@
+package capture
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// interfaceUpPoll is how often the state of the interfaces that are down is checked
+var interfaceUpPoll = 500 * time.Millisecond
+
+// interfaceUp reports whether an interface is up, the devices that are not network interfaces are assumed to be
+var interfaceUp = func(name string) bool {
+	ni, err := net.InterfaceByName(name)
+	return err != nil || ni.Flags&net.FlagUp != 0
+}
+
+// errLinkTypeChanged is returned once by a handle whose link type changed, e.g an interface that was reconfigured
+// while it was down. the handle is read again with its new link type, see Listener.relink
+var errLinkTypeChanged = errors.New("the link type of the interface changed")
+
+// downHandle is the handle of an interface that was down when the listener was activated,
+// libpcap can't activate such interfaces, so the handle is only opened once the interface is up
+type downHandle struct {
+	ifi      pcap.Interface
+	linkType layers.LinkType // expected link type of the interface, then its link type once it is opened
+	open     func(pcap.Interface) (*pcap.Handle, error)
+	up       func(string) bool
+	poll     time.Duration
+
+	mu     sync.Mutex
+	handle *pcap.Handle
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newDownHandle(ifi pcap.Interface, linkType layers.LinkType, open func(pcap.Interface) (*pcap.Handle, error)) *downHandle {
+	return &downHandle{
+		ifi:      ifi,
+		linkType: linkType,
+		open:     open,
+		up:       interfaceUp,
+		poll:     interfaceUpPoll,
+		closed:   make(chan struct{}),
+	}
+}
+
+// ZeroCopyReadPacketData waits for the interface to be up before reading from it
+func (h *downHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	h.mu.Lock()
+	handle := h.handle
+	h.mu.Unlock()
+	if handle == nil {
+		var err error
+		if handle, err = h.wait(); err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+		if handle.LinkType() != h.LinkType() {
+			h.mu.Lock()
+			h.linkType = handle.LinkType()
+			h.mu.Unlock()
+			return nil, gopacket.CaptureInfo{}, errLinkTypeChanged
+		}
+	}
+	return handle.ZeroCopyReadPacketData()
+}
+
+func (h *downHandle) wait() (*pcap.Handle, error) {
+	ticker := time.NewTicker(h.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return nil, io.EOF
+		case <-ticker.C:
+		}
+		if !h.up(h.ifi.Name) {
+			continue
+		}
+		handle, err := h.open(h.ifi)
+		if err != nil {
+			return nil, err
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		select {
+		case <-h.closed:
+			handle.Close()
+			return nil, io.EOF
+		default:
+		}
+		h.handle = handle
+		return handle, nil
+	}
+}
+
+// LinkType returns the link type the interface is expected to have once it is up, then the one it has
+func (h *downHandle) LinkType() layers.LinkType {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.linkType
+}
+
+// Close stops waiting for the interface, and closes its handle if it was opened
+func (h *downHandle) Close() {
+	h.once.Do(func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		close(h.closed)
+		if h.handle != nil {
+			h.handle.Close()
+		}
+	})
+}
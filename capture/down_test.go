@@ -0,0 +1,124 @@
+package capture
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func mockInterfaceUp(t *testing.T) (up *int32) {
+	up = new(int32)
+	poll, isUp := interfaceUpPoll, interfaceUp
+	interfaceUpPoll = 10 * time.Millisecond
+	interfaceUp = func(string) bool { return atomic.LoadInt32(up) == 1 }
+	t.Cleanup(func() { interfaceUpPoll, interfaceUp = poll, isUp })
+	return
+}
+
+func TestDownHandle(t *testing.T) {
+	up := mockInterfaceUp(t)
+	name, err := writePcapFile(rawPackets(1, 3, 5, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	var opened int32
+	h := newDownHandle(pcap.Interface{Name: "down0"}, layers.LinkTypeLoop, func(pcap.Interface) (*pcap.Handle, error) {
+		atomic.AddInt32(&opened, 1)
+		return pcap.OpenOffline(name)
+	})
+	l, _ := NewListener("", nil, "", EnginePcapFile, false)
+	l.Handles["down0"] = h
+	var handled int32
+	errCh := l.ListenBackground(context.Background(), func(*tcp.Packet) { atomic.AddInt32(&handled, 1) })
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&opened) != 0 {
+		t.Fatal("expected the interface not to be opened while it is down")
+	}
+	atomic.StoreInt32(up, 1)
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("expected the capture to end with the packets of the interface")
+	}
+	if atomic.LoadInt32(&opened) != 1 || atomic.LoadInt32(&handled) != 3 {
+		t.Errorf("expected the interface to be opened once and 3 packets, got %d and %d", opened, handled)
+	}
+}
+
+func TestDownHandleLinkTypeChanged(t *testing.T) {
+	up := mockInterfaceUp(t)
+	atomic.StoreInt32(up, 1)
+	name, err := writePcapFile(rawPackets(1, 3, 5, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	// the interface was expected to be an ethernet one
+	h := newDownHandle(pcap.Interface{Name: "down0"}, layers.LinkTypeEthernet, func(pcap.Interface) (*pcap.Handle, error) {
+		return pcap.OpenOffline(name)
+	})
+	l, _ := NewListener("", nil, "", EnginePcapFile, false)
+	l.SetDebugLevel(DebugSilent)
+	l.Handles["down0"] = h
+	var handled int32
+	dumped := make(chan layers.LinkType, 3)
+	l.DumpHandler = func(_ string, _ []byte, _ *gopacket.CaptureInfo, linkType layers.LinkType) error {
+		dumped <- linkType
+		return nil
+	}
+	errCh := l.ListenBackground(context.Background(), func(*tcp.Packet) { atomic.AddInt32(&handled, 1) })
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("expected the capture to end with the packets of the interface")
+	}
+	if linkType := <-dumped; linkType != layers.LinkTypeLoop {
+		t.Errorf("expected the packets to be dumped with the new link type, got %s", linkType)
+	}
+	if atomic.LoadInt32(&handled) != 3 || l.LinkType("down0") != layers.LinkTypeLoop {
+		t.Errorf("expected 3 packets read with the new link type, got %d and %s", handled, l.LinkType("down0"))
+	}
+}
+
+func TestDownHandleClose(t *testing.T) {
+	mockInterfaceUp(t)
+	h := newDownHandle(pcap.Interface{Name: "down0"}, layers.LinkTypeEthernet, func(pcap.Interface) (*pcap.Handle, error) {
+		t.Error("expected the interface not to be opened")
+		return nil, nil
+	})
+	l, _ := NewListener("", nil, "", EnginePcapFile, false)
+	l.Handles["down0"] = h
+	errCh := l.ListenBackground(context.Background(), func(*tcp.Packet) {})
+	<-l.Ready()
+	l.Close()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("expected the listener to stop waiting for the interface")
+	}
+}
+
+func TestSetInterfacesIncludeDown(t *testing.T) {
+	defer func(f func() ([]pcap.Interface, error)) { findAllDevs = f }(findAllDevs)
+	findAllDevs = func() ([]pcap.Interface, error) {
+		return []pcap.Interface{{Name: "span1"}, {Name: "mock0", Flags: pcapIfUp}}, nil
+	}
+	l := &Listener{host: "span1"}
+	l.setInterfaces()
+	if len(l.Interfaces) != 0 {
+		t.Errorf("expected the interface that is down to be skipped by default, got %v", l.Interfaces)
+	}
+	l.SetPcapOptions(PcapOptions{IncludeDown: true})
+	if len(l.Interfaces) != 1 || l.Interfaces[0].Name != "span1" {
+		t.Errorf("expected the named interface to be selected, got %v", l.Interfaces)
+	}
+}
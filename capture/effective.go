@@ -0,0 +1,44 @@
+package capture
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// EffectiveOptions are the options the handle of an interface was activated with, as granted by libpcap
+// and the kernel rather than as requested in PcapOptions
+type EffectiveOptions struct {
+	Snaplen     int
+	BufferSize  BufferSize
+	Timestamp   string // timestamp source, empty when the default one of the interface is used
+	Resolution  gopacket.TimestampResolution
+	Promiscuous bool
+	Monitor     bool // false when the interface can't be put in monitor mode
+	Immediate   bool
+	LinkType    layers.LinkType
+	BPFFilter   string // empty when every packet is captured
+}
+
+// setEffective updates the effective options of an interface
+func (l *Listener) setEffective(name string, update func(*EffectiveOptions)) {
+	l.effectiveMu.Lock()
+	defer l.effectiveMu.Unlock()
+	if l.effective == nil {
+		l.effective = make(map[string]EffectiveOptions)
+	}
+	opts := l.effective[name]
+	update(&opts)
+	l.effective[name] = opts
+}
+
+// EffectiveOptions returns the options of the handles activated, by interface name. the handles of
+// the interfaces that are down are only reported once they are up
+func (l *Listener) EffectiveOptions() map[string]EffectiveOptions {
+	l.effectiveMu.Lock()
+	defer l.effectiveMu.Unlock()
+	opts := make(map[string]EffectiveOptions, len(l.effective))
+	for name, o := range l.effective {
+		opts[name] = o
+	}
+	return opts
+}
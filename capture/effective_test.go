@@ -0,0 +1,42 @@
+package capture
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestEffectiveOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "effective")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dump := NewRotatingDump(filepath.Join(dir, "capture"), DumpRotation{})
+	data := rawPackets(1, 1, 10, 4)[0]
+	if err = dump.WritePacket(gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}, data, layers.LinkTypeLoop); err != nil {
+		t.Fatal(err)
+	}
+	dump.Close()
+
+	l, err := NewListener(dump.Files()[0], []uint16{8000}, "", EnginePcapFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	opts, ok := l.EffectiveOptions()["pcap_file"]
+	if !ok || opts.Snaplen != dumpSnaplen || opts.LinkType != layers.LinkTypeLoop || opts.BPFFilter != l.BPFFilter {
+		t.Errorf("unexpected effective options %+v", opts)
+	}
+	l.recordBufferSizes(nil)
+	if opts = l.EffectiveOptions()["pcap_file"]; opts.Snaplen != dumpSnaplen {
+		t.Errorf("expected the buffer sizes to be merged with the other options, got %+v", opts)
+	}
+}
@@ -0,0 +1,92 @@
+package capture
+
+import (
+	"io"
+	"time"
+)
+
+// CaptureEventType is the lifecycle transition of the handle of an interface
+type CaptureEventType uint8
+
+// Lifecycle transitions
+const (
+	// CaptureStarted is sent once the handle of an interface is being read
+	CaptureStarted CaptureEventType = iota + 1
+	// CaptureStopped is sent once the handle of an interface is closed, it is the only event of the handles
+	// closed before they started to be read
+	CaptureStopped
+)
+
+func (t CaptureEventType) String() string {
+	switch t {
+	case CaptureStarted:
+		return "started"
+	case CaptureStopped:
+		return "stopped"
+	}
+	return ""
+}
+
+// StopReason tells why the handle of an interface was closed
+type StopReason string
+
+// Reasons of CaptureStopped
+const (
+	StopClosed StopReason = "closed" // Close was called or the context given to Listen was done, e.g once MaxPackets were read
+	StopEOF    StopReason = "eof"    // the handle has no more packets, e.g the end of a pcap file
+	StopEnd    StopReason = "end"    // the end of the time range of the pcap_file engine was reached
+	StopError  StopReason = "error"  // the handle failed to start or to be read, see CaptureEvent.Err
+)
+
+// CaptureEvent is a lifecycle transition of the handle of an interface
+type CaptureEvent struct {
+	Type      CaptureEventType
+	Interface string
+	Time      time.Time
+	Options   EffectiveOptions // the options the handle was activated with, for CaptureStarted
+	Reason    StopReason       // for CaptureStopped
+	Err       error            // the error that stopped the handle, when Reason is StopError
+}
+
+// EventHandler is called at the lifecycle transitions of the handles, exactly once per transition of a handle.
+// it is called concurrently for different interfaces, and must not call Close
+type EventHandler func(CaptureEvent)
+
+// captureStop is why the read loop of a handle stopped
+type captureStop struct {
+	reason StopReason
+	err    error
+}
+
+// readStopped returns why reading a handle stopped on err, a handle closed returns an error once it is
+func (l *Listener) readStopped(err error) captureStop {
+	select {
+	case <-l.quit:
+		return captureStop{reason: StopClosed}
+	default:
+	}
+	if err == io.EOF {
+		return captureStop{reason: StopEOF}
+	}
+	return captureStop{reason: StopError, err: err}
+}
+
+// captureStarted sends the CaptureStarted event of a handle
+func (l *Listener) captureStarted(key string, meta PacketMeta) {
+	if l.EventHandler == nil {
+		return
+	}
+	l.effectiveMu.Lock()
+	opts := l.effective[key]
+	l.effectiveMu.Unlock()
+	opts.LinkType = meta.LinkType
+	l.EventHandler(CaptureEvent{Type: CaptureStarted, Interface: key, Time: time.Now(), Options: opts})
+}
+
+// captureStopped sends the CaptureStopped event of a handle
+func (l *Listener) captureStopped(key string, stop captureStop) {
+	if l.EventHandler == nil {
+		return
+	}
+	l.EventHandler(CaptureEvent{Type: CaptureStopped, Interface: key, Time: time.Now(), Reason: stop.reason, Err: stop.err})
+}
@@ -0,0 +1,68 @@
+package capture
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket/layers"
+)
+
+func TestCaptureEvents(t *testing.T) {
+	eof, bad, live := newFakeHandle(layers.LinkTypeEthernet), newFakeHandle(layers.LinkType(250)), newFakeHandle(layers.LinkTypeLoop)
+	close(eof.packets)
+	l := newFakeListener(eof, bad, live)
+	var mu sync.Mutex
+	events := make(map[string][]CaptureEvent)
+	l.EventHandler = func(e CaptureEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events[e.Interface] = append(events[e.Interface], e)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := l.ListenBackground(ctx, func(*tcp.Packet) {})
+	select {
+	case <-l.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("expected the listener to be ready")
+	}
+	// the handle at its end stops on its own
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(events["a"])
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+	}
+	cancel()
+	<-errCh
+
+	mu.Lock()
+	defer mu.Unlock()
+	expect := map[string][]StopReason{"a": {"", StopEOF}, "b": {StopError}, "c": {"", StopClosed}}
+	for key, reasons := range expect {
+		got := events[key]
+		if len(got) != len(reasons) {
+			t.Errorf("%s: expected %d events, got %+v", key, len(reasons), got)
+			continue
+		}
+		for i, reason := range reasons {
+			typ := CaptureStopped
+			if reason == "" {
+				typ = CaptureStarted
+			}
+			if got[i].Type != typ || got[i].Reason != reason {
+				t.Errorf("%s: expected the event %d to be %s %s, got %+v", key, i, typ, reason, got[i])
+			}
+		}
+	}
+	if e := events["c"][0]; e.Options.LinkType != layers.LinkTypeLoop {
+		t.Errorf("expected the link type to be reported, got %+v", e)
+	}
+	if e := events["b"][0]; e.Err == nil {
+		t.Errorf("expected the error of the link type to be reported, got %+v", e)
+	}
+}
@@ -0,0 +1,36 @@
+package capture_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/buger/goreplay/capture"
+	"github.com/buger/goreplay/tcp"
+)
+
+func ExampleNewReaderListener() {
+	data, err := ioutil.ReadFile("testdata/http.pcap")
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := capture.NewReaderListener(bytes.NewReader(data), []uint16{8000}, "tcp", true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = l.Activate(); err != nil {
+		log.Fatal(err)
+	}
+	// Listen returns once the whole capture is read
+	err = l.Listen(context.Background(), func(pckt *tcp.Packet) {
+		fmt.Printf("%s -> %s %q\n", pckt.Src(), pckt.Dst(), bytes.SplitN(pckt.Payload, []byte("\r\n"), 2)[0])
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Output:
+	// 127.0.0.1:5535 -> 127.0.0.1:8000 "GET / HTTP/1.1"
+	// 127.0.0.1:8000 -> 127.0.0.1:5535 "HTTP/1.1 200 OK"
+}
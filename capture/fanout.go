@@ -0,0 +1,100 @@
+package capture
+
+import (
+	"sync"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// FlowDispatcher passes the packets to several workers, the packets of a flow always go to the same worker
+// in both directions, so that every worker sees complete conversations, requests along with their responses.
+// the packets of a flow are handled in order. Policy tells what to do with the packets of a full queue,
+// PolicyBlock by default, and Hash how the flows are spread, they must be set before dispatching
+type FlowDispatcher struct {
+	Policy    OverflowPolicy
+	Hash      FlowHash // DefaultFlowHash when nil
+	queues    []chan *tcp.Packet
+	wg        sync.WaitGroup
+	once      sync.Once
+	dropping  flowDropper
+	overflows overflows
+}
+
+// NewFlowDispatcher starts workers goroutines, the worker i calls the handler returned by handler(i)
+func NewFlowDispatcher(workers int, handler func(worker int) PacketHandler) *FlowDispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	d := &FlowDispatcher{queues: make([]chan *tcp.Packet, workers)}
+	d.wg.Add(workers)
+	for i := range d.queues {
+		d.queues[i] = make(chan *tcp.Packet, 1024)
+		go func(queue chan *tcp.Packet, h PacketHandler) {
+			defer d.wg.Done()
+			for pckt := range queue {
+				h(pckt)
+			}
+		}(d.queues[i], handler(i))
+	}
+	return d
+}
+
+// Worker returns the index of the worker of a flow, by DefaultFlowHash
+func (d *FlowDispatcher) Worker(flow tcp.FlowKey) int {
+	return int(flow.Hash() % uint32(len(d.queues)))
+}
+
+// PacketHandler is the handler to be passed to Listener.Listen, it must not be called after Close
+func (d *FlowDispatcher) PacketHandler(pckt *tcp.Packet) {
+	queue := d.queues[d.Hash.hash(pckt)%uint64(len(d.queues))]
+	policy := d.Policy.or(PolicyBlock)
+	if policy == PolicyDropFlow && d.dropped(pckt, false) {
+		d.overflows.add(policy)
+		return
+	}
+	select {
+	case queue <- pckt:
+		return
+	default:
+	}
+	d.overflows.add(policy)
+	switch policy {
+	case PolicyBlock:
+		queue <- pckt
+	case PolicyDropOldest:
+		for {
+			select {
+			case <-queue:
+			default:
+			}
+			select {
+			case queue <- pckt:
+				return
+			default:
+			}
+		}
+	case PolicyDropFlow:
+		d.dropped(pckt, true)
+	}
+}
+
+// dropped reports whether the packets of the flow of pckt are being dropped, drop starts dropping them
+func (d *FlowDispatcher) dropped(pckt *tcp.Packet, drop bool) bool {
+	d.dropping.Lock()
+	defer d.dropping.Unlock()
+	if drop {
+		d.dropping.drop(pckt)
+		return true
+	}
+	return d.dropping.dropping(pckt)
+}
+
+// Close waits for the workers to handle the packets already dispatched
+func (d *FlowDispatcher) Close() {
+	d.once.Do(func() {
+		for _, queue := range d.queues {
+			close(queue)
+		}
+	})
+	d.wg.Wait()
+}
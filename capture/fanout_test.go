@@ -0,0 +1,49 @@
+package capture
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestFlowDispatcher(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[int][]*tcp.Packet)
+	d := NewFlowDispatcher(4, func(worker int) PacketHandler {
+		return func(pckt *tcp.Packet) {
+			mu.Lock()
+			seen[worker] = append(seen[worker], pckt)
+			mu.Unlock()
+		}
+	})
+	for i := 0; i < 100; i++ {
+		client := net.IP{10, 0, byte(i >> 8), byte(i)}
+		req := wsPacket(true, []byte("GET / HTTP/1.1\r\n\r\n"))
+		req.SrcIP, req.SrcPort = client, uint16(40000+i)
+		req.Flow, req.Reversed = tcp.NewFlowKey(req.SrcIP, req.SrcPort, req.DstIP, req.DstPort)
+		resp := wsPacket(false, []byte("HTTP/1.1 200 OK\r\n\r\n"))
+		resp.DstIP, resp.DstPort = client, uint16(40000+i)
+		resp.Flow, resp.Reversed = tcp.NewFlowKey(resp.SrcIP, resp.SrcPort, resp.DstIP, resp.DstPort)
+		if d.Worker(req.Flow) != d.Worker(resp.Flow) {
+			t.Fatalf("expected the request and the response of %s to go to the same worker, got %d and %d",
+				req.Src(), d.Worker(req.Flow), d.Worker(resp.Flow))
+		}
+		d.PacketHandler(req)
+		d.PacketHandler(resp)
+	}
+	d.Close()
+	total := 0
+	for worker, pckts := range seen {
+		total += len(pckts)
+		for i := 0; i < len(pckts); i += 2 {
+			if pckts[i].Flow != pckts[i+1].Flow || pckts[i].Reversed == pckts[i+1].Reversed {
+				t.Fatalf("worker %d: expected every request to be followed by its response", worker)
+			}
+		}
+	}
+	if total != 200 || len(seen) != 4 {
+		t.Errorf("expected 200 packets dispatched to 4 workers, got %d to %d", total, len(seen))
+	}
+}
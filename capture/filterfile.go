@@ -0,0 +1,132 @@
+package capture
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// ReadBPFFilter reads a filter written over several lines, the comments from a # to the end of
+// the line are stripped and the lines are joined into a single line filter
+func ReadBPFFilter(r io.Reader) (string, error) {
+	var clauses []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			clauses = append(clauses, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return strings.Join(clauses, " "), nil
+}
+
+// LoadBPFFilterFile reads the filter of a file with ReadBPFFilter, and checks that it compiles
+func LoadBPFFilterFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("BPF filter file: %v", err)
+	}
+	defer f.Close()
+	filter, err := ReadBPFFilter(f)
+	if err != nil {
+		return "", fmt.Errorf("BPF filter file %s: %v", name, err)
+	}
+	if err = ValidateBPFFilter(filter, layers.LinkTypeEthernet, 64<<10); err != nil {
+		return "", fmt.Errorf("BPF filter file %s: %v", name, err)
+	}
+	return filter, nil
+}
+
+// loadFilterFile loads the filter of BPFFilterFile, it is ANDed with the filter of every interface
+func (l *Listener) loadFilterFile() error {
+	if l.BPFFilterFile == "" {
+		l.fileFilter.Store("")
+		return nil
+	}
+	filter, err := LoadBPFFilterFile(l.BPFFilterFile)
+	if err != nil {
+		return err
+	}
+	l.fileFilter.Store(filter)
+	return nil
+}
+
+// withFileFilter ANDs the filter of BPFFilterFile with a generated filter
+func (l *Listener) withFileFilter(filter string) string {
+	extra, _ := l.fileFilter.Load().(string)
+	switch {
+	case extra == "":
+		return filter
+	case filter == "":
+		return extra
+	}
+	return fmt.Sprintf("(%s) and (%s)", filter, extra)
+}
+
+// ReloadBPFFilterFile reads BPFFilterFile again and sets the filters of the handles being read,
+// the filter in effect is kept if the file can't be read or doesn't compile
+func (l *Listener) ReloadBPFFilterFile() error {
+	if err := l.loadFilterFile(); err != nil {
+		return err
+	}
+	return l.setFilters()
+}
+
+// setFilters sets the filters of the handles being read again, once the filters ANDed with their generated filter changed
+func (l *Listener) setFilters() error {
+	if err := l.compileGTPFilter(); err != nil {
+		return err
+	}
+	l.Lock()
+	keys := make([]string, 0, len(l.Handles))
+	for key := range l.Handles {
+		keys = append(keys, key)
+	}
+	l.Unlock()
+	filters := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if l.Engine == EnginePcapFile {
+			filters[key] = l.pcapFileFilter()
+			continue
+		}
+		ifi := pcap.Interface{Name: key}
+		for _, i := range l.Interfaces {
+			if i.Name == key {
+				ifi = i
+			}
+		}
+		filters[key] = l.Filter(ifi)
+	}
+	l.Lock()
+	defer l.Unlock()
+	// the handles are closed with the lock held, those left are still open
+	var errs []string
+	for key, filter := range filters {
+		handle, ok := l.Handles[key].(interface{ SetBPFFilter(string) error })
+		if !ok {
+			continue // handles that are not active yet use the new filter once they are
+		}
+		if err := handle.SetBPFFilter(filter); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+			continue
+		}
+		l.debug(DebugInfo, "Interface: %s. BPF Filter reloaded: %s\n", key, filter)
+		filter := filter
+		l.setEffective(key, func(opts *EffectiveOptions) { opts.BPFFilter = filter })
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("BPF filter reload error: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package capture
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+)
+
+func TestReadBPFFilter(t *testing.T) {
+	filter, err := ReadBPFFilter(strings.NewReader(`# internal chatter
+not net 10.1.0.0/16   # monitoring
+	and not (host 10.2.0.1
+	         or host 10.2.0.2)
+
+# end
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "not net 10.1.0.0/16 and not (host 10.2.0.1 or host 10.2.0.2)"; filter != want {
+		t.Errorf("expected %q, got %q", want, filter)
+	}
+}
+
+func TestBPFFilterFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# internal chatter\nnot host 10.2.0.1\n")
+	f.Close()
+
+	l := &Listener{Transport: "tcp", ports: []uint16{8000}}
+	l.BPFFilterFile = f.Name()
+	if err = l.loadFilterFile(); err != nil {
+		t.Fatal(err)
+	}
+	ifi := pcap.Interface{Name: "mock0", Addresses: []pcap.InterfaceAddress{{IP: []byte{192, 0, 2, 1}}}}
+	want := "(" + l.generatedFilter(ifi) + ") and (not host 10.2.0.1)"
+	if filter := l.Filter(ifi); filter != want {
+		t.Errorf("expected %q, got %q", want, filter)
+	}
+
+	// a filter that doesn't compile is rejected and the previous one is kept
+	ioutil.WriteFile(f.Name(), []byte("not host foo\n"), 0644)
+	if err = l.ReloadBPFFilterFile(); err == nil || !strings.Contains(err.Error(), f.Name()) {
+		t.Errorf("expected an error naming the file, got %v", err)
+	}
+	if filter := l.Filter(ifi); filter != want {
+		t.Errorf("expected the previous filter to be kept, got %q", filter)
+	}
+}
@@ -0,0 +1,291 @@
+package capture
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// FlowDump defaults
+const (
+	defaultFlowDumpOpen = 256
+	defaultFlowDumpIdle = 2 * time.Minute
+)
+
+// FlowDump writes the packets of every TCP connection or UDP flow in its own PCAP file, named after a prefix,
+// the transport and the endpoints of the flow, e.g prefix-tcp-10.0.0.1_5535-10.0.0.2_80.pcap. the packets of
+// other protocols, and the IP fragments but the first ones, are written in prefix-other.pcap.
+// a file is closed once its connection is closed by FIN or RST or is idle, a connection opened again
+// is written in a new file, e.g prefix-tcp-10.0.0.1_5535-10.0.0.2_80-2.pcap. existing files are never overwritten.
+// at most MaxOpen files are open at once, the least recently written one is closed to open another,
+// it is appended to when its flow has more packets
+type FlowDump struct {
+	sync.Mutex
+	MaxOpen int           // open files, 256 by default
+	Idle    time.Duration // a file is closed and its flow forgotten after this duration without packets, 2 minutes by default
+	prefix  string
+	flows   map[flowFileKey]*flowFile
+	open    *list.List // of the open files, the most recently written first
+	files   []string   // written, in the order they were created
+	last    time.Time
+}
+
+// flowFileKey identifies the file of a flow, a file only holds a single link type
+type flowFileKey struct {
+	flow     tcp.FlowKey
+	proto    byte
+	linkType layers.LinkType
+}
+
+type flowFile struct {
+	key    flowFileKey
+	name   string
+	file   *os.File
+	buf    *bufio.Writer
+	w      *Writer
+	elem   *list.Element // in FlowDump.open, nil when the file is closed
+	seen   time.Time
+	fin    [2]bool // FIN sent by A, by B
+	closed bool    // the connection was closed, a SYN opens a new file
+}
+
+// NewFlowDump returns a dump writing the files of the flows with the given prefix, no file is created before
+// the first packet
+func NewFlowDump(prefix string) *FlowDump {
+	return &FlowDump{
+		prefix: strings.TrimSuffix(prefix, ".pcap"),
+		flows:  make(map[flowFileKey]*flowFile),
+		open:   list.New(),
+	}
+}
+
+// Handler returns the DumpHandler to be set on a Listener, the flows of all the interfaces are written together
+func (d *FlowDump) Handler() DumpHandler {
+	return func(_ string, data []byte, ci *gopacket.CaptureInfo, linkType layers.LinkType) error {
+		return d.WritePacket(*ci, data, linkType)
+	}
+}
+
+// WritePacket writes a packet read from a handle of the given link type in the file of its flow
+func (d *FlowDump) WritePacket(ci gopacket.CaptureInfo, data []byte, linkType layers.LinkType) (err error) {
+	now := ci.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+	sig := dumpFlowOf(linkType, data, &ci)
+	key := flowFileKey{sig.key, sig.proto, linkType}
+	d.Lock()
+	defer d.Unlock()
+	d.expire(now)
+	f, ok := d.flows[key]
+	if ok && f.closed && sig.syn && !sig.ack {
+		// the connection is opened again
+		d.closeFile(f)
+		delete(d.flows, key)
+		ok = false
+	}
+	if !ok {
+		f = &flowFile{key: key}
+		d.flows[key] = f
+	}
+	f.seen = now
+	if err = d.openFile(f); err != nil {
+		return
+	}
+	d.open.MoveToFront(f.elem)
+	if err = f.w.WritePacket(ci, data); err != nil {
+		return fmt.Errorf("dump %s: %v", f.name, err)
+	}
+	if sig.proto != tcp.ProtoTCP {
+		return
+	}
+	if sig.fin {
+		f.fin[dirIndex(sig.reversed)] = true
+	}
+	if sig.rst || f.fin[0] && f.fin[1] {
+		f.closed = true
+		return d.closeFile(f)
+	}
+	return
+}
+
+// openFile opens the file of a flow, it is created with a new name for the first packet of the flow,
+// otherwise it is appended to. the least recently written file is closed beyond MaxOpen
+func (d *FlowDump) openFile(f *flowFile) (err error) {
+	if f.file != nil {
+		return
+	}
+	maxOpen := d.MaxOpen
+	if maxOpen <= 0 {
+		maxOpen = defaultFlowDumpOpen
+	}
+	for d.open.Len() >= maxOpen {
+		if err = d.closeFile(d.open.Back().Value.(*flowFile)); err != nil {
+			return
+		}
+	}
+	header := f.name == ""
+	if header {
+		f.name, f.file, err = createUnique(d.flowName(f.key))
+	} else {
+		f.file, err = os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("dump: %v", err)
+	}
+	f.buf = bufio.NewWriter(f.file)
+	f.w = NewWriterNanos(f.buf)
+	f.elem = d.open.PushFront(f)
+	if header {
+		d.files = append(d.files, f.name)
+		if err = f.w.WriteFileHeader(dumpSnaplen, f.key.linkType); err != nil {
+			d.closeFile(f)
+			return fmt.Errorf("dump %s: %v", f.name, err)
+		}
+	}
+	return
+}
+
+// flowName returns the name of the file of a flow, without its extension
+func (d *FlowDump) flowName(key flowFileKey) string {
+	switch key.proto {
+	case tcp.ProtoTCP:
+		return fmt.Sprintf("%s-tcp-%s-%s", d.prefix, fileNameSafe(key.flow.A()), fileNameSafe(key.flow.B()))
+	case tcp.ProtoUDP:
+		return fmt.Sprintf("%s-udp-%s-%s", d.prefix, fileNameSafe(key.flow.A()), fileNameSafe(key.flow.B()))
+	}
+	return d.prefix + "-other"
+}
+
+// createUnique creates the file name.pcap, or name-2.pcap etc. when it exists
+func createUnique(name string) (string, *os.File, error) {
+	for i := 1; ; i++ {
+		path := name + ".pcap"
+		if i > 1 {
+			path = fmt.Sprintf("%s-%d.pcap", name, i)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		return path, f, err
+	}
+}
+
+// closeFile flushes and closes the file of a flow, the flow is kept so that its file can be appended to
+func (d *FlowDump) closeFile(f *flowFile) (err error) {
+	if f.file == nil {
+		return
+	}
+	if err = f.buf.Flush(); err == nil {
+		err = f.file.Close()
+	} else {
+		f.file.Close()
+	}
+	d.open.Remove(f.elem)
+	f.file, f.buf, f.w, f.elem = nil, nil, nil, nil
+	if err != nil {
+		return fmt.Errorf("dump %s: %v", f.name, err)
+	}
+	return
+}
+
+// expire closes the files of the flows idle for longer than Idle and forgets them
+func (d *FlowDump) expire(now time.Time) {
+	idle := d.Idle
+	if idle <= 0 {
+		idle = defaultFlowDumpIdle
+	}
+	if now.Sub(d.last) < idle/2 {
+		return
+	}
+	d.last = now
+	for key, f := range d.flows {
+		if now.Sub(f.seen) > idle {
+			d.closeFile(f)
+			delete(d.flows, key)
+		}
+	}
+}
+
+// Files returns the names of the files written, in the order they were created
+func (d *FlowDump) Files() []string {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string(nil), d.files...)
+}
+
+// Flush writes the buffered packets of the open files, and syncs them
+func (d *FlowDump) Flush() (err error) {
+	d.Lock()
+	defer d.Unlock()
+	for elem := d.open.Front(); elem != nil; elem = elem.Next() {
+		f := elem.Value.(*flowFile)
+		if e := f.buf.Flush(); e != nil {
+			err = fmt.Errorf("dump %s: %v", f.name, e)
+		} else if e = f.file.Sync(); e != nil {
+			err = fmt.Errorf("dump %s: %v", f.name, e)
+		}
+	}
+	return
+}
+
+// Close flushes and closes the open files, the flows are forgotten
+func (d *FlowDump) Close() (err error) {
+	d.Lock()
+	defer d.Unlock()
+	for key, f := range d.flows {
+		if e := d.closeFile(f); e != nil {
+			err = e
+		}
+		delete(d.flows, key)
+	}
+	return
+}
+
+// dumpFlowSignal is the flow of a packet and its TCP flags, the flow is empty for the packets of other protocols
+type dumpFlowSignal struct {
+	key                tcp.FlowKey
+	reversed           bool
+	proto              byte
+	syn, ack, fin, rst bool
+}
+
+func dumpFlowOf(linkType layers.LinkType, data []byte, ci *gopacket.CaptureInfo) (sig dumpFlowSignal) {
+	linkSize, _ := pcapLinkTypeLength(int(linkType))
+	_, _, size, err := linkLayer(linkType, data, linkSize, ci)
+	if err != nil || size < 0 || len(data) < size {
+		return
+	}
+	s, err := parseIPSegment(data[size:])
+	if err != nil || len(s.transport) < 4 || s.proto != tcp.ProtoTCP && s.proto != tcp.ProtoUDP {
+		return
+	}
+	half := len(s.addrs) / 2
+	src, dst := net.IP(s.addrs[:half]), net.IP(s.addrs[half:])
+	srcPort, dstPort := binary.BigEndian.Uint16(s.transport[0:2]), binary.BigEndian.Uint16(s.transport[2:4])
+	sig.key, sig.reversed = tcp.NewFlowKey(src, srcPort, dst, dstPort)
+	sig.proto = s.proto
+	if s.proto == tcp.ProtoTCP && len(s.transport) >= 14 {
+		flags := s.transport[13]
+		sig.fin, sig.syn, sig.rst, sig.ack = flags&0x01 != 0, flags&0x02 != 0, flags&0x04 != 0, flags&0x10 != 0
+	}
+	return
+}
+
+func dirIndex(reversed bool) int {
+	if reversed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// flowPacket returns a loopback TCP packet of rawPackets from port src to 8000, or from 8000 to src
+func flowPacket(src uint16, fromClient bool, flags byte) []byte {
+	data := rawPackets(1, 1, 10, 4)[0]
+	tcp := data[4+24:]
+	binary.BigEndian.PutUint16(tcp, src)
+	if !fromClient {
+		binary.BigEndian.PutUint16(tcp, 8000)
+		binary.BigEndian.PutUint16(tcp[2:], src)
+	}
+	tcp[13] = flags
+	return data
+}
+
+func TestFlowDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowdump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := NewFlowDump(filepath.Join(dir, "capture.pcap"))
+	d.MaxOpen = 1
+	now := time.Now()
+	write := func(data []byte) {
+		now = now.Add(time.Millisecond)
+		ci := gopacket.CaptureInfo{Timestamp: now, CaptureLength: len(data), Length: len(data)}
+		if err := d.WritePacket(ci, data, layers.LinkTypeLoop); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const syn, ack, fin = 0x02, 0x10, 0x01
+	write(flowPacket(5535, true, syn))
+	write(flowPacket(5536, true, syn)) // closes the file of the first connection
+	write(flowPacket(5535, false, syn|ack))
+	write(flowPacket(5535, true, fin|ack))
+	write(flowPacket(5535, false, fin|ack)) // the connection is closed
+	write(flowPacket(5535, true, ack))      // appended to the closed connection
+	write(flowPacket(5535, true, syn))      // the connection is opened again
+	icmp := rawPackets(1, 1, 10, 4)[0]
+	icmp[4+9] = uint8(layers.IPProtocolICMPv4)
+	write(icmp)
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := filepath.Join(dir, "capture")
+	expected := []struct {
+		name    string
+		packets int
+	}{
+		{prefix + "-tcp-127.0.0.1_5535-127.0.0.1_8000.pcap", 5},
+		{prefix + "-tcp-127.0.0.1_5536-127.0.0.1_8000.pcap", 1},
+		{prefix + "-tcp-127.0.0.1_5535-127.0.0.1_8000-2.pcap", 1},
+		{prefix + "-other.pcap", 1},
+	}
+	files := d.Files()
+	if len(files) != len(expected) {
+		t.Fatalf("expected %d files, got %v", len(expected), files)
+	}
+	for i, f := range expected {
+		if files[i] != f.name {
+			t.Errorf("expected the file %s, got %s", f.name, files[i])
+			continue
+		}
+		if n, linkType := dumpRecords(t, f.name); n != f.packets || linkType != layers.LinkTypeLoop {
+			t.Errorf("%s: expected %d packets, got %d of link type %s", f.name, f.packets, n, linkType)
+		}
+	}
+}
+
+func TestFlowDumpIdle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flowdump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := NewFlowDump(filepath.Join(dir, "capture"))
+	d.Idle = time.Minute
+	now := time.Now()
+	for _, at := range []time.Duration{0, time.Second, time.Hour} {
+		data := flowPacket(5535, true, 0x10)
+		d.WritePacket(gopacket.CaptureInfo{Timestamp: now.Add(at), CaptureLength: len(data), Length: len(data)}, data, layers.LinkTypeLoop)
+	}
+	d.Close()
+	// the connection idle for an hour is written in a new file
+	if files := d.Files(); len(files) != 2 || filepath.Base(files[1]) != "capture-tcp-127.0.0.1_5535-127.0.0.1_8000-2.pcap" {
+		t.Errorf("expected a file per idle period, got %v", files)
+	}
+}
@@ -0,0 +1,59 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+)
+
+// flowFilterOf returns the filter of the packets of a connection in both directions
+func flowFilterOf(srcIP, dstIP string, srcPort, dstPort uint16) (string, error) {
+	src, dst := net.ParseIP(srcIP), net.ParseIP(dstIP)
+	switch {
+	case src == nil:
+		return "", fmt.Errorf("capture flow: invalid source address %q", srcIP)
+	case dst == nil:
+		return "", fmt.Errorf("capture flow: invalid destination address %q", dstIP)
+	case (src.To4() == nil) != (dst.To4() == nil):
+		return "", fmt.Errorf("capture flow: %s and %s are not of the same IP version", src, dst)
+	case srcPort == 0 || dstPort == 0:
+		return "", fmt.Errorf("capture flow: the ports must be set")
+	}
+	return fmt.Sprintf("(src host %s and src port %d and dst host %s and dst port %d) or (src host %s and src port %d and dst host %s and dst port %d)",
+		src, srcPort, dst, dstPort, dst, dstPort, src, srcPort), nil
+}
+
+// CaptureFlow restricts the capture to the packets of a single connection, in both directions, e.g to
+// debug a misbehaving connection. the filter is ANDed with the filter of every interface and set on
+// the handles being read, like ReloadBPFFilterFile, the filter in effect is kept on error
+func (l *Listener) CaptureFlow(srcIP, dstIP string, srcPort, dstPort uint16) error {
+	filter, err := flowFilterOf(srcIP, dstIP, srcPort, dstPort)
+	if err != nil {
+		return err
+	}
+	previous, _ := l.flowFilter.Load().(string)
+	l.flowFilter.Store(filter)
+	if err = l.setFilters(); err != nil {
+		l.flowFilter.Store(previous)
+		l.setFilters()
+		return err
+	}
+	return nil
+}
+
+// CaptureAllFlows removes the restriction set by CaptureFlow
+func (l *Listener) CaptureAllFlows() error {
+	l.flowFilter.Store("")
+	return l.setFilters()
+}
+
+// withFlowFilter ANDs the filter of the connection set by CaptureFlow with a filter
+func (l *Listener) withFlowFilter(filter string) string {
+	extra, _ := l.flowFilter.Load().(string)
+	switch {
+	case extra == "":
+		return filter
+	case filter == "":
+		return extra
+	}
+	return fmt.Sprintf("(%s) and (%s)", filter, extra)
+}
@@ -0,0 +1,46 @@
+package capture
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/pcap"
+)
+
+func TestCaptureFlow(t *testing.T) {
+	l := &Listener{Transport: "tcp", ports: []uint16{8000}}
+	ifi := pcap.Interface{Name: "mock0", Addresses: []pcap.InterfaceAddress{{IP: []byte{192, 0, 2, 1}}}}
+	generated := l.Filter(ifi)
+
+	if err := l.CaptureFlow("192.0.2.1", "192.0.2.7", 8000, 5535); err != nil {
+		t.Fatal(err)
+	}
+	want := "(" + generated + ") and ((src host 192.0.2.1 and src port 8000 and dst host 192.0.2.7 and dst port 5535) or " +
+		"(src host 192.0.2.7 and src port 5535 and dst host 192.0.2.1 and dst port 8000))"
+	if filter := l.Filter(ifi); filter != want {
+		t.Errorf("expected %q, got %q", want, filter)
+	}
+
+	if err := l.CaptureFlow("2001:db8::1", "2001:db8:0::2", 443, 40000); err != nil {
+		t.Fatal(err)
+	}
+	if filter := l.Filter(ifi); !strings.Contains(filter, "dst host 2001:db8::2 and dst port 40000") {
+		t.Errorf("expected the IPv6 flow to be filtered, got %q", filter)
+	}
+
+	for _, c := range [][2]string{{"192.0.2.300", "192.0.2.1"}, {"192.0.2.1", "example.com"}, {"192.0.2.1", "2001:db8::1"}} {
+		if err := l.CaptureFlow(c[0], c[1], 80, 5535); err == nil {
+			t.Errorf("expected %s and %s to be rejected", c[0], c[1])
+		}
+	}
+	if err := l.CaptureFlow("192.0.2.1", "192.0.2.7", 0, 5535); err == nil {
+		t.Error("expected a zero port to be rejected")
+	}
+
+	if err := l.CaptureAllFlows(); err != nil {
+		t.Fatal(err)
+	}
+	if filter := l.Filter(ifi); filter != generated {
+		t.Errorf("expected %q, got %q", generated, filter)
+	}
+}
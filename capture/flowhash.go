@@ -0,0 +1,36 @@
+package capture
+
+import "github.com/buger/goreplay/tcp"
+
+// FlowHash returns the hash of the flow of a packet, the same for both directions of the flow. the flows are
+// sampled and dispatched to the workers by their hash, e.g a hash of the 4-tuple and of the VLAN or the VNI
+// keeps apart the tenants of an overlay whose addresses overlap. the hash of a listener is used by the samples
+// and the dispatchers it creates, so that they all agree on the flows; the state the listener keeps per
+// connection, e.g to track the closes, is keyed by tcp.FlowKey whatever the hash
+type FlowHash func(*tcp.Packet) uint64
+
+// DefaultFlowHash is the hash of the 4-tuple of the flow, normalized so that both directions hash the same,
+// or of the connection ID of a QUIC flow, see tcp.FlowKey.Hash
+func DefaultFlowHash(pckt *tcp.Packet) uint64 {
+	return uint64(pckt.Flow.Hash())
+}
+
+// hash returns the hash of the flow of pckt, by DefaultFlowHash when hash is nil
+func (hash FlowHash) hash(pckt *tcp.Packet) uint64 {
+	if hash == nil {
+		return DefaultFlowHash(pckt)
+	}
+	return hash(pckt)
+}
+
+// Sample is the Sample transform picking the flows by the FlowHash of the listener
+func (l *Listener) Sample(n uint32) PacketTransform {
+	return SampleBy(n, l.FlowHash)
+}
+
+// NewFlowDispatcher is NewFlowDispatcher dispatching the flows by the FlowHash of the listener
+func (l *Listener) NewFlowDispatcher(workers int, handler func(worker int) PacketHandler) *FlowDispatcher {
+	d := NewFlowDispatcher(workers, handler)
+	d.Hash = l.FlowHash
+	return d
+}
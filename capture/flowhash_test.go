@@ -0,0 +1,59 @@
+package capture
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestFlowHash(t *testing.T) {
+	l := &Listener{}
+	// the flows of the port 80 are one tenant, the others another
+	l.FlowHash = func(pckt *tcp.Packet) uint64 {
+		if pckt.Flow.PortA == 80 || pckt.Flow.PortB == 80 {
+			return 0
+		}
+		return 1
+	}
+	packet := func(port uint16, reversed bool) *tcp.Packet {
+		pckt := &tcp.Packet{SrcIP: net.IP{10, 0, 0, 1}, SrcPort: 40000, DstIP: net.IP{10, 0, 0, 2}, DstPort: port}
+		if reversed {
+			pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort = pckt.DstIP, pckt.DstPort, pckt.SrcIP, pckt.SrcPort
+		}
+		pckt.Flow, pckt.Reversed = tcp.NewFlowKey(pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort)
+		return pckt
+	}
+	sample := l.Sample(2)
+	for _, reversed := range []bool{false, true} {
+		if _, ok := sample(packet(80, reversed)); !ok {
+			t.Error("expected the flows of the port 80 to be kept")
+		}
+		if _, ok := sample(packet(443, reversed)); ok {
+			t.Error("expected the other flows to be dropped")
+		}
+	}
+
+	var mu sync.Mutex
+	workers := make(map[uint16]int)
+	d := l.NewFlowDispatcher(2, func(worker int) PacketHandler {
+		return func(pckt *tcp.Packet) {
+			mu.Lock()
+			workers[pckt.SrcPort^pckt.DstPort^40000] = worker
+			mu.Unlock()
+		}
+	})
+	d.PacketHandler(packet(80, false))
+	d.PacketHandler(packet(443, true))
+	d.Close()
+	if workers[80] != 0 || workers[443] != 1 {
+		t.Errorf("expected the flows to be dispatched by their hash, got %v", workers)
+	}
+
+	// the default hash is the one of the flow key
+	pckt := packet(80, false)
+	if DefaultFlowHash(pckt) != uint64(pckt.Flow.Hash()) {
+		t.Error("wrong default hash")
+	}
+}
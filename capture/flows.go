@@ -0,0 +1,146 @@
+package capture
+
+import (
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// flowTable holds the per flow state of the parsers, flows idle for longer than expire are
+// evicted while packets are handled. The parsers hold its lock for the whole packet.
+type flowTable struct {
+	sync.Mutex
+	expire time.Duration
+	flows  map[tcp.FlowKey]*flowEntry
+	last   time.Time // last time idle flows were evicted
+	limits *StateLimits
+
+	removed func(state interface{}) // called with the state of the flows removed, when set
+}
+
+type flowEntry struct {
+	state interface{}
+	fin   [2]bool // FIN sent in each direction
+	seen  time.Time
+}
+
+// init prepares the table, def is the expiration used when expire is not positive
+func (t *flowTable) init(expire, def time.Duration) {
+	t.expire = expire
+	if t.expire <= 0 {
+		t.expire = def
+	}
+	t.flows = make(map[tcp.FlowKey]*flowEntry)
+}
+
+// lookup evicts the idle flows and returns the state of key, marking it as seen at now
+func (t *flowTable) lookup(key tcp.FlowKey, now time.Time) (interface{}, bool) {
+	t.evict(now)
+	entry, ok := t.flows[key]
+	if !ok {
+		return nil, false
+	}
+	entry.seen = now
+	return entry.state, true
+}
+
+// Limit shares limits with the other stateful features, the least recently seen flow is evicted
+// when a new flow would go over MaxFlows
+func (t *flowTable) Limit(limits *StateLimits) {
+	t.Lock()
+	defer t.Unlock()
+	t.limits.release(int64(len(t.flows)), 0)
+	t.limits = limits
+	t.limits.force(int64(len(t.flows)), 0)
+}
+
+func (t *flowTable) store(key tcp.FlowKey, state interface{}, now time.Time) {
+	if _, ok := t.flows[key]; ok {
+		t.flows[key] = &flowEntry{state: state, seen: now}
+		return
+	}
+	for !t.limits.reserve(1, 0) {
+		if !t.evictOldest() {
+			t.limits.force(1, 0)
+			break
+		}
+	}
+	t.flows[key] = &flowEntry{state: state, seen: now}
+}
+
+func (t *flowTable) remove(key tcp.FlowKey) {
+	if entry, ok := t.flows[key]; ok {
+		delete(t.flows, key)
+		t.limits.release(1, 0)
+		if t.removed != nil {
+			t.removed(entry.state)
+		}
+	}
+}
+
+// evictOldest evicts the least recently seen flow, it reports false when there is no flow
+func (t *flowTable) evictOldest() bool {
+	var oldest *flowEntry
+	var key tcp.FlowKey
+	for k, entry := range t.flows {
+		if oldest == nil || entry.seen.Before(oldest.seen) {
+			oldest, key = entry, k
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	t.remove(key)
+	t.limits.evicted()
+	return true
+}
+
+// closed records the FIN or RST of pckt, sent in the direction dir(0 or 1) of the flow, and removes
+// the flow once both directions sent a FIN or the connection is reset. the other direction can
+// still send data after a half-close. it reports whether the flow was removed
+func (t *flowTable) closed(key tcp.FlowKey, dir int, pckt *tcp.Packet) bool {
+	entry, ok := t.flows[key]
+	if !ok {
+		return false
+	}
+	if !pckt.RST {
+		entry.fin[dir] = entry.fin[dir] || pckt.FIN
+		if !entry.fin[0] || !entry.fin[1] {
+			return false
+		}
+	}
+	t.remove(key)
+	return true
+}
+
+// CloseHandler is the handler to be set as Listener.CloseHandler, the FIN and RST packets without
+// data are not passed to the packet handlers. the flow is removed once its connection is closed,
+// so that a connection reusing its addresses starts from a new state
+func (t *flowTable) CloseHandler(flow tcp.FlowKey, reason tcp.CloseReason) {
+	if reason == tcp.CloseHalf {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.remove(flow)
+}
+
+// Flows returns the number of flows being tracked
+func (t *flowTable) Flows() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.flows)
+}
+
+func (t *flowTable) evict(now time.Time) {
+	if now.Sub(t.last) < t.expire {
+		return
+	}
+	t.last = now
+	for key, entry := range t.flows {
+		if now.Sub(entry.seen) > t.expire {
+			t.remove(key)
+		}
+	}
+}
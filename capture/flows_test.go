@@ -0,0 +1,53 @@
+package capture
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestFlowTableEvict(t *testing.T) {
+	var table flowTable
+	table.init(0, time.Minute)
+	idle, _ := tcp.NewFlowKey(net.IP{127, 0, 0, 1}, 5535, net.IP{127, 0, 0, 1}, 8000)
+	other, _ := tcp.NewFlowKey(net.IP{127, 0, 0, 1}, 5536, net.IP{127, 0, 0, 1}, 8000)
+	now := time.Now()
+	table.store(idle, 1, now)
+	if _, ok := table.lookup(idle, now.Add(40*time.Second)); !ok {
+		t.Fatal("expected the flow to be tracked")
+	}
+	// the lookup marked the flow as seen
+	if _, ok := table.lookup(idle, now.Add(100*time.Second)); !ok {
+		t.Error("expected a flow seen within expire to be kept")
+	}
+	if _, ok := table.lookup(other, now.Add(200*time.Second)); ok {
+		t.Error("expected an unknown flow")
+	}
+	if table.Flows() != 0 {
+		t.Errorf("expected the idle flow to be evicted, got %d flows", table.Flows())
+	}
+}
+
+func TestFlowTableClosed(t *testing.T) {
+	var table flowTable
+	table.init(0, time.Minute)
+	now := time.Now()
+	fin := wsPacket(true, nil)
+	fin.FIN = true
+	key := fin.Flow
+	table.store(key, 1, now)
+	if table.closed(key, 0, fin) || table.closed(key, 0, fin) || table.Flows() != 1 {
+		t.Fatal("expected a half-closed flow to be kept")
+	}
+	if !table.closed(key, 1, fin) || table.Flows() != 0 {
+		t.Error("expected the flow to be removed once both directions sent a FIN")
+	}
+	table.store(key, 1, now)
+	rst := wsPacket(false, nil)
+	rst.RST = true
+	if !table.closed(key, 1, rst) || table.Flows() != 0 {
+		t.Error("expected the flow to be removed on reset")
+	}
+}
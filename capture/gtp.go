@@ -0,0 +1,116 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// GTP-U, see 3GPP TS 29.281
+const (
+	gtpUPort   = 2152
+	gtpFilter  = "udp port 2152"
+	gtpGPDU    = 0xFF // message type of the packets carrying user data
+	gtpFlagE   = 0x04 // an extension header follows
+	gtpFlagS   = 0x02 // the sequence number is set
+	gtpFlagPN  = 0x01 // the N-PDU number is set
+	gtpHdrLen  = 8
+	gtpOptLen  = 4 // sequence number, N-PDU number and next extension header type, present when E, S or PN is set
+	dltRaw     = 12
+	udpHdrSize = 8
+)
+
+var errGTPHeader = errors.New("invalid GTP-U header")
+
+// decapGTP reports whether the packets are GTP-U encapsulated, see DecapGTP
+func (l *Listener) decapGTP() bool {
+	return l.DecapGTP && l.Mode != ModeConnectionEvents
+}
+
+// gtpInnerOffset returns the offset of the IP packet carried by a GTP-U packet, and its tunnel endpoint identifier.
+// the IP packet of the frame starts at linkSize, errNotIP is returned for the packets not carrying user data
+func gtpInnerOffset(data []byte, linkSize int) (offset int, teid uint32, err error) {
+	if len(data) < linkSize {
+		return 0, 0, errTruncatedIP
+	}
+	s, err := parseIPSegment(data[linkSize:])
+	if err != nil {
+		return 0, 0, err
+	}
+	if s.proto != tcp.ProtoUDP || len(s.transport) < udpHdrSize ||
+		binary.BigEndian.Uint16(s.transport[0:2]) != gtpUPort && binary.BigEndian.Uint16(s.transport[2:4]) != gtpUPort {
+		return 0, 0, errNotIP
+	}
+	gtp := s.transport[udpHdrSize:]
+	if len(gtp) < gtpHdrLen || gtp[0]>>5 != 1 || gtp[0]&0x10 == 0 {
+		return 0, 0, errGTPHeader // not GTP-U, or GTP'
+	}
+	if gtp[1] != gtpGPDU {
+		return 0, 0, errNotIP // signalling, e.g echo requests or end markers
+	}
+	teid = binary.BigEndian.Uint32(gtp[4:8])
+	size := gtpHdrLen
+	if gtp[0]&(gtpFlagE|gtpFlagS|gtpFlagPN) != 0 {
+		size += gtpOptLen
+		if len(gtp) < size {
+			return 0, 0, errGTPHeader
+		}
+		// the extension headers are chained by the type of the next one, their length is in 4 bytes units
+		for next := gtp[size-1]; gtp[0]&gtpFlagE != 0 && next != 0; next = gtp[size-1] {
+			if len(gtp) <= size || gtp[size] == 0 {
+				return 0, 0, errGTPHeader
+			}
+			size += int(gtp[size]) * 4
+			if len(gtp) < size {
+				return 0, 0, errGTPHeader
+			}
+		}
+	}
+	if len(gtp) <= size {
+		return 0, 0, errGTPHeader
+	}
+	if v := gtp[size] >> 4; v != 4 && v != 6 {
+		return 0, 0, errNotIP // e.g non-IP PDU sessions
+	}
+	return len(data) - len(gtp) + size, teid, nil
+}
+
+// decapsulate locates the IP packet carried by a GTP-U packet and matches it with the filter of the listener,
+// errNotIP is returned for the packets not carrying user data and for those not matching
+func (l *Listener) decapsulate(data []byte, linkSize int, ci *gopacket.CaptureInfo) (int, uint32, error) {
+	offset, teid, err := gtpInnerOffset(data, linkSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	if bpf, _ := l.gtpInner.Load().(*pcap.BPF); bpf != nil {
+		inner := *ci
+		inner.CaptureLength, inner.Length = len(data)-offset, ci.Length-offset
+		if !bpf.Matches(inner, data[offset:]) {
+			return 0, 0, errNotIP
+		}
+	}
+	return offset, teid, nil
+}
+
+// compileGTPFilter compiles the filter of the packets carried by GTP-U, the handles only filter the GTP-U packets
+func (l *Listener) compileGTPFilter() error {
+	if !l.decapGTP() {
+		return nil
+	}
+	filter := l.innerFilter(pcap.Interface{})
+	if filter == "" {
+		l.gtpInner.Store((*pcap.BPF)(nil))
+		return nil
+	}
+	bpf, err := pcap.NewBPF(layers.LinkType(dltRaw), maxSnaplen, filter)
+	if err != nil {
+		return fmt.Errorf("GTP-U inner BPF filter error: %v, filter: %q", err, filter)
+	}
+	l.gtpInner.Store(bpf)
+	return nil
+}
@@ -0,0 +1,91 @@
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// gtpPacket returns a loopback frame of a GTP-U packet carrying the IP packet inner
+func gtpPacket(msgType, flags byte, opt []byte, teid uint32, inner []byte) []byte {
+	gtp := []byte{0x30 | flags, msgType, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(gtp[4:], teid)
+	gtp = append(append(gtp, opt...), inner...)
+	binary.BigEndian.PutUint16(gtp[2:], uint16(len(gtp)-gtpHdrLen))
+	udp := make([]byte, 8, 8+len(gtp))
+	binary.BigEndian.PutUint16(udp[0:], gtpUPort)
+	binary.BigEndian.PutUint16(udp[2:], gtpUPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(gtp)))
+	udp = append(udp, gtp...)
+	ip := []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, tcp.ProtoUDP, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+	return append(append([]byte{2, 0, 0, 0}, ip...), udp...)
+}
+
+func TestGTPInnerOffset(t *testing.T) {
+	inner := rawPackets(1, 1, 5, 4)[0][4:]
+	// a sequence number, and a PDU session container extension header
+	ext := []byte{0, 7, 0, 0x85, 1, 0x10, 9, 0}
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"plain", gtpPacket(gtpGPDU, 0, nil, 42, inner), nil},
+		{"sequence", gtpPacket(gtpGPDU, gtpFlagS, []byte{0, 7, 0, 0}, 42, inner), nil},
+		{"extension", gtpPacket(gtpGPDU, gtpFlagE|gtpFlagS, ext, 42, inner), nil},
+		{"echo", gtpPacket(1, gtpFlagS, []byte{0, 7, 0, 0}, 0, nil), errNotIP},
+		{"truncated extension", gtpPacket(gtpGPDU, gtpFlagE, []byte{0, 0, 0, 0x85, 3, 0}, 42, nil), errGTPHeader},
+		{"not gtp", rawPackets(1, 1, 5, 4)[0], errNotIP},
+	}
+	for _, tt := range tests {
+		offset, teid, err := gtpInnerOffset(tt.frame, 4)
+		if err != tt.err {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.err, err)
+			continue
+		}
+		if err == nil && (teid != 42 || offset != len(tt.frame)-len(inner)) {
+			t.Errorf("%s: wrong offset %d or TEID %d", tt.name, offset, teid)
+		}
+	}
+}
+
+func TestDecapGTP(t *testing.T) {
+	inner := rawPackets(1, 2, 5, 4)
+	name, err := writePcapFile([][]byte{
+		gtpPacket(gtpGPDU, gtpFlagS, []byte{0, 1, 0, 0}, 7, inner[0][4:]),
+		gtpPacket(1, gtpFlagS, []byte{0, 2, 0, 0}, 0, nil),
+		gtpPacket(gtpGPDU, 0, nil, 8, inner[1][4:]),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	l, err := NewListener(name, []uint16{8000}, "", EnginePcapFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetPcapOptions(PcapOptions{DecapGTP: true})
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	if l.BPFFilter != gtpFilter {
+		t.Errorf("expected the GTP-U packets to be filtered, got %q", l.BPFFilter)
+	}
+	var teids []uint32
+	_ = l.ListenWithMeta(context.Background(), func(pckt *tcp.Packet, meta PacketMeta) {
+		if pckt.DstPort != 8000 || len(pckt.Payload) != 5 {
+			t.Errorf("expected the inner packet, got %s:%d %d bytes", pckt.DstIP, pckt.DstPort, len(pckt.Payload))
+		}
+		teids = append(teids, meta.TEID)
+	})
+	if len(teids) != 2 || teids[0] != 7 || teids[1] != 8 {
+		t.Errorf("expected the packets of the tunnels 7 and 8, got %v", teids)
+	}
+	if n := l.ParseErrors(); n != 0 {
+		t.Errorf("expected the echo request to be skipped, got %d parse errors", n)
+	}
+}
@@ -0,0 +1,235 @@
+package capture
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// TCPHealth is the health of a TCP connection, derived from the headers of its packets
+type TCPHealth struct {
+	Flow         tcp.FlowKey
+	A, B         TCPEndpointHealth // the endpoints of Flow
+	HandshakeRTT time.Duration     // from the SYN to the SYN-ACK, 0 when the handshake was not captured
+	LastPacket   time.Time
+	Closed       bool // the connection was closed or reset, it is not reported anymore
+}
+
+// TCPEndpointHealth is the health of an endpoint of a connection, as seen from where the packets are captured
+type TCPEndpointHealth struct {
+	Window          uint32        // last receive window advertised, scaled when the handshake was captured
+	RTT             time.Duration // smoothed round trip from the capture to the endpoint, timed by its acknowledgments
+	RTTSamples      uint64
+	Packets         uint64 // sent by the endpoint
+	Retransmissions uint64 // segments sent again by the endpoint
+}
+
+// TCPHealthHandler is called every HealthInterval with the connections that had packets since the previous call,
+// sorted by flow. it is called a last time once the capture stops
+type TCPHealthHandler func([]TCPHealth)
+
+// healthExpire is how long an idle connection is remembered
+const healthExpire = 2 * time.Minute
+
+// healthTracker times the acknowledgments of the segments of the connections, only a few fields
+// of a connection are kept, the payloads are not buffered
+type healthTracker struct {
+	sync.Mutex
+	flows  map[tcp.FlowKey]*flowHealth
+	last   time.Time
+	limits *StateLimits
+}
+
+type flowHealth struct {
+	health  TCPHealth
+	scale   [2]int8         // window scale of the SYN of A, of B
+	next    [2]uint32       // sequence number following the highest one sent by A, by B
+	started [2]bool         // next is set
+	fin     [2]bool         // FIN sent by A, by B
+	timed   [2]timedSegment // segment of A, of B, whose acknowledgment is awaited
+	changed bool            // since the last report
+	seen    time.Time
+}
+
+// timedSegment is a segment sent at a time, it is acknowledged once the acknowledgments reach end
+type timedSegment struct {
+	end uint32
+	at  time.Time
+	syn bool
+	set bool
+}
+
+func newHealthTracker(limits *StateLimits) *healthTracker {
+	return &healthTracker{
+		flows:  make(map[tcp.FlowKey]*flowHealth),
+		limits: limits,
+	}
+}
+
+// track updates the health of the connection of a TCP packet, including the packets without payload
+func (t *healthTracker) track(pckt *tcp.Packet) {
+	ts := pckt.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.evict(ts)
+	f, ok := t.flows[pckt.Flow]
+	if ok && f.health.Closed && pckt.SYN {
+		// the connection is being reopened
+		t.remove(pckt.Flow)
+		ok = false
+	}
+	if !ok {
+		for !t.limits.reserve(1, 0) {
+			if !t.evictOldest() {
+				t.limits.force(1, 0)
+				break
+			}
+		}
+		f = &flowHealth{scale: [2]int8{-1, -1}}
+		f.health.Flow = pckt.Flow
+		t.flows[pckt.Flow] = f
+	}
+	f.seen, f.changed = ts, true
+	f.health.LastPacket = ts
+	i := 0
+	if pckt.Reversed {
+		i = 1
+	}
+	ep := f.endpoint(i)
+	ep.Packets++
+	if pckt.SYN {
+		f.scale[i] = pckt.WindowScale
+	}
+	// the windows are scaled once both sides have agreed to, the window of a SYN is never scaled
+	ep.Window = uint32(pckt.Window)
+	if !pckt.SYN && f.scale[0] >= 0 && f.scale[1] >= 0 {
+		ep.Window <<= uint(f.scale[i])
+	}
+
+	if seg := &f.timed[1-i]; pckt.ACK && seg.set && int32(pckt.Ack-seg.end) >= 0 {
+		rtt := ts.Sub(seg.at)
+		if seg.syn && pckt.SYN {
+			f.health.HandshakeRTT = rtt
+		}
+		seg.set = false
+		// RFC 6298
+		if ep.RTTSamples == 0 {
+			ep.RTT = rtt
+		} else {
+			ep.RTT += (rtt - ep.RTT) / 8
+		}
+		ep.RTTSamples++
+	}
+
+	// the SYN and the FIN take a sequence number
+	length := len(pckt.Payload) + int(pckt.Lost)
+	if pckt.SYN || pckt.FIN {
+		length++
+	}
+	if length > 0 {
+		end := pckt.Seq + uint32(length)
+		if f.started[i] && int32(end-f.next[i]) <= 0 {
+			ep.Retransmissions++
+			// Karn's algorithm: the acknowledgments of a segment sent again are ambiguous
+			f.timed[i].set = false
+		} else {
+			if !f.timed[i].set {
+				f.timed[i] = timedSegment{end: end, at: ts, syn: pckt.SYN, set: true}
+			}
+			f.next[i], f.started[i] = end, true
+		}
+	}
+
+	if pckt.FIN {
+		f.fin[i] = true
+	}
+	if pckt.RST || f.fin[0] && f.fin[1] {
+		f.health.Closed = true
+	}
+}
+
+func (f *flowHealth) endpoint(i int) *TCPEndpointHealth {
+	if i == 0 {
+		return &f.health.A
+	}
+	return &f.health.B
+}
+
+// report returns the health of the connections that changed since the previous report,
+// the connections closed are forgotten
+func (t *healthTracker) report() []TCPHealth {
+	t.Lock()
+	defer t.Unlock()
+	var health []TCPHealth
+	for key, f := range t.flows {
+		if f.changed {
+			f.changed = false
+			health = append(health, f.health)
+		}
+		if f.health.Closed {
+			t.remove(key)
+		}
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Flow.String() < health[j].Flow.String() })
+	return health
+}
+
+// run calls handler every interval with the connections that changed, until done is closed
+func (t *healthTracker) run(interval time.Duration, handler TCPHealthHandler, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			if health := t.report(); len(health) != 0 {
+				handler(health)
+			}
+			return
+		}
+		if health := t.report(); len(health) != 0 {
+			handler(health)
+		}
+	}
+}
+
+func (t *healthTracker) evict(now time.Time) {
+	if now.Sub(t.last) < healthExpire {
+		return
+	}
+	t.last = now
+	for key, f := range t.flows {
+		if now.Sub(f.seen) > healthExpire {
+			t.remove(key)
+		}
+	}
+}
+
+func (t *healthTracker) remove(key tcp.FlowKey) {
+	if _, ok := t.flows[key]; ok {
+		delete(t.flows, key)
+		t.limits.release(1, 0)
+	}
+}
+
+// evictOldest evicts the least recently seen connection, it reports false when there is none
+func (t *healthTracker) evictOldest() bool {
+	var oldest *flowHealth
+	var key tcp.FlowKey
+	for k, f := range t.flows {
+		if oldest == nil || f.seen.Before(oldest.seen) {
+			oldest, key = f, k
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	t.remove(key)
+	t.limits.evicted()
+	return true
+}
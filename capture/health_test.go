@@ -0,0 +1,91 @@
+package capture
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestHealthTracker(t *testing.T) {
+	tracker := newHealthTracker(nil)
+	start := time.Now()
+	send := func(fromClient bool, at time.Duration, set func(*tcp.Packet)) {
+		pckt := wsPacket(fromClient, nil)
+		pckt.Timestamp = start.Add(at)
+		pckt.WindowScale = -1
+		set(pckt)
+		tracker.track(pckt)
+	}
+	// handshake, the client scales its window by 4, the server by 2
+	send(true, 0, func(p *tcp.Packet) { p.SYN, p.Seq, p.Window, p.WindowScale = true, 100, 1000, 2 })
+	send(false, 10*time.Millisecond, func(p *tcp.Packet) {
+		p.SYN, p.ACK, p.Seq, p.Ack, p.Window, p.WindowScale = true, true, 500, 101, 2000, 1
+	})
+	send(true, 30*time.Millisecond, func(p *tcp.Packet) { p.ACK, p.Seq, p.Ack, p.Window = true, 101, 501, 1000 })
+	// a request sent twice and its acknowledgment, which is not timed
+	request := func(p *tcp.Packet) { p.ACK, p.Seq, p.Ack, p.Payload = true, 101, 501, []byte("GET /") }
+	send(true, 40*time.Millisecond, request)
+	send(true, 50*time.Millisecond, request)
+	send(false, 60*time.Millisecond, func(p *tcp.Packet) { p.ACK, p.Seq, p.Ack, p.Window = true, 501, 106, 3000 })
+	// the response, acknowledged by the client
+	send(false, 70*time.Millisecond, func(p *tcp.Packet) { p.ACK, p.Seq, p.Ack, p.Window, p.Payload = true, 501, 106, 3000, []byte("200 OK") })
+	send(true, 100*time.Millisecond, func(p *tcp.Packet) { p.ACK, p.Seq, p.Ack, p.Window = true, 106, 507, 1000 })
+
+	health := tracker.report()
+	if len(health) != 1 {
+		t.Fatalf("expected the health of a connection, got %+v", health)
+	}
+	h := health[0]
+	if h.HandshakeRTT != 10*time.Millisecond || h.Closed {
+		t.Errorf("expected a handshake of 10ms, got %+v", h)
+	}
+	client, server := h.A, h.B
+	if server.RTT != 10*time.Millisecond || server.RTTSamples != 1 {
+		t.Errorf("expected a single RTT sample of the server, got %+v", server)
+	}
+	// the ACK of the SYN-ACK and the ACK of the response
+	if client.RTT != 20*time.Millisecond+(30-20)*time.Millisecond/8 || client.RTTSamples != 2 {
+		t.Errorf("expected two RTT samples of the client, got %+v", client)
+	}
+	if client.Retransmissions != 1 || server.Retransmissions != 0 || client.Packets != 5 {
+		t.Errorf("expected a retransmission of the client, got %+v", client)
+	}
+	if client.Window != 1000<<2 || server.Window != 3000<<1 {
+		t.Errorf("expected the scaled windows, got %d and %d", client.Window, server.Window)
+	}
+	if health = tracker.report(); len(health) != 0 {
+		t.Errorf("expected no change, got %+v", health)
+	}
+
+	send(false, time.Second, func(p *tcp.Packet) { p.RST = true })
+	if health = tracker.report(); len(health) != 1 || !health[0].Closed {
+		t.Fatalf("expected the connection to be closed, got %+v", health)
+	}
+	if len(tracker.flows) != 0 {
+		t.Errorf("expected the closed connection to be forgotten")
+	}
+}
+
+func TestHealthTrackerLimits(t *testing.T) {
+	limits := NewStateLimits(0, 1)
+	tracker := newHealthTracker(limits)
+	now := time.Now()
+	for port := uint16(1); port <= 3; port++ {
+		pckt := wsPacket(true, []byte("a"))
+		pckt.SrcPort = port
+		pckt.Flow, pckt.Reversed = tcp.NewFlowKey(pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort)
+		pckt.Timestamp = now.Add(time.Duration(port) * time.Second)
+		tracker.track(pckt)
+	}
+	if _, flows := limits.Usage(); flows != 1 || limits.Evictions() != 2 {
+		t.Errorf("expected a single connection tracked, got %d after %d evictions", flows, limits.Evictions())
+	}
+	// idle connections are forgotten
+	pckt := wsPacket(false, nil)
+	pckt.Timestamp = now.Add(time.Hour)
+	tracker.track(pckt)
+	if _, flows := limits.Usage(); flows != 1 || limits.Evictions() != 2 {
+		t.Errorf("expected the idle connection to be forgotten, %d tracked after %d evictions", flows, limits.Evictions())
+	}
+}
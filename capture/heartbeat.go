@@ -0,0 +1,72 @@
+package capture
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Heartbeat is the liveness of the handle of an interface
+type Heartbeat struct {
+	Interface  string
+	LastPacket time.Time // timestamp of the last packet read, zero before the first one
+	Packets    uint64    // packets read
+	Alive      bool      // the handle is being read, it is false once its read loop stopped
+}
+
+// HeartbeatHandler is called every HeartbeatInterval with the heartbeats of all the handles, sorted by interface
+type HeartbeatHandler func([]Heartbeat)
+
+// liveness is updated by the read loop of a handle
+type liveness struct {
+	last    int64 // unix nanoseconds, first fields to be 64-bit aligned for atomic operations
+	packets uint64
+	alive   int32
+}
+
+func (lv *liveness) packet(ts time.Time) {
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	atomic.AddUint64(&lv.packets, 1)
+	atomic.StoreInt64(&lv.last, ts.UnixNano())
+}
+
+func (lv *liveness) setAlive(alive bool) {
+	var v int32
+	if alive {
+		v = 1
+	}
+	atomic.StoreInt32(&lv.alive, v)
+}
+
+func (lv *liveness) heartbeat(iface string) Heartbeat {
+	hb := Heartbeat{
+		Interface: iface,
+		Packets:   atomic.LoadUint64(&lv.packets),
+		Alive:     atomic.LoadInt32(&lv.alive) == 1,
+	}
+	if last := atomic.LoadInt64(&lv.last); last != 0 {
+		hb.LastPacket = time.Unix(0, last)
+	}
+	return hb
+}
+
+// heartbeats calls handler every interval with the liveness of the handles until done is closed
+func heartbeats(lives map[string]*liveness, interval time.Duration, handler HeartbeatHandler, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			hbs := make([]Heartbeat, 0, len(lives))
+			for iface, lv := range lives {
+				hbs = append(hbs, lv.heartbeat(iface))
+			}
+			sort.Slice(hbs, func(i, j int) bool { return hbs[i].Interface < hbs[j].Interface })
+			handler(hbs)
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package capture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket/layers"
+)
+
+func TestHeartbeat(t *testing.T) {
+	a, b := newFakeHandle(layers.LinkTypeLoop), newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(a, b)
+	l.Heartbeat = 10 * time.Millisecond
+	beats := make(chan []Heartbeat, 100)
+	l.HeartbeatHandler = func(hbs []Heartbeat) { beats <- hbs }
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := l.ListenBackground(ctx, func(*tcp.Packet) {})
+	<-l.Ready()
+	a.packets <- rawPackets(1, 1, 5, 4)[0]
+	// the read loop of b stops while a is still read
+	close(b.packets)
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case hbs := <-beats:
+			if len(hbs) != 2 || hbs[0].Interface != "a" || hbs[1].Interface != "b" {
+				t.Fatalf("expected the heartbeats of a and b, got %+v", hbs)
+			}
+			done = hbs[0].Alive && hbs[0].Packets == 1 && !hbs[0].LastPacket.IsZero() && !hbs[1].Alive && hbs[1].LastPacket.IsZero()
+		case <-timeout:
+			t.Fatal("expected a heartbeat of a alive and b stopped")
+		}
+	}
+	cancel()
+	<-errCh
+}
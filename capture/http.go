@@ -0,0 +1,177 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// HTTPRequestHandler is called with every request, id is the one of its response
+type HTTPRequestHandler func(id string, req *http.Request)
+
+// HTTPResponseHandler is called with every response, id is the one of its request, it is empty
+// when the request was not captured
+type HTTPResponseHandler func(id string, resp *http.Response)
+
+// httpPipeline bounds the requests waiting for their responses on a connection
+const httpPipeline = 1024
+
+// HTTPParser parses the HTTP/1.x requests and responses of the streams of its StreamAssembler,
+// keep-alive connections and pipelined requests are correlated by their order. the bodies, chunked or not,
+// are read before the handlers are called, and are capped to maxBody bytes while ContentLength is kept.
+// the handlers are called concurrently for the different connections
+type HTTPParser struct {
+	*StreamAssembler
+	onRequest  HTTPRequestHandler
+	onResponse HTTPResponseHandler
+	maxBody    int64
+	ids        uint64
+
+	mu    sync.Mutex
+	conns map[tcp.FlowKey]*httpConn
+}
+
+type httpConn struct {
+	reqs    chan httpPending
+	streams int // streams of the connection being parsed
+	once    sync.Once
+}
+
+type httpPending struct {
+	id  string
+	req *http.Request
+}
+
+// NewHTTPParser returns a new HTTP parser, a connection is dropped after being idle for expire. maxBody
+// caps the bodies kept in memory, default is 5mb. either handler can be nil
+func NewHTTPParser(expire time.Duration, maxBody int, onRequest HTTPRequestHandler, onResponse HTTPResponseHandler) *HTTPParser {
+	parser := &HTTPParser{
+		onRequest:  onRequest,
+		onResponse: onResponse,
+		maxBody:    int64(maxBody),
+		conns:      make(map[tcp.FlowKey]*httpConn),
+	}
+	if parser.maxBody < 1 {
+		parser.maxBody = 5 << 20
+	}
+	parser.StreamAssembler = NewStreamAssembler(expire, 0, parser.stream)
+	return parser
+}
+
+func (parser *HTTPParser) conn(flow tcp.FlowKey) *httpConn {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+	conn, ok := parser.conns[flow]
+	if !ok {
+		conn = &httpConn{reqs: make(chan httpPending, httpPipeline)}
+		parser.conns[flow] = conn
+	}
+	conn.streams++
+	return conn
+}
+
+func (parser *HTTPParser) release(flow tcp.FlowKey, conn *httpConn) {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+	if conn.streams--; conn.streams == 0 && parser.conns[flow] == conn {
+		delete(parser.conns, flow)
+	}
+}
+
+// Conns returns the number of connections being parsed
+func (parser *HTTPParser) Conns() int {
+	parser.mu.Lock()
+	defer parser.mu.Unlock()
+	return len(parser.conns)
+}
+
+func (parser *HTTPParser) stream(s *Stream) {
+	defer s.Close()
+	conn := parser.conn(s.Flow)
+	defer parser.release(s.Flow, conn)
+	if s.FromClient {
+		defer conn.once.Do(func() { close(conn.reqs) })
+		parser.requests(s, conn)
+		return
+	}
+	parser.responses(s, conn)
+}
+
+func (parser *HTTPParser) requests(s *Stream, conn *httpConn) {
+	r := bufio.NewReader(s)
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		if err = parser.readBody(&req.Body); err != nil {
+			return
+		}
+		req.RemoteAddr = s.SrcAddr
+		id := fmt.Sprintf("%08x%08x", s.Flow.Hash(), atomic.AddUint64(&parser.ids, 1))
+		select {
+		case conn.reqs <- httpPending{id, req}:
+		default: // the responses are not captured
+		}
+		if parser.onRequest != nil {
+			parser.onRequest(id, req)
+		}
+	}
+}
+
+func (parser *HTTPParser) responses(s *Stream, conn *httpConn) {
+	r := bufio.NewReader(s)
+	for {
+		// wait for the data of the response, the request is parsed concurrently
+		if _, err := r.Peek(1); err != nil {
+			return
+		}
+		var pending httpPending
+		select {
+		case pending = <-conn.reqs:
+		case <-time.After(parser.expire):
+			// the client side is not captured
+		}
+		for {
+			resp, err := http.ReadResponse(r, pending.req)
+			if err != nil {
+				return
+			}
+			if err = parser.readBody(&resp.Body); err != nil {
+				return
+			}
+			if parser.onResponse != nil {
+				parser.onResponse(pending.id, resp)
+			}
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				return // not HTTP anymore
+			}
+			if resp.StatusCode >= 200 || resp.StatusCode < 100 {
+				break
+			}
+			// informational responses precede the final one
+		}
+	}
+}
+
+// readBody reads the body up to maxBody bytes, and discards the rest
+func (parser *HTTPParser) readBody(body *io.ReadCloser) error {
+	if *body == nil || *body == http.NoBody {
+		return nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(*body, parser.maxBody))
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, *body)
+	}
+	(*body).Close()
+	*body = ioutil.NopCloser(bytes.NewReader(data))
+	return err
+}
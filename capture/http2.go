@@ -0,0 +1,325 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP2Preface is the client connection preface https://tools.ietf.org/html/rfc7540#section-3.5
+var HTTP2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// HTTP/2 frame types https://tools.ietf.org/html/rfc7540#section-6
+const (
+	h2FrameData         = 0x0
+	h2FrameHeaders      = 0x1
+	h2FrameRSTStream    = 0x3
+	h2FrameSettings     = 0x4
+	h2FramePushPromise  = 0x5
+	h2FrameGoAway       = 0x7
+	h2FrameContinuation = 0x9
+
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+
+	h2SettingHeaderTableSize = 0x1
+	h2FrameHeaderLen         = 9
+)
+
+// HTTP2Message is a logical request or response of a single HTTP/2 stream
+type HTTP2Message struct {
+	Flow             tcp.FlowKey
+	SrcAddr, DstAddr string
+	FromClient       bool
+	StreamID         uint32
+	Headers          []hpack.HeaderField
+	Trailers         []hpack.HeaderField
+	Data             []byte
+	Start, End       time.Time
+}
+
+// HTTP2Emitter is called on every complete HTTP/2 request or response
+type HTTP2Emitter func(*HTTP2Message)
+
+// HTTP2Parser decodes h2c(prior knowledge) flows, it recognizes flows from the client preface and
+// keeps the HPACK state of each direction of a connection until the connection is closed or idle.
+// packets are expected to arrive in order. its CloseHandler must be set as Listener.CloseHandler
+// for the HPACK state to be dropped on close.
+type HTTP2Parser struct {
+	flowTable
+	emit    HTTP2Emitter
+	maxSize int
+}
+
+type h2Flow struct {
+	client bool            // Reversed flag of the packets sent by the client
+	dirs   [2]*h2Direction // 0 from client, 1 from server
+}
+
+type h2Direction struct {
+	buf       []byte
+	decoder   *hpack.Decoder
+	streams   map[uint32]*HTTP2Message
+	discarded map[uint32]bool // streams over maxSize, ignored until they end
+	block     []byte          // header block waiting for CONTINUATION frames
+	blockID   uint32
+	blockEnds bool // the header block ends its stream
+	lost      bool // a header block over maxSize was dropped, the HPACK state of the direction is lost
+}
+
+// NewHTTP2Parser returns a new HTTP/2 parser, a flow is evicted after being idle for expire,
+// or when it is closed. maxSize bounds the buffered data of a single stream and of a header block, default is 5mb
+func NewHTTP2Parser(expire time.Duration, maxSize int, emit HTTP2Emitter) *HTTP2Parser {
+	parser := new(HTTP2Parser)
+	parser.init(expire, time.Minute)
+	parser.emit = emit
+	parser.maxSize = maxSize
+	if parser.maxSize < 1 {
+		parser.maxSize = 5 << 20
+	}
+	return parser
+}
+
+// PacketHandler is the handler to be passed to Listener.Listen
+func (parser *HTTP2Parser) PacketHandler(pckt *tcp.Packet) {
+	parser.Lock()
+	defer parser.Unlock()
+
+	key := pckt.Flow
+	v, ok := parser.lookup(key, pckt.Timestamp)
+	flow, _ := v.(*h2Flow)
+	payload := pckt.Payload
+	if !ok {
+		if !bytes.HasPrefix(payload, HTTP2Preface) {
+			return
+		}
+		flow = &h2Flow{client: pckt.Reversed}
+		for i := range flow.dirs {
+			flow.dirs[i] = &h2Direction{
+				decoder:   hpack.NewDecoder(4096, nil),
+				streams:   make(map[uint32]*HTTP2Message),
+				discarded: make(map[uint32]bool),
+			}
+		}
+		parser.store(key, flow, pckt.Timestamp)
+		payload = payload[len(HTTP2Preface):]
+	}
+	i := 1
+	if pckt.Reversed == flow.client {
+		i = 0
+	}
+	flow.dirs[i].buf = append(flow.dirs[i].buf, payload...)
+	if err := parser.parse(flow, i, pckt); err != nil {
+		// the HPACK state can't be trusted anymore
+		parser.remove(key)
+		return
+	}
+	if pckt.FIN || pckt.RST {
+		parser.closed(key, i, pckt)
+	}
+}
+
+func (parser *HTTP2Parser) parse(flow *h2Flow, i int, pckt *tcp.Packet) error {
+	dir := flow.dirs[i]
+	if dir.lost {
+		dir.buf = nil
+		return nil
+	}
+	for len(dir.buf) >= h2FrameHeaderLen {
+		length := int(dir.buf[0])<<16 | int(dir.buf[1])<<8 | int(dir.buf[2])
+		if len(dir.buf) < h2FrameHeaderLen+length {
+			if length > parser.maxSize {
+				return fmt.Errorf("http2: frame of %d bytes is too large", length)
+			}
+			break
+		}
+		typ, flags := dir.buf[3], dir.buf[4]
+		id := binary.BigEndian.Uint32(dir.buf[5:]) & (1<<31 - 1)
+		payload := dir.buf[h2FrameHeaderLen : h2FrameHeaderLen+length]
+		dir.buf = dir.buf[h2FrameHeaderLen+length:]
+		if err := parser.frame(flow, i, pckt, typ, flags, id, payload); err != nil {
+			return err
+		}
+	}
+	if len(dir.buf) == 0 {
+		dir.buf = nil
+	}
+	return nil
+}
+
+func (parser *HTTP2Parser) frame(flow *h2Flow, i int, pckt *tcp.Packet, typ, flags byte, id uint32, payload []byte) (err error) {
+	dir := flow.dirs[i]
+	if dir.block != nil && typ != h2FrameContinuation {
+		return fmt.Errorf("http2: expected CONTINUATION frame, got %#x", typ)
+	}
+	switch typ {
+	case h2FrameHeaders:
+		if payload, err = h2Unpad(flags, payload); err != nil {
+			return
+		}
+		if flags&h2FlagPriority != 0 {
+			if len(payload) < 5 {
+				return fmt.Errorf("http2: short HEADERS frame")
+			}
+			payload = payload[5:]
+		}
+		dir.block = append([]byte{}, payload...)
+		dir.blockID = id
+		dir.blockEnds = flags&h2FlagEndStream != 0
+		if flags&h2FlagEndHeaders != 0 {
+			return parser.headers(flow, i, pckt)
+		}
+	case h2FrameContinuation:
+		if dir.block == nil || id != dir.blockID {
+			return fmt.Errorf("http2: unexpected CONTINUATION frame")
+		}
+		if len(dir.block)+len(payload) > parser.maxSize {
+			dir.reset()
+			return
+		}
+		dir.block = append(dir.block, payload...)
+		if flags&h2FlagEndHeaders != 0 {
+			return parser.headers(flow, i, pckt)
+		}
+	case h2FramePushPromise:
+		// the promised request headers are part of the same HPACK context
+		if payload, err = h2Unpad(flags, payload); err != nil || len(payload) < 4 {
+			return fmt.Errorf("http2: invalid PUSH_PROMISE frame")
+		}
+		if flags&h2FlagEndHeaders == 0 {
+			return fmt.Errorf("http2: fragmented PUSH_PROMISE frames are not supported")
+		}
+		_, err = dir.decoder.DecodeFull(payload[4:])
+	case h2FrameData:
+		if payload, err = h2Unpad(flags, payload); err != nil {
+			return
+		}
+		if dir.discarded[id] {
+			if flags&h2FlagEndStream != 0 {
+				delete(dir.discarded, id)
+			}
+			return
+		}
+		msg := dir.stream(i, pckt, id)
+		if len(msg.Data)+len(payload) > parser.maxSize {
+			delete(dir.streams, id)
+			if flags&h2FlagEndStream == 0 {
+				dir.discarded[id] = true
+			}
+			return
+		}
+		msg.Data = append(msg.Data, payload...)
+		if flags&h2FlagEndStream != 0 {
+			parser.end(dir, id, pckt)
+		}
+	case h2FrameRSTStream:
+		for _, dir := range flow.dirs {
+			delete(dir.streams, id)
+			delete(dir.discarded, id)
+		}
+	case h2FrameSettings:
+		if flags&h2FlagAck != 0 {
+			return
+		}
+		for ; len(payload) >= 6; payload = payload[6:] {
+			if binary.BigEndian.Uint16(payload) == h2SettingHeaderTableSize {
+				// the peer's encoder can use up to the table size we advertise
+				flow.dirs[1-i].decoder.SetAllowedMaxDynamicTableSize(binary.BigEndian.Uint32(payload[2:]))
+			}
+		}
+	case h2FrameGoAway:
+		// streams above the last stream id will never complete
+		if len(payload) >= 4 {
+			last := binary.BigEndian.Uint32(payload) & (1<<31 - 1)
+			for _, dir := range flow.dirs {
+				for id := range dir.streams {
+					if id > last {
+						delete(dir.streams, id)
+					}
+				}
+				for id := range dir.discarded {
+					if id > last {
+						delete(dir.discarded, id)
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+func (parser *HTTP2Parser) headers(flow *h2Flow, i int, pckt *tcp.Packet) error {
+	dir := flow.dirs[i]
+	fields, err := dir.decoder.DecodeFull(dir.block)
+	id, ends := dir.blockID, dir.blockEnds
+	dir.block = nil
+	if err != nil {
+		return err
+	}
+	if dir.discarded[id] { // trailers of a stream over maxSize
+		if ends {
+			delete(dir.discarded, id)
+		}
+		return nil
+	}
+	msg := dir.stream(i, pckt, id)
+	if msg.Headers == nil {
+		msg.Headers = fields
+	} else {
+		msg.Trailers = fields
+	}
+	if ends {
+		parser.end(dir, id, pckt)
+	}
+	return nil
+}
+
+func (parser *HTTP2Parser) end(dir *h2Direction, id uint32, pckt *tcp.Packet) {
+	msg := dir.streams[id]
+	delete(dir.streams, id)
+	msg.End = pckt.Timestamp
+	parser.emit(msg)
+}
+
+// reset drops the state of a direction whose header block went over maxSize, the following header
+// blocks can't be decoded without it, so the rest of the direction is ignored
+func (dir *h2Direction) reset() {
+	dir.buf, dir.block = nil, nil
+	dir.streams = make(map[uint32]*HTTP2Message)
+	dir.discarded = make(map[uint32]bool)
+	dir.lost = true
+}
+
+func (dir *h2Direction) stream(i int, pckt *tcp.Packet, id uint32) *HTTP2Message {
+	msg, ok := dir.streams[id]
+	if !ok {
+		msg = &HTTP2Message{
+			Flow:       pckt.Flow,
+			SrcAddr:    pckt.Src(),
+			DstAddr:    pckt.Dst(),
+			FromClient: i == 0,
+			StreamID:   id,
+			Start:      pckt.Timestamp,
+		}
+		dir.streams[id] = msg
+	}
+	return msg
+}
+
+func h2Unpad(flags byte, payload []byte) ([]byte, error) {
+	if flags&h2FlagPadded == 0 {
+		return payload, nil
+	}
+	if len(payload) < 1 || int(payload[0]) >= len(payload) {
+		return nil, fmt.Errorf("http2: invalid padding")
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
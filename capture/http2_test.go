@@ -0,0 +1,179 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+func h2Frame(typ, flags byte, id uint32, payload []byte) []byte {
+	frame := make([]byte, h2FrameHeaderLen, h2FrameHeaderLen+len(payload))
+	frame[0], frame[1], frame[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	frame[3], frame[4] = typ, flags
+	binary.BigEndian.PutUint32(frame[5:], id)
+	return append(frame, payload...)
+}
+
+func h2Headers(enc *hpack.Encoder, buf *bytes.Buffer, fields ...string) []byte {
+	buf.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return append([]byte{}, buf.Bytes()...)
+}
+
+func TestHTTP2Parser(t *testing.T) {
+	var msgs []*HTTP2Message
+	parser := NewHTTP2Parser(0, 0, func(m *HTTP2Message) { msgs = append(msgs, m) })
+	var reqBuf, respBuf bytes.Buffer
+	reqEnc, respEnc := hpack.NewEncoder(&reqBuf), hpack.NewEncoder(&respBuf)
+
+	// client preface, settings and a POST request
+	data := append([]byte{}, HTTP2Preface...)
+	data = append(data, h2Frame(h2FrameSettings, 0, 0, nil)...)
+	block := h2Headers(reqEnc, &reqBuf, ":method", "POST", ":path", "/api", "x-request-id", "1")
+	data = append(data, h2Frame(h2FrameHeaders, h2FlagEndHeaders, 1, block)...)
+	data = append(data, h2Frame(h2FrameData, h2FlagEndStream, 1, []byte("ping"))...)
+	parser.PacketHandler(wsPacket(true, data[:30]))
+	parser.PacketHandler(wsPacket(true, data[30:]))
+
+	// response headers split into a CONTINUATION frame
+	block = h2Headers(respEnc, &respBuf, ":status", "200", "content-type", "text/plain")
+	data = h2Frame(h2FrameSettings, 0, 0, nil)
+	data = append(data, h2Frame(h2FrameHeaders, 0, 1, block[:3])...)
+	data = append(data, h2Frame(h2FrameContinuation, h2FlagEndHeaders, 1, block[3:])...)
+	data = append(data, h2Frame(h2FrameData, h2FlagPadded|h2FlagEndStream, 1, []byte{2, 'p', 'o', 'n', 'g', 0, 0})...)
+	parser.PacketHandler(wsPacket(false, data))
+
+	// second request relies on the dynamic table of the connection
+	block = h2Headers(reqEnc, &reqBuf, ":method", "POST", ":path", "/api", "x-request-id", "1")
+	parser.PacketHandler(wsPacket(true, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 3, block)))
+
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	if !msgs[0].FromClient || msgs[0].StreamID != 1 || string(msgs[0].Data) != "ping" || msgs[0].Headers[2].Value != "1" {
+		t.Errorf("wrong request %+v", msgs[0])
+	}
+	if msgs[1].FromClient || msgs[1].StreamID != 1 || string(msgs[1].Data) != "pong" || msgs[1].Headers[0].Value != "200" {
+		t.Errorf("wrong response %+v", msgs[1])
+	}
+	if msgs[2].StreamID != 3 || len(msgs[2].Headers) != 3 || msgs[2].Headers[1].Value != "/api" {
+		t.Errorf("wrong request %+v", msgs[2])
+	}
+
+	rst := wsPacket(true, nil)
+	rst.RST = true
+	parser.PacketHandler(rst)
+	if parser.Flows() != 0 {
+		t.Errorf("expected the flow to be flushed on close, got %d flows", parser.Flows())
+	}
+}
+
+func TestHTTP2ParserMaxSize(t *testing.T) {
+	var msgs []*HTTP2Message
+	parser := NewHTTP2Parser(0, 10, func(m *HTTP2Message) { msgs = append(msgs, m) })
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+
+	data := append([]byte{}, HTTP2Preface...)
+	data = append(data, h2Frame(h2FrameHeaders, h2FlagEndHeaders, 1, h2Headers(enc, &buf, ":method", "POST", ":path", "/upload"))...)
+	data = append(data, h2Frame(h2FrameData, 0, 1, []byte("0123456789"))...)
+	data = append(data, h2Frame(h2FrameData, 0, 1, []byte("abc"))...)
+	data = append(data, h2Frame(h2FrameData, h2FlagEndStream, 1, []byte("def"))...)
+	// the stream following the discarded one is decoded
+	data = append(data, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 3, h2Headers(enc, &buf, ":method", "GET", ":path", "/"))...)
+	parser.PacketHandler(wsPacket(true, data))
+
+	if len(msgs) != 1 || msgs[0].StreamID != 3 || msgs[0].Headers[1].Value != "/" {
+		t.Fatalf("expected only the request of stream 3, got %+v", msgs)
+	}
+}
+
+func TestHTTP2ParserContinuationFlood(t *testing.T) {
+	var msgs []*HTTP2Message
+	parser := NewHTTP2Parser(0, 10, func(m *HTTP2Message) { msgs = append(msgs, m) })
+	var reqBuf, respBuf bytes.Buffer
+	reqEnc, respEnc := hpack.NewEncoder(&reqBuf), hpack.NewEncoder(&respBuf)
+
+	// the header block of the client keeps growing with CONTINUATION frames
+	data := append([]byte{}, HTTP2Preface...)
+	data = append(data, h2Frame(h2FrameHeaders, 0, 1, []byte("0123"))...)
+	parser.PacketHandler(wsPacket(true, data))
+	for i := 0; i < 100; i++ {
+		parser.PacketHandler(wsPacket(true, h2Frame(h2FrameContinuation, 0, 1, []byte("4567"))))
+	}
+	p := wsPacket(true, nil)
+	v, _ := parser.lookup(p.Flow, p.Timestamp)
+	client := v.(*h2Flow).dirs[0]
+	if !client.lost || client.block != nil || client.buf != nil {
+		t.Fatalf("expected the header block over the max size to be dropped, got %d bytes", len(client.block))
+	}
+
+	// the server side is still decoded
+	resp := h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, h2Headers(respEnc, &respBuf, ":status", "431"))
+	parser.PacketHandler(wsPacket(false, resp))
+	parser.PacketHandler(wsPacket(true, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 3, h2Headers(reqEnc, &reqBuf, ":method", "GET"))))
+	if len(msgs) != 1 || msgs[0].FromClient || msgs[0].Headers[0].Value != "431" {
+		t.Fatalf("expected only the response, got %+v", msgs)
+	}
+}
+
+func TestHTTP2ParserCloseHandler(t *testing.T) {
+	var msgs []*HTTP2Message
+	parser := NewHTTP2Parser(0, 0, func(m *HTTP2Message) { msgs = append(msgs, m) })
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	data := append([]byte{}, HTTP2Preface...)
+	data = append(data, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, h2Headers(enc, &buf, ":method", "GET", "x-id", "1"))...)
+	req := wsPacket(true, data)
+	parser.PacketHandler(req)
+	parser.CloseHandler(req.Flow, tcp.CloseHalf)
+	if parser.Flows() != 1 {
+		t.Fatalf("expected the flow to be kept after a half-close, got %d flows", parser.Flows())
+	}
+	parser.CloseHandler(req.Flow, tcp.CloseFIN)
+	if parser.Flows() != 0 {
+		t.Fatalf("expected the flow to be removed once closed, got %d flows", parser.Flows())
+	}
+
+	// a new connection with the same addresses starts with an empty dynamic table
+	enc = hpack.NewEncoder(&buf)
+	data = append([]byte{}, HTTP2Preface...)
+	data = append(data, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, h2Headers(enc, &buf, ":method", "GET", "x-id", "2"))...)
+	parser.PacketHandler(wsPacket(true, data))
+	if len(msgs) != 2 || msgs[1].Headers[1].Value != "2" {
+		t.Errorf("expected the request of the new connection, got %+v", msgs)
+	}
+}
+
+func TestHTTP2ParserHalfClose(t *testing.T) {
+	var msgs []*HTTP2Message
+	parser := NewHTTP2Parser(0, 0, func(m *HTTP2Message) { msgs = append(msgs, m) })
+	var reqBuf, respBuf bytes.Buffer
+	reqEnc, respEnc := hpack.NewEncoder(&reqBuf), hpack.NewEncoder(&respBuf)
+
+	// the client closes its side once the request is sent
+	data := append([]byte{}, HTTP2Preface...)
+	data = append(data, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, h2Headers(reqEnc, &reqBuf, ":method", "GET", ":path", "/"))...)
+	req := wsPacket(true, data)
+	req.FIN = true
+	parser.PacketHandler(req)
+	if parser.Flows() != 1 {
+		t.Fatalf("expected the flow to be kept after a half-close, got %d flows", parser.Flows())
+	}
+
+	resp := wsPacket(false, h2Frame(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, h2Headers(respEnc, &respBuf, ":status", "204")))
+	resp.FIN = true
+	parser.PacketHandler(resp)
+	if len(msgs) != 2 || msgs[1].FromClient || msgs[1].Headers[0].Value != "204" {
+		t.Fatalf("expected the response sent after the half-close, got %+v", msgs)
+	}
+	if parser.Flows() != 0 {
+		t.Errorf("expected the flow to be evicted once both sides closed, got %d flows", parser.Flows())
+	}
+}
@@ -0,0 +1,68 @@
+package capture
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPParser(t *testing.T) {
+	var mu sync.Mutex
+	reqs := make(map[string]string)
+	resps := make(chan [3]string, 3)
+	parser := NewHTTPParser(time.Minute, 8, func(id string, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mu.Lock()
+		reqs[id] = req.Method + " " + req.URL.Path + " " + string(body)
+		mu.Unlock()
+	}, func(id string, resp *http.Response) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resps <- [3]string{id, resp.Status, string(body)}
+	})
+	defer parser.Close()
+
+	// pipelined requests, the body of the second one is over the cap
+	client := "GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"POST /b HTTP/1.1\r\nHost: localhost\r\nContent-Length: 12\r\n\r\n0123456789ab" +
+		"HEAD /c HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	server := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n2\r\nde\r\n0\r\n\r\n" +
+		"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"
+	parser.PacketHandler(streamPacket(true, 1, client[:50]))
+	parser.PacketHandler(streamPacket(true, 51, client[50:]))
+	parser.PacketHandler(streamPacket(false, 1, server))
+
+	expected := []struct{ req, status, body string }{
+		{"GET /a ", "200 OK", "abcde"},
+		{"POST /b 01234567", "100 Continue", ""},
+		{"POST /b 01234567", "201 Created", "ok"},
+		{"HEAD /c ", "200 OK", ""},
+	}
+	for i, e := range expected {
+		var resp [3]string
+		select {
+		case resp = <-resps:
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d responses, got %d", len(expected), i)
+		}
+		mu.Lock()
+		req := reqs[resp[0]]
+		mu.Unlock()
+		if req != e.req || resp[1] != e.status || resp[2] != e.body {
+			t.Errorf("%d: expected %q answered with %q %q, got %q answered with %q %q", i, e.req, e.status, e.body, req, resp[1], resp[2])
+		}
+	}
+
+	rst := streamPacket(true, uint32(len(client)+1), "")
+	rst.RST = true
+	parser.PacketHandler(rst)
+	deadline := time.Now().Add(time.Second)
+	for parser.Conns() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if parser.Conns() != 0 || parser.Flows() != 0 {
+		t.Errorf("expected the connection to be flushed on reset, got %d connections", parser.Conns())
+	}
+}
@@ -0,0 +1,207 @@
+package capture
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// fakeHandle is a packet source returning the packets sent to it, io.EOF once it is drained
+type fakeHandle struct {
+	packets  chan []byte
+	linkType layers.LinkType
+	closed   chan struct{}
+	lost     int // bytes of every packet that were not captured
+}
+
+func newFakeHandle(linkType layers.LinkType) *fakeHandle {
+	return &fakeHandle{packets: make(chan []byte, 10), linkType: linkType, closed: make(chan struct{})}
+}
+
+func (h *fakeHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	select {
+	case data, ok := <-h.packets:
+		if !ok {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		return data, gopacket.CaptureInfo{Length: len(data) + h.lost, CaptureLength: len(data), Timestamp: time.Now()}, nil
+	case <-h.closed:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+}
+
+func (h *fakeHandle) LinkType() layers.LinkType {
+	return h.linkType
+}
+
+func (h *fakeHandle) Close() {
+	close(h.closed)
+}
+
+func newFakeListener(handles ...*fakeHandle) *Listener {
+	l, _ := NewListener("", nil, "", EnginePcapFile, false)
+	for i, h := range handles {
+		l.AddPacketSource(string(rune('a'+i)), h, h.linkType)
+	}
+	return l
+}
+
+func TestListenerReady(t *testing.T) {
+	good, bad := newFakeHandle(layers.LinkTypeEthernet), newFakeHandle(layers.LinkType(250))
+	l := newFakeListener(good, bad)
+	ready := l.Ready()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := l.ListenBackground(ctx, func(*tcp.Packet) {})
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("expected the listener to be ready")
+	}
+	if l.StartErr() == nil {
+		t.Error("expected the handle with an unknown link type to fail")
+	}
+	if l.LinkType("a") != layers.LinkTypeEthernet || l.LinkType("b") != 250 || l.LinkType("c") != 0 {
+		t.Errorf("wrong link types %s %s %s", l.LinkType("a"), l.LinkType("b"), l.LinkType("c"))
+	}
+	select {
+	case <-bad.closed:
+	case <-time.After(time.Second):
+		t.Error("expected the failed handle to be closed")
+	}
+	close(good.packets)
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Error("expected the listener to stop")
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	// before Listen
+	l := newFakeListener()
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+
+	h1, h2 := newFakeHandle(layers.LinkTypeEthernet), newFakeHandle(layers.LinkTypeEthernet)
+	l = newFakeListener(h1, h2)
+	errCh := l.ListenBackground(context.Background(), func(*tcp.Packet) {})
+	<-l.Ready()
+	closed := make(chan struct{})
+	go func() {
+		l.Close()
+		l.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected Close to return")
+	}
+	for _, h := range []*fakeHandle{h1, h2} {
+		select {
+		case <-h.closed:
+		default:
+			t.Error("expected the handles to be closed when Close returns")
+		}
+	}
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Error("expected Listen to return")
+	}
+}
+
+// TestListenerCloseWhileHandling checks that a handle is not closed, freeing the data being handled,
+// before the handler returns
+func TestListenerCloseWhileHandling(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	handling, release := make(chan struct{}), make(chan struct{})
+	errCh := l.ListenBackground(context.Background(), func(*tcp.Packet) {
+		close(handling)
+		<-release
+	})
+	h.packets <- append(generateHeader4(1, 5), make([]byte, 5)...)
+	<-handling
+	closed := make(chan struct{})
+	go func() {
+		l.Close()
+		close(closed)
+	}()
+	select {
+	case <-h.closed:
+		t.Fatal("expected the handle to stay open while its packet is handled")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected Close to return")
+	}
+	<-errCh
+}
+
+// TestListenerCloseRace races the handles closing on EOF with the cancellation of the context,
+// it is meant to be run with -race
+func TestListenerCloseRace(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		h1, h2 := newFakeHandle(layers.LinkTypeEthernet), newFakeHandle(layers.LinkTypeEthernet)
+		l := newFakeListener(h1, h2)
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := l.ListenBackground(ctx, func(*tcp.Packet) {})
+		if i%2 == 0 {
+			<-l.Ready()
+		}
+		go close(h1.packets)
+		go close(h2.packets)
+		go cancel()
+		go l.Close()
+		select {
+		case <-errCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected Listen to return")
+		}
+		// a later call on the closed listener returns immediately
+		if err := l.Listen(ctx, func(*tcp.Packet) {}); err != nil && err != context.Canceled {
+			t.Errorf("unexpected error %v", err)
+		}
+		l.Close()
+	}
+}
+
+func TestListenWithMeta(t *testing.T) {
+	lo, eth := newFakeHandle(layers.LinkTypeLoop), newFakeHandle(layers.LinkTypeEthernet)
+	l := newFakeListener(lo, eth)
+	data := rawPackets(1, 1, 5, 4)[0]
+	lo.packets <- data
+	frame := append(make([]byte, 12), 0x08, 0x00) // IPv4 ethernet header
+	eth.packets <- append(frame, rawPackets(1, 1, 5, 4)[0][4:]...)
+	close(lo.packets)
+	close(eth.packets)
+	var mu sync.Mutex
+	metas := make(map[string]PacketMeta)
+	_ = l.ListenWithMeta(context.Background(), func(pckt *tcp.Packet, meta PacketMeta) {
+		mu.Lock()
+		defer mu.Unlock()
+		metas[meta.Interface] = meta
+	})
+	if len(metas) != 2 || metas["a"].LinkType != layers.LinkTypeLoop || metas["b"].LinkType != layers.LinkTypeEthernet {
+		t.Errorf("wrong packet metas %v", metas)
+	}
+	if ci := metas["a"].CaptureInfo; ci.CaptureLength != len(data) || ci.Length != len(data) || ci.Timestamp.IsZero() {
+		t.Errorf("expected the capture info of the frame, got %+v", ci)
+	}
+}
@@ -0,0 +1,59 @@
+package capture
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// captureLimit stops the capture once MaxPackets packets were read or MaxDuration has elapsed,
+// the capture is stopped the way Close does
+type captureLimit struct {
+	packets uint64 // first field to be 64-bit aligned for atomic operations
+	reached int32
+	max     uint64 // 0 means no packet limit
+	stop    func()
+}
+
+func newCaptureLimit(max uint64, stop func()) *captureLimit {
+	return &captureLimit{max: max, stop: stop}
+}
+
+// wait stops the capture after d, unless it is done before
+func (c *captureLimit) wait(d time.Duration, done <-chan struct{}) {
+	timer := time.NewTimer(d)
+	select {
+	case <-timer.C:
+		c.reach()
+	case <-done:
+		timer.Stop()
+	}
+}
+
+// count counts a packet read from a handle, it reports whether the packet is within the limit
+func (c *captureLimit) count() bool {
+	n := atomic.AddUint64(&c.packets, 1)
+	if c.max == 0 || n < c.max {
+		return true
+	}
+	if n == c.max {
+		c.reach()
+		return true
+	}
+	return false
+}
+
+// reach stops the capture, only the first call has an effect
+func (c *captureLimit) reach() {
+	if atomic.CompareAndSwapInt32(&c.reached, 0, 1) {
+		// the handle of the caller may be locked, Close waits for it
+		go c.stop()
+	}
+}
+
+// LimitReached reports whether the capture was stopped because MaxDuration or MaxPackets was reached,
+// Listen returns a nil error in that case
+func (l *Listener) LimitReached() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.limit != nil && atomic.LoadInt32(&l.limit.reached) == 1
+}
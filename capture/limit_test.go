@@ -0,0 +1,84 @@
+package capture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestMaxPackets(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.MaxPackets = 5
+	go func() {
+		for _, data := range rawPackets(1, 10, 5, 4) {
+			select {
+			case h.packets <- data:
+			case <-h.closed:
+				return
+			}
+		}
+	}()
+	var handled int
+	errCh := l.ListenBackground(context.Background(), func(*tcp.Packet) { handled++ })
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("expected error to be nil, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the capture to stop")
+	}
+	if handled != 5 || !l.LimitReached() {
+		t.Errorf("expected 5 packets and the limit to be reached, got %d %t", handled, l.LimitReached())
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.MaxDuration = 50 * time.Millisecond
+	start := time.Now()
+	errCh := l.ListenBackground(context.Background(), func(*tcp.Packet) {})
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("expected error to be nil, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the capture to stop")
+	}
+	if time.Since(start) < l.MaxDuration || !l.LimitReached() {
+		t.Errorf("expected the capture to stop once the duration is reached, after %s %t", time.Since(start), l.LimitReached())
+	}
+	select {
+	case <-h.closed:
+	default:
+		t.Error("expected the handle to be closed")
+	}
+}
+
+func TestLimitNotReached(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.MaxPackets = 5
+	l.MaxDuration = time.Minute
+	close(h.packets)
+	if err := l.Listen(context.Background(), func(*tcp.Packet) {}); err != nil {
+		t.Errorf("expected error to be nil, got %v", err)
+	}
+	if l.LimitReached() {
+		t.Error("expected the limit not to be reached")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l = newFakeListener(newFakeHandle(layers.LinkTypeLoop))
+	l.MaxPackets = 5
+	if err := l.Listen(ctx, func(*tcp.Packet) {}); err != context.Canceled || l.LimitReached() {
+		t.Errorf("expected the capture to be canceled, got %v %t", err, l.LimitReached())
+	}
+}
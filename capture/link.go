@@ -0,0 +1,55 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/gopacket/layers"
+)
+
+// variableLinkLength is returned by pcapLinkTypeLength for the link types whose header length
+// depends on every packet, see linkHeaders
+const variableLinkLength = -1
+
+// errNotIP is returned for the frames that can't carry IP packets, e.g 802.11 management frames,
+// they are skipped without being counted as parse errors
+var errNotIP = errors.New("frame does not carry an IP packet")
+
+// linkHeaders returns the length of the link layer header of a packet, and the length of its trailer
+func linkHeaders(linkType layers.LinkType, data []byte) (header, trailer int, err error) {
+	switch linkType {
+	case layers.LinkTypeIEEE80211Radio:
+		return radiotapHeaders(data)
+	case layers.LinkTypeIEEE802_11:
+		header, err = dot11Header(data)
+	case layers.LinkTypePPP, layers.LinkTypePPP_HDLC:
+		header, err = pppHeader(data)
+	case layers.LinkTypePPPEthernet:
+		header, err = pppoeHeader(data)
+	case layers.LinkTypeEthernet:
+		switch binary.BigEndian.Uint16(data[12:14]) {
+		case etherTypeMPLSUnicast, etherTypeMPLSMulticast:
+			header, err = mplsHeader(data[14:])
+		default:
+			header, err = pppoeHeader(data[14:])
+		}
+		if err == nil {
+			header += 14
+		}
+	default:
+		err = errors.New("unknown link type")
+	}
+	return
+}
+
+// encapsulated reports whether an ethernet frame carries a PPPoE session or MPLS labels before its IP packet
+func encapsulated(data []byte) bool {
+	if len(data) <= 14 {
+		return false
+	}
+	switch binary.BigEndian.Uint16(data[12:14]) {
+	case uint16(layers.EthernetTypePPPoESession), etherTypeMPLSUnicast, etherTypeMPLSMulticast:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package capture
+
+import "github.com/google/gopacket/pcap"
+
+// defaultLocalhost are the addresses of the host localhost when LocalhostAddresses is not set
+var defaultLocalhost = []string{"127.0.0.1", "::1"}
+
+// hostAddresses returns the addresses the host of the listener stands for, the addresses of localhost,
+// or the host itself
+func (l *Listener) hostAddresses() []string {
+	if l.host != "localhost" {
+		return []string{l.host}
+	}
+	if len(l.LocalhostAddresses) != 0 {
+		return l.LocalhostAddresses
+	}
+	return defaultLocalhost
+}
+
+// hostLoopback reports whether the host of the listener is a loopback address
+func (l *Listener) hostLoopback() bool {
+	for _, addr := range l.hostAddresses() {
+		if isLoopback(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatches reports whether the host of the listener names the interface or is one of its addresses
+func (l *Listener) hostMatches(ifi pcap.Interface) bool {
+	for _, addr := range l.hostAddresses() {
+		if isDevice(addr, ifi) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
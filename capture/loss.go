@@ -0,0 +1,60 @@
+package capture
+
+import "sync"
+
+// lossCheck remembers the drops counted by the previous call of IsLossy
+type lossCheck struct {
+	sync.Mutex
+	last    uint64
+	sockets uint64 // dropped by the raw sockets, their kernel counters are reset once read
+}
+
+// IsLossy reports whether packets were dropped since the previous call, or since the capture started on the
+// first call, so "currently" is the interval between two calls, e.g the scrape interval of a dashboard.
+// the drops are the packets dropped by the kernel and the interfaces as reported by the pcap handles
+// and the raw sockets, and the packets dropped over MaxPPS or MaxBPS. it costs a system call per handle.
+// it must not be called from a PacketHandler, and the raw sockets statistics are reset by the call,
+// see SockRaw.Stats
+func (l *Listener) IsLossy() bool {
+	l.loss.Lock()
+	defer l.loss.Unlock()
+	drops := l.RateLimited()
+	l.Lock()
+	keys := make([]string, 0, len(l.Handles))
+	for key := range l.Handles {
+		keys = append(keys, key)
+	}
+	l.Unlock()
+	for _, key := range keys {
+		if stats := l.pcapStats(key); stats != nil {
+			drops += uint64(stats.PacketsDropped) + uint64(stats.PacketsIfDropped)
+		}
+		l.loss.sockets += l.socketDrops(key)
+	}
+	drops += l.loss.sockets
+	// the pcap counters start again when an interface is activated again
+	lossy := drops > l.loss.last
+	l.loss.last = drops
+	return lossy
+}
+
+// socketDrops returns the packets dropped by the raw socket of an interface since the previous call
+func (l *Listener) socketDrops(iface string) uint64 {
+	l.Lock()
+	handle, hl := l.Handles[iface], l.handleLocks[iface]
+	l.Unlock()
+	sock, ok := handle.(interface{ dropped() (uint64, error) })
+	if !ok || hl == nil {
+		return 0
+	}
+	hl.Lock()
+	defer hl.Unlock()
+	if hl.closed {
+		return 0
+	}
+	n, err := sock.dropped()
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,32 @@
+package capture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket/layers"
+)
+
+func TestIsLossy(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.MaxPPS, l.Overflow = 1, PolicyDropNewest
+	if l.IsLossy() {
+		t.Error("expected no loss before the capture")
+	}
+	for _, data := range rawPackets(1, 5, 10, 4) {
+		h.packets <- data
+	}
+	close(h.packets)
+	if err := l.Listen(context.Background(), func(*tcp.Packet) {}); err != nil {
+		t.Fatal(err)
+	}
+	if l.RateLimited() == 0 || !l.IsLossy() {
+		t.Fatalf("expected the packets over MaxPPS to be a loss, got %d dropped", l.RateLimited())
+	}
+	// the drops were already seen
+	if l.IsLossy() {
+		t.Error("expected no loss since the previous call")
+	}
+}
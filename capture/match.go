@@ -0,0 +1,88 @@
+package capture
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// matchExpire is how long a flow done with MatchOnce is remembered without packets, it is then matched again
+const matchExpire = 2 * time.Minute
+
+// MatchRules are the regular expressions of the payload prefilter, see PcapOptions.PayloadMatch
+type MatchRules = RedactRules
+
+// flowMatcher forwards the packets whose payload matches one of its rules. with once, a flow is done after
+// its first match: its next packets are dropped until the connection is closed by FIN or RST, or opened
+// again by a SYN, or is forgotten once idle. every segment is matched on its own
+type flowMatcher struct {
+	matched   uint64 // first field to be 64-bit aligned for atomic operations
+	flowTable        // of the flows done
+	rules     MatchRules
+	once      bool
+}
+
+func newFlowMatcher(rules MatchRules, once bool, limits *StateLimits) *flowMatcher {
+	m := &flowMatcher{rules: rules, once: once}
+	m.init(0, matchExpire)
+	m.limits = limits
+	return m
+}
+
+// allow reports whether a packet carrying payload is to be forwarded
+func (m *flowMatcher) allow(pckt *tcp.Packet) bool {
+	if !m.once {
+		return m.match(pckt.Payload)
+	}
+	now := pckt.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+	m.Lock()
+	_, done := m.lookup(pckt.Flow, now)
+	m.Unlock()
+	// the payload is matched without holding the lock of the other flows
+	if done || !m.match(pckt.Payload) {
+		return false
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, done = m.lookup(pckt.Flow, now); done {
+		return false // another packet of the flow matched meanwhile
+	}
+	m.store(pckt.Flow, struct{}{}, now)
+	atomic.AddUint64(&m.matched, 1)
+	return true
+}
+
+func (m *flowMatcher) match(payload []byte) bool {
+	for _, rule := range m.rules {
+		if rule.Match(payload) {
+			return true
+		}
+	}
+	return false
+}
+
+// track forgets the flows done once their connection is closed or opened again
+func (m *flowMatcher) track(sig closeSignal) {
+	m.Lock()
+	defer m.Unlock()
+	if sig.syn {
+		m.remove(sig.key)
+		return
+	}
+	m.closed(sig.key, dirIndex(sig.reversed), &tcp.Packet{FIN: sig.fin, RST: sig.rst})
+}
+
+// MatchedFlows returns the number of flows done with MatchOnce, a connection opened again on the same
+// addresses and ports is counted again. it is 0 without MatchOnce
+func (l *Listener) MatchedFlows() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	if l.matcher == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.matcher.matched)
+}
@@ -0,0 +1,63 @@
+package capture
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestFlowMatcher(t *testing.T) {
+	var rules MatchRules
+	if err := rules.Set(`HTTP/1\.1 5\d\d`); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	packet := func(srcPort uint16, payload string, at time.Duration) *tcp.Packet {
+		pckt := &tcp.Packet{Payload: []byte(payload), Timestamp: now.Add(at)}
+		pckt.Flow, pckt.Reversed = tcp.NewFlowKey(net.IP{10, 0, 0, 2}, 80, net.IP{10, 0, 0, 1}, srcPort)
+		return pckt
+	}
+	m := newFlowMatcher(rules, false, new(StateLimits))
+	for i, want := range []bool{false, true, true} {
+		payload := "HTTP/1.1 200 OK"
+		if want {
+			payload = "HTTP/1.1 503 Service Unavailable"
+		}
+		if ok := m.allow(packet(5535, payload, 0)); ok != want {
+			t.Errorf("packet %d: expected %v, got %v", i, want, ok)
+		}
+	}
+	if m.matched != 0 || m.Flows() != 0 {
+		t.Error("expected no flow to be tracked without once")
+	}
+
+	// only the first match of a flow is forwarded
+	m = newFlowMatcher(rules, true, new(StateLimits))
+	for i, want := range []bool{false, true, false, false} {
+		payload := "HTTP/1.1 200 OK"
+		if i != 0 {
+			payload = "HTTP/1.1 500 Internal Server Error"
+		}
+		if ok := m.allow(packet(5535, payload, 0)); ok != want {
+			t.Errorf("packet %d: expected %v, got %v", i, want, ok)
+		}
+	}
+	if !m.allow(packet(5536, "HTTP/1.1 500", 0)) {
+		t.Error("expected another flow to be matched on its own")
+	}
+	// a closed connection is matched again
+	first := packet(5535, "", 0)
+	m.track(closeSignal{key: first.Flow, rst: true})
+	if !m.allow(packet(5535, "HTTP/1.1 500", 0)) {
+		t.Error("expected the flow to be forgotten on RST")
+	}
+	// or an idle one
+	if !m.allow(packet(5535, "HTTP/1.1 500", 2*matchExpire)) {
+		t.Error("expected an idle flow to be forgotten")
+	}
+	if m.matched != 4 {
+		t.Errorf("expected 4 matched flows, got %d", m.matched)
+	}
+}
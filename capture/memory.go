@@ -0,0 +1,108 @@
+package capture
+
+import (
+	"sync/atomic"
+
+	"github.com/buger/goreplay/size"
+)
+
+// StateLimits bounds the memory held by the stateful features of a capture: the IP fragments being
+// reassembled, the connections tracked for their closes and QUIC connection IDs, and the flows of
+// the parsers given the limits, see flowTable.Limit. The limits are shared by all of them.
+// When a feature would go over a limit, it evicts its oldest state first, the fragments of the oldest
+// datagram or its least recently seen flow, and counts an eviction. A feature holding no state can still
+// add a single one, the other features then evict theirs. A nil *StateLimits has no limit
+type StateLimits struct {
+	bytes     int64 // first fields to be 64-bit aligned for atomic operations
+	flows     int64
+	evictions uint64
+	maxBytes  int64 // 0 means no limit
+	maxFlows  int64
+}
+
+// NewStateLimits returns limits of maxBytes bytes of buffered data and maxFlows flows, 0 means no limit
+func NewStateLimits(maxBytes size.Size, maxFlows int) *StateLimits {
+	s := new(StateLimits)
+	s.set(maxBytes, maxFlows)
+	return s
+}
+
+func (s *StateLimits) set(maxBytes size.Size, maxFlows int) {
+	atomic.StoreInt64(&s.maxBytes, int64(maxBytes))
+	atomic.StoreInt64(&s.maxFlows, int64(maxFlows))
+}
+
+// reserve accounts for flows and bytes of new state, it reports false without accounting for them
+// when that would go over a limit
+func (s *StateLimits) reserve(flows, bytes int64) bool {
+	if s == nil {
+		return true
+	}
+	f := atomic.AddInt64(&s.flows, flows)
+	b := atomic.AddInt64(&s.bytes, bytes)
+	maxFlows, maxBytes := atomic.LoadInt64(&s.maxFlows), atomic.LoadInt64(&s.maxBytes)
+	if maxFlows > 0 && flows > 0 && f > maxFlows || maxBytes > 0 && bytes > 0 && b > maxBytes {
+		s.release(flows, bytes)
+		return false
+	}
+	return true
+}
+
+// force accounts for new state regardless of the limits
+func (s *StateLimits) force(flows, bytes int64) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.flows, flows)
+	atomic.AddInt64(&s.bytes, bytes)
+}
+
+// release accounts for the state that was removed
+func (s *StateLimits) release(flows, bytes int64) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.flows, -flows)
+	atomic.AddInt64(&s.bytes, -bytes)
+}
+
+func (s *StateLimits) evicted() {
+	if s != nil {
+		atomic.AddUint64(&s.evictions, 1)
+	}
+}
+
+// Evictions returns the number of states evicted to stay within the limits
+func (s *StateLimits) Evictions() uint64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&s.evictions)
+}
+
+// Usage returns the bytes and flows currently held
+func (s *StateLimits) Usage() (bytes int64, flows int) {
+	if s == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&s.bytes), int(atomic.LoadInt64(&s.flows))
+}
+
+// StateLimits returns the limits set by MaxReassemblyBytes and MaxFlows, they can be shared with the parsers
+// handling the packets of the listener
+func (l *Listener) StateLimits() *StateLimits {
+	l.Lock()
+	defer l.Unlock()
+	if l.limits == nil {
+		l.limits = new(StateLimits)
+	}
+	l.limits.set(l.MaxReassemblyBytes, l.MaxFlows)
+	return l.limits
+}
+
+// Evicted returns the number of states evicted to stay within MaxReassemblyBytes and MaxFlows
+func (l *Listener) Evicted() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.limits.Evictions()
+}
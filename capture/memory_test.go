@@ -0,0 +1,67 @@
+package capture
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestStateLimitsDefragmenter(t *testing.T) {
+	limits := NewStateLimits(200, 0)
+	d := newDefragmenter(limits)
+	frags := fragments4(rawPackets(100, 1, 100, 4)[0], 48)
+	now := time.Now()
+	// the first fragment of a datagram holds 76 bytes with its headers, the third datagram evicts the first
+	for i := 0; i < 3; i++ {
+		frag := append([]byte{}, frags[0]...)
+		frag[4+5] = byte(i)
+		d.add(frag, 4, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if bytes, flows := limits.Usage(); d.pending() != 2 || limits.Evictions() != 1 || bytes != 152 || flows != 2 {
+		t.Errorf("expected 2 pending datagrams of 152 bytes and an eviction, got %d %d bytes %d evictions", d.pending(), bytes, limits.Evictions())
+	}
+	// the datagram of the last fragments goes over the limit, its oldest datagrams are evicted
+	for _, frag := range frags[1:] {
+		frag = append([]byte{}, frag...)
+		frag[4+5] = 2
+		d.add(frag, 4, now)
+	}
+	if bytes, flows := limits.Usage(); bytes > 200 || flows != d.pending() {
+		t.Errorf("expected at most 200 bytes for %d datagrams, got %d bytes for %d", d.pending(), bytes, flows)
+	}
+}
+
+func TestStateLimitsFlows(t *testing.T) {
+	limits := NewStateLimits(0, 3)
+	parser := NewWebSocketParser(time.Minute, 0, func(*WebSocketMessage) {})
+	parser.Limit(limits)
+	closes := newCloseTracker(func(tcp.FlowKey, tcp.CloseReason) {}, limits)
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		pckt := wsPacket(true, []byte("GET /chat HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+		pckt.SrcPort += uint16(i)
+		pckt.Timestamp = now.Add(time.Duration(i) * time.Second)
+		pckt.Flow, pckt.Reversed = tcp.NewFlowKey(pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort)
+		parser.PacketHandler(pckt)
+	}
+	if parser.Flows() != 3 || limits.Evictions() != 1 {
+		t.Errorf("expected 3 flows and an eviction, got %d flows %d evictions", parser.Flows(), limits.Evictions())
+	}
+	// the tracker shares the limits, the parser evicts its flows as the tracker adds its own
+	fin := wsPacket(true, nil)
+	fin.FIN = true
+	sig, _ := newCloseSignal(fin)
+	closes.track(sig)
+	if _, flows := limits.Usage(); flows != 4 || len(closes.flows) != 1 {
+		t.Errorf("expected the tracker to add a flow, got %d flows", flows)
+	}
+	pckt := wsPacket(true, []byte("GET /chat HTTP/1.1\r\nUpgrade: websocket\r\n\r\n"))
+	pckt.SrcPort = 1
+	pckt.Flow, pckt.Reversed = tcp.NewFlowKey(pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort)
+	parser.PacketHandler(pckt)
+	// the parser evicts its oldest flows until the new one fits
+	if _, flows := limits.Usage(); flows != 3 || parser.Flows() != 2 {
+		t.Errorf("expected the parser to evict its oldest flows, got %d flows, %d of the parser", flows, parser.Flows())
+	}
+}
@@ -0,0 +1,35 @@
+package capture
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// monotonicClock sets the Monotonic time of the packets, see MonotonicTime. the packets of a live capture
+// are timed when they are read, the ones of a pcap file by their timestamp relative to the first packet
+type monotonicClock struct {
+	fileStart int64 // unix nanoseconds of the first packet of the file, first field to be 64-bit aligned
+	start     time.Time
+	file      bool
+}
+
+func newMonotonicClock(file bool) *monotonicClock {
+	return &monotonicClock{start: time.Now(), file: file}
+}
+
+// read is called with every packet in the order they are read, the first one starts the clock of a file
+func (c *monotonicClock) read(ci *gopacket.CaptureInfo) {
+	if c.file && atomic.LoadInt64(&c.fileStart) == 0 {
+		atomic.CompareAndSwapInt64(&c.fileStart, 0, ci.Timestamp.UnixNano())
+	}
+}
+
+// now returns the monotonic time of a packet being parsed
+func (c *monotonicClock) now(ci *gopacket.CaptureInfo) time.Duration {
+	if c.file {
+		return time.Duration(ci.Timestamp.UnixNano() - atomic.LoadInt64(&c.fileStart))
+	}
+	return time.Since(c.start)
+}
@@ -0,0 +1,41 @@
+package capture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestMonotonicTime(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.MonotonicTime = true
+	for _, data := range rawPackets(1, 3, 10, 4) {
+		h.packets <- data
+	}
+	close(h.packets)
+	var times []time.Duration
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) { times = append(times, pckt.Monotonic) })
+	if len(times) != 3 || times[0] <= 0 || times[1] < times[0] || times[2] < times[1] {
+		t.Errorf("expected increasing monotonic times, got %v", times)
+	}
+}
+
+func TestMonotonicFileClock(t *testing.T) {
+	c := newMonotonicClock(true)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := gopacket.CaptureInfo{Timestamp: start.Add(time.Second)}
+	second := gopacket.CaptureInfo{Timestamp: start.Add(3 * time.Second)}
+	c.read(&first)
+	c.read(&second)
+	if now := c.now(&second); now != 2*time.Second {
+		t.Errorf("expected the time of a file to start at its first packet, got %v", now)
+	}
+	if now := c.now(&first); now != 0 {
+		t.Errorf("expected 0 for the first packet, got %v", now)
+	}
+}
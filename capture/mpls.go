@@ -0,0 +1,36 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MPLS ether types, https://tools.ietf.org/html/rfc5332
+const (
+	etherTypeMPLSUnicast   = 0x8847
+	etherTypeMPLSMulticast = 0x8848
+)
+
+// mplsHeader returns the length of the MPLS label stack, each label is 4 bytes long and the last one
+// has the bottom of stack bit set. the payload has no type, only IP packets are recognized
+func mplsHeader(data []byte) (int, error) {
+	n := 0
+	for {
+		if len(data) < n+4 {
+			return 0, errors.New("invalid MPLS label stack length")
+		}
+		bottom := binary.BigEndian.Uint32(data[n:])&0x100 != 0
+		n += 4
+		if bottom {
+			break
+		}
+	}
+	if len(data) == n {
+		return 0, errors.New("invalid MPLS payload length")
+	}
+	switch data[n] >> 4 {
+	case 4, 6:
+		return n, nil
+	}
+	return 0, errNotIP // e.g ethernet pseudowires
+}
@@ -0,0 +1,65 @@
+package capture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket/layers"
+)
+
+// mplsFrame returns an ethernet frame carrying ip under the given labels
+func mplsFrame(ip []byte, labels ...uint32) []byte {
+	frame := append(make([]byte, 12), 0x88, 0x47)
+	for i, label := range labels {
+		entry := label<<12 | 64 // TTL
+		if i == len(labels)-1 {
+			entry |= 0x100
+		}
+		frame = append(frame, byte(entry>>24), byte(entry>>16), byte(entry>>8), byte(entry))
+	}
+	return append(frame, ip...)
+}
+
+func TestMPLSHeaders(t *testing.T) {
+	ip := rawPackets(1, 1, 5, 4)[0][4:]
+	tests := []struct {
+		data   []byte
+		header int
+		err    error
+	}{
+		{mplsFrame(ip, 100), 18, nil},
+		{mplsFrame(ip, 100, 200), 22, nil},
+		{mplsFrame(make([]byte, 20), 100), 0, errNotIP}, // ethernet pseudowire control word
+	}
+	for i, tt := range tests {
+		header, _, err := linkHeaders(layers.LinkTypeEthernet, tt.data)
+		if header != tt.header || err != tt.err {
+			t.Errorf("#%d: expected a %d bytes header and %v, got %d %v", i, tt.header, tt.err, header, err)
+		}
+	}
+	// the bottom of stack is missing
+	frame := mplsFrame(ip, 100)
+	frame[16] &^= 0x01
+	if _, _, err := linkHeaders(layers.LinkTypeEthernet, frame[:30]); err == nil || err == errNotIP {
+		t.Errorf("expected an invalid label stack, got %v", err)
+	}
+}
+
+func TestListenMPLS(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeEthernet)
+	l := newFakeListener(h)
+	ip := rawPackets(1, 1, 5, 4)[0][4:]
+	h.packets <- mplsFrame(ip, 100)
+	h.packets <- mplsFrame(ip, 100, 200)
+	close(h.packets)
+	var packets []*tcp.Packet
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) { packets = append(packets, pckt) })
+	if len(packets) != 2 || l.ParseErrors() != 0 {
+		t.Fatalf("expected 2 packets, got %d and %d parse errors", len(packets), l.ParseErrors())
+	}
+	if packets[1].SrcPort != 5535 || len(packets[1].Payload) != 5 {
+		t.Errorf("wrong MPLS packet %+v", packets[1])
+	}
+}
@@ -0,0 +1,98 @@
+package capture
+
+import (
+	"net"
+	"sync"
+
+	"github.com/google/gopacket"
+)
+
+// interfaceMTU returns the current MTU of an interface, 0 when it is unknown
+var interfaceMTU = func(name string) int {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0
+	}
+	return ifi.MTU
+}
+
+// snaplenInfo is the snapshot length of the handle of an interface, and the MTU it was derived from
+type snaplenInfo struct {
+	snaplen int
+	mtu     int  // 0 when the snapshot length is not derived from the MTU
+	offload bool // GRO/GSO/TSO aggregate the packets beyond the MTU
+}
+
+// mtuChecks records the interfaces whose packets reaching the snapshot length were checked
+type mtuChecks struct {
+	sync.Mutex
+	checked map[string]bool
+}
+
+// setSnaplen records the snapshot length of the handle of an interface
+func (l *Listener) setSnaplen(name string, snaplen int) {
+	info := snaplenInfo{snaplen: snaplen}
+	if _, pinned := l.InterfaceSnaplen[name]; !pinned && !l.Snaplen {
+		if info.offload = interfaceOffloads(name); info.offload {
+			l.debug(DebugInfo, "Interface: %s. GRO/TSO offloads are enabled, the packets are captured up to %d bytes "+
+				"instead of the MTU\n", name, snaplen)
+		} else {
+			info.mtu = snaplen - 200
+		}
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.snaplens == nil {
+		l.snaplens = make(map[string]snaplenInfo)
+	}
+	l.snaplens[name] = info
+}
+
+// Snaplens returns the snapshot lengths of the pcap handles once they are activated, they can be pinned
+// with InterfaceSnaplen when the MTU of an interface changes after its handle was activated
+func (l *Listener) Snaplens() map[string]int {
+	l.Lock()
+	defer l.Unlock()
+	snaplens := make(map[string]int, len(l.snaplens))
+	for name, info := range l.snaplens {
+		snaplens[name] = info.snaplen
+	}
+	return snaplens
+}
+
+// checkSnaplen is called for the packets of an interface reaching its snapshot length, it warns when
+// its MTU grew since its handle was activated, when the offloads of the interface aggregated them beyond
+// its MTU, or when the packets are likely truncated while their length doesn't tell. only the first of them is checked
+func (l *Listener) checkSnaplen(key string, info snaplenInfo, ci *gopacket.CaptureInfo) {
+	if info.snaplen == 0 {
+		return
+	}
+	l.mtuChecks.Lock()
+	if l.mtuChecks.checked == nil {
+		l.mtuChecks.checked = make(map[string]bool)
+	}
+	checked := l.mtuChecks.checked[key]
+	l.mtuChecks.checked[key] = true
+	l.mtuChecks.Unlock()
+	if checked {
+		return
+	}
+	if mtu := interfaceMTU(key); info.mtu != 0 && mtu > info.mtu {
+		l.debug(DebugWarn, "Interface: %s. The MTU changed from %d to %d since the capture started, the snapshot length of %d bytes "+
+			"derived from it truncates the packets. Restart the capture or pin the snapshot length(--input-raw-snaplen-iface %s=%d)\n",
+			key, info.mtu, mtu, info.snaplen, key, mtu+200)
+		return
+	}
+	if info.offload || (info.mtu != 0 && ci.Length > info.mtu+200) {
+		l.debug(DebugWarn, "Interface: %s. Packets of %d bytes were aggregated beyond the MTU by GRO/TSO offloads, they are "+
+			"truncated to the snapshot length of %d bytes. Disable the offloads(ethtool -K %s gro off gso off tso off) "+
+			"or raise the snapshot length(--input-raw-snaplen-iface %s=%d)\n",
+			key, ci.Length, info.snaplen, key, key, maxSnaplen)
+		return
+	}
+	if ci.CaptureLength < ci.Length {
+		return // reported as truncated
+	}
+	l.debug(DebugWarn, "Interface: %s. Packets reach the snapshot length of %d bytes, they are likely truncated. "+
+		"Consider raising it(--input-raw-snaplen-iface %s=%d)\n", key, info.snaplen, key, info.snaplen*2)
+}
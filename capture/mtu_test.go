@@ -0,0 +1,77 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket/layers"
+)
+
+func TestStaleMTU(t *testing.T) {
+	defer func(f func(string) int) { interfaceMTU = f }(interfaceMTU)
+	interfaceMTU = func(string) int { return 9000 }
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	a, b := newFakeHandle(layers.LinkTypeLoop), newFakeHandle(layers.LinkTypeLoop)
+	a.lost = 100
+	l := newFakeListener(a, b)
+	l.InterfaceSnaplen = InterfaceSizes{"b": 128}
+	l.setSnaplen("a", 1700)
+	l.setSnaplen("b", 128)
+	if s := l.Snaplens(); s["a"] != 1700 || s["b"] != 128 {
+		t.Errorf("unexpected snapshot lengths %v", s)
+	}
+	a.packets <- rawPackets(1, 1, 1700-52, 4)[0]
+	// b reports the length of the packets it truncated
+	b.packets <- rawPackets(1, 1, 128-52, 4)[0]
+	close(a.packets)
+	close(b.packets)
+	_ = l.Listen(context.Background(), func(*tcp.Packet) {})
+	out := buf.String()
+	if !strings.Contains(out, "Interface: a. The MTU changed from 1500 to 9000") || !strings.Contains(out, "--input-raw-snaplen-iface a=9200") {
+		t.Errorf("expected a warning about the MTU of a, got %q", out)
+	}
+	if !strings.Contains(out, "Interface: b. Packets reach the snapshot length of 128 bytes") {
+		t.Errorf("expected a warning about the snapshot length of b, got %q", out)
+	}
+}
+
+func TestOffloadedPackets(t *testing.T) {
+	defer func(f func(string) int) { interfaceMTU = f }(interfaceMTU)
+	defer func(f func(string) bool) { interfaceOffloads = f }(interfaceOffloads)
+	interfaceMTU = func(string) int { return 1500 }
+	interfaceOffloads = func(name string) bool { return name == "b" }
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	a, b := newFakeHandle(layers.LinkTypeLoop), newFakeHandle(layers.LinkTypeLoop)
+	// a doesn't report its offloads, its aggregated packets are truncated
+	a.lost = 9000 - 1700
+	l := newFakeListener(a, b)
+	l.SetDebugLevel(DebugInfo)
+	l.setSnaplen("a", 1700)
+	l.setSnaplen("b", 64<<10+200)
+	a.packets <- rawPackets(1, 1, 1700-52, 4)[0]
+	b.packets <- rawPackets(1, 1, 9000-52, 4)[0]
+	close(a.packets)
+	close(b.packets)
+	_ = l.Listen(context.Background(), func(*tcp.Packet) {})
+	out := buf.String()
+	if !strings.Contains(out, "Interface: a. Packets of 9000 bytes were aggregated beyond the MTU") || !strings.Contains(out, "ethtool -K a gro off") {
+		t.Errorf("expected a warning about the offloads of a, got %q", out)
+	}
+	if !strings.Contains(out, "Interface: b. GRO/TSO offloads are enabled") || strings.Contains(out, "Interface: b. Packets") {
+		t.Errorf("expected the packets of b to be captured whole, got %q", out)
+	}
+	if n := l.Truncated(); n != 1 {
+		t.Errorf("expected 1 truncated packet, got %d", n)
+	}
+}
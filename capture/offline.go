@@ -0,0 +1,184 @@
+package capture
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+)
+
+// offlineBatch is the number of packets of a pcap file parsed at once by a worker
+const offlineBatch = 256
+
+type offlinePacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+	pckt *tcp.Packet
+	teid uint32
+	err  error
+}
+
+type offlineJob struct {
+	packets []offlinePacket
+	buf     []byte // data of the packets, they are sliced from it once the batch is full
+	ends    []int
+	parsed  chan struct{} // closed once every packet is parsed
+}
+
+// parallel reports whether the packets are parsed by ParseWorkers goroutines, only the packets of
+// pcap files are, and only when parsing a packet doesn't depend on the packets read before it.
+// a single CPU only adds the cost of the hand-offs. the SCTP packets are parsed into several chunks
+func (l *Listener) parallel() bool {
+	return l.Engine == EnginePcapFile && l.ParseWorkers > 1 && runtime.GOMAXPROCS(0) > 1 &&
+		l.Mode != ModeConnectionEvents && l.defrag == nil && l.closes == nil && l.health == nil && !l.stateCloses() && l.Transport != "sctp"
+}
+
+// readParallel reads the packets of a handle on the calling goroutine and parses them on ParseWorkers goroutines.
+// the packets are passed to the handler in the order they are read, or concurrently as soon as they are parsed
+// when Unordered is set. it returns why reading stopped once every packet read was passed to the handler
+func (l *Listener) readParallel(hndl gopacket.ZeroCopyPacketDataSource, hl *handleLock, meta PacketMeta, linkSize int, handler PacketHandlerWithMeta, state readState) (stop captureStop) {
+	jobs := make(chan *offlineJob, l.ParseWorkers)
+	var ordered chan *offlineJob
+	if !l.Unordered {
+		ordered = make(chan *offlineJob, 2*l.ParseWorkers)
+	}
+	var workers sync.WaitGroup
+	workers.Add(l.ParseWorkers)
+	for i := 0; i < l.ParseWorkers; i++ {
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				l.parseBatch(meta, linkSize, job)
+				if ordered == nil {
+					l.emitBatch(handler, meta, job)
+					continue
+				}
+				close(job.parsed)
+			}
+		}()
+	}
+	emitted := make(chan struct{})
+	if ordered == nil {
+		close(emitted)
+	} else {
+		go func() {
+			defer close(emitted)
+			for job := range ordered {
+				<-job.parsed
+				l.emitBatch(handler, meta, job)
+			}
+		}()
+	}
+
+	job := newOfflineJob()
+	flush := func() {
+		if len(job.packets) == 0 {
+			return
+		}
+		for i, start := 0, 0; i < len(job.packets); i++ {
+			job.packets[i].data, start = job.buf[start:job.ends[i]:job.ends[i]], job.ends[i]
+		}
+		if ordered != nil {
+			job.parsed = make(chan struct{})
+			ordered <- job
+		}
+		jobs <- job
+		job = newOfflineJob()
+	}
+	// the packets already read are parsed and handled before the handle is closed
+	defer func() {
+		flush()
+		close(jobs)
+		if ordered != nil {
+			close(ordered)
+		}
+		workers.Wait()
+		<-emitted
+	}()
+	stop.reason = StopClosed
+	for {
+		select {
+		case <-l.quit:
+			return
+		default:
+		}
+		data, ci, err := hndl.ZeroCopyReadPacketData()
+		if err != nil {
+			if temporaryReadError(err) {
+				continue
+			}
+			l.debug(DebugWarn, "stopped reading from %s interface with error %s\n", meta.Interface, err)
+			return l.readStopped(err)
+		}
+		hl.Lock()
+		if hl.closed {
+			hl.Unlock()
+			return
+		}
+		ok, end := l.admit(meta, state, data, &ci)
+		if end {
+			hl.Unlock()
+			stop.reason = StopEnd
+			return
+		}
+		if !ok {
+			hl.Unlock()
+			continue
+		}
+		// data is reused by the next read
+		job.buf = append(job.buf, data...)
+		job.ends = append(job.ends, len(job.buf))
+		job.packets = append(job.packets, offlinePacket{ci: ci})
+		hl.Unlock()
+		if len(job.packets) == offlineBatch {
+			flush()
+		}
+	}
+}
+
+func newOfflineJob() *offlineJob {
+	return &offlineJob{
+		packets: make([]offlinePacket, 0, offlineBatch),
+		ends:    make([]int, 0, offlineBatch),
+	}
+}
+
+func (l *Listener) parseBatch(meta PacketMeta, linkSize int, job *offlineJob) {
+	for i := range job.packets {
+		p := &job.packets[i]
+		data, ci, size, err := linkLayer(meta.LinkType, p.data, linkSize, &p.ci)
+		if err != nil {
+			p.err = err
+			continue
+		}
+		p.data = data
+		if !l.validChecksums(data, size) {
+			p.err = errBadChecksum
+			continue
+		}
+		if l.decapGTP() {
+			if size, p.teid, p.err = l.decapsulate(data, size, ci); p.err != nil {
+				continue
+			}
+		}
+		p.pckt, p.err = l.parse(data, int(meta.LinkType), size, ci)
+		if p.err == nil && l.clock != nil {
+			p.pckt.Monotonic = l.clock.now(ci)
+		}
+	}
+}
+
+func (l *Listener) emitBatch(handler PacketHandlerWithMeta, meta PacketMeta, job *offlineJob) {
+	for i := range job.packets {
+		p := &job.packets[i]
+		switch p.err {
+		case nil:
+			meta.CaptureInfo, meta.TEID = p.ci, p.teid
+			l.emit(handler, meta, p.pckt, len(p.data))
+		case errNotIP, errBadChecksum:
+		default:
+			l.parseFailedOrEmpty(meta.counters, p.data, &p.ci, p.err)
+		}
+	}
+}
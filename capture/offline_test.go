@@ -0,0 +1,86 @@
+package capture
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestParseWorkers(t *testing.T) {
+	const n = 3*offlineBatch + 7
+	name, err := writePcapFile(rawPackets(1, n, 5, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	// the packets are parsed on a single goroutine with a single CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	for _, unordered := range []bool{false, true} {
+		l, err := NewListener(name, []uint16{8000}, "", EnginePcapFile, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.ParseWorkers = 4
+		l.Unordered = unordered
+		if err = l.Activate(); err != nil {
+			t.Fatal(err)
+		}
+		var mu sync.Mutex
+		var seqs []uint32
+		_ = l.Listen(context.Background(), func(pckt *tcp.Packet) {
+			mu.Lock()
+			seqs = append(seqs, pckt.Seq)
+			mu.Unlock()
+		})
+		// every packet is handled before Listen returns
+		if len(seqs) != n {
+			t.Errorf("unordered %t: expected %d packets, got %d", unordered, n, len(seqs))
+			continue
+		}
+		for i := 0; i < n && !unordered; i++ {
+			if seqs[i] != uint32(i+1) {
+				t.Errorf("expected the packet %d to have the seq %d, got %d", i, i+1, seqs[i])
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkParseWorkers(b *testing.B) {
+	const n = 200000
+	name, err := writePcapFile(rawPackets(1, n, 512, 4), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(name)
+	for _, bench := range []struct {
+		name      string
+		workers   int
+		unordered bool
+	}{
+		{"serial", 0, false},
+		{"ordered", 4, false},
+		{"unordered", 4, true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(n * 512))
+			for i := 0; i < b.N; i++ {
+				l, err := NewListener(name, []uint16{8000}, "", EnginePcapFile, true)
+				if err != nil {
+					b.Fatal(err)
+				}
+				l.ParseWorkers = bench.workers
+				l.Unordered = bench.unordered
+				if err = l.Activate(); err != nil {
+					b.Fatal(err)
+				}
+				_ = l.Listen(context.Background(), func(pckt *tcp.Packet) {})
+			}
+			b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "packets/s")
+		})
+	}
+}
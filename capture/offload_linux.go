@@ -0,0 +1,50 @@
+package capture
+
+import (
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ethtool commands reading the receive and segmentation offloads, see linux/ethtool.h
+const (
+	ethtoolGTSO = 0x1e
+	ethtoolGGSO = 0x23
+	ethtoolGGRO = 0x2b
+)
+
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+type ifreqData struct {
+	name [unix.IFNAMSIZ]byte
+	data uintptr
+	_    [16]byte
+}
+
+// interfaceOffloads reports whether GRO, GSO or TSO is enabled on an interface, the packets seen by
+// the capture are then aggregated up to 64k, beyond the MTU of the interface
+var interfaceOffloads = func(name string) bool {
+	if len(name) >= unix.IFNAMSIZ {
+		return false
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(fd)
+	for _, cmd := range []uint32{ethtoolGGRO, ethtoolGGSO, ethtoolGTSO} {
+		value := &ethtoolValue{cmd: cmd}
+		ifr := &ifreqData{data: uintptr(unsafe.Pointer(value))}
+		copy(ifr.name[:], name)
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(ifr)))
+		runtime.KeepAlive(value)
+		if errno == 0 && value.data != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package capture
+
+// interfaceOffloads reports whether the packets seen by the capture are aggregated beyond the MTU,
+// it is only known on linux
+var interfaceOffloads = func(name string) bool {
+	return false
+}
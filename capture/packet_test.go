@@ -4,7 +4,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"testing"
-	"time"
+
+	"github.com/buger/goreplay/tcp"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -30,6 +31,37 @@ func generateHeader4(seq uint32, length uint16) []byte {
 	return hdr
 }
 
+// tcpSegment returns a loopback IPv4 TCP segment of the connection of wsPacket, sent by the client
+// or by the server, flags is the byte of the TCP flags
+func tcpSegment(fromClient bool, flags byte, payload []byte) []byte {
+	data := append(generateHeader4(1, uint16(len(payload))), payload...)
+	tcp := data[4+24:]
+	tcp[13] = flags
+	if !fromClient {
+		copy(tcp[:4], []byte{tcp[2], tcp[3], tcp[0], tcp[1]})
+	}
+	return data
+}
+
+// udpDatagram returns a loopback IPv4 UDP datagram from 127.0.0.1:5535 to 127.0.0.1:53
+func udpDatagram(payload []byte) []byte {
+	data := make([]byte, 4+20+8, 4+20+8+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(layers.ProtocolFamilyIPv4))
+
+	ip := data[4:]
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+8+len(payload)))
+	ip[9] = uint8(layers.IPProtocolUDP)
+	copy(ip[12:16], []byte{127, 0, 0, 1})
+	copy(ip[16:], []byte{127, 0, 0, 1})
+
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp, 5535)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	return append(data, payload...)
+}
+
 func generateHeader6(seq uint32, length uint16) []byte {
 	hdr := make([]byte, 4+40+32+24, 4+40+32+24)
 	binary.BigEndian.PutUint32(hdr, uint32(layers.ProtocolFamilyIPv6Linux))
@@ -58,8 +90,9 @@ func generateHeader6(seq uint32, length uint16) []byte {
 	return hdr
 }
 
-func Packets(start uint32, _len int, length uint16, version byte) []*Packet {
-	var packets = make([]*Packet, _len)
+// rawPackets returns the data of _len loopback packets with consecutive sequence numbers
+func rawPackets(start uint32, _len int, length uint16, version byte) [][]byte {
+	var packets = make([][]byte, _len)
 	for i := start; i < start+uint32(_len); i++ {
 		var h []byte
 		if version == 4 {
@@ -67,120 +100,165 @@ func Packets(start uint32, _len int, length uint16, version byte) []*Packet {
 		} else {
 			h = generateHeader6(i, length)
 		}
-		d := append(h, make([]byte, int(length))...)
-		ci := &gopacket.CaptureInfo{Length: len(d), CaptureLength: len(d), Timestamp: time.Now()}
-		packets[i-start] = NewPacket(d, int(layers.LinkTypeLoop), 4, ci)
+		packets[i-start] = append(h, make([]byte, int(length))...)
 	}
 	return packets
 }
 
+// fragments4 splits a loopback IPv4 packet of rawPackets into fragments carrying size bytes of its payload
+func fragments4(data []byte, size int) [][]byte {
+	hdr, payload := data[:4+24], data[4+24:]
+	var frags [][]byte
+	for off := 0; off < len(payload); off += size {
+		end := off + size
+		flags := uint16(0x2000)
+		if end >= len(payload) {
+			end, flags = len(payload), 0
+		}
+		frag := append(append([]byte{}, hdr...), payload[off:end]...)
+		ip := frag[4:]
+		binary.BigEndian.PutUint16(ip[2:4], uint16(24+end-off))
+		binary.BigEndian.PutUint16(ip[4:6], 0xbeef)
+		binary.BigEndian.PutUint16(ip[6:8], flags|uint16(off/8))
+		frags = append(frags, frag)
+	}
+	return frags
+}
+
+// fragments6 splits a loopback IPv6 packet of rawPackets into fragments carrying size bytes of its payload,
+// the fragment header follows its extension headers
+func fragments6(data []byte, size int) [][]byte {
+	hdr, payload := data[:4+40+32], data[4+40+32:]
+	var frags [][]byte
+	for off := 0; off < len(payload); off += size {
+		end := off + size
+		more := uint16(1)
+		if end >= len(payload) {
+			end, more = len(payload), 0
+		}
+		frag := append(append([]byte{}, hdr...), make([]byte, 8)...)
+		frag = append(frag, payload[off:end]...)
+		ip := frag[4:]
+		binary.BigEndian.PutUint16(ip[4:6], uint16(32+8+end-off))
+		ip[56] = ipv6FragmentHdr
+		fh := ip[72:]
+		fh[0] = uint8(layers.IPProtocolTCP)
+		binary.BigEndian.PutUint16(fh[2:4], uint16(off/8)<<3|more)
+		binary.BigEndian.PutUint32(fh[4:8], 0xbeef)
+		frags = append(frags, frag)
+	}
+	return frags
+}
+
 func TestIPv4Packet(t *testing.T) {
-	pckt := packet(append(generateHeader4(1024, 10), make([]byte, 10)...))
-	if pckt.Err != nil {
-		t.Error(pckt)
+	data := append(generateHeader4(1024, 10), make([]byte, 10)...)
+	if _, err := packet(data); err != nil {
+		t.Error(err)
 		return
 	}
-	if err := packet(pckt.Data[:2]).Err; !errors.Is(err, ErrHdrLength("Link")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrLength("Link"), err)
+	netLayer, transLayer := data[4:], data[4+24:]
+	if _, err := packet(data[:2]); !errors.Is(err, tcp.ErrHdrLength("Link")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrLength("Link"), err)
 		return
 	}
-	if err := packet(pckt.Data[:20]).Err; !errors.Is(err, ErrHdrLength("IPv4")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrLength("IPv4"), err)
+	if _, err := packet(data[:20]); !errors.Is(err, tcp.ErrHdrLength("IPv4")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrLength("IPv4"), err)
 		return
 	}
-	if err := packet(pckt.Data[:27]).Err; !errors.Is(err, ErrHdrLength("IPv4 opts")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrLength("IPv4 opts"), err)
+	if _, err := packet(data[:27]); !errors.Is(err, tcp.ErrHdrLength("IPv4 opts")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrLength("IPv4 opts"), err)
 		return
 	}
-	if err := packet(pckt.Data[:40]).Err; !errors.Is(err, ErrHdrLength("TCP")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrLength("TCP opts"), err)
+	if _, err := packet(data[:40]); !errors.Is(err, tcp.ErrHdrLength("TCP")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrLength("TCP"), err)
 		return
 	}
-	if err := packet(pckt.Data[:50]).Err; !errors.Is(err, ErrHdrLength("TCP opts")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrLength("TCP opts"), err)
+	if _, err := packet(data[:50]); !errors.Is(err, tcp.ErrHdrLength("TCP opts")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrLength("TCP opts"), err)
 		return
 	}
-	pckt.TransLayer[12] = 0x10
-	if err := packet(pckt.Data[:50]).Err; !errors.Is(err, ErrHdrInvalid("TCP's data offset")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrInvalid("TCP's data offset"), err)
+	transLayer[12] = 0x10
+	if _, err := packet(data[:50]); !errors.Is(err, tcp.ErrHdrInvalid("TCP's data offset")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrInvalid("TCP's data offset"), err)
 		return
 	}
-	pckt.TransLayer[12] = 0x60
-	if err := packet(pckt.Data[:28]).Err; !errors.Is(err, ErrHdrMissing("TCP")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrMissing("TCP"), err)
+	transLayer[12] = 0x60
+	if _, err := packet(data[:28]); !errors.Is(err, tcp.ErrHdrMissing("TCP")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrMissing("TCP"), err)
 		return
 	}
-	pckt.NetLayer[9] = 0x02
-	if err := packet(pckt.Data).Err; !errors.Is(err, ErrHdrExpected("TCP")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrExpected("TCP"), err)
+	netLayer[9] = 0x02
+	if _, err := packet(data); !errors.Is(err, tcp.ErrHdrExpected("TCP")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrExpected("TCP"), err)
 		return
 	}
-	pckt.NetLayer[9] = 0x06
-	pckt.NetLayer[0] = 0x44
-	if err := packet(pckt.Data).Err; !errors.Is(err, ErrHdrInvalid("IPv4's IHL")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrInvalid("IPv4's IHL"), err)
+	netLayer[9] = 0x06
+	netLayer[0] = 0x44
+	if _, err := packet(data); !errors.Is(err, tcp.ErrHdrInvalid("IPv4's IHL")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrInvalid("IPv4's IHL"), err)
 		return
 	}
-	pckt.NetLayer[0] = 0x56
-	if err := packet(pckt.Data).Err; !errors.Is(err, ErrHdrExpected("IPv4 or IPv6")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrExpected("IPv4 or IPv6"), err)
+	netLayer[0] = 0x56
+	if _, err := packet(data); !errors.Is(err, tcp.ErrHdrExpected("IPv4 or IPv6")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrExpected("IPv4 or IPv6"), err)
 		return
 	}
 }
 
 func TestIPv6Packet(t *testing.T) {
-	pckt := packet(append(generateHeader6(1024, 10), make([]byte, 10)...))
-	if pckt.Err != nil {
-		t.Error(pckt)
+	data := append(generateHeader6(1024, 10), make([]byte, 10)...)
+	if _, err := packet(data); err != nil {
+		t.Error(err)
 		return
 	}
-	if err := packet(pckt.Data[:4]).Err; !errors.Is(err, ErrHdrMissing("IPv4 or IPv6")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrMissing("IPv4 or IPv6"), err)
+	netLayer, transLayer := data[4:], data[4+40+32:]
+	if _, err := packet(data[:4]); !errors.Is(err, tcp.ErrHdrMissing("IPv4 or IPv6")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrMissing("IPv4 or IPv6"), err)
 		return
 	}
-	if err := packet(pckt.Data[:40]).Err; !errors.Is(err, ErrHdrLength("IPv6")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrLength("IPv6"), err)
+	if _, err := packet(data[:40]); !errors.Is(err, tcp.ErrHdrLength("IPv6")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrLength("IPv6"), err)
 		return
 	}
-	if err := packet(pckt.Data[:52]).Err; !errors.Is(err, ErrHdrLength("IPv6 opts")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrLength("IPv6 opts"), err)
+	if _, err := packet(data[:52]); !errors.Is(err, tcp.ErrHdrLength("IPv6 opts")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrLength("IPv6 opts"), err)
 		return
 	}
-	if err := packet(pckt.Data[:80]).Err; !errors.Is(err, ErrHdrLength("TCP")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrLength("TCP opts"), err)
+	if _, err := packet(data[:80]); !errors.Is(err, tcp.ErrHdrLength("TCP")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrLength("TCP"), err)
 		return
 	}
-	if err := packet(pckt.Data[:98]).Err; !errors.Is(err, ErrHdrLength("TCP opts")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrLength("TCP opts"), err)
+	if _, err := packet(data[:98]); !errors.Is(err, tcp.ErrHdrLength("TCP opts")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrLength("TCP opts"), err)
 		return
 	}
-	pckt.TransLayer[12] = 0x10
-	if err := packet(pckt.Data).Err; !errors.Is(err, ErrHdrInvalid("TCP's data offset")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrInvalid("TCP's data offset"), err)
+	transLayer[12] = 0x10
+	if _, err := packet(data); !errors.Is(err, tcp.ErrHdrInvalid("TCP's data offset")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrInvalid("TCP's data offset"), err)
 		return
 	}
-	pckt.TransLayer[12] = 0x60
-	if err := packet(pckt.Data[:76]).Err; !errors.Is(err, ErrHdrMissing("TCP")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrMissing("TCP"), err)
+	transLayer[12] = 0x60
+	if _, err := packet(data[:76]); !errors.Is(err, tcp.ErrHdrMissing("TCP")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrMissing("TCP"), err)
 		return
 	}
-	pckt.NetLayer[56] = 0x02
-	if err := packet(pckt.Data).Err; !errors.Is(err, ErrHdrExpected("TCP")) {
-		t.Errorf("should fail with %q, got %q", ErrHdrExpected("TCP"), err)
+	netLayer[56] = 0x02
+	if _, err := packet(data); !errors.Is(err, tcp.ErrHdrExpected("TCP")) {
+		t.Errorf("should fail with %q, got %q", tcp.ErrHdrExpected("TCP"), err)
 		return
 	}
-	pckt.NetLayer[56] = 0x06
+	netLayer[56] = 0x06
 }
 
-func packet(data []byte) *Packet {
-	return NewPacket(data, int(layers.LinkTypeLoop), 4, &gopacket.CaptureInfo{})
+func packet(data []byte) (*tcp.Packet, error) {
+	return tcp.ParsePacket(data, int(layers.LinkTypeLoop), 4, &gopacket.CaptureInfo{})
 }
 
 func BenchmarkNewPacketIPv4(b *testing.B) {
 	data := append(generateHeader4(1204, 10), make([]byte, 10)...)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if err := packet(data).Err; err != nil {
+		if _, err := packet(data); err != nil {
 			b.Error(err)
 		}
 	}
@@ -190,7 +268,7 @@ func BenchmarkNewPacketIPv6(b *testing.B) {
 	data := append(generateHeader6(1024, 10), make([]byte, 10)...)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if err := packet(data).Err; err != nil {
+		if _, err := packet(data); err != nil {
 			b.Error(err)
 		}
 	}
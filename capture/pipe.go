@@ -0,0 +1,173 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapngMagic is the block type of the section header starting a pcapng stream
+const pcapngMagic = 0x0A0D0D0A
+
+// offlineHandle is the handle of the pcap_file engine, a *pcap.Handle or a pcapStream
+type offlineHandle interface {
+	gopacket.ZeroCopyPacketDataSource
+	SetBPFFilter(string) error
+	SnapLen() int
+	Resolution() gopacket.TimestampResolution
+	LinkType() layers.LinkType
+	Close()
+}
+
+// pcapStream reads the packets of a pcap or pcapng stream with the pure Go readers, e.g the packets
+// written to a named pipe by a privileged capture. unlike libpcap, its reads can be interrupted by Close.
+// there is no kernel to filter the packets, they are filtered once read
+type pcapStream struct {
+	src      gopacket.ZeroCopyPacketDataSource // *pcapgo.Reader or *pcapgo.NgReader
+	closer   io.Closer
+	linkType layers.LinkType
+	snaplen  int
+	res      gopacket.TimestampResolution
+	bpf      atomic.Value // *pcap.BPF, set while the stream is read
+	closed   int32
+}
+
+// newPcapStream reads the header of the stream r, it blocks until the header is written.
+// closer is closed along with the stream, it may be nil
+func newPcapStream(r io.Reader, closer io.Closer) (*pcapStream, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	s := &pcapStream{closer: closer}
+	if binary.LittleEndian.Uint32(magic) == pcapngMagic {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+		s.src, s.linkType, s.res = ng, ng.LinkType(), ng.Resolution()
+		if ifi, err := ng.Interface(0); err == nil {
+			s.snaplen = int(ifi.SnapLength)
+		}
+	} else {
+		pr, err := pcapgo.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		s.src, s.linkType, s.res, s.snaplen = pr, pr.LinkType(), pr.Resolution(), int(pr.Snaplen())
+	}
+	if s.snaplen == 0 {
+		s.snaplen = dumpSnaplen
+	}
+	return s, nil
+}
+
+// waitPcapStream is newPcapStream whose wait for the header is interrupted by closing closer
+// once quit is closed
+func waitPcapStream(r io.Reader, closer io.Closer, quit <-chan struct{}) (*pcapStream, error) {
+	if closer == nil {
+		return newPcapStream(r, closer)
+	}
+	read := make(chan struct{})
+	defer close(read)
+	go func() {
+		select {
+		case <-quit:
+			closer.Close()
+		case <-read:
+		}
+	}()
+	return newPcapStream(r, closer)
+}
+
+// openPcapPipe opens a named pipe streaming a pcap or pcapng capture. the pipe is also opened
+// for writing, so that the stream doesn't end when the writer closes it: reading it only stops
+// once quit is closed, which also interrupts the wait for the header of the stream
+func openPcapPipe(name string, quit <-chan struct{}) (*pcapStream, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	s, err := waitPcapStream(f, f, quit)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %q", name, err)
+	}
+	return s, nil
+}
+
+// isNamedPipe reports whether the file name is a named pipe
+func isNamedPipe(name string) bool {
+	st, err := os.Stat(name)
+	return err == nil && st.Mode()&os.ModeNamedPipe != 0
+}
+
+func (s *pcapStream) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := s.src.ZeroCopyReadPacketData()
+		if err != nil && atomic.LoadInt32(&s.closed) == 1 {
+			return nil, ci, io.EOF
+		}
+		bpf, _ := s.bpf.Load().(*pcap.BPF)
+		if err != nil || bpf == nil || bpf.Matches(ci, data) {
+			return data, ci, err
+		}
+	}
+}
+
+// SetBPFFilter sets the filter applied to the packets once they are read
+func (s *pcapStream) SetBPFFilter(filter string) error {
+	bpf, err := pcap.NewBPF(s.linkType, s.snaplen, filter)
+	if err != nil {
+		return err
+	}
+	s.bpf.Store(bpf)
+	return nil
+}
+
+func (s *pcapStream) SnapLen() int {
+	return s.snaplen
+}
+
+func (s *pcapStream) Resolution() gopacket.TimestampResolution {
+	return s.res
+}
+
+func (s *pcapStream) LinkType() layers.LinkType {
+	return s.linkType
+}
+
+// Close closes the reader of the stream, interrupting a pending read
+func (s *pcapStream) Close() {
+	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) && s.closer != nil {
+		s.closer.Close()
+	}
+}
+
+// NewReaderListener returns a listener of the pcap_file engine reading a pcap or pcapng capture from r with the
+// pure Go readers, e.g a capture streamed over HTTP or held in memory. the link type is the one of the capture,
+// whose header is read by Activate. the capture is read until r returns io.EOF or the listener is closed,
+// r is closed along with the listener when it is an io.Closer, which also interrupts a pending read or
+// an Activate waiting for the header
+func NewReaderListener(r io.Reader, ports []uint16, transport string, trackResponse bool) (*Listener, error) {
+	l, err := NewListener("", ports, transport, EnginePcapFile, trackResponse)
+	if err != nil {
+		return nil, err
+	}
+	closer, _ := r.(io.Closer)
+	l.Activate = func() error {
+		return l.activateOffline(func() (offlineHandle, error) {
+			return waitPcapStream(r, closer, l.quit)
+		})
+	}
+	return l, nil
+}
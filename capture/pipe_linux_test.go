@@ -0,0 +1,82 @@
+package capture
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPcapPipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "capture.pcap")
+	if err = syscall.Mkfifo(name, 0600); err != nil {
+		t.Skip(err)
+	}
+	// the writer stops before the capture does
+	go func() {
+		f, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		streamPackets(f, rawPackets(1, 2, 10, 4))
+	}()
+	l, err := NewListener(name, []uint16{8000}, "", EnginePcapFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	seqs, errCh := readStream(t, l, 2)
+	if seqs[0] != 1 || seqs[1] != 2 {
+		t.Errorf("expected the packets of the pipe, got %v", seqs)
+	}
+	select {
+	case <-errCh:
+		t.Fatal("expected the listener to keep reading the pipe once the writer closed it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.Close()
+	<-errCh
+}
+
+func TestPcapPipeCloseBeforeHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "capture.pcap")
+	if err = syscall.Mkfifo(name, 0600); err != nil {
+		t.Skip(err)
+	}
+	l, err := NewListener(name, []uint16{8000}, "", EnginePcapFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing is ever written to the pipe
+	errCh := make(chan error, 1)
+	go func() { errCh <- l.Activate() }()
+	select {
+	case err = <-errCh:
+		t.Fatalf("expected Activate to wait for the header, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.Close()
+	select {
+	case err = <-errCh:
+		if err == nil {
+			t.Error("expected Activate to fail once the listener is closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected closing the listener to interrupt Activate")
+	}
+}
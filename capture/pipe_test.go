@@ -0,0 +1,195 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// streamPackets writes a pcap header and the packets to w
+func streamPackets(w io.Writer, packets [][]byte) error {
+	dw := NewWriterNanos(w)
+	if err := dw.WriteFileHeader(64<<10, layers.LinkTypeLoop); err != nil {
+		return err
+	}
+	for _, data := range packets {
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), Length: len(data), CaptureLength: len(data)}
+		if err := dw.WritePacket(ci, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readStream reads the packets of a listener until n are received, it fails if Listen returns before that
+func readStream(t *testing.T, l *Listener, n int) (seqs []uint32, errCh chan error) {
+	received := make(chan uint32, n)
+	errCh = l.ListenBackground(context.Background(), func(pckt *tcp.Packet) { received <- pckt.Seq })
+	for len(seqs) < n {
+		select {
+		case seq := <-received:
+			seqs = append(seqs, seq)
+		case <-errCh:
+			t.Fatalf("expected the listener to wait for the packets, got %v", seqs)
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d packets, got %v", n, seqs)
+		}
+	}
+	return
+}
+
+func TestPcapStream(t *testing.T) {
+	r, w := io.Pipe()
+	go streamPackets(w, rawPackets(1, 2, 10, 4))
+
+	s, err := newPcapStream(r, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LinkType() != layers.LinkTypeLoop || s.SnapLen() != 64<<10 {
+		t.Errorf("expected the link type and snaplen of the header, got %s %d", s.LinkType(), s.SnapLen())
+	}
+	if err = s.SetBPFFilter("tcp dst port 8000"); err != nil {
+		t.Fatal(err)
+	}
+	l := newFakeListener()
+	l.AddPacketSource("pipe", s, s.LinkType())
+	seqs, errCh := readStream(t, l, 2)
+	if seqs[0] != 1 || seqs[1] != 2 {
+		t.Errorf("expected the packets of the stream, got %v", seqs)
+	}
+	// the stream is still open
+	select {
+	case <-errCh:
+		t.Fatal("expected the listener to wait for more packets")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.Close()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("expected closing the listener to interrupt the read")
+	}
+}
+
+func TestReaderListenerPcapng(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := pcapgo.NewNgWriter(&buf, layers.LinkTypeLoop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range rawPackets(1, 2, 10, 4) {
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), Length: len(data), CaptureLength: len(data)}
+		if err = w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+	l, err := NewReaderListener(&buf, []uint16{8000}, "tcp", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	if l.LinkType("pcap_file") != 0 || l.EffectiveOptions()["pcap_file"].LinkType != layers.LinkTypeLoop {
+		t.Errorf("expected the link type of the capture, got %+v", l.EffectiveOptions())
+	}
+	var seqs []uint32
+	if err = l.Listen(context.Background(), func(pckt *tcp.Packet) { seqs = append(seqs, pckt.Seq) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 2 {
+		t.Errorf("expected the packets of the capture, got %v", seqs)
+	}
+	if l, err = NewReaderListener(&buf, nil, "dccp", false); err != nil || l.Transport != "tcp" {
+		t.Errorf("expected an unsupported transport to fall back to tcp, got %v", err)
+	}
+}
+
+// cookedPackets replaces the loopback header of the packets of rawPackets with a Linux cooked header
+func cookedPackets(packets [][]byte) [][]byte {
+	cooked := make([][]byte, len(packets))
+	for i, data := range packets {
+		// packet type, ARPHRD type, address length, address, protocol
+		hdr := []byte{0, 0, 0, 1, 0, 6, 2, 0, 0, 0, 0, 1, 0, 0, 0x08, 0x00}
+		cooked[i] = append(hdr, data[4:]...)
+	}
+	return cooked
+}
+
+func TestReaderListenerCooked(t *testing.T) {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(64<<10, layers.LinkTypeLinuxSLL); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range cookedPackets(rawPackets(1, 3, 10, 4)) {
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), Length: len(data), CaptureLength: len(data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := NewReaderListener(&buf, []uint16{8000}, "tcp", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	if lt := l.EffectiveOptions()["pcap_file"].LinkType; lt != layers.LinkTypeLinuxSLL {
+		t.Errorf("expected the link type of the capture, got %s", lt)
+	}
+	// the filter is compiled for the link type of the capture, not the one expected of an interface
+	if lt := l.expectedLinkType(pcap.Interface{Name: "pcap_file"}); lt != layers.LinkTypeLinuxSLL {
+		t.Errorf("expected the filter to be compiled for the link type of the capture, got %s", lt)
+	}
+	var seqs []uint32
+	err = l.Listen(context.Background(), func(pckt *tcp.Packet) {
+		if len(pckt.Payload) != 10 || pckt.DstPort != 8000 {
+			t.Errorf("expected a packet to port 8000 with 10 bytes of payload, got %d bytes to %d", len(pckt.Payload), pckt.DstPort)
+		}
+		seqs = append(seqs, pckt.Seq)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(seqs) != "[1 2 3]" {
+		t.Errorf("expected the packets of the capture, got %v", seqs)
+	}
+	if lt := l.LinkType("pcap_file"); lt != layers.LinkTypeLinuxSLL {
+		t.Errorf("expected the packets to be parsed as %s, got %s", layers.LinkTypeLinuxSLL, lt)
+	}
+}
+
+func TestReaderListenerNull(t *testing.T) {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(64<<10, layers.LinkTypeNull); err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewReaderListener(&buf, []uint16{8000}, "tcp", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lt := l.expectedLinkType(pcap.Interface{Name: "pcap_file"}); lt != layers.LinkTypeEthernet {
+		t.Errorf("expected ethernet before the capture is opened, got %s", lt)
+	}
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// the null link type is 0
+	if lt := l.expectedLinkType(pcap.Interface{Name: "pcap_file"}); lt != layers.LinkTypeNull {
+		t.Errorf("expected the filter to be compiled for the link type of the capture, got %s", lt)
+	}
+}
@@ -0,0 +1,157 @@
+package capture
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// OverflowPolicy tells what a backpressure point does with the packets it can't take right away.
+// two points use it: the rate limit of MaxPPS and MaxBPS, set by PcapOptions.Overflow, and the queues
+// of FlowDispatcher, set by its Policy. the other queues of the listener always block
+type OverflowPolicy uint8
+
+// Available overflow policies
+const (
+	// PolicyDefault is the policy of a point when none is chosen: the rate limit of MaxPPS and MaxBPS
+	// drops the flows (PolicyDropFlow), as it did before the policies could be chosen, since blocking
+	// it stalls the reading of every interface and the kernel then drops packets in the middle of the
+	// messages. FlowDispatcher blocks (PolicyBlock)
+	PolicyDefault OverflowPolicy = iota
+	// PolicyBlock waits until the packet can be taken, it stalls the reading of the interface and the
+	// packets are lost once the kernel buffer is full
+	PolicyBlock
+	// PolicyDropNewest drops the packet
+	PolicyDropNewest
+	// PolicyDropOldest drops the oldest packet queued to make room for the new one,
+	// the points without a queue drop the new packet
+	PolicyDropOldest
+	// PolicyDropFlow drops the packet along with the packets of its flow for the next second,
+	// so that its messages are dropped as a whole instead of being mangled
+	PolicyDropFlow
+
+	policyCount
+)
+
+var policyNames = [policyCount]string{"", "block", "drop-newest", "drop-oldest", "drop-flow"}
+
+// Set is here so that OverflowPolicy can implement flag.Var
+func (p *OverflowPolicy) Set(v string) error {
+	for i, name := range policyNames {
+		if v == name {
+			*p = OverflowPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid overflow policy %s", v)
+}
+
+func (p *OverflowPolicy) String() string {
+	if *p < policyCount {
+		return policyNames[*p]
+	}
+	return ""
+}
+
+// or returns def for PolicyDefault, the default policy of a point
+func (p OverflowPolicy) or(def OverflowPolicy) OverflowPolicy {
+	if p == PolicyDefault {
+		return def
+	}
+	return p
+}
+
+// overflows counts the packets a backpressure point couldn't take right away, by policy
+type overflows [policyCount]uint64
+
+func (o *overflows) add(p OverflowPolicy) {
+	atomic.AddUint64(&o[p], 1)
+}
+
+// collect adds the counters that fired to stats, labeled point/policy, e.g rate-limit/drop-flow
+func (o *overflows) collect(point string, stats map[string]uint64) {
+	for i := range o {
+		if n := atomic.LoadUint64(&o[i]); n != 0 {
+			stats[point+"/"+policyNames[i]] += n
+		}
+	}
+}
+
+// dropFlowFor is how long the packets of a flow keep being dropped after the first of its packets
+// was dropped with PolicyDropFlow
+const dropFlowFor = time.Second
+
+// droppedFlows holds the flows whose packets are being dropped with PolicyDropFlow. it is not safe
+// for concurrent use
+type droppedFlows struct {
+	flows     map[tcp.FlowKey]time.Time // flows being dropped, and when their drop started
+	lastEvict time.Time
+}
+
+// dropping reports whether the packets of the flow of pckt are being dropped
+func (d *droppedFlows) dropping(pckt *tcp.Packet) bool {
+	d.evict(pckt.Timestamp)
+	start, ok := d.flows[pckt.Flow]
+	if ok && pckt.Timestamp.Sub(start) >= dropFlowFor {
+		delete(d.flows, pckt.Flow)
+		return false
+	}
+	if ok && (pckt.FIN || pckt.RST) {
+		delete(d.flows, pckt.Flow)
+	}
+	return ok
+}
+
+// drop starts dropping the packets of the flow of pckt
+func (d *droppedFlows) drop(pckt *tcp.Packet) {
+	if pckt.FIN || pckt.RST {
+		return
+	}
+	if d.flows == nil {
+		d.flows = make(map[tcp.FlowKey]time.Time)
+	}
+	if _, ok := d.flows[pckt.Flow]; !ok {
+		d.flows[pckt.Flow] = pckt.Timestamp
+	}
+}
+
+func (d *droppedFlows) evict(now time.Time) {
+	if now.Sub(d.lastEvict) <= dropFlowFor {
+		return
+	}
+	d.lastEvict = now
+	for key, start := range d.flows {
+		if now.Sub(start) >= dropFlowFor {
+			delete(d.flows, key)
+		}
+	}
+}
+
+// Overflows returns the number of packets the backpressure points of the listener couldn't take
+// right away, labeled by point and policy, e.g rate-limit/block
+func (l *Listener) Overflows() map[string]uint64 {
+	stats := make(map[string]uint64)
+	l.Lock()
+	limiter := l.limiter
+	l.Unlock()
+	if limiter != nil {
+		limiter.overflows.collect("rate-limit", stats)
+	}
+	return stats
+}
+
+// Overflows returns the number of packets dispatched to a full queue, labeled by policy, e.g dispatch/block
+func (d *FlowDispatcher) Overflows() map[string]uint64 {
+	stats := make(map[string]uint64)
+	d.overflows.collect("dispatch", stats)
+	return stats
+}
+
+// flowDropper is a droppedFlows safe for concurrent use
+type flowDropper struct {
+	sync.Mutex
+	droppedFlows
+}
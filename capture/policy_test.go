@@ -0,0 +1,108 @@
+package capture
+
+import (
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestOverflowPolicyFlag(t *testing.T) {
+	var p OverflowPolicy
+	if err := p.Set("drop-oldest"); err != nil || p != PolicyDropOldest || p.String() != "drop-oldest" {
+		t.Errorf("expected drop-oldest, got %s %v", p.String(), err)
+	}
+	if err := p.Set(""); err != nil || p != PolicyDefault {
+		t.Errorf("expected the default policy, got %s %v", p.String(), err)
+	}
+	if err := p.Set("drop"); err == nil {
+		t.Error("expected an invalid policy to be rejected")
+	}
+}
+
+func TestRateLimiterPolicies(t *testing.T) {
+	var slept time.Duration
+	r := newRateLimiter(10, 0, PolicyBlock)
+	r.sleep = func(d time.Duration) {
+		slept += d
+		// the limiter is not locked while waiting
+		locked := make(chan struct{})
+		go func() {
+			r.Lock()
+			r.Unlock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(time.Second):
+			t.Fatal("expected the limiter to be unlocked while waiting")
+		}
+	}
+	for i := 0; i < 15; i++ {
+		if !r.allow(wsPacket(true, []byte("data"))) {
+			t.Fatal("expected PolicyBlock to allow every packet")
+		}
+	}
+	// the 5 packets over the burst wait for their tokens, a tenth of a second each
+	if slept < 100*time.Millisecond || r.dropped != 0 || r.overflows[PolicyBlock] != 5 {
+		t.Errorf("expected 5 packets to wait, got %d waiting for %v and %d dropped", r.overflows[PolicyBlock], slept, r.dropped)
+	}
+
+	// the rate limit drops the flows by default
+	if r = newRateLimiter(1, 0, PolicyDefault); r.policy != PolicyDropFlow {
+		t.Errorf("expected the default policy to be drop-flow, got %s", r.policy.String())
+	}
+
+	r = newRateLimiter(1, 0, PolicyDropNewest)
+	p := wsPacket(true, []byte("data"))
+	if !r.allow(p) || r.allow(p) {
+		t.Fatal("expected the packet over the limit to be dropped")
+	}
+	p.Timestamp = p.Timestamp.Add(time.Second)
+	if !r.allow(p) {
+		t.Error("expected PolicyDropNewest to only drop the packets over the limit")
+	}
+	if r.overflows[PolicyDropNewest] != 1 || r.dropped != 1 {
+		t.Errorf("expected 1 packet dropped, got %d", r.dropped)
+	}
+}
+
+func TestFlowDispatcherPolicies(t *testing.T) {
+	for _, policy := range []OverflowPolicy{PolicyDropNewest, PolicyDropOldest, PolicyDropFlow} {
+		release := make(chan struct{})
+		var seqs []uint32
+		d := NewFlowDispatcher(1, func(int) PacketHandler {
+			return func(pckt *tcp.Packet) {
+				<-release
+				seqs = append(seqs, pckt.Seq)
+			}
+		})
+		d.Policy = policy
+		start := time.Now()
+		// the first packet is taken by the worker, the next ones fill its queue
+		for i := 0; i < 1+1024+10; i++ {
+			p := wsPacket(true, []byte("data"))
+			p.Seq, p.Timestamp = uint32(i), start
+			d.PacketHandler(p)
+			if i == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		close(release)
+		d.Close()
+		stats := d.Overflows()
+		if n := stats["dispatch/"+policy.String()]; n != 10 || len(stats) != 1 {
+			t.Errorf("%s: expected 10 overflows, got %v", policy.String(), stats)
+		}
+		last := seqs[len(seqs)-1]
+		if len(seqs) != 1025 || (policy == PolicyDropOldest) != (last == 1034) {
+			t.Errorf("%s: unexpected packets handled, %d packets up to %d", policy.String(), len(seqs), last)
+		}
+		// the flow is dropped for a second
+		if policy == PolicyDropFlow {
+			if d.dropped(wsPacket(true, nil), false) != true {
+				t.Errorf("expected the flow to be dropped")
+			}
+		}
+	}
+}
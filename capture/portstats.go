@@ -0,0 +1,36 @@
+package capture
+
+import (
+	"sync/atomic"
+)
+
+// PortCounters are the packets and bytes captured for a destination port
+type PortCounters struct {
+	Packets uint64
+	Bytes   uint64 // captured bytes, including the headers
+}
+
+// portStats counts the captured traffic of every destination port without locking
+type portStats [1 << 16]PortCounters
+
+func (s *portStats) add(port uint16, length int) {
+	atomic.AddUint64(&s[port].Packets, 1)
+	atomic.AddUint64(&s[port].Bytes, uint64(length))
+}
+
+// PortStats returns the counters of the destination ports seen so far
+func (l *Listener) PortStats() map[uint16]PortCounters {
+	l.Lock()
+	defer l.Unlock()
+	stats := make(map[uint16]PortCounters)
+	if l.portStats == nil {
+		return stats
+	}
+	for port := range l.portStats {
+		c := &l.portStats[port]
+		if packets := atomic.LoadUint64(&c.Packets); packets != 0 {
+			stats[uint16(port)] = PortCounters{Packets: packets, Bytes: atomic.LoadUint64(&c.Bytes)}
+		}
+	}
+	return stats
+}
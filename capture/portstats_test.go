@@ -0,0 +1,63 @@
+package capture
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestPortStats(t *testing.T) {
+	l := &Listener{portStats: new(portStats)}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.portStats.add(443, 100)
+				l.portStats.add(80, 25)
+			}
+		}()
+	}
+	wg.Wait()
+	stats := l.PortStats()
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 ports, got %v", stats)
+	}
+	if stats[443] != (PortCounters{Packets: 400, Bytes: 40000}) || stats[80] != (PortCounters{Packets: 400, Bytes: 10000}) {
+		t.Errorf("wrong counters %v", stats)
+	}
+	if len(new(Listener).PortStats()) != 0 {
+		t.Error("expected no stats before reading")
+	}
+}
+
+func TestPortStatsCloseHandler(t *testing.T) {
+	// the FIN without payload is not counted, as it is not passed to the handler
+	fin := generateHeader4(4, 0)
+	fin[4+24+13] = 0x11
+	name, err := writePcapFile(append(rawPackets(1, 3, 5, 4), fin), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	for _, closes := range []bool{false, true} {
+		l, err := NewListener(name, []uint16{8000}, "", EnginePcapFile, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if closes {
+			l.CloseHandler = func(tcp.FlowKey, tcp.CloseReason) {}
+		}
+		if err = l.Activate(); err != nil {
+			t.Fatal(err)
+		}
+		_ = l.Listen(context.Background(), func(*tcp.Packet) {})
+		if stats := l.PortStats(); stats[8000].Packets != 3 {
+			t.Errorf("CloseHandler %t: expected 3 packets, got %v", closes, stats)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// PPP protocols of the IP packets
+const (
+	pppIPv4 = 0x0021
+	pppIPv6 = 0x0057
+)
+
+// pppHeader returns the length of the PPP header of a frame carrying an IP packet,
+// the address and control fields are optional, and so is the first byte of the protocol
+func pppHeader(data []byte) (int, error) {
+	n := 0
+	if len(data) >= 2 && data[0] == 0xFF && data[1] == 0x03 {
+		n = 2
+	}
+	if len(data) < n+1 {
+		return 0, errors.New("invalid PPP header length")
+	}
+	var proto uint16
+	if data[n]&0x01 != 0 { // compressed protocol field
+		proto = uint16(data[n])
+		n++
+	} else {
+		if len(data) < n+2 {
+			return 0, errors.New("invalid PPP header length")
+		}
+		proto = binary.BigEndian.Uint16(data[n:])
+		n += 2
+	}
+	if proto != pppIPv4 && proto != pppIPv6 {
+		return 0, errNotIP // e.g LCP and authentication frames
+	}
+	return n, nil
+}
+
+// pppoeHeader returns the length of the PPPoE session header, along with the PPP protocol following it
+func pppoeHeader(data []byte) (int, error) {
+	if len(data) < 8 {
+		return 0, errors.New("invalid PPPoE header length")
+	}
+	if data[0] != 0x11 || data[1] != 0x00 { // version 1, type 1, session data
+		return 0, errNotIP
+	}
+	n, err := pppHeader(data[6:])
+	if err != nil {
+		return 0, err
+	}
+	return 6 + n, nil
+}
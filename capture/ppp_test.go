@@ -0,0 +1,57 @@
+package capture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket/layers"
+)
+
+// pppoeFrame returns an ethernet frame carrying ip in a PPPoE session
+func pppoeFrame(ip []byte) []byte {
+	frame := append(make([]byte, 12), 0x88, 0x64)
+	frame = append(frame, 0x11, 0x00, 0x00, 0x01, byte((len(ip)+2)>>8), byte(len(ip)+2))
+	frame = append(frame, 0x00, 0x21)
+	return append(frame, ip...)
+}
+
+func TestPPPHeaders(t *testing.T) {
+	ip := rawPackets(1, 1, 5, 4)[0][4:]
+	tests := []struct {
+		linkType layers.LinkType
+		data     []byte
+		header   int
+		err      error
+	}{
+		{layers.LinkTypeEthernet, pppoeFrame(ip), 22, nil},
+		{layers.LinkTypePPPEthernet, pppoeFrame(ip)[14:], 8, nil},
+		{layers.LinkTypePPP_HDLC, append([]byte{0xFF, 0x03, 0x00, 0x21}, ip...), 4, nil},
+		{layers.LinkTypePPP, append([]byte{0x57}, ip...), 1, nil},                             // compressed protocol
+		{layers.LinkTypePPP_HDLC, append([]byte{0xFF, 0x03, 0xC0, 0x21}, ip...), 0, errNotIP}, // LCP
+	}
+	for i, tt := range tests {
+		header, _, err := linkHeaders(tt.linkType, tt.data)
+		if header != tt.header || err != tt.err {
+			t.Errorf("#%d: expected a %d bytes header and %v, got %d %v", i, tt.header, tt.err, header, err)
+		}
+	}
+}
+
+func TestListenPPPoE(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeEthernet)
+	l := newFakeListener(h)
+	ip := rawPackets(1, 1, 5, 4)[0][4:]
+	h.packets <- pppoeFrame(ip)
+	h.packets <- append(append(make([]byte, 12), 0x08, 0x00), ip...) // plain ethernet
+	close(h.packets)
+	var packets []*tcp.Packet
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) { packets = append(packets, pckt) })
+	if len(packets) != 2 || l.ParseErrors() != 0 {
+		t.Fatalf("expected 2 packets, got %d and %d parse errors", len(packets), l.ParseErrors())
+	}
+	if packets[0].SrcPort != packets[1].SrcPort || len(packets[0].Payload) != 5 {
+		t.Errorf("wrong PPPoE packet %+v", packets[0])
+	}
+}
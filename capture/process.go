@@ -0,0 +1,103 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// socketTuple is a TCP socket of a process, the remote address of the listening sockets is not set
+type socketTuple struct {
+	local, remote         net.IP
+	localPort, remotePort uint16
+	listen                bool
+}
+
+// processFilter returns the filter of the packets of the sockets, the listening sockets match the packets
+// of their port so that the connections they accept before the next refresh are captured.
+// no socket matches no packet
+func processFilter(sockets []socketTuple) string {
+	seen := make(map[string]bool, len(sockets))
+	clauses := make([]string, 0, len(sockets))
+	for _, s := range sockets {
+		var clause string
+		switch {
+		case s.listen && s.local.IsUnspecified():
+			clause = fmt.Sprintf("(tcp port %d)", s.localPort)
+		case s.listen:
+			clause = fmt.Sprintf("(host %s and tcp port %d)", s.local, s.localPort)
+		default:
+			clause = fmt.Sprintf("(host %s and tcp port %d and host %s and tcp port %d)", s.local, s.localPort, s.remote, s.remotePort)
+		}
+		if !seen[clause] {
+			seen[clause] = true
+			clauses = append(clauses, clause)
+		}
+	}
+	if len(clauses) == 0 {
+		return "less 0"
+	}
+	return strings.Join(clauses, " or ")
+}
+
+// loadProcessFilter resolves the sockets of ProcessID into the filter ANDed with the filter of every interface,
+// it reports whether the filter changed
+func (l *Listener) loadProcessFilter() (bool, error) {
+	if l.ProcessID == 0 {
+		l.processFilter.Store("")
+		return false, nil
+	}
+	sockets, err := processSockets(l.ProcessID)
+	if err != nil {
+		return false, fmt.Errorf("sockets of the process %d: %v", l.ProcessID, err)
+	}
+	filter := processFilter(sockets)
+	previous, _ := l.processFilter.Load().(string)
+	l.processFilter.Store(filter)
+	return filter != previous, nil
+}
+
+// withProcessFilter ANDs the filter of the sockets of ProcessID with a generated filter
+func (l *Listener) withProcessFilter(filter string) string {
+	extra, _ := l.processFilter.Load().(string)
+	switch {
+	case extra == "":
+		return filter
+	case filter == "":
+		return extra
+	}
+	return fmt.Sprintf("(%s) and (%s)", filter, extra)
+}
+
+// defaultProcessRefresh is the interval the sockets of ProcessID are resolved at when ProcessRefresh is not set
+const defaultProcessRefresh = time.Second
+
+// refreshProcessFilter resolves the sockets of ProcessID every ProcessRefresh, and sets the filters of the
+// handles when they changed. it stops once done is closed, or once the process is gone
+func (l *Listener) refreshProcessFilter(done chan struct{}) {
+	interval := l.ProcessRefresh
+	if interval <= 0 {
+		interval = defaultProcessRefresh
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		changed, err := l.loadProcessFilter()
+		if err != nil {
+			l.debug(DebugWarn, "%v, the filter is not refreshed anymore\n", err)
+			return
+		}
+		if !changed {
+			continue
+		}
+		if err = l.setFilters(); err != nil {
+			l.debug(DebugWarn, "%v\n", err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// nativeEndian is the byte order of the host
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// processSockets returns the TCP sockets of the process pid, the inodes of its file descriptors are
+// looked up in the TCP tables of its network namespace
+func processSockets(pid int) ([]socketTuple, error) {
+	proc := filepath.Join("/proc", strconv.Itoa(pid))
+	dir, err := os.Open(filepath.Join(proc, "fd"))
+	if err != nil {
+		return nil, err
+	}
+	fds, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+	inodes := make(map[uint64]bool, len(fds))
+	for _, fd := range fds {
+		link, err := os.Readlink(filepath.Join(proc, "fd", fd))
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue // closed since listed
+		}
+		if inode, err := strconv.ParseUint(link[len("socket:["):len(link)-1], 10, 64); err == nil {
+			inodes[inode] = true
+		}
+	}
+	var sockets []socketTuple
+	for _, table := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(filepath.Join(proc, "net", table))
+		if os.IsNotExist(err) {
+			continue // no IPv6
+		}
+		if err != nil {
+			return nil, err
+		}
+		s, err := parseProcNetTCP(f, inodes)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", table, err)
+		}
+		sockets = append(sockets, s...)
+	}
+	return sockets, nil
+}
+
+// tcpListen is the state of the listening sockets in /proc/net/tcp
+const tcpListen = "0A"
+
+// parseProcNetTCP parses the sockets of /proc/net/tcp or /proc/net/tcp6 whose inode is in inodes
+func parseProcNetTCP(r io.Reader, inodes map[uint64]bool) ([]socketTuple, error) {
+	var sockets []socketTuple
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil || !inodes[inode] {
+			continue
+		}
+		var s socketTuple
+		if s.local, s.localPort, err = parseProcAddr(fields[1]); err != nil {
+			return nil, err
+		}
+		if s.listen = fields[3] == tcpListen; !s.listen {
+			if s.remote, s.remotePort, err = parseProcAddr(fields[2]); err != nil {
+				return nil, err
+			}
+		}
+		sockets = append(sockets, s)
+	}
+	return sockets, scanner.Err()
+}
+
+// parseProcAddr parses an address of /proc/net/tcp, e.g 0100007F:1F90 is 127.0.0.1:8080.
+// the address is made of 32 bits words in the byte order of the host, see nativeEndian
+func parseProcAddr(s string) (net.IP, uint16, error) {
+	i := strings.IndexByte(s, ':')
+	if i == -1 {
+		return nil, 0, fmt.Errorf("invalid socket address %q", s)
+	}
+	addr, err := hex.DecodeString(s[:i])
+	if err != nil || (len(addr) != 4 && len(addr) != 16) {
+		return nil, 0, fmt.Errorf("invalid socket address %q", s)
+	}
+	port, err := strconv.ParseUint(s[i+1:], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid socket port %q", s)
+	}
+	ip := make(net.IP, len(addr))
+	for w := 0; w < len(addr); w += 4 {
+		binary.BigEndian.PutUint32(ip[w:], nativeEndian.Uint32(addr[w:]))
+	}
+	return ip, uint16(port), nil
+}
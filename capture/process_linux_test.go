@@ -0,0 +1,62 @@
+package capture
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 101 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000  1000        0 102 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:0CEA 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 103 1 0000000000000000 100 0 0 10 0
+`
+
+const procNetTCP6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0000000000000000FFFF00000100007F:0050 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 104 1 0000000000000000 100 0 0 10 0
+`
+
+func TestParseProcNetTCP(t *testing.T) {
+	if nativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("the sample tables are little endian")
+	}
+	sockets, err := parseProcNetTCP(strings.NewReader(procNetTCP), map[uint64]bool{101: true, 102: true})
+	if err != nil || len(sockets) != 2 {
+		t.Fatalf("expected 2 sockets of the process, got %v %v", sockets, err)
+	}
+	if !sockets[0].listen || !sockets[0].local.IsUnspecified() || sockets[0].localPort != 8080 {
+		t.Errorf("expected a listening socket on *:8080, got %+v", sockets[0])
+	}
+	conn := sockets[1]
+	if conn.listen || conn.local.String() != "127.0.0.1" || conn.remotePort != 54321 {
+		t.Errorf("expected a connection from 127.0.0.1:54321, got %+v", conn)
+	}
+	sockets6, err := parseProcNetTCP(strings.NewReader(procNetTCP6), map[uint64]bool{104: true})
+	if err != nil || len(sockets6) != 1 || sockets6[0].local.String() != "127.0.0.1" || sockets6[0].localPort != 80 {
+		t.Fatalf("expected the IPv4 mapped listening socket on port 80, got %v %v", sockets6, err)
+	}
+	want := "(tcp port 8080) or (host 127.0.0.1 and tcp port 8080 and host 127.0.0.1 and tcp port 54321) or (host 127.0.0.1 and tcp port 80)"
+	if filter := processFilter(append(sockets, sockets6...)); filter != want {
+		t.Errorf("unexpected filter\nwant: %s\ngot:  %s", want, filter)
+	}
+}
+
+func TestProcessSockets(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	sockets, err := processSockets(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	for _, s := range sockets {
+		if s.listen && s.localPort == port {
+			return
+		}
+	}
+	t.Errorf("expected the listening socket on port %d, got %+v", port, sockets)
+}
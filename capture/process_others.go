@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package capture
+
+import "fmt"
+
+// processSockets returns the TCP sockets of the process pid, they are only resolved on linux
+func processSockets(pid int) ([]socketTuple, error) {
+	return nil, fmt.Errorf("the sockets of a process can only be resolved on linux")
+}
@@ -0,0 +1,14 @@
+package capture
+
+import "testing"
+
+func TestProcessFilter(t *testing.T) {
+	if filter := processFilter(nil); filter != "less 0" {
+		t.Errorf("expected a process without sockets to match no packet, got %q", filter)
+	}
+	l := &Listener{}
+	l.processFilter.Store("tcp port 80")
+	if filter := l.withProcessFilter("tcp dst port 80"); filter != "(tcp dst port 80) and (tcp port 80)" {
+		t.Errorf("unexpected filter %q", filter)
+	}
+}
@@ -0,0 +1,113 @@
+package capture
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Progress of reading a pcap file. Bytes is estimated from the lengths of the packets read,
+// it is exact for the pcap format and approximate for pcapng. Total is 0 when the size
+// of the file is unknown, e.g for a pipe
+type Progress struct {
+	Bytes   int64
+	Total   int64
+	Packets uint64
+	Elapsed time.Duration // since the listener started reading the file
+}
+
+// Percent returns the percentage of the file read, it is 0 when the size of the file is unknown
+func (p Progress) Percent() float64 {
+	if p.Total <= 0 {
+		return 0
+	}
+	return 100 * float64(p.Bytes) / float64(p.Total)
+}
+
+// ETA estimates the time left to read the file at the average rate so far,
+// it is 0 when the size of the file is unknown or nothing was read yet
+func (p Progress) ETA() time.Duration {
+	if p.Total <= 0 || p.Bytes <= pcapFileHeaderLen || p.Elapsed <= 0 {
+		return 0
+	}
+	return time.Duration(float64(p.Elapsed) * float64(p.Total-p.Bytes) / float64(p.Bytes))
+}
+
+func (p Progress) String() string {
+	if p.Total <= 0 {
+		return fmt.Sprintf("%d bytes, %d packets read in %s", p.Bytes, p.Packets, p.Elapsed.Round(time.Second))
+	}
+	return fmt.Sprintf("%.1f%%, %d/%d bytes, %d packets read in %s, %s left", p.Percent(), p.Bytes, p.Total,
+		p.Packets, p.Elapsed.Round(time.Second), p.ETA().Round(time.Second))
+}
+
+// ProgressHandler is called every ProgressEvery while a pcap file is read, and once it is read
+type ProgressHandler func(Progress)
+
+// fileProgress counts the packets read from a pcap file
+type fileProgress struct {
+	bytes   int64 // first fields to be 64-bit aligned for atomic operations
+	packets uint64
+	started int64 // unix nanoseconds
+	total   int64
+}
+
+func newFileProgress(name string) *fileProgress {
+	p := &fileProgress{bytes: pcapFileHeaderLen}
+	if st, err := os.Stat(name); err == nil && st.Mode().IsRegular() {
+		p.total = st.Size()
+	}
+	return p
+}
+
+func (p *fileProgress) start() {
+	atomic.StoreInt64(&p.started, time.Now().UnixNano())
+}
+
+// add counts a packet read, along with its record header
+func (p *fileProgress) add(captureLength int) {
+	atomic.AddUint64(&p.packets, 1)
+	atomic.AddInt64(&p.bytes, int64(pcapRecordHeaderLen+captureLength))
+}
+
+func (p *fileProgress) get() Progress {
+	progress := Progress{
+		Bytes:   atomic.LoadInt64(&p.bytes),
+		Total:   p.total,
+		Packets: atomic.LoadUint64(&p.packets),
+	}
+	if started := atomic.LoadInt64(&p.started); started != 0 {
+		progress.Elapsed = time.Since(time.Unix(0, started))
+	}
+	if progress.Total > 0 && progress.Bytes > progress.Total {
+		progress.Bytes = progress.Total
+	}
+	return progress
+}
+
+// report calls handler every interval until done is closed, and a last time then
+func (p *fileProgress) report(interval time.Duration, handler ProgressHandler, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			handler(p.get())
+		case <-done:
+			handler(p.get())
+			return
+		}
+	}
+}
+
+// Progress returns the progress of reading the file of the pcap_file engine,
+// ok is false for the other engines which have no end
+func (l *Listener) Progress() (p Progress, ok bool) {
+	l.Lock()
+	defer l.Unlock()
+	if l.progress == nil {
+		return p, false
+	}
+	return l.progress.get(), true
+}
@@ -0,0 +1,54 @@
+package capture
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestProgress(t *testing.T) {
+	name, err := writePcapFile(rawPackets(1, 10, 5, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	st, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewListener(name, []uint16{8000}, "", EnginePcapFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.ProgressEvery = time.Hour
+	reports := make(chan Progress, 1)
+	l.ProgressHandler = func(p Progress) { reports <- p }
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Listen(context.Background(), func(*tcp.Packet) {})
+	p, ok := l.Progress()
+	if !ok || p.Total != st.Size() || p.Bytes != p.Total || p.Packets != 10 || p.Percent() != 100 || p.ETA() != 0 {
+		t.Errorf("expected the whole file to be read, got %+v %t", p, ok)
+	}
+	// the last report is made once the file is read
+	select {
+	case p = <-reports:
+		if p.Packets != 10 {
+			t.Errorf("expected a report of 10 packets, got %+v", p)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected a report once the file is read")
+	}
+
+	p = Progress{Bytes: 250, Total: 1000, Elapsed: time.Minute}
+	if p.Percent() != 25 || p.ETA() != 3*time.Minute {
+		t.Errorf("expected 25%% read with 3m left, got %v %s", p.Percent(), p.ETA())
+	}
+	if _, ok = (&Listener{}).Progress(); ok {
+		t.Error("expected no progress without a pcap file")
+	}
+}
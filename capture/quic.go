@@ -0,0 +1,169 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// QUIC header constants https://tools.ietf.org/html/rfc8999#section-5
+const (
+	quicLongHeader   = 0x80
+	quicFixedBit     = 0x40
+	quicVersion1     = 0x00000001
+	quicMaxConnIDLen = 20 // in QUIC version 1, other versions can use up to 255 bytes
+	quicExpire       = 2 * time.Minute
+)
+
+// QUICHeader holds the version independent fields of a QUIC packet header, nothing is decrypted
+type QUICHeader struct {
+	Long      bool
+	Version   uint32 // 0 for version negotiation packets, long headers only
+	DstConnID []byte // long headers only, the length of the connection ID of a short header is not part of it
+	SrcConnID []byte // long headers only
+}
+
+// ParseQUICHeader parses the header of the first QUIC packet of a datagram
+func ParseQUICHeader(data []byte) (hdr QUICHeader, err error) {
+	if len(data) < 1 {
+		return hdr, fmt.Errorf("quic: empty datagram")
+	}
+	if data[0]&quicLongHeader == 0 {
+		if data[0]&quicFixedBit == 0 {
+			return hdr, fmt.Errorf("quic: fixed bit is not set")
+		}
+		return hdr, nil
+	}
+	hdr.Long = true
+	if len(data) < 6 {
+		return hdr, fmt.Errorf("quic: short long header")
+	}
+	hdr.Version = binary.BigEndian.Uint32(data[1:5])
+	data = data[5:]
+	for _, id := range []*[]byte{&hdr.DstConnID, &hdr.SrcConnID} {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return hdr, fmt.Errorf("quic: short connection id")
+		}
+		if hdr.Version == quicVersion1 && int(data[0]) > quicMaxConnIDLen {
+			return hdr, fmt.Errorf("quic: connection id of %d bytes is too long", data[0])
+		}
+		*id = data[1 : 1+int(data[0])]
+		data = data[1+int(data[0]):]
+	}
+	return
+}
+
+// quicTracker sets the flow of the QUIC datagrams from their destination connection ID instead of their
+// addresses, so that a connection can be followed when it migrates to other addresses or ports.
+// the connection IDs are learnt from the long headers, the key of a connection is the destination
+// connection ID of the first Initial packet of its client.
+type quicTracker struct {
+	flowTable // connection ID, as flow key, to *quicConnID
+	ports     []uint16
+	lens      [256]bool // lengths of the tracked connection IDs
+}
+
+type quicConnID struct {
+	key    tcp.FlowKey
+	server bool // the connection ID was chosen by the server, the packets sent to it are from the client
+}
+
+func newQUICTracker(ports []uint16) *quicTracker {
+	t := &quicTracker{ports: ports}
+	t.init(0, quicExpire)
+	return t
+}
+
+// track sets the Flow of a QUIC datagram, Reversed is true for the datagrams sent by the server.
+// datagrams of unknown connections keep the flow of their addresses.
+func (t *quicTracker) track(pckt *tcp.Packet) {
+	if !t.port(pckt.SrcPort) && !t.port(pckt.DstPort) {
+		return
+	}
+	hdr, err := ParseQUICHeader(pckt.Payload)
+	if err != nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	var id *quicConnID
+	if hdr.Long {
+		id = t.longHeader(hdr, pckt.Timestamp)
+	} else {
+		id = t.shortHeader(pckt.Payload[1:], pckt.Timestamp)
+	}
+	if id != nil {
+		pckt.Flow, pckt.Reversed = id.key, !id.server
+	}
+}
+
+func (t *quicTracker) port(port uint16) bool {
+	for _, p := range t.ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// longHeader learns the connection IDs of a long header, it returns the destination connection ID
+func (t *quicTracker) longHeader(hdr QUICHeader, now time.Time) *quicConnID {
+	dst := t.connID(hdr.DstConnID, now)
+	src := t.connID(hdr.SrcConnID, now)
+	switch {
+	case dst == nil && src == nil:
+		// a version negotiation packet answers a packet we didn't see
+		if hdr.Version == 0 || len(hdr.DstConnID) == 0 {
+			return nil
+		}
+		// the client chooses the first destination connection ID for the server
+		dst = &quicConnID{key: tcp.NewQUICFlowKey(hdr.DstConnID), server: true}
+		t.add(hdr.DstConnID, dst, now)
+	case dst == nil:
+		// the destination connection ID belongs to the peer of the sender
+		dst = &quicConnID{key: src.key, server: !src.server}
+		t.add(hdr.DstConnID, dst, now)
+	}
+	if src == nil {
+		t.add(hdr.SrcConnID, &quicConnID{key: dst.key, server: !dst.server}, now)
+	}
+	if len(hdr.DstConnID) == 0 {
+		return nil
+	}
+	return dst
+}
+
+// shortHeader looks up the destination connection ID of a short header, data follows the first byte
+// of the header. the longest known connection ID that matches is used.
+func (t *quicTracker) shortHeader(data []byte, now time.Time) *quicConnID {
+	for n := len(t.lens) - 1; n > 0; n-- {
+		if !t.lens[n] || len(data) < n {
+			continue
+		}
+		if id := t.connID(data[:n], now); id != nil {
+			return id
+		}
+	}
+	return nil
+}
+
+func (t *quicTracker) connID(id []byte, now time.Time) *quicConnID {
+	if len(id) == 0 {
+		return nil
+	}
+	v, ok := t.lookup(tcp.NewQUICFlowKey(id), now)
+	if !ok {
+		return nil
+	}
+	return v.(*quicConnID)
+}
+
+func (t *quicTracker) add(id []byte, connID *quicConnID, now time.Time) {
+	if len(id) == 0 {
+		return
+	}
+	t.lens[len(id)] = true
+	t.store(tcp.NewQUICFlowKey(id), connID, now)
+}
@@ -0,0 +1,87 @@
+package capture
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func quicLong(version uint32, dcid, scid []byte) []byte {
+	data := []byte{quicLongHeader | quicFixedBit, byte(version >> 24), byte(version >> 16), byte(version >> 8), byte(version)}
+	data = append(data, byte(len(dcid)))
+	data = append(data, dcid...)
+	data = append(data, byte(len(scid)))
+	data = append(data, scid...)
+	return append(data, 0, 0, 0, 0) // token length, length and packet number
+}
+
+func quicShort(dcid []byte) []byte {
+	return append(append([]byte{quicFixedBit}, dcid...), 1, 2, 3, 4)
+}
+
+func quicPacket(fromClient bool, payload []byte) *tcp.Packet {
+	pckt := wsPacket(fromClient, payload)
+	pckt.Proto = tcp.ProtoUDP
+	return pckt
+}
+
+func TestParseQUICHeader(t *testing.T) {
+	dcid, scid := []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{9, 9, 9, 9}
+	hdr, err := ParseQUICHeader(quicLong(quicVersion1, dcid, scid))
+	if err != nil || !hdr.Long || hdr.Version != quicVersion1 || !bytes.Equal(hdr.DstConnID, dcid) || !bytes.Equal(hdr.SrcConnID, scid) {
+		t.Errorf("wrong long header %+v %v", hdr, err)
+	}
+	if hdr, err = ParseQUICHeader(quicLong(0, scid, dcid)[:5+1+4+1+8]); err != nil || hdr.Version != 0 {
+		t.Errorf("wrong version negotiation header %+v %v", hdr, err)
+	}
+	if hdr, err = ParseQUICHeader(quicShort(dcid)); err != nil || hdr.Long || hdr.DstConnID != nil {
+		t.Errorf("wrong short header %+v %v", hdr, err)
+	}
+	if _, err = ParseQUICHeader(quicLong(quicVersion1, make([]byte, 21), nil)); err == nil {
+		t.Error("expected an error for a too long connection id")
+	}
+	if _, err = ParseQUICHeader(quicLong(quicVersion1, dcid, scid)[:10]); err == nil {
+		t.Error("expected an error for a truncated header")
+	}
+	if _, err = ParseQUICHeader([]byte{0x01, 2, 3}); err == nil {
+		t.Error("expected an error for a datagram without the fixed bit")
+	}
+}
+
+func TestQUICTracker(t *testing.T) {
+	tracker := newQUICTracker([]uint16{8000})
+	original, client, server := []byte{1, 2, 3, 4, 5, 6, 7, 8}, []byte{7, 7, 7, 7}, []byte{5, 5, 5, 5, 5, 5, 5, 5}
+	want := tcp.NewQUICFlowKey(original)
+	check := func(name string, pckt *tcp.Packet, fromClient bool) {
+		t.Helper()
+		tracker.track(pckt)
+		if pckt.Flow != want || pckt.Reversed == fromClient {
+			t.Errorf("%s: expected flow %s, reversed %t, got %s, reversed %t", name, want, !fromClient, pckt.Flow, pckt.Reversed)
+		}
+	}
+	check("client Initial", quicPacket(true, quicLong(quicVersion1, original, client)), true)
+	check("version negotiation", quicPacket(false, quicLong(0, client, original)), false)
+	check("server Initial", quicPacket(false, quicLong(quicVersion1, client, server)), false)
+	check("server short header", quicPacket(false, quicShort(client)), false)
+
+	// the client migrated to another port
+	migrated := quicPacket(true, quicShort(server))
+	migrated.SrcPort = 6000
+	migrated.Flow, migrated.Reversed = tcp.NewFlowKey(migrated.SrcIP, migrated.SrcPort, migrated.DstIP, migrated.DstPort)
+	check("migrated client short header", migrated, true)
+
+	unknown := quicPacket(true, quicShort([]byte{3, 3, 3, 3, 3, 3, 3, 3}))
+	flow := unknown.Flow
+	tracker.track(unknown)
+	if unknown.Flow != flow {
+		t.Errorf("expected an unknown connection to keep its address flow, got %s", unknown.Flow)
+	}
+	other := quicPacket(true, quicLong(quicVersion1, []byte{4, 4, 4, 4}, nil))
+	other.DstPort = 9000
+	flow = other.Flow
+	tracker.track(other)
+	if other.Flow != flow || tracker.Flows() != 3 {
+		t.Errorf("expected the datagrams of other ports to be skipped, got %s with %d connection ids", other.Flow, tracker.Flows())
+	}
+}
@@ -0,0 +1,112 @@
+package capture
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// rateLimiter is a token bucket limiting the packets and payload bytes passed to the handler,
+// the burst is one second worth of tokens. packet timestamps are used as the clock, except with
+// PolicyBlock which paces the packets by the wall clock.
+type rateLimiter struct {
+	dropped uint64 // first field to be 64-bit aligned for atomic operations
+	sync.Mutex
+	pps, bps       float64 // 0 means no limit
+	packets, bytes float64 // available tokens
+	last           time.Time
+	policy         OverflowPolicy
+	dropping       droppedFlows
+	overflows      overflows
+	sleep          func(time.Duration)
+}
+
+func newRateLimiter(pps, bps int, policy OverflowPolicy) *rateLimiter {
+	return &rateLimiter{
+		pps:     float64(pps),
+		bps:     float64(bps),
+		packets: float64(pps),
+		bytes:   float64(bps),
+		policy:  policy.or(PolicyDropFlow),
+		sleep:   time.Sleep,
+	}
+}
+
+// allow reports whether pckt can be passed to the handler, with PolicyBlock it waits for the tokens
+// of pckt and always allows it
+func (r *rateLimiter) allow(pckt *tcp.Packet) bool {
+	r.Lock()
+	if r.policy == PolicyBlock {
+		delay := r.reserve(pckt)
+		r.Unlock()
+		if delay > 0 {
+			r.sleep(delay)
+		}
+		return true
+	}
+	defer r.Unlock()
+	r.refill(pckt.Timestamp)
+	size := float64(len(pckt.Payload))
+	dropping := r.policy == PolicyDropFlow && r.dropping.dropping(pckt)
+	switch {
+	case dropping:
+	case r.pps > 0 && r.packets < 1:
+	case r.bps > 0 && r.bytes < size && r.bytes < r.bps: // packets larger than the burst pass when the bucket is full
+	default:
+		r.packets--
+		r.bytes -= size
+		return true
+	}
+	if r.policy == PolicyDropFlow {
+		r.dropping.drop(pckt)
+	}
+	r.overflows.add(r.policy)
+	atomic.AddUint64(&r.dropped, 1)
+	return false
+}
+
+// reserve takes the tokens of pckt, and returns how long to wait for them to be refilled when there
+// are not enough of them
+func (r *rateLimiter) reserve(pckt *tcp.Packet) time.Duration {
+	r.refill(time.Now())
+	size := float64(len(pckt.Payload))
+	if r.bps > 0 && size > r.bps {
+		size = r.bps // packets larger than the burst wait for a full bucket
+	}
+	r.packets--
+	r.bytes -= size
+	var delay float64
+	if r.pps > 0 && r.packets < 0 {
+		delay = -r.packets / r.pps
+	}
+	if r.bps > 0 && r.bytes < 0 && -r.bytes/r.bps > delay {
+		delay = -r.bytes / r.bps
+	}
+	if delay <= 0 {
+		return 0
+	}
+	r.overflows.add(PolicyBlock)
+	return time.Duration(delay * float64(time.Second))
+}
+
+func (r *rateLimiter) refill(now time.Time) {
+	if r.last.IsZero() {
+		r.last = now
+	}
+	elapsed := now.Sub(r.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	r.last = now
+	r.packets = minFloat(r.packets+elapsed*r.pps, r.pps)
+	r.bytes = minFloat(r.bytes+elapsed*r.bps, r.bps)
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,98 @@
+package capture
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(10, 0, PolicyDropFlow)
+	start := time.Now()
+	packet := func(port uint16, at time.Duration) *tcp.Packet {
+		p := wsPacket(true, []byte("data"))
+		p.SrcPort = port
+		p.Flow, p.Reversed = tcp.NewFlowKey(p.SrcIP, p.SrcPort, p.DstIP, p.DstPort)
+		p.Timestamp = start.Add(at)
+		return p
+	}
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if r.allow(packet(uint16(1000+i), 0)) {
+			allowed++
+		}
+	}
+	if allowed != 10 || r.dropped != 10 {
+		t.Errorf("expected 10 packets out of 20 to be allowed, got %d", allowed)
+	}
+
+	// half a second later there are 5 tokens, but the dropped flows keep being dropped
+	if r.allow(packet(1019, 500*time.Millisecond)) {
+		t.Error("expected the rest of a dropped flow to be dropped")
+	}
+	if !r.allow(packet(1000, 500*time.Millisecond)) {
+		t.Error("expected an allowed flow to be allowed")
+	}
+	if !r.allow(packet(1019, 2*time.Second)) {
+		t.Error("expected a flow to be allowed again after being idle")
+	}
+}
+
+// TestRateLimiterSteadyFlow checks that a flow sending slightly above the limit is not dropped
+// for good once one of its packets was dropped
+func TestRateLimiterSteadyFlow(t *testing.T) {
+	r := newRateLimiter(1, 0, PolicyDropFlow)
+	start := time.Now()
+	allowed := 0
+	for i := 0; i < 60; i++ {
+		p := wsPacket(true, []byte("data"))
+		p.Timestamp = start.Add(time.Duration(i) * time.Second * 10 / 11)
+		if r.allow(p) {
+			allowed++
+		}
+	}
+	// every drop costs the flow a second, one packet out of 3 gets through
+	if allowed < 15 {
+		t.Errorf("expected the flow to be allowed again after every drop, got %d packets out of 60", allowed)
+	}
+}
+
+func TestRateLimiterBytes(t *testing.T) {
+	r := newRateLimiter(0, 10, PolicyDropFlow)
+	p := wsPacket(true, []byte("0123456789abcdef"))
+	if !r.allow(p) {
+		t.Error("expected a packet larger than the burst to be allowed when the bucket is full")
+	}
+	p = wsPacket(true, []byte("0123"))
+	p.Timestamp = p.Timestamp.Add(2 * time.Second)
+	if !r.allow(p) || !r.allow(p) || r.allow(p) {
+		t.Error("expected the bytes limit to be enforced")
+	}
+}
+
+func TestListenerRateLimitReset(t *testing.T) {
+	name, err := writePcapFile(rawPackets(1, 3, 5, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+	l, err := NewListener(name, []uint16{8000}, "", EnginePcapFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// limiter left by a previous run with MaxPPS set
+	l.limiter = newRateLimiter(1, 0, PolicyDropFlow)
+	l.limiter.dropped = 5
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	pckts := 0
+	_ = l.Listen(context.Background(), func(*tcp.Packet) { pckts++ })
+	if pckts != 3 || l.RateLimited() != 0 {
+		t.Errorf("expected no rate limit without MaxPPS and MaxBPS, got %d packets and %d dropped", pckts, l.RateLimited())
+	}
+}
@@ -0,0 +1,130 @@
+package capture
+
+import (
+	"encoding/binary"
+	"regexp"
+	"strings"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// RedactRules are the regular expressions of the payload bytes masked by a PayloadRedactor
+type RedactRules []*regexp.Regexp
+
+func (r *RedactRules) String() string {
+	patterns := make([]string, len(*r))
+	for i, rule := range *r {
+		patterns[i] = rule.String()
+	}
+	return strings.Join(patterns, ",")
+}
+
+// Set compiles a regular expression, it can be called several times
+func (r *RedactRules) Set(pattern string) error {
+	rule, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// redactMask replaces the redacted bytes
+const redactMask = '*'
+
+// PayloadRedactor masks the parts of the TCP and UDP payloads matching its rules, e.g the tokens
+// of the Authorization headers. the matches of a rule with groups only have their groups masked.
+// the bytes are replaced one for one, so that the lengths, e.g the Content-Length of a request, stay valid.
+// every segment is scrubbed on its own: a match spanning two segments is not masked
+type PayloadRedactor struct {
+	rules RedactRules
+}
+
+// NewPayloadRedactor returns a PayloadRedactor applying rules in order
+func NewPayloadRedactor(rules RedactRules) *PayloadRedactor {
+	return &PayloadRedactor{rules: rules}
+}
+
+// Redact masks the parts of payload matching the rules, it returns the range of the bytes masked
+func (r *PayloadRedactor) Redact(payload []byte) (start, end int) {
+	start = len(payload)
+	for _, rule := range r.rules {
+		for _, match := range rule.FindAllSubmatchIndex(payload, -1) {
+			if len(match) > 2 {
+				match = match[2:] // the groups
+			}
+			for i := 0; i < len(match); i += 2 {
+				from, to := match[i], match[i+1]
+				if from < 0 || from == to {
+					continue // a group that didn't participate in the match
+				}
+				for j := from; j < to; j++ {
+					payload[j] = redactMask
+				}
+				if from < start {
+					start = from
+				}
+				if to > end {
+					end = to
+				}
+			}
+		}
+	}
+	if end == 0 {
+		start = 0
+	}
+	return
+}
+
+// RedactPacket is the PacketTransform masking the payload of a parsed packet, the raw packet it was parsed
+// from, e.g the one written by the DumpHandler, is left as it is
+func (r *PayloadRedactor) RedactPacket(pckt *tcp.Packet) (*tcp.Packet, bool) {
+	r.Redact(pckt.Payload)
+	return pckt, true
+}
+
+// Transform is the IPTransform masking the payload of an IP packet, the TCP and UDP checksums are updated
+func (r *PayloadRedactor) Transform(ip []byte) error {
+	s, err := parseIPSegment(ip)
+	if err != nil {
+		return err
+	}
+	var offset int
+	switch {
+	case s.proto == tcp.ProtoTCP && len(s.transport) >= 13:
+		offset = int(s.transport[12]>>4) * 4
+	case s.proto == tcp.ProtoUDP:
+		offset = 8
+	default:
+		return nil
+	}
+	if offset > len(s.transport) {
+		return nil
+	}
+	payload := s.transport[offset:]
+	if n := s.length - offset; n >= 0 && n < len(payload) {
+		payload = payload[:n] // the padding of the frame
+	}
+	field := s.checksumField()
+	var orig []byte
+	if field != -1 {
+		orig = append(orig, payload...)
+	}
+	start, end := r.Redact(payload)
+	if start == end || field == -1 {
+		return nil
+	}
+	// an offloaded checksum doesn't cover the payload
+	checksum := binary.BigEndian.Uint16(s.transport[field:])
+	pseudo := sum(uint32(s.proto)+uint32(s.length), s.addrs)
+	if checksum == fold(pseudo) {
+		return nil
+	}
+	// the words are aligned on the start of the segment, the transport headers are made of whole words
+	start &^= 1
+	if end < len(payload) {
+		end += end & 1
+	}
+	binary.BigEndian.PutUint16(s.transport[field:], s.updateChecksum(checksum, orig[start:end], payload[start:end]))
+	return nil
+}
@@ -0,0 +1,73 @@
+package capture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestPayloadRedactor(t *testing.T) {
+	var rules RedactRules
+	if err := rules.Set(`Authorization: Bearer (\S+)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := rules.Set(`ssn=\d+`); err != nil {
+		t.Fatal(err)
+	}
+	if err := rules.Set(`(`); err == nil {
+		t.Error("expected an invalid expression to be rejected")
+	}
+	r := NewPayloadRedactor(rules)
+	payload := []byte("GET /?ssn=123 HTTP/1.1\r\nAuthorization: Bearer abc.def\r\n\r\n")
+	start, end := r.Redact(payload)
+	if want := "GET /?******* HTTP/1.1\r\nAuthorization: Bearer *******\r\n\r\n"; string(payload) != want {
+		t.Errorf("unexpected payload %q", payload)
+	}
+	if start != 6 || end != 53 {
+		t.Errorf("expected the bytes 6 to 53 to be masked, got %d to %d", start, end)
+	}
+	if start, end = r.Redact([]byte("GET / HTTP/1.1\r\n")); start != end {
+		t.Errorf("expected nothing to be masked, got %d to %d", start, end)
+	}
+}
+
+func TestRedactChecksums(t *testing.T) {
+	var rules RedactRules
+	_ = rules.Set(`secret`)
+	r := NewPayloadRedactor(rules)
+	v := &checksumValidator{}
+	// the match starts at an odd offset of the segment
+	pckt := rawPackets(1, 1, 11, 4)[0]
+	copy(pckt[len(pckt)-11:], "xxxxxsecret")
+	pckt = checksummed(pckt, [4]byte{192, 0, 2, 1}, [4]byte{10, 0, 0, 1})
+	if err := r.Transform(pckt[4:]); err != nil {
+		t.Fatal(err)
+	}
+	if string(pckt[len(pckt)-11:]) != "xxxxx******" || !v.valid(pckt[4:]) {
+		t.Errorf("expected the payload to be masked and its checksum updated, got %q", pckt[len(pckt)-11:])
+	}
+}
+
+func TestListenerRedact(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	_ = l.Redact.Set(`token=(\w+)`)
+	l.AnonymizeKey = "secret"
+	var dumped []byte
+	l.DumpHandler = func(_ string, data []byte, _ *gopacket.CaptureInfo, _ layers.LinkType) error {
+		dumped = append([]byte(nil), data...)
+		return nil
+	}
+	pckt := rawPackets(1, 1, 9, 4)[0]
+	copy(pckt[len(pckt)-9:], "token=abc")
+	h.packets <- pckt
+	close(h.packets)
+	var payload []byte
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) { payload = pckt.Payload })
+	if string(payload) != "token=***" || string(dumped[len(dumped)-9:]) != "token=***" {
+		t.Errorf("expected the token to be masked, got %q", payload)
+	}
+}
@@ -0,0 +1,280 @@
+package capture
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/size"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DumpHandler is called with every packet read before it is parsed, along with the name of the interface
+// it was read from. data is only valid during the call
+type DumpHandler func(iface string, data []byte, ci *gopacket.CaptureInfo, linkType layers.LinkType) error
+
+// dumpSnaplen is the snapshot length written in the header of the dump files
+const dumpSnaplen = 256 << 10
+
+// pcap file and record header lengths
+const (
+	pcapFileHeaderLen   = 24
+	pcapRecordHeaderLen = 16
+)
+
+// DumpRotation controls when a RotatingDump rolls over to a new file, and which old files it deletes.
+// the zero value writes a single file
+type DumpRotation struct {
+	MaxSize   size.Size     `json:"input-raw-dump-size"`      // roll over before the file exceeds this size, like tcpdump -C
+	MaxAge    time.Duration `json:"input-raw-dump-rotate"`    // roll over once the file is older than this, like tcpdump -G
+	MaxFiles  int           `json:"input-raw-dump-files"`     // number of files kept, like tcpdump -W
+	Retention time.Duration `json:"input-raw-dump-retention"` // files opened before this duration are deleted
+}
+
+// RotatingDump writes packets in PCAP files named after a prefix, the time the file was opened and its index,
+// e.g prefix-20200102T150405-0001.pcap. only the files written by the dump are ever deleted
+type RotatingDump struct {
+	sync.Mutex // packets of several handles can be dumped concurrently
+	DumpRotation
+	prefix   string
+	file     *os.File
+	buf      *bufio.Writer
+	w        *Writer
+	size     int64
+	opened   time.Time
+	linkType layers.LinkType
+	index    int
+	files    []dumpFile // files written, oldest first
+}
+
+type dumpFile struct {
+	name   string
+	opened time.Time
+}
+
+// NewRotatingDump returns a dump writing its files with the given prefix, no file is created before the first packet
+func NewRotatingDump(prefix string, rotation DumpRotation) *RotatingDump {
+	return &RotatingDump{
+		DumpRotation: rotation,
+		prefix:       strings.TrimSuffix(prefix, ".pcap"),
+	}
+}
+
+// Handler returns the DumpHandler to be set on a Listener, the packets of all the interfaces are written together
+func (d *RotatingDump) Handler() DumpHandler {
+	return func(_ string, data []byte, ci *gopacket.CaptureInfo, linkType layers.LinkType) error {
+		return d.WritePacket(*ci, data, linkType)
+	}
+}
+
+// WritePacket writes a packet, a new file is opened first when the packet doesn't fit in the current one.
+// packets are timed by their timestamp
+func (d *RotatingDump) WritePacket(ci gopacket.CaptureInfo, data []byte, linkType layers.LinkType) (err error) {
+	d.Lock()
+	defer d.Unlock()
+	now := ci.Timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if d.rollover(now, len(data), linkType) {
+		if err = d.rotate(now, linkType); err != nil {
+			return
+		}
+	}
+	if err = d.w.WritePacket(ci, data); err != nil {
+		return fmt.Errorf("dump %s: %v", d.file.Name(), err)
+	}
+	d.size += int64(pcapRecordHeaderLen + len(data))
+	return
+}
+
+// rollover reports whether a packet needs a new file
+func (d *RotatingDump) rollover(now time.Time, n int, linkType layers.LinkType) bool {
+	if d.file == nil || linkType != d.linkType { // a file only holds a single link type
+		return true
+	}
+	if d.MaxAge > 0 && now.Sub(d.opened) >= d.MaxAge {
+		return true
+	}
+	// a packet too big for an empty file is written anyway
+	return d.MaxSize > 0 && d.size > pcapFileHeaderLen && d.size+int64(pcapRecordHeaderLen+n) > int64(d.MaxSize)
+}
+
+func (d *RotatingDump) rotate(now time.Time, linkType layers.LinkType) (err error) {
+	if err = d.closeFile(); err != nil {
+		return
+	}
+	d.index++
+	name := fmt.Sprintf("%s-%s-%04d.pcap", d.prefix, now.UTC().Format("20060102T150405"), d.index)
+	if d.file, err = os.Create(name); err != nil {
+		return fmt.Errorf("dump: %v", err)
+	}
+	d.buf = bufio.NewWriter(d.file)
+	d.w = NewWriterNanos(d.buf)
+	if err = d.w.WriteFileHeader(dumpSnaplen, linkType); err != nil {
+		d.closeFile()
+		return fmt.Errorf("dump %s: %v", name, err)
+	}
+	d.size = pcapFileHeaderLen
+	d.opened = now
+	d.linkType = linkType
+	d.files = append(d.files, dumpFile{name, now})
+	d.retain(now)
+	return
+}
+
+// retain deletes the oldest files beyond MaxFiles or Retention, the current file is always kept
+func (d *RotatingDump) retain(now time.Time) {
+	for len(d.files) > 1 {
+		oldest := d.files[0]
+		if (d.MaxFiles < 1 || len(d.files) <= d.MaxFiles) && (d.Retention <= 0 || now.Sub(oldest.opened) < d.Retention) {
+			return
+		}
+		os.Remove(oldest.name)
+		d.files = d.files[1:]
+	}
+}
+
+func (d *RotatingDump) closeFile() (err error) {
+	if d.file == nil {
+		return
+	}
+	if err = d.flush(); err == nil {
+		err = d.file.Close()
+	} else {
+		d.file.Close()
+	}
+	d.file, d.buf, d.w = nil, nil, nil
+	if err != nil {
+		return fmt.Errorf("dump: %v", err)
+	}
+	return
+}
+
+// flush writes the buffered packets to the current file, and syncs it to the disk
+func (d *RotatingDump) flush() error {
+	if d.file == nil {
+		return nil
+	}
+	if err := d.buf.Flush(); err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+// Flush writes the buffered packets to the current file and syncs it, the file is a complete pcap file
+// until the next packet is written
+func (d *RotatingDump) Flush() error {
+	d.Lock()
+	defer d.Unlock()
+	if err := d.flush(); err != nil {
+		return fmt.Errorf("dump: %v", err)
+	}
+	return nil
+}
+
+// Files returns the names of the files written that were not deleted, oldest first
+func (d *RotatingDump) Files() []string {
+	d.Lock()
+	defer d.Unlock()
+	names := make([]string, len(d.files))
+	for i, f := range d.files {
+		names[i] = f.name
+	}
+	return names
+}
+
+// Close flushes and closes the current file, the next packet written opens a new file
+func (d *RotatingDump) Close() error {
+	d.Lock()
+	defer d.Unlock()
+	return d.closeFile()
+}
+
+// InterfaceDump writes the packets of every interface in its own RotatingDump, named after the prefix
+// and the interface, e.g prefix-eth0-20200102T150405-0001.pcap. each file has the link type of its interface
+type InterfaceDump struct {
+	sync.Mutex
+	prefix   string
+	rotation DumpRotation
+	dumps    map[string]*RotatingDump
+}
+
+// NewInterfaceDump returns a dump writing the files of every interface with the given prefix and rotation
+func NewInterfaceDump(prefix string, rotation DumpRotation) *InterfaceDump {
+	return &InterfaceDump{
+		prefix:   strings.TrimSuffix(prefix, ".pcap"),
+		rotation: rotation,
+		dumps:    make(map[string]*RotatingDump),
+	}
+}
+
+// Handler returns the DumpHandler to be set on a Listener
+func (d *InterfaceDump) Handler() DumpHandler {
+	return func(iface string, data []byte, ci *gopacket.CaptureInfo, linkType layers.LinkType) error {
+		return d.dump(iface).WritePacket(*ci, data, linkType)
+	}
+}
+
+func (d *InterfaceDump) dump(iface string) *RotatingDump {
+	d.Lock()
+	defer d.Unlock()
+	dump, ok := d.dumps[iface]
+	if !ok {
+		dump = NewRotatingDump(d.prefix+"-"+fileNameSafe(iface), d.rotation)
+		d.dumps[iface] = dump
+	}
+	return dump
+}
+
+// Files returns the names of the files written for every interface that were not deleted, oldest first
+func (d *InterfaceDump) Files() map[string][]string {
+	d.Lock()
+	defer d.Unlock()
+	files := make(map[string][]string, len(d.dumps))
+	for iface, dump := range d.dumps {
+		files[iface] = dump.Files()
+	}
+	return files
+}
+
+// Flush writes the buffered packets of every interface to their current file, and syncs it
+func (d *InterfaceDump) Flush() (err error) {
+	d.Lock()
+	defer d.Unlock()
+	for _, dump := range d.dumps {
+		if e := dump.Flush(); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Close flushes and closes the current file of every interface
+func (d *InterfaceDump) Close() (err error) {
+	d.Lock()
+	defer d.Unlock()
+	for _, dump := range d.dumps {
+		if e := dump.Close(); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// fileNameSafe replaces the characters of an interface name that can't be used in a file name,
+// e.g the ones of \Device\NPF_{GUID} on windows
+func fileNameSafe(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,202 @@
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// dumpRecords returns the number of packets of a dump file and its link type
+func dumpRecords(t *testing.T, name string) (n int, linkType layers.LinkType) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < pcapFileHeaderLen || binary.LittleEndian.Uint32(data) != magicNanoseconds {
+		t.Fatalf("%s: wrong file header", name)
+	}
+	linkType = layers.LinkType(binary.LittleEndian.Uint32(data[20:]))
+	for off := pcapFileHeaderLen; off < len(data); n++ {
+		off += pcapRecordHeaderLen + int(binary.LittleEndian.Uint32(data[off+8:]))
+	}
+	return
+}
+
+func TestRotatingDumpSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// every file holds 2 packets of 100 bytes
+	d := NewRotatingDump(filepath.Join(dir, "capture.pcap"), DumpRotation{MaxSize: pcapFileHeaderLen + 2*(pcapRecordHeaderLen+100), MaxFiles: 2})
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		ci := gopacket.CaptureInfo{Timestamp: now, CaptureLength: 100, Length: 100}
+		if err = d.WritePacket(ci, make([]byte, 100), layers.LinkTypeEthernet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := d.Files()
+	if len(files) != 2 || filepath.Ext(files[1]) != ".pcap" {
+		t.Fatalf("expected the 2 last files to be kept, got %v", files)
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 2 {
+		t.Errorf("expected the oldest file to be deleted, got %v", names)
+	}
+	if n, _ := dumpRecords(t, files[0]); n != 2 {
+		t.Errorf("expected 2 packets in %s, got %d", files[0], n)
+	}
+	if n, _ := dumpRecords(t, files[1]); n != 1 {
+		t.Errorf("expected the last packet in %s, got %d", files[1], n)
+	}
+}
+
+func TestRotatingDumpAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := NewRotatingDump(filepath.Join(dir, "capture"), DumpRotation{MaxAge: time.Minute, Retention: 2 * time.Minute})
+	start := time.Now()
+	write := func(at time.Duration, linkType layers.LinkType) {
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(at), CaptureLength: 10, Length: 10}
+		if err := d.WritePacket(ci, make([]byte, 10), linkType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(0, layers.LinkTypeEthernet)
+	write(30*time.Second, layers.LinkTypeEthernet)
+	write(time.Minute, layers.LinkTypeEthernet)         // rolls over
+	write(time.Minute+time.Second, layers.LinkTypeLoop) // a new link type needs a new file
+	if files := d.Files(); len(files) != 3 {
+		t.Fatalf("expected 3 files, got %v", files)
+	}
+	write(3*time.Minute, layers.LinkTypeLoop) // the files of the first 2 minutes are deleted
+	d.Close()
+	files := d.Files()
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files to be kept, got %v", files)
+	}
+	if n, linkType := dumpRecords(t, files[0]); n != 1 || linkType != layers.LinkTypeLoop {
+		t.Errorf("wrong file %s: %d packets of %s", files[0], n, linkType)
+	}
+}
+
+func TestListenerDumpHandler(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	var dumped int
+	l.DumpHandler = func(iface string, data []byte, ci *gopacket.CaptureInfo, linkType layers.LinkType) error {
+		if iface != "a" || linkType != layers.LinkTypeLoop || ci.CaptureLength != len(data) {
+			t.Errorf("wrong packet of %d bytes, %s", len(data), linkType)
+		}
+		dumped++
+		return nil
+	}
+	h.packets <- rawPackets(1, 1, 5, 4)[0]
+	h.packets <- rawPackets(1, 1, 5, 4)[0][:20] // packets that can't be parsed are dumped too
+	close(h.packets)
+	var handled int
+	_ = l.Listen(context.Background(), func(*tcp.Packet) { handled++ })
+	if dumped != 2 || handled != 1 {
+		t.Errorf("expected 2 packets dumped and 1 handled, got %d and %d", dumped, handled)
+	}
+}
+
+func TestInterfaceDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	eth, lo := newFakeHandle(layers.LinkTypeEthernet), newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(eth, lo)
+	d := NewInterfaceDump(filepath.Join(dir, "capture"), DumpRotation{})
+	l.DumpHandler = d.Handler()
+	for i := 0; i < 3; i++ {
+		eth.packets <- make([]byte, 60)
+	}
+	lo.packets <- rawPackets(1, 1, 5, 4)[0]
+	close(eth.packets)
+	close(lo.packets)
+	_ = l.Listen(context.Background(), func(*tcp.Packet) {})
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := d.Files()
+	if len(files) != 2 || len(files["a"]) != 1 || len(files["b"]) != 1 {
+		t.Fatalf("expected a file per interface, got %v", files)
+	}
+	if n, linkType := dumpRecords(t, files["a"][0]); n != 3 || linkType != layers.LinkTypeEthernet {
+		t.Errorf("wrong file %s: %d packets of %s", files["a"][0], n, linkType)
+	}
+	if n, linkType := dumpRecords(t, files["b"][0]); n != 1 || linkType != layers.LinkTypeLoop {
+		t.Errorf("wrong file %s: %d packets of %s", files["b"][0], n, linkType)
+	}
+	if name := filepath.Base(files["b"][0]); name[:len("capture-b-")] != "capture-b-" {
+		t.Errorf("expected the file to be named after the interface, got %s", name)
+	}
+}
+
+func TestFileNameSafe(t *testing.T) {
+	if name := fileNameSafe(`\Device\NPF_{1B2C}`); name != "_Device_NPF__1B2C_" {
+		t.Errorf("wrong file name %s", name)
+	}
+}
+
+func TestDumpFlushedOnCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	dump := NewRotatingDump(filepath.Join(dir, "capture"), DumpRotation{})
+	l.DumpHandler, l.DumpCloser = dump.Handler(), dump
+	handled := make(chan struct{}, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := l.ListenBackground(ctx, func(*tcp.Packet) { handled <- struct{}{} })
+	for _, data := range rawPackets(1, 3, 10, 4) {
+		h.packets <- data
+		<-handled
+	}
+	// the handle is still open, as when the capture is interrupted
+	cancel()
+	<-errCh
+	files := dump.Files()
+	if len(files) != 1 {
+		t.Fatalf("expected a single dump file, got %v", files)
+	}
+	handle, err := pcap.OpenOffline(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	n := 0
+	for {
+		if _, _, err = handle.ReadPacketData(); err != nil {
+			break
+		}
+		n++
+	}
+	if err != io.EOF || n != 3 {
+		t.Errorf("expected the 3 packets to be read, got %d, %v", n, err)
+	}
+}
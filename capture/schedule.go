@@ -0,0 +1,35 @@
+package capture
+
+import "runtime"
+
+// readScheduler makes the read loop of a handle yield the CPU after reading ReadBatch packets in a row,
+// so that a busy interface doesn't keep the goroutines of the other interfaces from being scheduled
+type readScheduler struct {
+	batch int // 0 never yields
+	read  int // packets read since the last yield
+}
+
+// next is called after every packet read
+func (s *readScheduler) next() {
+	if s.batch < 1 {
+		return
+	}
+	if s.read++; s.read >= s.batch {
+		s.read = 0
+		runtime.Gosched()
+	}
+}
+
+// schedule pins the read goroutine of an interface to a CPU when PinReaders is set, index is the one of the interface
+func (l *Listener) schedule(key string, index int) readScheduler {
+	if l.PinReaders {
+		cpu, err := pinReader(index)
+		switch {
+		case err != nil:
+			l.debug(DebugWarn, "Interface: %s. Can't pin the read goroutine to a CPU: %v\n", key, err)
+		case cpu >= 0:
+			l.debug(DebugInfo, "Interface: %s. Read goroutine pinned to the CPU %d\n", key, cpu)
+		}
+	}
+	return readScheduler{batch: l.ReadBatch}
+}
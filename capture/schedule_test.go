@@ -0,0 +1,96 @@
+package capture
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestScheduledReaders(t *testing.T) {
+	a, b := newFakeHandle(layers.LinkTypeLoop), newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(a, b)
+	l.PinReaders = true
+	l.ReadBatch = 2
+	for _, data := range rawPackets(1, 5, 10, 4) {
+		a.packets <- data
+		b.packets <- data
+	}
+	close(a.packets)
+	close(b.packets)
+	var n int64
+	_ = l.Listen(context.Background(), func(*tcp.Packet) { atomic.AddInt64(&n, 1) })
+	if n != 10 {
+		t.Errorf("expected 10 packets, got %d", n)
+	}
+
+	cpus := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			cpu, err := pinReader(i)
+			if err != nil {
+				t.Error(err)
+			}
+			cpus <- cpu
+		}(i)
+	}
+	for i := 0; i < 2; i++ {
+		if cpu := <-cpus; runtime.GOOS == "linux" && (cpu < 0 || cpu >= runtime.NumCPU()) {
+			t.Errorf("expected the reader to be pinned to one of the %d CPUs, got %d", runtime.NumCPU(), cpu)
+		}
+	}
+}
+
+// BenchmarkReadScheduling reads a busy interface along with quiet ones, the packets sent while the
+// buffer of a handle is full are dropped like the kernel does, drops/op tells the share of them
+func BenchmarkReadScheduling(b *testing.B) {
+	for _, bb := range []struct {
+		name  string
+		pin   bool
+		batch int
+	}{{"default", false, 0}, {"batch", false, 64}, {"pinned", true, 64}} {
+		b.Run(bb.name, func(b *testing.B) {
+			handles := make([]*fakeHandle, 8)
+			for i := range handles {
+				handles[i] = newFakeHandle(layers.LinkTypeLoop)
+				handles[i].packets = make(chan []byte, 64)
+			}
+			l := newFakeListener(handles...)
+			l.PinReaders, l.ReadBatch = bb.pin, bb.batch
+			l.SetDebugLevel(DebugSilent)
+			data := rawPackets(1, 1, 512, 4)[0]
+			var dropped uint64
+			errCh := l.ListenBackground(context.Background(), func(*tcp.Packet) {})
+			<-l.Ready()
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for i, h := range handles {
+				n := b.N
+				if i != 0 {
+					n = b.N / 8 // quiet interfaces
+				}
+				wg.Add(1)
+				go func(h *fakeHandle, n int) {
+					defer wg.Done()
+					for j := 0; j < n; j++ {
+						select {
+						case h.packets <- data:
+						default:
+							atomic.AddUint64(&dropped, 1)
+						}
+						runtime.Gosched() // the packets arrive over time
+					}
+					close(h.packets)
+				}(h, n)
+			}
+			wg.Wait()
+			<-errCh
+			b.ReportMetric(float64(dropped)/float64(b.N+7*(b.N/8)), "drops/op")
+		})
+	}
+}
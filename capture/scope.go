@@ -0,0 +1,53 @@
+package capture
+
+import (
+	"net"
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// the networks of the multicast groups, see groupAddresses
+var multicastNets = []string{"224.0.0.0/4", "ff00::/8"}
+
+// interfaceAddresses returns the unicast addresses of an interface. the IPv6 link-local addresses are left out
+// unless LinkLocal is set or the interface has no other address: every IPv6 interface has one, it only
+// carries the neighbor discovery and the traffic between the hosts of the link, and a filter can't tell
+// the link it was meant for. the multicast groups an interface joined aren't its addresses, see Multicast
+func (l *Listener) interfaceAddresses(ifi pcap.Interface) []string {
+	var hosts, linkLocal []string
+	for _, addr := range ifi.Addresses {
+		switch {
+		case addr.IP == nil || addr.IP.IsUnspecified() || addr.IP.IsMulticast():
+		case addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast():
+			linkLocal = append(linkLocal, addr.IP.String())
+		default:
+			hosts = append(hosts, addr.IP.String())
+		}
+	}
+	if l.LinkLocal || len(hosts) == 0 {
+		hosts = append(hosts, linkLocal...)
+	}
+	return hosts
+}
+
+// groupAddresses returns the destinations of the packets sent to a group of hosts: the multicast networks,
+// the limited broadcast address and the broadcast addresses of the IPv4 networks of the interface
+func groupAddresses(ifi pcap.Interface) []string {
+	groups := append([]string(nil), multicastNets...)
+	groups = append(groups, net.IPv4bcast.String())
+	for _, addr := range ifi.Addresses {
+		if addr.Broadaddr != nil && addr.Broadaddr.To4() != nil && !addr.Broadaddr.Equal(net.IPv4bcast) {
+			groups = append(groups, addr.Broadaddr.String())
+		}
+	}
+	return groups
+}
+
+// splitZone splits an IPv6 scoped address, e.g fe80::1%eth0, into the address and its zone
+func splitZone(addr string) (host, zone string) {
+	if i := strings.LastIndexByte(addr, '%'); i >= 0 && strings.Contains(addr[:i], ":") {
+		return addr[:i], addr[i+1:]
+	}
+	return addr, ""
+}
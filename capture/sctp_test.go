@@ -0,0 +1,113 @@
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// sctpChunk returns an SCTP chunk padded to 4 bytes
+func sctpChunk(kind, flags byte, value []byte) []byte {
+	chunk := []byte{kind, flags, 0, 0}
+	binary.BigEndian.PutUint16(chunk[2:], uint16(4+len(value)))
+	chunk = append(chunk, value...)
+	for len(chunk)%4 != 0 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// sctpDataChunk returns a DATA chunk of the stream and payload protocol, see RFC 4960 section 3.3.1
+func sctpDataChunk(flags byte, tsn uint32, stream uint16, ppid uint32, data string) []byte {
+	value := make([]byte, 12, 12+len(data))
+	binary.BigEndian.PutUint32(value, tsn)
+	binary.BigEndian.PutUint16(value[4:], stream)
+	binary.BigEndian.PutUint32(value[8:], ppid)
+	return sctpChunk(0, flags, append(value, data...))
+}
+
+// sctpPacket returns a loopback IPv4 SCTP packet from 127.0.0.1:3868 to 127.0.0.1:3869 bundling the chunks
+func sctpPacket(chunks ...[]byte) []byte {
+	data := make([]byte, 4+20+12)
+	binary.BigEndian.PutUint32(data, uint32(layers.ProtocolFamilyIPv4))
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	ip := data[4:]
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)))
+	ip[9] = tcp.ProtoSCTP
+	copy(ip[12:16], []byte{127, 0, 0, 1})
+	copy(ip[16:], []byte{127, 0, 0, 1})
+	binary.BigEndian.PutUint16(ip[20:], 3868)
+	binary.BigEndian.PutUint16(ip[22:], 3869)
+	return data
+}
+
+func TestParseSCTPPacket(t *testing.T) {
+	sack := sctpChunk(3, 0, make([]byte, 12))
+	data := sctpPacket(
+		sack,
+		sctpDataChunk(tcp.SCTPBegin|tcp.SCTPEnd, 10, 1, 46, "diameter"),
+		sctpDataChunk(tcp.SCTPBegin, 11, 2, 18, "s1ap!"),
+	)
+	ci := &gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+	pckts, err := tcp.ParseSCTPPacket(data, int(layers.LinkTypeLoop), 4, ci)
+	if err != nil || len(pckts) != 2 {
+		t.Fatalf("expected the 2 DATA chunks, got %d %v", len(pckts), err)
+	}
+	first, second := pckts[0], pckts[1]
+	if string(first.Payload) != "diameter" || first.Seq != 10 || first.StreamID != 1 || first.PPID != 46 || first.ChunkFlags != tcp.SCTPBegin|tcp.SCTPEnd {
+		t.Errorf("wrong first chunk %+v", first)
+	}
+	if string(second.Payload) != "s1ap!" || second.StreamID != 2 || second.PPID != 18 || second.SrcPort != 3868 || second.DstPort != 3869 {
+		t.Errorf("wrong second chunk %+v", second)
+	}
+	// the data of the last chunk is cut by the snapshot length
+	ci = &gopacket.CaptureInfo{CaptureLength: len(data) - 6, Length: len(data)}
+	if pckts, err = tcp.ParseSCTPPacket(data[:len(data)-6], int(layers.LinkTypeLoop), 4, ci); err != nil || len(pckts) != 2 || string(pckts[1].Payload) != "s1" {
+		t.Errorf("expected the captured part of the last chunk, got %d %v", len(pckts), err)
+	}
+	data = sctpPacket(sack)
+	ci = &gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+	if _, err = tcp.ParseSCTPPacket(data, int(layers.LinkTypeLoop), 4, ci); err != tcp.ErrNoPayload {
+		t.Errorf("expected a packet without DATA chunk to have no payload, got %v", err)
+	}
+}
+
+func TestSCTPListener(t *testing.T) {
+	l, err := NewListener("", nil, "sctp", EnginePcapFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l.AddPacketSource("a", h, h.linkType)
+	h.packets <- sctpPacket(sctpDataChunk(tcp.SCTPBegin|tcp.SCTPEnd, 1, 0, 46, "a"), sctpDataChunk(tcp.SCTPBegin|tcp.SCTPEnd, 2, 0, 46, "b"))
+	h.packets <- rawPackets(1, 1, 10, 4)[0] // TCP
+	close(h.packets)
+	var payloads []string
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) { payloads = append(payloads, string(pckt.Payload)) })
+	if len(payloads) != 2 || payloads[0] != "a" || payloads[1] != "b" {
+		t.Errorf("expected the 2 bundled chunks, got %q", payloads)
+	}
+}
+
+func TestSCTPFilter(t *testing.T) {
+	ifi := pcap.Interface{
+		Name:      "lo",
+		Addresses: []pcap.InterfaceAddress{{IP: net.IP{127, 0, 0, 1}}},
+	}
+	l, err := NewListener("127.0.0.1", []uint16{3868}, "sctp", EnginePcap, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter := l.Filter(ifi); filter != "((sctp dst port 3868) and (dst host 127.0.0.1))" {
+		t.Error("wrong filter", filter)
+	}
+}
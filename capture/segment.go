@@ -0,0 +1,250 @@
+package capture
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// Segmentation normalizes the TCP segments captured to the ones sent on the wire, see PcapOptions.Segmentation
+type Segmentation uint8
+
+// Available segmentations
+const (
+	// SegmentOff passes the segments on as they are captured
+	SegmentOff Segmentation = iota
+	// SegmentSplit splits the segments larger than the MSS of their interface, e.g the ones aggregated by
+	// GSO/TSO or GRO on the capturing host, into segments of the MSS, the way the NIC sends them
+	SegmentSplit
+	// SegmentCoalesce merges the consecutive segments of a connection captured back to back, like GRO,
+	// e.g on a mirror port, the way the host would have seen them
+	SegmentCoalesce
+)
+
+// Set is here so that Segmentation can implement flag.Var
+func (s *Segmentation) Set(v string) error {
+	switch v {
+	case "", "off":
+		*s = SegmentOff
+	case "split":
+		*s = SegmentSplit
+	case "coalesce":
+		*s = SegmentCoalesce
+	default:
+		return fmt.Errorf("invalid segmentation %s", v)
+	}
+	return nil
+}
+
+func (s *Segmentation) String() string {
+	switch *s {
+	case SegmentOff:
+		return "off"
+	case SegmentSplit:
+		return "split"
+	case SegmentCoalesce:
+		return "coalesce"
+	}
+	return ""
+}
+
+const (
+	// coalesceGap is the longest time between two segments merged, by their timestamps
+	coalesceGap = time.Millisecond
+	// coalesceHold is how long a segment is held waiting for the next one
+	coalesceHold = 5 * time.Millisecond
+	// coalesceMax is the largest payload of a coalesced segment, the one of the largest GRO packets
+	coalesceMax = 64<<10 - 1
+	// defaultMTU is the MTU of the interfaces whose MTU is unknown, e.g when reading a pcap file
+	defaultMTU = 1500
+)
+
+// segment is a parsed packet on its way to be emitted
+type segment struct {
+	handler PacketHandlerWithMeta
+	meta    PacketMeta
+	pckt    *tcp.Packet
+	length  int
+	headers bool      // emitted by emitHeaders
+	held    time.Time // when a segment being coalesced started to be held
+}
+
+// segmenter splits or coalesces the TCP segments before they are emitted. the segments of a connection
+// being coalesced are held until a segment doesn't follow them, or for coalesceHold
+type segmenter struct {
+	resegmented uint64 // first field to be 64-bit aligned for atomic operations
+	sync.Mutex
+	mode    Segmentation
+	size    int            // MSS of the split segments, 0 derives it from the MTU of the interfaces
+	mtus    map[string]int // of the interfaces
+	pending map[tcp.FlowKey]*segment
+	timer   *time.Timer
+	stopped bool
+	emit    func(*segment)
+}
+
+func newSegmenter(mode Segmentation, size int, emit func(*segment)) *segmenter {
+	return &segmenter{mode: mode, size: size, emit: emit, mtus: make(map[string]int), pending: make(map[tcp.FlowKey]*segment)}
+}
+
+// add passes a TCP segment on, split or coalesced
+func (s *segmenter) add(seg *segment) {
+	if s.mode == SegmentSplit {
+		s.split(seg)
+		return
+	}
+	s.coalesce(seg)
+}
+
+// mss returns the MSS of the segments sent by an interface, the headers are assumed to have no option
+func (s *segmenter) mss(iface string, version uint8) int {
+	if s.size > 0 {
+		return s.size
+	}
+	s.Lock()
+	mtu, ok := s.mtus[iface]
+	if !ok {
+		if mtu = interfaceMTU(iface); mtu <= 0 {
+			mtu = defaultMTU
+		}
+		s.mtus[iface] = mtu
+	}
+	s.Unlock()
+	if version == 6 {
+		return mtu - 40 - 20
+	}
+	return mtu - 20 - 20
+}
+
+// split emits the segments of the MSS carrying the payload of seg, the SYN is kept by the first one,
+// and the FIN, the RST and the bytes that were not captured by the last one
+func (s *segmenter) split(seg *segment) {
+	pckt := seg.pckt
+	mss := s.mss(seg.meta.Interface, pckt.Version)
+	payload := pckt.Payload
+	if mss <= 0 || len(payload) <= mss {
+		s.emit(seg)
+		return
+	}
+	atomic.AddUint64(&s.resegmented, 1)
+	headers := seg.length - len(payload)
+	seq := pckt.Seq
+	if pckt.SYN {
+		seq++ // the SYN consumes one sequence number
+	}
+	for off := 0; off < len(payload); off += mss {
+		part := *seg
+		if end := off + mss; end < len(payload) {
+			cp := *pckt
+			cp.Payload = payload[off:end:end]
+			cp.FIN, cp.RST, cp.Lost = false, false, 0
+			part.pckt = &cp
+		} else {
+			part.pckt.Payload = payload[off:]
+		}
+		if off != 0 {
+			part.pckt.Seq, part.pckt.SYN = seq+uint32(off), false
+		}
+		part.length = headers + len(part.pckt.Payload)
+		s.emit(&part)
+	}
+}
+
+// coalesce merges seg into the segment held for its connection when it follows it, or else emits the
+// segment held and holds seg. the segments with flags other than ACK, or truncated, are not held
+func (s *segmenter) coalesce(seg *segment) {
+	pckt := seg.pckt
+	s.Lock()
+	held := s.pending[pckt.Flow]
+	if held != nil && mergeable(held, seg) {
+		held.pckt.Payload = append(held.pckt.Payload, pckt.Payload...)
+		held.length += len(pckt.Payload)
+		held.pckt.Timestamp = pckt.Timestamp // of the last segment, see mergeable
+		atomic.AddUint64(&s.resegmented, 1)
+		if len(held.pckt.Payload) < coalesceMax {
+			s.Unlock()
+			return
+		}
+		seg = nil // the merged segment is full
+	}
+	delete(s.pending, pckt.Flow)
+	hold := seg != nil && !s.stopped && len(pckt.Payload) != 0 && len(pckt.Payload) < coalesceMax &&
+		!pckt.SYN && !pckt.FIN && !pckt.RST && pckt.Lost == 0
+	if hold {
+		// the addresses point to the data of the handle, which is reused by the next read
+		pckt.SrcIP = append(net.IP(nil), pckt.SrcIP...)
+		pckt.DstIP = append(net.IP(nil), pckt.DstIP...)
+		seg.held = time.Now()
+		s.pending[pckt.Flow] = seg
+		if s.timer == nil {
+			s.timer = time.AfterFunc(coalesceHold, s.expire)
+		}
+	}
+	s.Unlock()
+	if held != nil {
+		s.emit(held)
+	}
+	if seg != nil && !hold {
+		s.emit(seg)
+	}
+}
+
+// mergeable reports whether next follows the segment held, in the same direction and captured right after it
+func mergeable(held, next *segment) bool {
+	h, n := held.pckt, next.pckt
+	return h.Reversed == n.Reversed && h.Seq+uint32(len(h.Payload)) == n.Seq && h.Ack == n.Ack &&
+		held.headers == next.headers && held.meta.Interface == next.meta.Interface &&
+		len(n.Payload) != 0 && !n.SYN && !n.FIN && !n.RST && n.Lost == 0 &&
+		n.Timestamp.Sub(h.Timestamp) <= coalesceGap && len(h.Payload)+len(n.Payload) <= coalesceMax
+}
+
+// expire emits the segments held for coalesceHold
+func (s *segmenter) expire() {
+	now := time.Now()
+	var expired []*segment
+	s.Lock()
+	for flow, seg := range s.pending {
+		if now.Sub(seg.held) >= coalesceHold {
+			expired = append(expired, seg)
+			delete(s.pending, flow)
+		}
+	}
+	s.timer = nil
+	if len(s.pending) != 0 && !s.stopped {
+		s.timer = time.AfterFunc(coalesceHold, s.expire)
+	}
+	s.Unlock()
+	for _, seg := range expired {
+		s.emit(seg)
+	}
+}
+
+// stop emits the segments held, once the handles are closed
+func (s *segmenter) stop() {
+	s.Lock()
+	s.stopped = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	held := s.pending
+	s.pending = make(map[tcp.FlowKey]*segment)
+	s.Unlock()
+	for _, seg := range held {
+		s.emit(seg)
+	}
+}
+
+// Resegmented returns the number of segments split, or merged into the previous one, with Segmentation
+func (l *Listener) Resegmented() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	if l.segments == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.segments.resegmented)
+}
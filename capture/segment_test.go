@@ -0,0 +1,113 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket/layers"
+)
+
+func segmentPacket(reversed bool, seq uint32, payload int, at time.Time) *segment {
+	pckt := &tcp.Packet{Version: 4, Proto: tcp.ProtoTCP, Seq: seq, Ack: 1, ACK: true, Payload: make([]byte, payload), Timestamp: at}
+	pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort = net.IP{10, 0, 0, 1}, 40000, net.IP{10, 0, 0, 2}, 80
+	if reversed {
+		pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort = pckt.DstIP, pckt.DstPort, pckt.SrcIP, pckt.SrcPort
+	}
+	pckt.Flow, pckt.Reversed = tcp.NewFlowKey(pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort)
+	return &segment{pckt: pckt, length: 14 + 40 + payload, meta: PacketMeta{Interface: "eth0"}}
+}
+
+func TestSegmentSplit(t *testing.T) {
+	defer func(f func(string) int) { interfaceMTU = f }(interfaceMTU)
+	interfaceMTU = func(string) int { return 1000 }
+	var emitted []*segment
+	s := newSegmenter(SegmentSplit, 0, func(seg *segment) { emitted = append(emitted, seg) })
+	seg := segmentPacket(false, 100, 2500, time.Now())
+	seg.pckt.FIN = true
+	s.add(seg)
+	if len(emitted) != 3 {
+		t.Fatalf("expected 3 segments of the MSS 960, got %d", len(emitted))
+	}
+	for i, want := range []struct {
+		seq     uint32
+		payload int
+		fin     bool
+	}{{100, 960, false}, {1060, 960, false}, {2020, 580, true}} {
+		p := emitted[i].pckt
+		if p.Seq != want.seq || len(p.Payload) != want.payload || p.FIN != want.fin || emitted[i].length != 54+want.payload {
+			t.Errorf("segment %d: expected seq %d, %d bytes, FIN %t, got seq %d, %d bytes, FIN %t, length %d",
+				i, want.seq, want.payload, want.fin, p.Seq, len(p.Payload), p.FIN, emitted[i].length)
+		}
+	}
+	// the segments within the MSS are left as they are
+	emitted = nil
+	s.add(segmentPacket(false, 100, 960, time.Now()))
+	if len(emitted) != 1 || s.resegmented != 1 {
+		t.Errorf("expected the segment to be left as it is, got %d segments", len(emitted))
+	}
+}
+
+func TestSegmentCoalesce(t *testing.T) {
+	var emitted []*segment
+	s := newSegmenter(SegmentCoalesce, 0, func(seg *segment) { emitted = append(emitted, seg) })
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		s.add(segmentPacket(false, uint32(100+i*1000), 1000, now))
+	}
+	if len(emitted) != 0 {
+		t.Fatalf("expected the segments to be held, got %d", len(emitted))
+	}
+	// the acknowledgment of the other direction emits them first
+	ack := segmentPacket(true, 1, 0, now)
+	s.add(ack)
+	if len(emitted) != 2 || len(emitted[0].pckt.Payload) != 3000 || emitted[0].pckt.Seq != 100 || emitted[1] != ack {
+		t.Fatalf("expected the merged segment followed by the acknowledgment, got %d segments", len(emitted))
+	}
+	// a gap in the sequence numbers, or in time, is not merged
+	emitted = nil
+	s.add(segmentPacket(false, 3100, 1000, now))
+	s.add(segmentPacket(false, 5100, 1000, now))
+	s.add(segmentPacket(false, 6100, 1000, now.Add(time.Second)))
+	s.stop()
+	var sizes []int
+	for _, seg := range emitted {
+		sizes = append(sizes, len(seg.pckt.Payload))
+	}
+	if fmt.Sprint(sizes) != "[1000 1000 1000]" || s.resegmented != 2 {
+		t.Errorf("expected 3 segments, got %v", sizes)
+	}
+}
+
+func TestSegmentCoalesceExpire(t *testing.T) {
+	emitted := make(chan *segment, 1)
+	s := newSegmenter(SegmentCoalesce, 0, func(seg *segment) { emitted <- seg })
+	s.add(segmentPacket(false, 100, 1000, time.Now()))
+	select {
+	case seg := <-emitted:
+		if len(seg.pckt.Payload) != 1000 {
+			t.Errorf("expected the segment held, got %d bytes", len(seg.pckt.Payload))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the segment to be emitted once held for too long")
+	}
+	s.stop()
+}
+
+func TestListenerSegmentation(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.Segmentation, l.SegmentSize = SegmentSplit, 4
+	h.packets <- rawPackets(1, 1, 10, 4)[0]
+	close(h.packets)
+	var sizes []int
+	if err := l.Listen(context.Background(), func(pckt *tcp.Packet) { sizes = append(sizes, len(pckt.Payload)) }); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sizes) != "[4 4 2]" || l.Resegmented() != 1 {
+		t.Errorf("expected segments of 4 bytes, got %v", sizes)
+	}
+}
@@ -39,8 +39,10 @@ type SockRaw struct {
 	snaplen     int
 	pollTimeout uintptr
 	frame       uint32 // current frame
+	frames      uint32 // frames of the ring buffer
 	buf         []byte // points to the memory space of the ring buffer shared with the kernel.
 	loopIndex   int32  // this field must filled to avoid reading packet twice on a loopback device
+	egress      bool   // only the packets sent by the host are read
 }
 
 // NewSocket returns new M'maped sock_raw on packet version 2.
@@ -58,7 +60,7 @@ func NewSocket(pifi pcap.Interface) (*SockRaw, error) {
 	}
 
 	if !found {
-		return nil, fmt.Errorf("Can't find matching interface")
+		return nil, fmt.Errorf("Can't find matching interface: %w", unix.ENODEV)
 	}
 
 	// sock create
@@ -97,30 +99,74 @@ func NewSocket(pifi pcap.Interface) (*SockRaw, error) {
 		return nil, e
 	}
 
-	// create shared-memory ring buffer
+	if err = sock.setRing(BLOCKNR); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return sock, nil
+}
+
+// setRing creates the shared-memory ring buffer of the socket with the given number of blocks,
+// the ring buffer created before is released
+func (sock *SockRaw) setRing(blocks int) (err error) {
+	if sock.buf != nil {
+		unix.Munmap(sock.buf)
+		sock.buf = nil
+		// a request without blocks releases the ring buffer
+		if err = unix.SetsockoptTpacketReq(sock.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &unix.TpacketReq{}); err != nil {
+			return fmt.Errorf("setsockopt packet_rx_ring: %v", err)
+		}
+	}
 	tp := &unix.TpacketReq{
 		Block_size: BLOCKSIZE,
-		Block_nr:   BLOCKNR,
+		Block_nr:   uint32(blocks),
 		Frame_size: FRAMESIZE,
-		Frame_nr:   FRAMENR,
+		Frame_nr:   uint32(blocks * BLOCKSIZE / FRAMESIZE),
 	}
 	err = unix.SetsockoptTpacketReq(sock.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, tp)
 	if err != nil {
-		unix.Close(fd)
-		return nil, fmt.Errorf("setsockopt packet_rx_ring: %v", err)
+		return fmt.Errorf("setsockopt packet_rx_ring: %v", err)
 	}
 	sock.buf, err = unix.Mmap(
 		sock.fd,
 		0,
-		BLOCKSIZE*BLOCKNR,
+		blocks*BLOCKSIZE,
 		unix.PROT_READ|unix.PROT_WRITE,
 		unix.MAP_SHARED|MAPHUGE2MB,
 	)
 	if err != nil {
-		unix.Close(fd)
-		return nil, fmt.Errorf("socket mmap error: %v", err)
+		return fmt.Errorf("socket mmap error: %v", err)
 	}
-	return sock, nil
+	sock.frame, sock.frames = 0, tp.Frame_nr
+	return nil
+}
+
+// SetBufferSize sets the size of the ring buffer of the socket, rounded down to a number of blocks,
+// and its SO_RCVBUF. the SO_RCVBUF beyond net.core.rmem_max is only granted with CAP_NET_ADMIN
+func (sock *SockRaw) SetBufferSize(size int) error {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+	if size <= 0 {
+		return fmt.Errorf("expected the buffer size %d to be positive", size)
+	}
+	if err := unix.SetsockoptInt(sock.fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, size); err != nil {
+		if err = unix.SetsockoptInt(sock.fd, unix.SOL_SOCKET, unix.SO_RCVBUF, size); err != nil {
+			return fmt.Errorf("setsockopt so_rcvbuf: %v", err)
+		}
+	}
+	blocks := size / BLOCKSIZE
+	if blocks < 1 {
+		blocks = 1
+	}
+	return sock.setRing(blocks)
+}
+
+// BufferSizes returns the size of the ring buffer of the socket and its SO_RCVBUF, as doubled by the kernel
+func (sock *SockRaw) BufferSizes() (ring, rcvbuf int) {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+	rcvbuf, _ = unix.GetsockoptInt(sock.fd, unix.SOL_SOCKET, unix.SO_RCVBUF)
+	return len(sock.buf), rcvbuf
 }
 
 // ReadPacketData implements gopacket.PacketDataSource.
@@ -136,7 +182,7 @@ func (sock *SockRaw) ZeroCopyReadPacketData() (buf []byte, ci gopacket.CaptureIn
 read:
 	i = int(sock.frame * FRAMESIZE)
 	tpHdr = (*unix.Tpacket2Hdr)(unsafe.Pointer(&sock.buf[i]))
-	sock.frame = (sock.frame + 1) % FRAMENR
+	sock.frame = (sock.frame + 1) % sock.frames
 
 	if tpHdr.Status&unix.TP_STATUS_USER == 0 {
 		_, _, e := unix.Syscall(unix.SYS_POLL, uintptr(unsafe.Pointer(poll)), 1, sock.pollTimeout)
@@ -148,17 +194,27 @@ read:
 			goto read
 		}
 	}
+	status := tpHdr.Status
 	tpHdr.Status = unix.TP_STATUS_KERNEL
 	sockAddr := (*unix.RawSockaddrLinklayer)(unsafe.Pointer(&sock.buf[i+tpacket2hdrlen]))
 
-	// parse out repeating packets on loopback
-	if sockAddr.Ifindex == sock.loopIndex && sock.frame%2 != 0 {
+	if sock.egress {
+		// the packets sent on loopback are also received, only once as outgoing packets
+		if sockAddr.Pkttype != unix.PACKET_OUTGOING {
+			goto read
+		}
+	} else if sockAddr.Ifindex == sock.loopIndex && sock.frame%2 != 0 {
+		// parse out repeating packets on loopback
 		goto read
 	}
 
 	ci.Length = int(tpHdr.Len)
 	ci.Timestamp = time.Unix(int64(tpHdr.Sec), int64(tpHdr.Nsec))
 	ci.InterfaceIndex = int(sockAddr.Ifindex)
+	ci.AncillaryData = append(ci.AncillaryData, AncillaryPacketType(sockAddr.Pkttype))
+	if status&unix.TP_STATUS_VLAN_VALID != 0 {
+		ci.AncillaryData = append(ci.AncillaryData, AncillaryVLAN{ID: tpHdr.Vlan_tci & 0x0fff, Priority: uint8(tpHdr.Vlan_tci >> 13)})
+	}
 	buf = make([]byte, tpHdr.Snaplen)
 	ci.CaptureLength = copy(buf, sock.buf[i+int(tpHdr.Mac):])
 
@@ -214,7 +270,7 @@ func (sock *SockRaw) SetBPFFilter(expr string) error {
 	sock.mu.Lock()
 	defer sock.mu.Unlock()
 	if expr == "" {
-		return unix.SetsockoptInt(sock.fd, unix.SOL_SOCKET, unix.SO_DETACH_FILTER, 0)
+		return sock.detachFilter()
 	}
 	filter, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, sock.snaplen, expr)
 	if err != nil {
@@ -224,7 +280,7 @@ func (sock *SockRaw) SetBPFFilter(expr string) error {
 		return fmt.Errorf("filters out of range 0-%d", ^uint16(0))
 	}
 	if len(filter) == 0 {
-		return unix.SetsockoptInt(sock.fd, unix.SOL_SOCKET, unix.SO_DETACH_FILTER, 0)
+		return sock.detachFilter()
 	}
 	fprog := &unix.SockFprog{
 		Len:    uint16(len(filter)),
@@ -233,6 +289,16 @@ func (sock *SockRaw) SetBPFFilter(expr string) error {
 	return unix.SetsockoptSockFprog(sock.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, fprog)
 }
 
+// detachFilter removes the filter of the socket so that it accepts all the packets,
+// a socket without filter already does
+func (sock *SockRaw) detachFilter() error {
+	err := unix.SetsockoptInt(sock.fd, unix.SOL_SOCKET, unix.SO_DETACH_FILTER, 0)
+	if err == unix.ENOENT {
+		return nil
+	}
+	return err
+}
+
 // SetPromiscuous sets promiscuous mode to the required value. for better result capture on all interfaces instead.
 // If it is enabled, traffic not destined for the interface will also be captured.
 func (sock *SockRaw) SetPromiscuous(b bool) error {
@@ -251,6 +317,14 @@ func (sock *SockRaw) SetPromiscuous(b bool) error {
 	return unix.SetsockoptPacketMreq(sock.fd, unix.SOL_PACKET, opt, &mreq)
 }
 
+// SetFanout joins the socket to a PACKET_FANOUT group, the packets of the interface are split between
+// the sockets of the group, e.g of several processes. they are split by flow hash, the same for both
+// directions of a connection since Linux 4.7, and the IP fragments of a datagram are kept together
+func (sock *SockRaw) SetFanout(group uint16) error {
+	return unix.SetsockoptInt(sock.fd, unix.SOL_PACKET, unix.PACKET_FANOUT,
+		int(group)|(unix.PACKET_FANOUT_HASH|unix.PACKET_FANOUT_FLAG_DEFRAG)<<16)
+}
+
 // Stats returns number of packets and dropped packets. This will be the number of packets/dropped packets since the last call to stats (not the cummulative sum!).
 func (sock *SockRaw) Stats() (*unix.TpacketStats, error) {
 	sock.mu.Lock()
@@ -258,6 +332,15 @@ func (sock *SockRaw) Stats() (*unix.TpacketStats, error) {
 	return unix.GetsockoptTpacketStats(sock.fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
 }
 
+// dropped returns the packets dropped by the kernel since the last call to Stats
+func (sock *SockRaw) dropped() (uint64, error) {
+	stats, err := sock.Stats()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stats.Drops), nil
+}
+
 // SetLoopbackIndex necessary to avoid reading packet twice on a loopback device
 func (sock *SockRaw) SetLoopbackIndex(i int32) {
 	sock.mu.Lock()
@@ -265,6 +348,13 @@ func (sock *SockRaw) SetLoopbackIndex(i int32) {
 	sock.loopIndex = i
 }
 
+// SetEgress only reads the packets sent by the host, they are tapped once the qdisc released them to the driver
+func (sock *SockRaw) SetEgress(egress bool) {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+	sock.egress = egress
+}
+
 // WritePacketData transmits a raw packet.
 func (sock *SockRaw) WritePacketData(pkt []byte) error {
 	_, err := unix.Write(sock.fd, pkt)
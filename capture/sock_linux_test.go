@@ -0,0 +1,89 @@
+package capture
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/sys/unix"
+)
+
+func TestSockRawBufferSize(t *testing.T) {
+	sock, err := NewSocket(pcap.Interface{Name: LoopBack.Name})
+	if err != nil {
+		t.Skipf("raw sockets are not available: %v", err)
+	}
+	defer sock.Close()
+	if ring, _ := sock.BufferSizes(); ring != BLOCKSIZE*BLOCKNR {
+		t.Errorf("expected the default ring buffer, got %d bytes", ring)
+	}
+	if err = sock.SetBufferSize(4 << 20); err != nil {
+		t.Fatal(err)
+	}
+	ring, rcvbuf := sock.BufferSizes()
+	if ring != 4<<20 || sock.frames != 4<<20/FRAMESIZE {
+		t.Errorf("expected a 4mb ring buffer, got %d bytes and %d frames", ring, sock.frames)
+	}
+	// the kernel doubles the size asked for, up to net.core.rmem_max without CAP_NET_ADMIN
+	if want, _ := unix.GetsockoptInt(sock.fd, unix.SOL_SOCKET, unix.SO_RCVBUF); rcvbuf != want || rcvbuf == 0 {
+		t.Errorf("expected SO_RCVBUF %d, got %d", want, rcvbuf)
+	}
+}
+
+func TestSockRawEgress(t *testing.T) {
+	sock, err := NewSocket(pcap.Interface{Name: LoopBack.Name})
+	if err != nil {
+		t.Skipf("raw sockets are not available: %v", err)
+	}
+	defer sock.Close()
+	sock.SetEgress(true)
+	// the datagrams to a closed port would be answered by ICMP errors quoting them
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for _, payload := range []string{"egress-1", "egress-2", "egress-3"} {
+			conn.Write([]byte(payload))
+		}
+		// so that the reads don't wait forever
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				conn.Write([]byte("egress-x"))
+			}
+		}
+	}()
+	// a packet sent on loopback is read once, as outgoing
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		data, ci, err := sock.ZeroCopyReadPacketData()
+		if err != nil || !bytes.Contains(data, []byte("egress-")) {
+			continue
+		}
+		if ci.AncillaryData[0] != PacketOutgoing {
+			t.Errorf("expected an outgoing packet, got %v", ci.AncillaryData[0])
+		}
+		payload := string(data[len(data)-8:])
+		if payload == "egress-x" {
+			break
+		}
+		got = append(got, payload)
+	}
+	if strings.Join(got, ",") != "egress-1,egress-2,egress-3" {
+		t.Errorf("expected every packet to be read once, got %v", got)
+	}
+}
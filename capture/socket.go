@@ -18,3 +18,23 @@ type Socket interface {
 	SetLoopbackIndex(i int32)
 	Close() error
 }
+
+// AncillaryPacketType is the direction of a packet read by a raw socket, found in the AncillaryData of its
+// CaptureInfo, like the packet type of the linux cooked captures
+type AncillaryPacketType uint8
+
+// Packet types, see linux/if_packet.h
+const (
+	PacketHost      AncillaryPacketType = 0 // addressed to the host
+	PacketBroadcast AncillaryPacketType = 1
+	PacketMulticast AncillaryPacketType = 2
+	PacketOtherHost AncillaryPacketType = 3 // addressed to another host, e.g captured in promiscuous mode
+	PacketOutgoing  AncillaryPacketType = 4 // sent by the host
+)
+
+// AncillaryVLAN is the VLAN tag of a packet read by a raw socket, found in the AncillaryData of its CaptureInfo
+// when the tag was stripped by the VLAN offload of the NIC
+type AncillaryVLAN struct {
+	ID       uint16
+	Priority uint8
+}
@@ -0,0 +1,120 @@
+package capture
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// fakeSocket records the promiscuous mode and the buffer size asked for
+type fakeSocket struct {
+	promisc []bool
+	buffer  int
+	closed  bool
+	filter  error // returned by SetBPFFilter
+	egress  bool
+}
+
+func (s *fakeSocket) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, nil
+}
+func (s *fakeSocket) WritePacketData([]byte) error   { return nil }
+func (s *fakeSocket) SetBPFFilter(string) error      { return s.filter }
+func (s *fakeSocket) SetSnapLen(int) error           { return nil }
+func (s *fakeSocket) GetSnapLen() int                { return 64 << 10 }
+func (s *fakeSocket) SetTimeout(time.Duration) error { return nil }
+func (s *fakeSocket) SetLoopbackIndex(int32)         {}
+func (s *fakeSocket) Close() error                   { s.closed = true; return nil }
+func (s *fakeSocket) SetPromiscuous(b bool) error {
+	s.promisc = append(s.promisc, b)
+	return nil
+}
+func (s *fakeSocket) SetEgress(egress bool) {
+	s.egress = egress
+}
+func (s *fakeSocket) SetBufferSize(size int) error {
+	s.buffer = size
+	return nil
+}
+
+func TestSocketPromiscuous(t *testing.T) {
+	defer func(f func(pcap.Interface) (Socket, error)) { newSocket = f }(newSocket)
+	var sock *fakeSocket
+	newSocket = func(pcap.Interface) (Socket, error) {
+		sock = new(fakeSocket)
+		return sock, nil
+	}
+	ifi := pcap.Interface{Name: "eth0"}
+	for _, c := range []struct{ promisc, monitor bool }{{false, false}, {false, true}, {true, false}, {true, true}} {
+		l := &Listener{Transport: "tcp", ports: []uint16{8000}}
+		l.Promiscuous, l.Monitor = c.promisc, c.monitor
+		l.SetDebugLevel(DebugSilent)
+		if _, err := l.SocketHandle(ifi); err != nil {
+			t.Fatal(err)
+		}
+		if promisc := len(sock.promisc) == 1 && sock.promisc[0]; promisc != c.promisc || len(sock.promisc) > 1 {
+			t.Errorf("promiscuous %v monitor %v: the socket was set promiscuous %v", c.promisc, c.monitor, sock.promisc)
+		}
+		if opts := l.EffectiveOptions()["eth0"]; opts.Promiscuous != c.promisc {
+			t.Errorf("promiscuous %v monitor %v: expected the effective option to match, got %+v", c.promisc, c.monitor, opts)
+		}
+	}
+}
+
+func TestSocketBufferSize(t *testing.T) {
+	defer func(f func(pcap.Interface) (Socket, error)) { newSocket = f }(newSocket)
+	var sock *fakeSocket
+	newSocket = func(pcap.Interface) (Socket, error) {
+		sock = new(fakeSocket)
+		return sock, nil
+	}
+	l := &Listener{Transport: "tcp", ports: []uint16{8000}}
+	l.SetDebugLevel(DebugSilent)
+	if _, err := l.SocketHandle(pcap.Interface{Name: "eth0"}); err != nil {
+		t.Fatal(err)
+	}
+	if sock.buffer != 0 {
+		t.Errorf("expected the default buffer size to be kept, got %d", sock.buffer)
+	}
+	l.BufferSize = 8 << 20
+	l.InterfaceBufferSize = InterfaceSizes{"eth1": 16 << 20}
+	for name, want := range map[string]int{"eth0": 8 << 20, "eth1": 16 << 20} {
+		if _, err := l.SocketHandle(pcap.Interface{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+		if sock.buffer != want {
+			t.Errorf("%s: expected a buffer of %d bytes, got %d", name, want, sock.buffer)
+		}
+	}
+}
+
+func TestSocketEgress(t *testing.T) {
+	defer func(f func(pcap.Interface) (Socket, error)) { newSocket = f }(newSocket)
+	var sock *fakeSocket
+	newSocket = func(pcap.Interface) (Socket, error) {
+		sock = new(fakeSocket)
+		return sock, nil
+	}
+	var point AttachPoint
+	if err := point.Set("egress"); err != nil || point != PointEgress {
+		t.Fatalf("expected the egress attach point, got %v %v", point, err)
+	}
+	l := &Listener{Transport: "tcp", ports: []uint16{8000}}
+	l.SetDebugLevel(DebugSilent)
+	for _, point := range []AttachPoint{PointDefault, PointEgress} {
+		l.AttachPoint = point
+		if _, err := l.SocketHandle(pcap.Interface{Name: "eth0"}); err != nil {
+			t.Fatal(err)
+		}
+		if sock.egress != (point == PointEgress) {
+			t.Errorf("%s: the socket egress is %v", &point, sock.egress)
+		}
+	}
+	// the packets of a file have no direction
+	if err := l.activateOffline(nil); err == nil || !strings.Contains(err.Error(), "egress") {
+		t.Errorf("expected the egress attach point to be rejected, got %v", err)
+	}
+}
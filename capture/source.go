@@ -0,0 +1,40 @@
+package capture
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// AddPacketSource adds a packet source that is read like the handles of the interfaces, e.g packets generated
+// by tests or replayed from memory. it must be called before Listen, the source is closed along with the
+// listener if it has a Close method, and reading it stops once it returns io.EOF
+func (l *Listener) AddPacketSource(name string, src gopacket.ZeroCopyPacketDataSource, linkType layers.LinkType) error {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.Handles[name]; ok {
+		return fmt.Errorf("packet source %q already exists", name)
+	}
+	l.Handles[name] = &packetSource{src, linkType}
+	return nil
+}
+
+// packetSource reports the link type of a packet source added with AddPacketSource
+type packetSource struct {
+	gopacket.ZeroCopyPacketDataSource
+	linkType layers.LinkType
+}
+
+func (src *packetSource) LinkType() layers.LinkType {
+	return src.linkType
+}
+
+func (src *packetSource) Close() {
+	switch s := src.ZeroCopyPacketDataSource.(type) {
+	case interface{ Close() error }:
+		s.Close()
+	case interface{ Close() }:
+		s.Close()
+	}
+}
@@ -0,0 +1,52 @@
+package capture
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// memorySource replays packets held in memory
+type memorySource struct {
+	packets [][]byte
+}
+
+func (src *memorySource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(src.packets) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := src.packets[0]
+	src.packets = src.packets[1:]
+	return data, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}, nil
+}
+
+func TestAddPacketSource(t *testing.T) {
+	// the listener needs neither libpcap nor an interface
+	l, err := NewListener("", []uint16{8000}, "tcp", EnginePcapFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &memorySource{packets: rawPackets(1, 3, 5, 4)}
+	if err = l.AddPacketSource("memory", src, layers.LinkTypeLoop); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.AddPacketSource("memory", src, layers.LinkTypeLoop); err == nil {
+		t.Error("expected the sources to have distinct names")
+	}
+	var seqs []uint32
+	if err = l.Listen(context.Background(), func(pckt *tcp.Packet) { seqs = append(seqs, pckt.Seq) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 3 || seqs[0] != 1 || seqs[2] != 3 {
+		t.Errorf("expected the 3 packets in order, got %v", seqs)
+	}
+	if l.LinkType("memory") != layers.LinkTypeLoop {
+		t.Errorf("wrong link type %s", l.LinkType("memory"))
+	}
+}
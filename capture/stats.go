@@ -0,0 +1,133 @@
+package capture
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// InterfaceStats are the counters of the capture of an interface. Packets, Bytes, ParseErrors and Dropped are
+// maintained by goreplay, StatsReset sets them back to zero. Pcap is reported by libpcap for the pcap handles,
+// it counts from the opening of the handle and can't be reset
+type InterfaceStats struct {
+	Packets     uint64 // read from the handle
+	Bytes       uint64 // captured bytes, including the headers
+	ParseErrors uint64
+	Dropped     uint64      // packets parsed but dropped before the handler, over MaxPPS or MaxBPS
+	Pcap        *pcap.Stats // nil for the other handles, or once the handle is closed
+}
+
+// interfaceCounters are the counters of InterfaceStats goreplay maintains, the methods are safe on nil
+type interfaceCounters struct {
+	packets, bytes, parseErrors, dropped uint64
+}
+
+func (c *interfaceCounters) read(length int) {
+	if c != nil {
+		atomic.AddUint64(&c.packets, 1)
+		atomic.AddUint64(&c.bytes, uint64(length))
+	}
+}
+
+func (c *interfaceCounters) parseFailed() {
+	if c != nil {
+		atomic.AddUint64(&c.parseErrors, 1)
+	}
+}
+
+func (c *interfaceCounters) drop() {
+	if c != nil {
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// stats returns the counters, they are set to zero when reset is true. each counter is read and reset
+// atomically, a packet being handled meanwhile can be counted in the packets of one interval and in the
+// parse errors of the next
+func (c *interfaceCounters) stats(reset bool) InterfaceStats {
+	load := atomic.LoadUint64
+	if reset {
+		load = func(addr *uint64) uint64 { return atomic.SwapUint64(addr, 0) }
+	}
+	return InterfaceStats{
+		Packets:     load(&c.packets),
+		Bytes:       load(&c.bytes),
+		ParseErrors: load(&c.parseErrors),
+		Dropped:     load(&c.dropped),
+	}
+}
+
+// interfaceStats are the counters of every interface read, they are kept once its handle is closed
+type interfaceStats struct {
+	sync.Mutex
+	counters map[string]*interfaceCounters
+}
+
+func (s *interfaceStats) of(iface string) *interfaceCounters {
+	s.Lock()
+	defer s.Unlock()
+	if s.counters == nil {
+		s.counters = make(map[string]*interfaceCounters)
+	}
+	c, ok := s.counters[iface]
+	if !ok {
+		c = new(interfaceCounters)
+		s.counters[iface] = c
+	}
+	return c
+}
+
+// Stats returns the counters of every interface read since Listen was called. it must not be called from a
+// PacketHandler, the statistics of a pcap handle are read once the packet being handled is done with
+func (l *Listener) Stats() map[string]InterfaceStats {
+	return l.interfaceStats(false)
+}
+
+// StatsReset is Stats setting the counters maintained by goreplay back to zero, so that each call returns
+// the counts of the interval since the previous one. the Pcap counters are left cumulative
+func (l *Listener) StatsReset() map[string]InterfaceStats {
+	return l.interfaceStats(true)
+}
+
+func (l *Listener) interfaceStats(reset bool) map[string]InterfaceStats {
+	stats := make(map[string]InterfaceStats)
+	l.Lock()
+	s := l.stats
+	l.Unlock()
+	if s == nil {
+		return stats
+	}
+	s.Lock()
+	for iface, c := range s.counters {
+		stats[iface] = c.stats(reset)
+	}
+	s.Unlock()
+	for iface, st := range stats {
+		st.Pcap = l.pcapStats(iface)
+		stats[iface] = st
+	}
+	return stats
+}
+
+// pcapStats returns the statistics of the pcap handle of an interface, nil if it isn't an open pcap handle
+func (l *Listener) pcapStats(iface string) *pcap.Stats {
+	l.Lock()
+	handle, hl := l.Handles[iface], l.handleLocks[iface]
+	l.Unlock()
+	ph, ok := handle.(*pcap.Handle)
+	if !ok || hl == nil {
+		return nil
+	}
+	// the handle is freed once closed
+	hl.Lock()
+	defer hl.Unlock()
+	if hl.closed {
+		return nil
+	}
+	stats, err := ph.Stats()
+	if err != nil {
+		return nil
+	}
+	return stats
+}
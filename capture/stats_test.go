@@ -0,0 +1,39 @@
+package capture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket/layers"
+)
+
+func TestStatsReset(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.SetDebugLevel(DebugSilent)
+	packets := rawPackets(1, 3, 10, 4)
+	for _, data := range packets {
+		h.packets <- data
+	}
+	h.packets <- packets[0][:4+10] // truncated IP header
+	close(h.packets)
+	if err := l.Listen(context.Background(), func(*tcp.Packet) {}); err != nil {
+		t.Fatal(err)
+	}
+	stats := l.StatsReset()["a"]
+	bytes := uint64(3*len(packets[0]) + 4 + 10)
+	if stats.Packets != 4 || stats.Bytes != bytes || stats.ParseErrors != 1 || stats.Dropped != 0 {
+		t.Errorf("expected 4 packets, %d bytes and 1 parse error, got %+v", bytes, stats)
+	}
+	if stats.Pcap != nil {
+		t.Error("expected no pcap statistics of a packet source")
+	}
+	if stats := l.Stats()["a"]; stats != (InterfaceStats{}) {
+		t.Errorf("expected the counters to be reset, got %+v", stats)
+	}
+	// the listener counters are cumulative
+	if l.ParseErrors() != 1 {
+		t.Errorf("expected 1 parse error, got %d", l.ParseErrors())
+	}
+}
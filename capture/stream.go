@@ -0,0 +1,300 @@
+package capture
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// errors ending the reads of a Stream, once its buffered data was read
+var (
+	ErrConnectionReset = errors.New("stream: connection reset")
+	ErrStreamIdle      = errors.New("stream: idle for too long or evicted")
+	ErrStreamOverflow  = errors.New("stream: too much data buffered")
+	ErrStreamClosed    = errors.New("stream: assembler closed")
+)
+
+// Stream is the payload of one direction of a TCP connection, ordered by sequence number.
+// Read blocks until more data arrives, it returns io.EOF once the direction is closed by a FIN,
+// ErrConnectionReset on a RST and ErrStreamIdle when no data arrives for the expiration of its assembler.
+// e.g http.ReadRequest(bufio.NewReader(stream)) parses the requests of a client stream
+type Stream struct {
+	Flow             tcp.FlowKey
+	SrcAddr, DstAddr string
+	FromClient       bool
+	Start            time.Time // timestamp of the first packet
+
+	mu      sync.Mutex
+	ready   chan struct{} // signaled when data is added or the stream ends
+	buf     []byte        // ordered data not read yet
+	pending map[uint32][]byte
+	pendLen int
+	next    uint32 // sequence number of the next byte expected
+	seqSet  bool
+	fin     uint32 // sequence number of the FIN, when finSet
+	finSet  bool
+	err     error // returned once buf is read
+	closed  bool  // the reader is gone, data is discarded
+	expire  time.Duration
+	maxSize int
+}
+
+func newStream(pckt *tcp.Packet, fromClient bool, expire time.Duration, maxSize int) *Stream {
+	return &Stream{
+		Flow:       pckt.Flow,
+		SrcAddr:    pckt.Src(),
+		DstAddr:    pckt.Dst(),
+		FromClient: fromClient,
+		Start:      pckt.Timestamp,
+		ready:      make(chan struct{}, 1),
+		pending:    make(map[uint32][]byte),
+		expire:     expire,
+		maxSize:    maxSize,
+	}
+}
+
+// Read reads the ordered payload of the stream, see Stream
+func (s *Stream) Read(p []byte) (n int, err error) {
+	var idle *time.Timer
+	for {
+		s.mu.Lock()
+		if len(s.buf) != 0 {
+			n = copy(p, s.buf)
+			s.buf = s.buf[n:]
+			if len(s.buf) == 0 {
+				s.buf = nil
+			}
+			s.mu.Unlock()
+			return n, nil
+		}
+		if s.err != nil {
+			err = s.err
+			s.mu.Unlock()
+			return 0, err
+		}
+		s.mu.Unlock()
+		if idle == nil {
+			idle = time.NewTimer(s.expire)
+			defer idle.Stop()
+		}
+		select {
+		case <-s.ready:
+		case <-idle.C:
+			s.end(ErrStreamIdle)
+		}
+	}
+}
+
+// Close stops the reads of the stream, the data arriving afterwards is discarded
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.buf, s.pending, s.pendLen = nil, nil, 0
+	s.mu.Unlock()
+	s.end(io.ErrClosedPipe)
+	return nil
+}
+
+// end sets the error returned once the buffered data is read, the first one wins
+func (s *Stream) end(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *Stream) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// add orders the payload of pckt in the stream, the out of order segments wait for the missing ones
+func (s *Stream) add(pckt *tcp.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil || s.closed {
+		return
+	}
+	seq := pckt.Seq
+	if pckt.SYN {
+		seq++
+	}
+	if !s.seqSet {
+		s.next, s.seqSet = seq, true
+	}
+	if pckt.FIN && !s.finSet {
+		s.fin, s.finSet = seq+uint32(len(pckt.Payload)), true
+	}
+	if len(pckt.Payload) != 0 {
+		if diff := int32(seq - s.next); diff > 0 {
+			if _, ok := s.pending[seq]; !ok {
+				s.pending[seq] = append([]byte(nil), pckt.Payload...)
+				s.pendLen += len(pckt.Payload)
+			}
+		} else {
+			s.push(seq, pckt.Payload)
+		}
+	}
+	for len(s.pending) != 0 {
+		progress := false
+		for seq, data := range s.pending {
+			if int32(seq-s.next) <= 0 {
+				delete(s.pending, seq)
+				s.pendLen -= len(data)
+				s.push(seq, data)
+				progress = true
+			}
+		}
+		if !progress {
+			break
+		}
+	}
+	switch {
+	case len(s.buf)+s.pendLen > s.maxSize:
+		s.buf, s.pending, s.pendLen = nil, nil, 0
+		s.err = ErrStreamOverflow
+	case s.finSet && int32(s.next-s.fin) >= 0:
+		s.err = io.EOF
+	}
+	s.signal()
+}
+
+// push appends the data starting at seq, the bytes already received are trimmed
+func (s *Stream) push(seq uint32, data []byte) {
+	if skip := int(s.next - seq); skip > 0 {
+		if skip >= len(data) {
+			return // retransmission
+		}
+		data = data[skip:]
+	}
+	s.buf = append(s.buf, data...)
+	s.next += uint32(len(data))
+}
+
+// StreamHandler is called in its own goroutine with every new Stream, it should read it until
+// it returns an error or close it
+type StreamHandler func(*Stream)
+
+// StreamAssembler splits the TCP connections in two streams, one for each direction. the side sending
+// the first packet, or the SYN without ACK, is the client.
+type StreamAssembler struct {
+	flowTable
+	handle  StreamHandler
+	maxSize int
+}
+
+type streamPair struct {
+	client bool       // Reversed flag of the packets sent by the client
+	dirs   [2]*Stream // 0 from client, 1 from server
+}
+
+// NewStreamAssembler returns a new assembler, a stream is ended after being idle for expire. maxSize
+// bounds the data buffered by a stream, including the out of order segments, default is 5mb
+func NewStreamAssembler(expire time.Duration, maxSize int, handle StreamHandler) *StreamAssembler {
+	a := new(StreamAssembler)
+	a.init(expire, time.Minute)
+	a.handle = handle
+	a.maxSize = maxSize
+	if a.maxSize < 1 {
+		a.maxSize = 5 << 20
+	}
+	a.removed = func(state interface{}) {
+		for _, s := range state.(*streamPair).dirs {
+			if s != nil {
+				s.end(ErrStreamIdle)
+			}
+		}
+	}
+	return a
+}
+
+// PacketHandler is the handler to be passed to Listener.Listen
+func (a *StreamAssembler) PacketHandler(pckt *tcp.Packet) {
+	if pckt.Proto == tcp.ProtoUDP {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	key := pckt.Flow
+	v, ok := a.lookup(key, pckt.Timestamp)
+	pair, _ := v.(*streamPair)
+	if !ok {
+		if pckt.RST {
+			return
+		}
+		pair = &streamPair{client: pckt.Reversed != (pckt.SYN && pckt.ACK)}
+		a.store(key, pair, pckt.Timestamp)
+	}
+	i := 1
+	if pckt.Reversed == pair.client {
+		i = 0
+	}
+	if pckt.RST {
+		a.reset(key, pair)
+		return
+	}
+	s := pair.dirs[i]
+	if s == nil {
+		s = newStream(pckt, i == 0, a.expire, a.maxSize)
+		pair.dirs[i] = s
+		go a.handle(s)
+	}
+	s.add(pckt)
+	if pckt.FIN {
+		a.closed(key, i, pckt)
+	}
+}
+
+// CloseHandler is the handler to be set as Listener.CloseHandler, the FIN and RST packets
+// without data are not passed to the packet handlers
+func (a *StreamAssembler) CloseHandler(flow tcp.FlowKey, reason tcp.CloseReason) {
+	a.Lock()
+	defer a.Unlock()
+	entry, ok := a.flows[flow]
+	if !ok {
+		return
+	}
+	pair := entry.state.(*streamPair)
+	switch reason {
+	case tcp.CloseRST:
+		a.reset(flow, pair)
+	case tcp.CloseFIN:
+		for _, s := range pair.dirs {
+			if s != nil {
+				s.end(io.EOF)
+			}
+		}
+		a.remove(flow)
+	}
+}
+
+func (a *StreamAssembler) reset(key tcp.FlowKey, pair *streamPair) {
+	for _, s := range pair.dirs {
+		if s != nil {
+			s.end(ErrConnectionReset)
+		}
+	}
+	a.remove(key)
+}
+
+// Close ends the streams still open, their reads return ErrStreamClosed
+func (a *StreamAssembler) Close() {
+	a.Lock()
+	defer a.Unlock()
+	for key, entry := range a.flows {
+		for _, s := range entry.state.(*streamPair).dirs {
+			if s != nil {
+				s.end(ErrStreamClosed)
+			}
+		}
+		a.remove(key)
+	}
+}
@@ -0,0 +1,95 @@
+package capture
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+func streamPacket(fromClient bool, seq uint32, payload string) *tcp.Packet {
+	pckt := wsPacket(fromClient, []byte(payload))
+	pckt.Seq = seq
+	return pckt
+}
+
+func TestStreamAssembler(t *testing.T) {
+	streams := make(chan *Stream, 2)
+	a := NewStreamAssembler(time.Minute, 0, func(s *Stream) { streams <- s })
+	defer a.Close()
+
+	req := "POST /items HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"
+	// the third segment arrives before the second one, which is retransmitted
+	a.PacketHandler(streamPacket(true, 1000, req[:10]))
+	a.PacketHandler(streamPacket(true, 1000+20, req[20:]))
+	a.PacketHandler(streamPacket(true, 1000+10, req[10:20]))
+	a.PacketHandler(streamPacket(true, 1000, req[:30]))
+	resp := "HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok"
+	a.PacketHandler(streamPacket(false, 5000, resp))
+
+	client, server := <-streams, <-streams
+	if !client.FromClient || server.FromClient {
+		client, server = server, client
+	}
+	r, err := http.ReadRequest(bufio.NewReader(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Method != "POST" || r.URL.Path != "/items" || string(body) != "hello" {
+		t.Errorf("unexpected request %s %s %q", r.Method, r.URL, body)
+	}
+	br := bufio.NewReader(server)
+	w, err := http.ReadResponse(br, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(w.Body)
+	if w.StatusCode != 201 || string(body) != "ok" {
+		t.Errorf("unexpected response %d %q", w.StatusCode, body)
+	}
+
+	fin := streamPacket(true, 1000+uint32(len(req)), "")
+	fin.FIN = true
+	a.PacketHandler(fin)
+	if _, err = client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected io.EOF after the FIN of the client, got %v", err)
+	}
+	a.CloseHandler(fin.Flow, tcp.CloseRST)
+	if _, err = br.ReadByte(); err != ErrConnectionReset {
+		t.Errorf("expected ErrConnectionReset, got %v", err)
+	}
+	if a.Flows() != 0 {
+		t.Errorf("expected the flow to be removed, got %d flows", a.Flows())
+	}
+}
+
+func TestStreamIdle(t *testing.T) {
+	streams := make(chan *Stream, 1)
+	a := NewStreamAssembler(50*time.Millisecond, 16, func(s *Stream) { streams <- s })
+	a.PacketHandler(streamPacket(true, 1, "GET"))
+	s := <-streams
+	buf := make([]byte, 8)
+	if n, err := s.Read(buf); n != 3 || err != nil {
+		t.Fatalf("expected 3 bytes, got %d %v", n, err)
+	}
+	if _, err := s.Read(buf); err != ErrStreamIdle {
+		t.Errorf("expected ErrStreamIdle, got %v", err)
+	}
+
+	// out of order segments waiting for a missing one are bounded
+	other := streamPacket(true, 1, "0123456789")
+	other.SrcPort = 5536
+	other.Flow, other.Reversed = tcp.NewFlowKey(other.SrcIP, other.SrcPort, other.DstIP, other.DstPort)
+	a.PacketHandler(other)
+	s = <-streams
+	other.Seq, other.Payload = 100, []byte("0123456789")
+	a.PacketHandler(other)
+	if _, err := ioutil.ReadAll(s); err != ErrStreamOverflow {
+		t.Errorf("expected ErrStreamOverflow, got %v", err)
+	}
+}
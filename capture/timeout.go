@@ -0,0 +1,59 @@
+package capture
+
+import (
+	"time"
+)
+
+// minBufferTimeout is the shortest buffer timeout of the pcap handles, libpcap returns from the reads
+// after a shorter one even without packets, and reading a quiet interface keeps a CPU busy
+const minBufferTimeout = time.Millisecond
+
+// bufferTimeout returns the buffer timeout of the pcap handles, BufferTimeout raised to minBufferTimeout,
+// or pcap.BlockForever when it is not set
+func (l *Listener) bufferTimeout(blockForever time.Duration) time.Duration {
+	switch {
+	case l.BufferTimeout == 0:
+		return blockForever
+	case l.BufferTimeout > 0 && l.BufferTimeout < minBufferTimeout:
+		l.debug(DebugWarn, "the buffer timeout %s is too short, %s is used instead, see --input-raw-immediate "+
+			"to deliver the packets as soon as they are captured\n", l.BufferTimeout, minBufferTimeout)
+		return minBufferTimeout
+	}
+	return l.BufferTimeout
+}
+
+// bounds of the sleeps of readBackoff
+const (
+	backoffAfter = 4 // consecutive timeouts before sleeping
+	minBackoff   = 50 * time.Microsecond
+	maxBackoff   = 5 * time.Millisecond
+)
+
+// readBackoff sleeps after consecutive read timeouts without packets, doubling the sleep up to maxBackoff,
+// so that the handles returning at once without packets don't keep a CPU busy. the first packet after
+// a quiet period is delayed by maxBackoff at most
+type readBackoff struct {
+	timeouts int
+	delay    time.Duration
+}
+
+// timeout records a read that returned without packet, and sleeps once it happened backoffAfter times in a row
+func (b *readBackoff) timeout() {
+	b.timeouts++
+	if b.timeouts < backoffAfter {
+		return
+	}
+	b.delay *= 2
+	if b.delay < minBackoff {
+		b.delay = minBackoff
+	}
+	if b.delay > maxBackoff {
+		b.delay = maxBackoff
+	}
+	time.Sleep(b.delay)
+}
+
+// reset records a packet
+func (b *readBackoff) reset() {
+	b.timeouts, b.delay = 0, 0
+}
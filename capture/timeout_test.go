@@ -0,0 +1,99 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func TestBufferTimeout(t *testing.T) {
+	l := &Listener{}
+	l.SetDebugLevel(DebugSilent)
+	for _, tt := range []struct{ timeout, want time.Duration }{
+		{0, pcap.BlockForever},
+		{pcap.BlockForever, pcap.BlockForever},
+		{10 * time.Microsecond, minBufferTimeout},
+		{2 * time.Second, 2 * time.Second},
+	} {
+		l.BufferTimeout = tt.timeout
+		if got := l.bufferTimeout(pcap.BlockForever); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.timeout, tt.want, got)
+		}
+	}
+}
+
+func TestReadBackoff(t *testing.T) {
+	var b readBackoff
+	for i := 1; i < backoffAfter; i++ {
+		b.timeout()
+	}
+	if b.delay != 0 {
+		t.Errorf("expected no sleep before %d timeouts, got %s", backoffAfter, b.delay)
+	}
+	b.timeout()
+	b.timeout()
+	if b.delay != 2*minBackoff {
+		t.Errorf("expected the sleep to double, got %s", b.delay)
+	}
+	b.delay = maxBackoff
+	b.timeout()
+	if b.delay != maxBackoff {
+		t.Errorf("expected the sleep to be bounded, got %s", b.delay)
+	}
+	b.reset()
+	if b.timeouts != 0 || b.delay != 0 {
+		t.Errorf("expected a packet to reset the backoff, got %+v", b)
+	}
+}
+
+// quietHandle is a handle without packets, its reads time out after timeout
+type quietHandle struct {
+	timeout time.Duration
+	reads   uint64
+	closed  chan struct{}
+}
+
+func (h *quietHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	atomic.AddUint64(&h.reads, 1)
+	select {
+	case <-h.closed:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	default:
+	}
+	time.Sleep(h.timeout)
+	return nil, gopacket.CaptureInfo{}, pcap.NextErrorTimeoutExpired
+}
+
+func (h *quietHandle) Close() {
+	close(h.closed)
+}
+
+// BenchmarkQuietInterface reads an interface without packets for a millisecond per op, reads/op tells
+// how busy the read loop keeps a CPU with the buffer timeout of the handle. a timeout of 0 is a handle
+// returning at once
+func BenchmarkQuietInterface(b *testing.B) {
+	for _, timeout := range []time.Duration{0, 100 * time.Microsecond, minBufferTimeout, 10 * time.Millisecond} {
+		b.Run(fmt.Sprintf("timeout=%s", timeout), func(b *testing.B) {
+			h := &quietHandle{timeout: timeout, closed: make(chan struct{})}
+			l := newFakeListener()
+			l.SetDebugLevel(DebugSilent)
+			l.AddPacketSource("quiet", h, layers.LinkTypeLoop)
+			errCh := l.ListenBackground(context.Background(), func(*tcp.Packet) {})
+			<-l.Ready()
+			b.ResetTimer()
+			time.Sleep(time.Duration(b.N) * time.Millisecond)
+			b.StopTimer()
+			l.Close()
+			<-errCh
+			b.ReportMetric(float64(atomic.LoadUint64(&h.reads))/float64(b.N), "reads/op")
+		})
+	}
+}
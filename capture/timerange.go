@@ -0,0 +1,27 @@
+package capture
+
+import "time"
+
+// timeRangeSlack is how far past EndTime the timestamps of a pcap file can go before it is no longer read,
+// the packets of a file are not always written in the order of their timestamps
+const timeRangeSlack = 5 * time.Second
+
+// timeRange selects the packets of a pcap file between StartTime and EndTime
+type timeRange struct {
+	start, end time.Time // zero when unbounded
+}
+
+func newTimeRange(start, end time.Time) *timeRange {
+	if start.IsZero() && end.IsZero() {
+		return nil
+	}
+	return &timeRange{start, end}
+}
+
+// check reports whether a packet is within the range, and whether the packets following it can't be anymore
+func (r *timeRange) check(ts time.Time) (in, over bool) {
+	if !r.end.IsZero() && !ts.Before(r.end) {
+		return false, ts.Sub(r.end) > timeRangeSlack
+	}
+	return r.start.IsZero() || !ts.Before(r.start), false
+}
@@ -0,0 +1,67 @@
+package capture
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestTimeRange(t *testing.T) {
+	base := time.Date(2020, 1, 2, 15, 0, 0, 0, time.UTC)
+	f, err := ioutil.TempFile("", "pcap_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	w := NewWriter(f)
+	if err = w.WriteFileHeader(64<<10, layers.LinkTypeLoop); err != nil {
+		t.Fatal(err)
+	}
+	// a packet every minute from 15:00 to 15:09, the packet of 15:04 is written after the one of 15:05
+	// and the one of 15:06 a second before 15:06
+	offsets := []time.Duration{0, 1, 2, 3, 5, 4, 6, 7, 8, 9}
+	for i, data := range rawPackets(1, len(offsets), 5, 4) {
+		ts := base.Add(offsets[i] * time.Minute)
+		if offsets[i] == 6 {
+			ts = ts.Add(-time.Second)
+		}
+		ci := gopacket.CaptureInfo{Timestamp: ts, Length: len(data), CaptureLength: len(data)}
+		if err = w.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	l, err := NewListener(f.Name(), []uint16{8000}, "", EnginePcapFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.StartTime = base.Add(2 * time.Minute)
+	l.EndTime = base.Add(6 * time.Minute)
+	if err = l.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint32
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) {
+		seqs = append(seqs, pckt.Seq)
+	})
+	// the packets of 15:02 up to 15:06 excluded, including the one written out of order
+	want := []uint32{3, 4, 5, 6, 7}
+	if len(seqs) != len(want) {
+		t.Fatalf("expected the packets %v, got %v", want, seqs)
+	}
+	for i := range want {
+		if seqs[i] != want[i] {
+			t.Fatalf("expected the packets %v, got %v", want, seqs)
+		}
+	}
+	if p, _ := l.Progress(); p.Packets != 8 {
+		t.Errorf("expected reading to stop at the packet of 15:07, got %d packets read", p.Packets)
+	}
+}
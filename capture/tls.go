@@ -0,0 +1,246 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+)
+
+// TLS record and handshake constants https://tools.ietf.org/html/rfc8446#section-5.1
+const (
+	tlsRecordHandshake   = 0x16
+	tlsHandshakeClientHi = 0x01
+	tlsRecordHeaderLen   = 5
+	tlsExtServerName     = 0x0
+	tlsExtALPN           = 0x10
+	tlsMaxHandshakeLen   = 1 << 16
+)
+
+// TLSClientHello is the unencrypted metadata of a TLS connection, it is emitted once per connection
+type TLSClientHello struct {
+	Flow             tcp.FlowKey
+	SrcAddr, DstAddr string
+	Version          uint16 // legacy version of the ClientHello
+	ServerName       string
+	ALPN             []string
+	Timestamp        time.Time // timestamp of the packet that completed the ClientHello
+}
+
+// TLSEmitter is called with the ClientHello of every TLS connection
+type TLSEmitter func(*TLSClientHello)
+
+// TLSParser reads the ClientHello of the flows it sees to extract the SNI and ALPN extensions,
+// nothing gets decrypted. flows that don't start with a TLS handshake are skipped.
+// its CloseHandler must be set as Listener.CloseHandler for the flows to be removed on close.
+type TLSParser struct {
+	flowTable
+	emit TLSEmitter
+}
+
+type tlsFlow struct {
+	client bool   // Reversed flag of the packets sent by the client
+	buf    []byte // handshake bytes, without the record headers
+	rec    []byte // incomplete record
+	done   bool   // the ClientHello was parsed or the flow is not TLS
+}
+
+// NewTLSParser returns a new TLS parser, a flow is evicted after being idle for expire, or when it is closed
+func NewTLSParser(expire time.Duration, emit TLSEmitter) *TLSParser {
+	parser := new(TLSParser)
+	parser.init(expire, time.Minute)
+	parser.emit = emit
+	return parser
+}
+
+// PacketHandler is the handler to be passed to Listener.Listen
+func (parser *TLSParser) PacketHandler(pckt *tcp.Packet) {
+	parser.Lock()
+	defer parser.Unlock()
+
+	key := pckt.Flow
+	v, ok := parser.lookup(key, pckt.Timestamp)
+	flow, _ := v.(*tlsFlow)
+	if pckt.FIN || pckt.RST {
+		if ok {
+			dir := 1
+			if pckt.Reversed == flow.client {
+				dir = 0
+			}
+			parser.closed(key, dir, pckt)
+		}
+		return
+	}
+	if len(pckt.Payload) == 0 {
+		return
+	}
+	if !ok {
+		flow = &tlsFlow{client: pckt.Reversed}
+		parser.store(key, flow, pckt.Timestamp)
+		// the first data of a TLS connection is the client's handshake record
+		if !isTLSClientHello(pckt.Payload) {
+			flow.done = true
+		}
+	}
+	if flow.done {
+		return
+	}
+	hello, err := flow.read(pckt.Payload)
+	if err != nil || hello != nil {
+		flow.done = true
+		flow.buf, flow.rec = nil, nil
+	}
+	if hello != nil {
+		hello.Flow = pckt.Flow
+		hello.SrcAddr = pckt.Src()
+		hello.DstAddr = pckt.Dst()
+		hello.Timestamp = pckt.Timestamp
+		parser.emit(hello)
+	}
+}
+
+// read unwraps the handshake records of data, the ClientHello can span several records and segments
+func (flow *tlsFlow) read(data []byte) (*TLSClientHello, error) {
+	flow.rec = append(flow.rec, data...)
+	for len(flow.rec) >= tlsRecordHeaderLen {
+		if flow.rec[0] != tlsRecordHandshake {
+			return nil, fmt.Errorf("tls: unexpected record type %#x", flow.rec[0])
+		}
+		length := int(binary.BigEndian.Uint16(flow.rec[3:]))
+		if len(flow.rec) < tlsRecordHeaderLen+length {
+			break
+		}
+		flow.buf = append(flow.buf, flow.rec[tlsRecordHeaderLen:tlsRecordHeaderLen+length]...)
+		flow.rec = flow.rec[tlsRecordHeaderLen+length:]
+	}
+	if len(flow.buf) < 4 {
+		return nil, nil
+	}
+	length := int(flow.buf[1])<<16 | int(flow.buf[2])<<8 | int(flow.buf[3])
+	if length > tlsMaxHandshakeLen {
+		return nil, fmt.Errorf("tls: handshake message of %d bytes is too large", length)
+	}
+	if len(flow.buf) < 4+length {
+		return nil, nil
+	}
+	return ParseTLSClientHello(flow.buf[4 : 4+length])
+}
+
+// ParseTLSClientHello parses the body of a ClientHello handshake message https://tools.ietf.org/html/rfc8446#section-4.1.2
+func ParseTLSClientHello(body []byte) (*TLSClientHello, error) {
+	r := tlsReader(body)
+	hello := new(TLSClientHello)
+	version, ok := r.uint16()
+	if !ok || !r.skip(32) { // random
+		return nil, errTLSShortHello
+	}
+	hello.Version = version
+	if _, ok = r.vector(1); !ok { // session id
+		return nil, errTLSShortHello
+	}
+	if _, ok = r.vector(2); !ok { // cipher suites
+		return nil, errTLSShortHello
+	}
+	if _, ok = r.vector(1); !ok { // compression methods
+		return nil, errTLSShortHello
+	}
+	if len(r) == 0 {
+		// extensions are optional
+		return hello, nil
+	}
+	exts, ok := r.vector(2)
+	if !ok {
+		return nil, errTLSShortHello
+	}
+	for len(exts) > 0 {
+		typ, ok := exts.uint16()
+		if !ok {
+			return nil, errTLSShortHello
+		}
+		data, ok := exts.vector(2)
+		if !ok {
+			return nil, errTLSShortHello
+		}
+		switch typ {
+		case tlsExtServerName:
+			names, _ := data.vector(2)
+			for len(names) > 0 {
+				nameType, _ := names.uint8()
+				name, ok := names.vector(2)
+				if !ok {
+					return nil, errTLSShortHello
+				}
+				if nameType == 0 {
+					hello.ServerName = string(name)
+				}
+			}
+		case tlsExtALPN:
+			protos, _ := data.vector(2)
+			for len(protos) > 0 {
+				proto, ok := protos.vector(1)
+				if !ok {
+					return nil, errTLSShortHello
+				}
+				hello.ALPN = append(hello.ALPN, string(proto))
+			}
+		}
+	}
+	return hello, nil
+}
+
+var errTLSShortHello = fmt.Errorf("tls: malformed ClientHello")
+
+// isTLSClientHello reports whether data starts with a handshake record holding a ClientHello
+func isTLSClientHello(data []byte) bool {
+	return len(data) > tlsRecordHeaderLen &&
+		data[0] == tlsRecordHandshake &&
+		data[1] == 3 && // SSL 3.0 and every TLS version
+		data[tlsRecordHeaderLen] == tlsHandshakeClientHi
+}
+
+type tlsReader []byte
+
+func (r *tlsReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *tlsReader) uint8() (byte, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *tlsReader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+// vector reads a variable-length vector prefixed by a size of lenSize bytes
+func (r *tlsReader) vector(lenSize int) (tlsReader, bool) {
+	if len(*r) < lenSize {
+		return nil, false
+	}
+	n := 0
+	for _, b := range (*r)[:lenSize] {
+		n = n<<8 | int(b)
+	}
+	*r = (*r)[lenSize:]
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
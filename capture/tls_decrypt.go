@@ -0,0 +1,569 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// TLS record and handshake types used by the decrypter
+const (
+	tlsRecordChangeCipherSpec = 0x14
+	tlsRecordApplicationData  = 0x17
+	tlsHandshakeServerHi      = 0x02
+	tlsHandshakeFinished      = 0x14
+	tlsExtSupportedVersions   = 0x2b
+	tlsVersion13              = 0x0304
+	tlsMaxRecordLen           = 1<<14 + 2048
+	tlsMaxPendingSegments     = 256
+)
+
+// tlsHelloRetryRandom is the random of a ServerHello asking for a new ClientHello https://tools.ietf.org/html/rfc8446#section-4.1.3
+var tlsHelloRetryRandom = []byte{
+	0xCF, 0x21, 0xAD, 0x74, 0xE5, 0x9A, 0x61, 0x11, 0xBE, 0x1D, 0x8C, 0x02, 0x1E, 0x65, 0xB8, 0x91,
+	0xC2, 0xA2, 0x11, 0x16, 0x7A, 0xBB, 0x8C, 0x5E, 0x07, 0x9E, 0x09, 0xE2, 0xC8, 0xA8, 0x33, 0x9C,
+}
+
+// KeyLog holds the secrets of an NSS key log file, as written by clients honoring SSLKEYLOGFILE
+// https://developer.mozilla.org/en-US/docs/Mozilla/Projects/NSS/Key_Log_Format
+type KeyLog struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	secrets map[string][]byte // label and client random -> secret
+}
+
+// LoadKeyLog reads the key log at path, the file is read again when a secret is missing
+// because clients keep appending to it
+func LoadKeyLog(path string) (*KeyLog, error) {
+	kl := &KeyLog{path: path, secrets: make(map[string][]byte)}
+	return kl, kl.reload()
+}
+
+// ParseKeyLog reads a key log from r
+func ParseKeyLog(r io.Reader) (*KeyLog, error) {
+	kl := &KeyLog{secrets: make(map[string][]byte)}
+	return kl, kl.read(r)
+}
+
+// Secret returns the secret logged with label for the connection identified by clientRandom, or nil
+func (kl *KeyLog) Secret(label string, clientRandom []byte) []byte {
+	kl.Lock()
+	defer kl.Unlock()
+	key := label + string(clientRandom)
+	if secret, ok := kl.secrets[key]; ok || kl.path == "" {
+		return secret
+	}
+	if kl.reload() != nil {
+		return nil
+	}
+	return kl.secrets[key]
+}
+
+func (kl *KeyLog) reload() error {
+	stat, err := os.Stat(kl.path)
+	if err != nil {
+		return err
+	}
+	if !stat.ModTime().After(kl.modTime) {
+		return nil
+	}
+	f, err := os.Open(kl.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	kl.modTime = stat.ModTime()
+	return kl.read(f)
+}
+
+func (kl *KeyLog) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		random, err := hex.DecodeString(fields[1])
+		if err != nil || len(random) != 32 {
+			continue
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+		kl.secrets[fields[0]+string(random)] = secret
+	}
+	return scanner.Err()
+}
+
+// tlsSuite describes the AEAD cipher suites the decrypter supports
+type tlsSuite struct {
+	keyLen        int
+	hash          func() hash.Hash
+	aead          func(key []byte) (cipher.AEAD, error)
+	explicitNonce bool // TLS 1.2 AES-GCM records start with the explicit part of the nonce
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var tlsSuites = map[uint16]tlsSuite{
+	0x1301: {16, sha256.New, aesGCM, false},               // TLS_AES_128_GCM_SHA256
+	0x1302: {32, sha512.New384, aesGCM, false},            // TLS_AES_256_GCM_SHA384
+	0x1303: {32, sha256.New, chacha20poly1305.New, false}, // TLS_CHACHA20_POLY1305_SHA256
+	0x009C: {16, sha256.New, aesGCM, true},                // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009D: {32, sha512.New384, aesGCM, true},             // TLS_RSA_WITH_AES_256_GCM_SHA384
+	0xC02B: {16, sha256.New, aesGCM, true},                // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xC02C: {32, sha512.New384, aesGCM, true},             // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xC02F: {16, sha256.New, aesGCM, true},                // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xC030: {32, sha512.New384, aesGCM, true},             // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	0xCCA8: {32, sha256.New, chacha20poly1305.New, false}, // TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+	0xCCA9: {32, sha256.New, chacha20poly1305.New, false}, // TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256
+}
+
+// tlsCipher decrypts the records of one direction of a connection
+type tlsCipher struct {
+	aead          cipher.AEAD
+	iv            []byte
+	seq           uint64
+	explicitNonce bool
+	tls13         bool
+}
+
+func newTLSCipher(suite tlsSuite, key, iv []byte, tls13 bool) (*tlsCipher, error) {
+	aead, err := suite.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsCipher{aead: aead, iv: iv, explicitNonce: suite.explicitNonce, tls13: tls13}, nil
+}
+
+// open decrypts the payload of a record, it returns the content type and the plaintext
+func (c *tlsCipher) open(header, payload []byte) (byte, []byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if c.explicitNonce {
+		if len(payload) < 8 {
+			return 0, nil, fmt.Errorf("tls: short encrypted record")
+		}
+		copy(nonce, c.iv)
+		copy(nonce[len(c.iv):], payload[:8])
+		payload = payload[8:]
+	} else {
+		copy(nonce, c.iv)
+		for i := 0; i < 8; i++ {
+			nonce[len(nonce)-1-i] ^= byte(c.seq >> (8 * i))
+		}
+	}
+	if len(payload) < c.aead.Overhead() {
+		return 0, nil, fmt.Errorf("tls: short encrypted record")
+	}
+	aad := header
+	if !c.tls13 {
+		aad = make([]byte, 13)
+		binary.BigEndian.PutUint64(aad, c.seq)
+		copy(aad[8:], header[:3])
+		binary.BigEndian.PutUint16(aad[11:], uint16(len(payload)-c.aead.Overhead()))
+	}
+	plain, err := c.aead.Open(nil, nonce, payload, aad)
+	if err != nil {
+		return 0, nil, err
+	}
+	c.seq++
+	if !c.tls13 {
+		return header[0], plain, nil
+	}
+	// the real content type is the last non zero byte of TLSInnerPlaintext
+	i := len(plain) - 1
+	for i >= 0 && plain[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return 0, nil, fmt.Errorf("tls: record without content type")
+	}
+	return plain[i], plain[:i], nil
+}
+
+// TLSDecrypter decrypts TLS 1.2 and TLS 1.3 flows with the secrets of a key log, and passes
+// the decrypted application data to the next handler as if it was captured in plaintext.
+// flows that are not TLS are passed untouched, and TLS flows without known secrets are dropped.
+// only AEAD cipher suites are supported, and TLS 1.3 KeyUpdate messages are not: the records
+// following a KeyUpdate fail to decrypt and the rest of the flow is dropped. This is meant for
+// debugging in staging environments, the key log gives access to all the traffic of the clients
+// that wrote it. its CloseHandler must be set as Listener.CloseHandler for the flows to be
+// removed on close.
+type TLSDecrypter struct {
+	flowTable
+	keys    *KeyLog
+	handler PacketHandler
+}
+
+type tlsSession struct {
+	plain        bool // not TLS, packets are passed through
+	failed       bool // can't be decrypted, packets are dropped
+	client       bool // Reversed flag of the packets sent by the client
+	version      uint16
+	suite        uint16
+	clientRandom []byte
+	serverRandom []byte
+	dirs         [2]*tlsStream // 0 from client, 1 from server
+}
+
+// tlsStream reorders the segments of one direction and holds its record layer state
+type tlsStream struct {
+	synced   bool
+	nextSeq  uint32
+	pending  map[uint32][]byte // segments received ahead of nextSeq
+	rec      []byte            // incomplete record
+	hs       []byte            // incomplete handshake message
+	cipher   *tlsCipher
+	next     *tlsCipher // TLS 1.3 application keys, used after the Finished message
+	plainSeq uint32     // sequence number of the decrypted stream
+}
+
+// NewTLSDecrypter returns a new decrypter passing decrypted packets to handler, a flow is evicted
+// after being idle for expire, default is 5 minutes, or when it is closed.
+func NewTLSDecrypter(keys *KeyLog, expire time.Duration, handler PacketHandler) *TLSDecrypter {
+	d := new(TLSDecrypter)
+	d.init(expire, 5*time.Minute)
+	d.keys = keys
+	d.handler = handler
+	return d
+}
+
+// PacketHandler is the handler to be passed to Listener.Listen
+func (d *TLSDecrypter) PacketHandler(pckt *tcp.Packet) {
+	d.Lock()
+	defer d.Unlock()
+
+	key := pckt.Flow
+	v, ok := d.lookup(key, pckt.Timestamp)
+	s, _ := v.(*tlsSession)
+	if !ok {
+		if len(pckt.Payload) == 0 {
+			d.handler(pckt)
+			return
+		}
+		s = &tlsSession{client: pckt.Reversed}
+		switch {
+		case isTLSClientHello(pckt.Payload):
+			s.dirs[0], s.dirs[1] = new(tlsStream), new(tlsStream)
+		case isTLSRecord(pckt.Payload):
+			// we missed the handshake
+			s.failed = true
+		default:
+			s.plain = true
+		}
+		d.store(key, s, pckt.Timestamp)
+	}
+	i := 1
+	if pckt.Reversed == s.client {
+		i = 0
+	}
+	switch {
+	case s.plain:
+		d.handler(pckt)
+	case !s.failed:
+		data, err := s.dirs[i].push(pckt.Seq, pckt.Payload)
+		if err == nil {
+			data, err = d.records(s, i, data)
+		}
+		if err != nil {
+			s.failed = true
+			s.dirs = [2]*tlsStream{}
+			break
+		}
+		if len(data) > 0 {
+			d.emit(s, i, pckt, data)
+		}
+	}
+	if pckt.FIN || pckt.RST {
+		d.closed(key, i, pckt)
+	}
+}
+
+// emit passes the plaintext as a new packet, sequence numbers are those of the decrypted streams
+func (d *TLSDecrypter) emit(s *tlsSession, i int, pckt *tcp.Packet, data []byte) {
+	stream, peer := s.dirs[i], s.dirs[1-i]
+	p := new(tcp.Packet)
+	*p = *pckt
+	p.Payload = data
+	p.Seq = stream.plainSeq
+	p.Ack = peer.plainSeq
+	stream.plainSeq += uint32(len(data))
+	d.handler(p)
+}
+
+// push returns the data of the segment and of the pending segments that follow it, in order.
+// the stream is synced on the first segment starting with a record.
+func (stream *tlsStream) push(seq uint32, data []byte) ([]byte, error) {
+	if !stream.synced {
+		if !isTLSRecord(data) {
+			return nil, stream.hold(seq, data)
+		}
+		stream.synced = true
+		stream.nextSeq = seq
+	}
+	diff := int32(seq - stream.nextSeq)
+	if diff > 0 {
+		return nil, stream.hold(seq, data)
+	}
+	if int(-diff) >= len(data) {
+		// retransmission
+		return nil, nil
+	}
+	out := append([]byte{}, data[-diff:]...)
+	stream.nextSeq += uint32(len(out))
+	for found := true; found; {
+		found = false
+		for seq, data := range stream.pending {
+			diff := int32(seq - stream.nextSeq)
+			if diff > 0 {
+				continue
+			}
+			delete(stream.pending, seq)
+			if int(-diff) < len(data) {
+				out = append(out, data[-diff:]...)
+				stream.nextSeq += uint32(len(data[-diff:]))
+				found = true
+			}
+		}
+	}
+	return out, nil
+}
+
+func (stream *tlsStream) hold(seq uint32, data []byte) error {
+	if stream.pending == nil {
+		stream.pending = make(map[uint32][]byte)
+	}
+	if len(stream.pending) >= tlsMaxPendingSegments {
+		return fmt.Errorf("tls: too many out of order segments")
+	}
+	stream.pending[seq] = append([]byte{}, data...)
+	return nil
+}
+
+// records parses the complete records of a direction and returns their application data
+func (d *TLSDecrypter) records(s *tlsSession, i int, data []byte) (out []byte, err error) {
+	stream := s.dirs[i]
+	stream.rec = append(stream.rec, data...)
+	for len(stream.rec) >= tlsRecordHeaderLen {
+		length := int(binary.BigEndian.Uint16(stream.rec[3:]))
+		if length > tlsMaxRecordLen {
+			return nil, fmt.Errorf("tls: record of %d bytes is too large", length)
+		}
+		if len(stream.rec) < tlsRecordHeaderLen+length {
+			break
+		}
+		header, payload := stream.rec[:tlsRecordHeaderLen], stream.rec[tlsRecordHeaderLen:tlsRecordHeaderLen+length]
+		stream.rec = stream.rec[tlsRecordHeaderLen+length:]
+		typ := header[0]
+		if typ != tlsRecordChangeCipherSpec {
+			switch {
+			case stream.cipher != nil:
+				if typ, payload, err = stream.cipher.open(header, payload); err != nil {
+					return
+				}
+			case typ == tlsRecordApplicationData:
+				return nil, fmt.Errorf("tls: application data before the keys are known")
+			}
+		}
+		switch typ {
+		case tlsRecordChangeCipherSpec:
+			// in TLS 1.3 it is only sent for middlebox compatibility
+			if s.version != tlsVersion13 {
+				if stream.cipher, err = d.cipher12(s, i); err != nil {
+					return
+				}
+			}
+		case tlsRecordHandshake:
+			stream.hs = append(stream.hs, payload...)
+			if err = d.handshake(s, i); err != nil {
+				return
+			}
+		case tlsRecordApplicationData:
+			out = append(out, payload...)
+		}
+	}
+	if len(stream.rec) == 0 {
+		stream.rec = nil
+	}
+	return
+}
+
+func (d *TLSDecrypter) handshake(s *tlsSession, i int) error {
+	stream := s.dirs[i]
+	for len(stream.hs) >= 4 {
+		length := int(stream.hs[1])<<16 | int(stream.hs[2])<<8 | int(stream.hs[3])
+		if length > tlsMaxHandshakeLen {
+			return fmt.Errorf("tls: handshake message of %d bytes is too large", length)
+		}
+		if len(stream.hs) < 4+length {
+			break
+		}
+		typ, body := stream.hs[0], stream.hs[4:4+length]
+		stream.hs = stream.hs[4+length:]
+		switch typ {
+		case tlsHandshakeClientHi:
+			if len(body) < 34 {
+				return errTLSShortHello
+			}
+			s.clientRandom = append([]byte{}, body[2:34]...)
+		case tlsHandshakeServerHi:
+			if err := s.serverHello(body); err != nil {
+				return err
+			}
+			if s.version == tlsVersion13 && !bytes.Equal(s.serverRandom, tlsHelloRetryRandom) {
+				if err := d.ciphers13(s); err != nil {
+					return err
+				}
+			}
+		case tlsHandshakeFinished:
+			if stream.next != nil {
+				stream.cipher, stream.next = stream.next, nil
+			}
+		}
+	}
+	if len(stream.hs) == 0 {
+		stream.hs = nil
+	}
+	return nil
+}
+
+func (s *tlsSession) serverHello(body []byte) error {
+	r := tlsReader(body)
+	version, ok := r.uint16()
+	if !ok || len(r) < 32 {
+		return fmt.Errorf("tls: malformed ServerHello")
+	}
+	s.version = version
+	s.serverRandom = append([]byte{}, r[:32]...)
+	r.skip(32)
+	if _, ok = r.vector(1); !ok { // session id
+		return fmt.Errorf("tls: malformed ServerHello")
+	}
+	if s.suite, ok = r.uint16(); !ok || !r.skip(1) {
+		return fmt.Errorf("tls: malformed ServerHello")
+	}
+	if _, ok := tlsSuites[s.suite]; !ok {
+		return fmt.Errorf("tls: unsupported cipher suite %#04x", s.suite)
+	}
+	exts, _ := r.vector(2)
+	for len(exts) > 0 {
+		typ, _ := exts.uint16()
+		data, ok := exts.vector(2)
+		if !ok {
+			return fmt.Errorf("tls: malformed ServerHello")
+		}
+		if typ == tlsExtSupportedVersions {
+			s.version, _ = data.uint16()
+		}
+	}
+	return nil
+}
+
+// cipher12 returns the TLS 1.2 cipher of direction i, keys are expanded from the master secret
+// https://tools.ietf.org/html/rfc5246#section-6.3
+func (d *TLSDecrypter) cipher12(s *tlsSession, i int) (*tlsCipher, error) {
+	suite, ok := tlsSuites[s.suite]
+	if !ok || s.clientRandom == nil {
+		return nil, fmt.Errorf("tls: ChangeCipherSpec before the hellos")
+	}
+	master := d.keys.Secret("CLIENT_RANDOM", s.clientRandom)
+	if master == nil {
+		return nil, fmt.Errorf("tls: no master secret for client random %x", s.clientRandom)
+	}
+	ivLen := 12
+	if suite.explicitNonce {
+		ivLen = 4
+	}
+	seed := append(append([]byte{}, s.serverRandom...), s.clientRandom...)
+	block := prf12(suite.hash, master, "key expansion", seed, 2*suite.keyLen+2*ivLen)
+	key := block[i*suite.keyLen : (i+1)*suite.keyLen]
+	iv := block[2*suite.keyLen+i*ivLen : 2*suite.keyLen+(i+1)*ivLen]
+	return newTLSCipher(suite, key, iv, false)
+}
+
+// ciphers13 sets the handshake and application ciphers of both directions
+// https://tools.ietf.org/html/rfc8446#section-7.3
+func (d *TLSDecrypter) ciphers13(s *tlsSession) (err error) {
+	suite := tlsSuites[s.suite]
+	labels := [2][2]string{
+		{"CLIENT_HANDSHAKE_TRAFFIC_SECRET", "CLIENT_TRAFFIC_SECRET_0"},
+		{"SERVER_HANDSHAKE_TRAFFIC_SECRET", "SERVER_TRAFFIC_SECRET_0"},
+	}
+	for i, stream := range s.dirs {
+		var ciphers [2]*tlsCipher
+		for j, label := range labels[i] {
+			secret := d.keys.Secret(label, s.clientRandom)
+			if secret == nil {
+				return fmt.Errorf("tls: no %s for client random %x", label, s.clientRandom)
+			}
+			key := hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen)
+			iv := hkdfExpandLabel(suite.hash, secret, "iv", 12)
+			if ciphers[j], err = newTLSCipher(suite, key, iv, true); err != nil {
+				return
+			}
+		}
+		stream.cipher, stream.next = ciphers[0], ciphers[1]
+	}
+	return
+}
+
+// prf12 is the TLS 1.2 pseudorandom function https://tools.ietf.org/html/rfc5246#section-5
+func prf12(hash func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(hash, secret)
+	out := make([]byte, 0, n+mac.Size())
+	a := seed
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label with an empty context https://tools.ietf.org/html/rfc8446#section-7.1
+func hkdfExpandLabel(hash func() hash.Hash, secret []byte, label string, n int) []byte {
+	label = "tls13 " + label
+	info := append([]byte{byte(n >> 8), byte(n), byte(len(label))}, label...)
+	info = append(info, 0)
+	out := make([]byte, n)
+	io.ReadFull(hkdf.Expand(hash, secret, info), out)
+	return out
+}
+
+// isTLSRecord reports whether data looks like the start of a TLS record
+func isTLSRecord(data []byte) bool {
+	return len(data) >= tlsRecordHeaderLen &&
+		data[0] >= tlsRecordChangeCipherSpec && data[0] <= tlsRecordApplicationData &&
+		data[1] == 3 && data[2] <= 4
+}
@@ -0,0 +1,206 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket/layers"
+)
+
+type tlsSegment struct {
+	fromClient bool
+	data       []byte
+}
+
+// recordConn records what is written to a connection, in the order of the writes
+type recordConn struct {
+	net.Conn
+	fromClient bool
+	mu         *sync.Mutex
+	segments   *[]tlsSegment
+}
+
+func (c recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	*c.segments = append(*c.segments, tlsSegment{c.fromClient, append([]byte{}, b...)})
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func tlsCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour), DNSNames: []string{"example.com"}}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsExchange runs a request and a response over a TLS connection and returns its segments and key log
+func tlsExchange(t *testing.T, version uint16, suite uint16) ([]tlsSegment, string) {
+	var (
+		mu       sync.Mutex
+		segments []tlsSegment
+		keyLog   bytes.Buffer
+	)
+	c1, c2 := net.Pipe()
+	client := tls.Client(recordConn{c1, true, &mu, &segments}, &tls.Config{
+		InsecureSkipVerify: true,
+		KeyLogWriter:       &keyLog,
+		MinVersion:         version,
+		MaxVersion:         version,
+		CipherSuites:       []uint16{suite},
+	})
+	server := tls.Server(recordConn{c2, false, &mu, &segments}, &tls.Config{
+		Certificates: []tls.Certificate{tlsCertificate(t)},
+		MaxVersion:   version,
+	})
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64)
+		n, err := server.Read(buf)
+		if err == nil && !strings.HasPrefix(string(buf[:n]), "GET") {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			_, err = server.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+		}
+		done <- err
+	}()
+	if _, err := client.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	if _, err := io.ReadAtLeast(client, buf, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c1.Close()
+	c2.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	return segments, keyLog.String()
+}
+
+func TestTLSDecrypter(t *testing.T) {
+	tests := []struct {
+		name    string
+		version uint16
+		suite   uint16
+	}{
+		{"TLS 1.2 AES-GCM", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		{"TLS 1.2 ChaCha20", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+		{"TLS 1.3", tls.VersionTLS13, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, log := tlsExchange(t, tt.version, tt.suite)
+			keys, err := ParseKeyLog(strings.NewReader(log))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var packets []*tcp.Packet
+			d := NewTLSDecrypter(keys, 0, func(p *tcp.Packet) { packets = append(packets, p) })
+
+			// every segment is split in two, and the halves of the segments after the ClientHello are swapped
+			var seq [2]uint32
+			for n, seg := range segments {
+				dir := 1
+				if seg.fromClient {
+					dir = 0
+				}
+				half := len(seg.data) / 2
+				first, second := wsPacket(seg.fromClient, seg.data[:half]), wsPacket(seg.fromClient, seg.data[half:])
+				first.Seq, second.Seq = seq[dir], seq[dir]+uint32(half)
+				seq[dir] += uint32(len(seg.data))
+				if n == 1 || n == 2 {
+					first, second = second, first
+				}
+				d.PacketHandler(first)
+				d.PacketHandler(second)
+			}
+
+			if len(packets) != 2 {
+				t.Fatalf("expected 2 decrypted packets, got %d", len(packets))
+			}
+			req, resp := packets[0], packets[1]
+			if !strings.HasPrefix(string(req.Payload), "GET / HTTP/1.1") || req.SrcPort != 5535 {
+				t.Errorf("wrong request %q", req.Payload)
+			}
+			if !strings.HasPrefix(string(resp.Payload), "HTTP/1.1 200 OK") || resp.SrcPort != 8000 {
+				t.Errorf("wrong response %q", resp.Payload)
+			}
+			if req.Ack != resp.Seq || resp.Ack != uint32(len(req.Payload)) {
+				t.Errorf("expected the sequence numbers of the plaintext, got %d %d %d", req.Ack, resp.Seq, resp.Ack)
+			}
+		})
+	}
+}
+
+func TestTLSDecrypterPassthrough(t *testing.T) {
+	var packets []*tcp.Packet
+	d := NewTLSDecrypter(&KeyLog{secrets: map[string][]byte{}}, 0, func(p *tcp.Packet) { packets = append(packets, p) })
+
+	d.PacketHandler(wsPacket(true, []byte("GET / HTTP/1.1\r\n\r\n")))
+	// the handshake is unknown, nothing can be decrypted
+	enc := wsPacket(true, []byte{tlsRecordApplicationData, 3, 3, 0, 2, 1, 2})
+	enc.SrcPort = 5536
+	enc.Flow, enc.Reversed = tcp.NewFlowKey(enc.SrcIP, enc.SrcPort, enc.DstIP, enc.DstPort)
+	d.PacketHandler(enc)
+	if len(packets) != 1 || packets[0].SrcPort != 5535 {
+		t.Errorf("expected plaintext flows to be passed through, got %d packets", len(packets))
+	}
+}
+
+func TestTLSDecrypterCloseHandler(t *testing.T) {
+	d := NewTLSDecrypter(&KeyLog{secrets: map[string][]byte{}}, 0, func(p *tcp.Packet) {})
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.CloseHandler = d.CloseHandler
+	// the RST packet without payload only reaches the CloseHandler
+	h.packets <- tcpSegment(true, 0x18, tlsRecord(tlsClientHello("example.com")))
+	h.packets <- tcpSegment(false, 0x04, nil)
+	close(h.packets)
+	var flows int
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) {
+		d.PacketHandler(pckt)
+		flows = d.Flows()
+	})
+	if flows != 1 || d.Flows() != 0 {
+		t.Errorf("expected the flow to be removed once reset, got %d flows tracked and %d left", flows, d.Flows())
+	}
+}
+
+func TestParseKeyLog(t *testing.T) {
+	random := strings.Repeat("ab", 32)
+	keys, err := ParseKeyLog(strings.NewReader("# comment\nCLIENT_RANDOM " + random + " 0102\ninvalid line\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := keys.Secret("CLIENT_RANDOM", bytes.Repeat([]byte{0xab}, 32)); !bytes.Equal(s, []byte{1, 2}) {
+		t.Errorf("wrong secret %x", s)
+	}
+	if s := keys.Secret("SERVER_TRAFFIC_SECRET_0", bytes.Repeat([]byte{0xab}, 32)); s != nil {
+		t.Errorf("unexpected secret %x", s)
+	}
+}
@@ -0,0 +1,127 @@
+package capture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket/layers"
+)
+
+func tlsVector(lenSize int, data []byte) []byte {
+	v := make([]byte, lenSize, lenSize+len(data))
+	for i := 0; i < lenSize; i++ {
+		v[i] = byte(len(data) >> (8 * (lenSize - 1 - i)))
+	}
+	return append(v, data...)
+}
+
+func tlsClientHello(serverName string, alpn ...string) []byte {
+	body := []byte{3, 3}
+	body = append(body, make([]byte, 32)...)              // random
+	body = append(body, tlsVector(1, nil)...)             // session id
+	body = append(body, tlsVector(2, []byte{0x13, 1})...) // cipher suites
+	body = append(body, tlsVector(1, []byte{0})...)       // compression methods
+
+	name := append([]byte{0}, tlsVector(2, []byte(serverName))...)
+	exts := append([]byte{0, tlsExtServerName}, tlsVector(2, tlsVector(2, name))...)
+	var protos []byte
+	for _, p := range alpn {
+		protos = append(protos, tlsVector(1, []byte(p))...)
+	}
+	exts = append(exts, 0, tlsExtALPN)
+	exts = append(exts, tlsVector(2, tlsVector(2, protos))...)
+	body = append(body, tlsVector(2, exts)...)
+	return append([]byte{tlsHandshakeClientHi}, tlsVector(3, body)...)
+}
+
+func tlsRecord(data []byte) []byte {
+	return append([]byte{tlsRecordHandshake, 3, 1}, tlsVector(2, data)...)
+}
+
+func TestTLSParser(t *testing.T) {
+	var hellos []*TLSClientHello
+	parser := NewTLSParser(time.Minute, func(h *TLSClientHello) { hellos = append(hellos, h) })
+
+	// the handshake message is split into two records, and the second record into two segments
+	msg := tlsClientHello("example.com", "h2", "http/1.1")
+	data := append(tlsRecord(msg[:20]), tlsRecord(msg[20:])...)
+	parser.PacketHandler(wsPacket(true, data[:40]))
+	parser.PacketHandler(wsPacket(true, data[40:]))
+	// nothing left to parse on this connection
+	parser.PacketHandler(wsPacket(true, tlsRecord(msg)))
+
+	if len(hellos) != 1 {
+		t.Fatalf("expected 1 ClientHello, got %d", len(hellos))
+	}
+	h := hellos[0]
+	if h.ServerName != "example.com" || len(h.ALPN) != 2 || h.ALPN[0] != "h2" || h.ALPN[1] != "http/1.1" {
+		t.Errorf("wrong ClientHello %+v", h)
+	}
+	if h.SrcAddr != "127.0.0.1:5535" || h.Version != 0x0303 || h.Flow != wsPacket(true, nil).Flow {
+		t.Errorf("wrong ClientHello %+v", h)
+	}
+
+	rst := wsPacket(true, nil)
+	rst.RST = true
+	parser.PacketHandler(rst)
+
+	// plain HTTP flows are skipped
+	parser.PacketHandler(wsPacket(true, []byte("GET / HTTP/1.1\r\n\r\n")))
+	parser.PacketHandler(wsPacket(true, tlsRecord(msg)))
+	if len(hellos) != 1 {
+		t.Errorf("expected non-TLS flows to be skipped, got %d", len(hellos))
+	}
+}
+
+func TestTLSParserHalfClose(t *testing.T) {
+	parser := NewTLSParser(time.Minute, func(h *TLSClientHello) {})
+	msg := tlsClientHello("example.com")
+	parser.PacketHandler(wsPacket(true, tlsRecord(msg[:20])))
+
+	fin := wsPacket(false, nil)
+	fin.FIN = true
+	parser.PacketHandler(fin)
+	if parser.Flows() != 1 {
+		t.Fatalf("expected the flow to be kept after a half-close, got %d flows", parser.Flows())
+	}
+	fin = wsPacket(true, nil)
+	fin.FIN = true
+	parser.PacketHandler(fin)
+	if parser.Flows() != 0 {
+		t.Errorf("expected the flow to be evicted once both sides closed, got %d flows", parser.Flows())
+	}
+}
+
+func TestTLSParserCloseHandler(t *testing.T) {
+	parser := NewTLSParser(time.Minute, func(h *TLSClientHello) {})
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.CloseHandler = parser.CloseHandler
+	// the RST packet without payload only reaches the CloseHandler
+	msg := tlsClientHello("example.com")
+	h.packets <- tcpSegment(true, 0x18, tlsRecord(msg[:20]))
+	h.packets <- tcpSegment(true, 0x04, nil)
+	close(h.packets)
+	var flows int
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) {
+		parser.PacketHandler(pckt)
+		flows = parser.Flows()
+	})
+	if flows != 1 || parser.Flows() != 0 {
+		t.Errorf("expected the flow to be removed once reset, got %d flows tracked and %d left", flows, parser.Flows())
+	}
+}
+
+func TestParseTLSClientHello(t *testing.T) {
+	msg := tlsClientHello("", "h2")
+	if _, err := ParseTLSClientHello(msg[4 : len(msg)-3]); err == nil {
+		t.Error("expected a truncated ClientHello to fail")
+	}
+	h, err := ParseTLSClientHello(msg[4:])
+	if err != nil || h.ServerName != "" || len(h.ALPN) != 1 {
+		t.Errorf("wrong ClientHello %+v %v", h, err)
+	}
+}
@@ -0,0 +1,125 @@
+package capture
+
+import (
+	"sync/atomic"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// IPTransform rewrites a captured IP packet in place, it is called with every packet before it is
+// passed to the DumpHandler and parsed. the packets it fails to transform are dropped
+type IPTransform func(ip []byte) error
+
+// IPTransforms chains transforms into an IPTransform, the nil ones are skipped
+func IPTransforms(transforms ...IPTransform) IPTransform {
+	var chain []IPTransform
+	for _, t := range transforms {
+		if t != nil {
+			chain = append(chain, t)
+		}
+	}
+	switch len(chain) {
+	case 0:
+		return nil
+	case 1:
+		return chain[0]
+	}
+	return func(ip []byte) error {
+		for _, t := range chain {
+			if err := t(ip); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ipTransformer applies the IPTransform of a listener and the transforms of its options
+type ipTransformer struct {
+	failed    uint64 // first field to be 64-bit aligned for atomic operations
+	transform IPTransform
+}
+
+// newIPTransformer returns the transformer of the listener, it is nil when there is no transform
+func (l *Listener) newIPTransformer() *ipTransformer {
+	var anonymize, redact IPTransform
+	if l.AnonymizeKey != "" {
+		anonymize = NewIPAnonymizer([]byte(l.AnonymizeKey)).Transform
+	}
+	if len(l.Redact) != 0 {
+		redact = NewPayloadRedactor(l.Redact).Transform
+	}
+	transform := IPTransforms(l.IPTransform, anonymize, redact)
+	if transform == nil {
+		return nil
+	}
+	return &ipTransformer{transform: transform}
+}
+
+// apply transforms the IP packet of a frame, it reports whether the packet can be dumped and parsed
+func (t *ipTransformer) apply(linkType layers.LinkType, data []byte, ci *gopacket.CaptureInfo) bool {
+	linkSize, _ := pcapLinkTypeLength(int(linkType))
+	_, _, size, err := linkLayer(linkType, data, linkSize, ci)
+	if err == nil && len(data) < size {
+		err = errTruncatedIP
+	}
+	if err == nil {
+		err = t.transform(data[size:])
+	}
+	if err != nil {
+		atomic.AddUint64(&t.failed, 1)
+		return false
+	}
+	return true
+}
+
+// Untransformed returns the number of packets dropped because they could not be transformed,
+// e.g the packets whose addresses can't be anonymized, see AnonymizeKey
+func (l *Listener) Untransformed() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	if l.transformer == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.transformer.failed)
+}
+
+// PacketTransform is called with every parsed packet before it is passed to the handler, it returns the
+// packet to pass on, pckt itself or another one, or false to drop it
+type PacketTransform func(pckt *tcp.Packet) (*tcp.Packet, bool)
+
+// Use appends transforms to the pipeline of the listener, the read loop runs them in order on every packet.
+// it must be called before Listen
+func (l *Listener) Use(transforms ...PacketTransform) {
+	l.Lock()
+	defer l.Unlock()
+	l.pipeline = append(l.pipeline, transforms...)
+}
+
+// runPipeline runs the transforms of the listener on pckt, it reports whether the packet is to be handled
+func (l *Listener) runPipeline(pckt *tcp.Packet) (*tcp.Packet, bool) {
+	ok := true
+	for _, transform := range l.pipeline {
+		if pckt, ok = transform(pckt); !ok || pckt == nil {
+			return nil, false
+		}
+	}
+	return pckt, true
+}
+
+// Sample is the PacketTransform keeping the packets of one flow out of n, both directions of a flow are
+// kept or dropped together. the flows are picked by their hash, so the same flows are kept by the
+// listeners sampling the same traffic
+func Sample(n uint32) PacketTransform {
+	return SampleBy(n, nil)
+}
+
+// SampleBy is Sample picking the flows by hash, e.g to keep the same flows as another tool,
+// DefaultFlowHash when it is nil
+func SampleBy(n uint32, hash FlowHash) PacketTransform {
+	return func(pckt *tcp.Packet) (*tcp.Packet, bool) {
+		return pckt, n <= 1 || hash.hash(pckt)%uint64(n) == 0
+	}
+}
@@ -0,0 +1,82 @@
+package capture
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestPacketPipeline(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	var order []string
+	l.Use(func(pckt *tcp.Packet) (*tcp.Packet, bool) {
+		order = append(order, "first")
+		return pckt, pckt.Seq%2 == 0
+	}, func(pckt *tcp.Packet) (*tcp.Packet, bool) {
+		order = append(order, "second")
+		copied := *pckt
+		copied.Payload = []byte("replaced")
+		return &copied, true
+	})
+	for _, data := range rawPackets(1, 4, 10, 4) {
+		h.packets <- data
+	}
+	close(h.packets)
+	var handled []*tcp.Packet
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) { handled = append(handled, pckt) })
+	if len(handled) != 2 || string(handled[0].Payload) != "replaced" {
+		t.Fatalf("expected the 2 even packets to be replaced, got %d", len(handled))
+	}
+	if len(order) != 6 || order[1] != "first" || order[2] != "second" {
+		t.Errorf("expected the transforms to run in order, got %v", order)
+	}
+}
+
+func TestSample(t *testing.T) {
+	sample := Sample(4)
+	kept := 0
+	for port := uint16(1000); port < 2000; port++ {
+		req, resp := wsPacket(true, nil), wsPacket(false, nil)
+		req.Flow, _ = tcp.NewFlowKey(req.SrcIP, port, req.DstIP, req.DstPort)
+		resp.Flow, _ = tcp.NewFlowKey(resp.SrcIP, resp.SrcPort, resp.DstIP, port)
+		_, ok := sample(req)
+		if _, rok := sample(resp); rok != ok {
+			t.Fatal("expected both directions of a flow to be sampled together")
+		}
+		if ok {
+			kept++
+		}
+	}
+	if kept < 150 || kept > 350 {
+		t.Errorf("expected about a fourth of the flows to be kept, got %d out of 1000", kept)
+	}
+}
+
+// BenchmarkPacketPipeline measures the cost of the pipeline in the parsing of a packet
+func BenchmarkPacketPipeline(b *testing.B) {
+	for _, bench := range []struct {
+		name       string
+		transforms []PacketTransform
+	}{
+		{"empty", nil},
+		{"sample", []PacketTransform{Sample(1)}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			l := newFakeListener()
+			l.Use(bench.transforms...)
+			l.read(func(*tcp.Packet, PacketMeta) {})
+			meta := PacketMeta{Interface: "a", LinkType: layers.LinkTypeLoop}
+			data := rawPackets(1, 1, 100, 4)[0]
+			ci := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.handlePacket(func(*tcp.Packet, PacketMeta) {}, meta, data, 4, &ci)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package capture
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// InterfaceReadiness is the result of the validation of an interface by Validate
+type InterfaceReadiness struct {
+	Interface string
+	LinkType  layers.LinkType // the filter was compiled for
+	Filter    string
+	Down      bool  // the interface is down, only its filter was validated, it is captured once it is up
+	Err       error // why the interface can't be captured, it matches ErrPermission etc. with errors.Is
+}
+
+// Ready reports whether the interface can be captured
+func (r InterfaceReadiness) Ready() bool {
+	return r.Err == nil
+}
+
+// Validate checks the configuration of the listener without capturing: the filter of every interface is compiled
+// for its link type, and a handle is opened and closed at once to check the permissions and the options.
+// the error is a failure of the whole configuration, e.g a filter file or a host matching no interface,
+// the failures of the interfaces are reported in their results. the handles being read are not affected
+func (l *Listener) Validate() ([]InterfaceReadiness, error) {
+	if l.Engine == EngineRawSocket && runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("sock_raw is not stabilized on OS other than linux")
+	}
+	if l.Engine != EnginePcapFile {
+		if err := l.checkHostMatch(); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.loadFilterFile(); err != nil {
+		return nil, err
+	}
+	if l.Engine != EnginePcapFile {
+		if _, err := l.loadProcessFilter(); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.compileGTPFilter(); err != nil {
+		return nil, err
+	}
+	if l.Engine == EnginePcapFile {
+		return []InterfaceReadiness{l.validateFile()}, nil
+	}
+	if len(l.Interfaces) == 0 {
+		return nil, fmt.Errorf("no interface to capture for the host %q", l.host)
+	}
+	results := make([]InterfaceReadiness, 0, len(l.Interfaces))
+	for _, ifi := range l.Interfaces {
+		results = append(results, l.validateInterface(ifi))
+	}
+	return results, nil
+}
+
+// validateInterface opens and closes a handle of an interface
+func (l *Listener) validateInterface(ifi pcap.Interface) (r InterfaceReadiness) {
+	r.Interface, r.Filter = ifi.Name, l.Filter(ifi)
+	r.LinkType = l.expectedLinkType(ifi)
+	if l.Engine == EngineRawSocket {
+		r.LinkType = layers.LinkTypeEthernet
+	}
+	defer l.forgetEffective(ifi.Name)
+	if l.Engine == EnginePcap && l.IncludeDown && !interfaceUp(ifi.Name) && ifi.Flags&pcapIfLoopback == 0 {
+		r.Down = true
+		if err := ValidateBPFFilter(r.Filter, r.LinkType, l.snaplen(ifi)); err != nil {
+			r.Err = &FilterError{Interface: ifi.Name, LinkType: r.LinkType, Filter: r.Filter, Err: err}
+		}
+		return
+	}
+	if l.Engine == EngineRawSocket {
+		var handle Socket
+		if handle, r.Err = l.SocketHandle(ifi); r.Err == nil {
+			handle.Close()
+		}
+		return
+	}
+	var handle *pcap.Handle
+	if handle, r.Err = l.PcapHandle(ifi); r.Err == nil {
+		r.LinkType = handle.LinkType()
+		handle.Close()
+	}
+	return
+}
+
+// validateFile opens and closes the pcap file, the filter is compiled for the link type of the file.
+// a named pipe isn't opened, it would wait for its writer, its filter is compiled for ethernet
+func (l *Listener) validateFile() (r InterfaceReadiness) {
+	r.Interface, r.Filter, r.LinkType = "pcap_file", l.pcapFileFilter(), layers.LinkTypeEthernet
+	if isNamedPipe(l.host) {
+		r.Err = ValidateBPFFilter(r.Filter, r.LinkType, maxSnaplen)
+		return
+	}
+	handle, err := pcap.OpenOffline(l.host)
+	if err != nil {
+		r.Err = fmt.Errorf("open pcap file error: %q", err)
+		return
+	}
+	defer handle.Close()
+	r.LinkType = handle.LinkType()
+	r.Err = ValidateBPFFilter(r.Filter, r.LinkType, handle.SnapLen())
+	return
+}
+
+// forgetEffective drops the effective options recorded for a handle opened by Validate
+func (l *Listener) forgetEffective(name string) {
+	l.Lock()
+	_, open := l.Handles[name]
+	l.Unlock()
+	if open {
+		return
+	}
+	l.effectiveMu.Lock()
+	delete(l.effective, name)
+	l.effectiveMu.Unlock()
+}
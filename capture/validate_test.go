@@ -0,0 +1,70 @@
+package capture
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func TestValidate(t *testing.T) {
+	defer func(f func() ([]pcap.Interface, error)) { findAllDevs = f }(findAllDevs)
+	defer func(f func(pcap.Interface) (Socket, error)) { newSocket = f }(newSocket)
+	findAllDevs = func() ([]pcap.Interface, error) {
+		return []pcap.Interface{
+			{Name: "mock0", Flags: pcapIfUp, Addresses: []pcap.InterfaceAddress{{IP: net.IP{192, 0, 2, 1}}}},
+			{Name: "mock1", Flags: pcapIfUp, Addresses: []pcap.InterfaceAddress{{IP: net.IP{192, 0, 2, 2}}}},
+		}, nil
+	}
+	var socks []*fakeSocket
+	newSocket = func(ifi pcap.Interface) (Socket, error) {
+		if ifi.Name == "mock1" {
+			return nil, syscall.EPERM
+		}
+		sock := new(fakeSocket)
+		socks = append(socks, sock)
+		return sock, nil
+	}
+	l, err := NewListener("", []uint16{8000}, "", EngineRawSocket, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetDebugLevel(DebugSilent)
+	results, err := l.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected a result by interface, got %+v", results)
+	}
+	if r := results[0]; r.Interface != "mock0" || !r.Ready() || r.Filter == "" || r.LinkType != layers.LinkTypeEthernet {
+		t.Errorf("expected mock0 to be ready, got %+v", r)
+	}
+	if r := results[1]; r.Interface != "mock1" || r.Ready() || !errors.Is(r.Err, ErrPermission) {
+		t.Errorf("expected mock1 to lack the permissions, got %+v", r)
+	}
+	if len(socks) != 1 || !socks[0].closed {
+		t.Errorf("expected the socket to be closed")
+	}
+	if len(l.Handles) != 0 || len(l.EffectiveOptions()) != 0 {
+		t.Errorf("expected no handle to be kept, got %v %v", l.Handles, l.EffectiveOptions())
+	}
+
+	// a filter file that doesn't compile fails the whole configuration
+	f, err := ioutil.TempFile("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not host foo\n")
+	f.Close()
+	l.SetPcapOptions(PcapOptions{BPFFilterFile: f.Name()})
+	if _, err = l.Validate(); err == nil {
+		t.Error("expected the filter file to be rejected")
+	}
+}
@@ -0,0 +1,244 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/tcp"
+)
+
+// WebSocket opcodes https://tools.ietf.org/html/rfc6455#section-5.2
+const (
+	WSContinuation byte = 0x0
+	WSText         byte = 0x1
+	WSBinary       byte = 0x2
+	WSClose        byte = 0x8
+	WSPing         byte = 0x9
+	WSPong         byte = 0xA
+)
+
+// WebSocketFrame is a single RFC 6455 frame, Payload is already unmasked
+type WebSocketFrame struct {
+	Fin     bool
+	Opcode  byte
+	Masked  bool
+	MaskKey [4]byte
+	Payload []byte
+}
+
+// WebSocketMessage is a complete WebSocket message, continuation frames are reassembled
+// into it and their boundaries are kept in Frames
+type WebSocketMessage struct {
+	Flow             tcp.FlowKey
+	SrcAddr, DstAddr string
+	FromClient       bool
+	Opcode           byte
+	Payload          []byte
+	Frames           []WebSocketFrame
+	Timestamp        time.Time // timestamp of the packet that completed the message
+}
+
+// WebSocketEmitter is called on every complete WebSocket message
+type WebSocketEmitter func(*WebSocketMessage)
+
+// WebSocketParser detects the WebSocket upgrade handshake of the flows it sees, and then
+// parses their data as WebSocket frames. packets are expected to arrive in order.
+// its CloseHandler must be set as Listener.CloseHandler for the flows to be removed on close.
+type WebSocketParser struct {
+	flowTable
+	emit    WebSocketEmitter
+	maxSize int
+}
+
+type wsFlow struct {
+	client   bool // Reversed flag of the packets sent by the client
+	upgraded bool
+	dirs     [2]wsDirection // 0 from client, 1 from server
+}
+
+type wsDirection struct {
+	buf []byte // incomplete frame bytes
+	msg *WebSocketMessage
+}
+
+// NewWebSocketParser returns a new WebSocket parser, a flow is evicted after being idle for expire,
+// or when it is closed. maxSize bounds the size of a single message, default is 5mb
+func NewWebSocketParser(expire time.Duration, maxSize int, emit WebSocketEmitter) *WebSocketParser {
+	parser := new(WebSocketParser)
+	parser.init(expire, time.Minute)
+	parser.emit = emit
+	parser.maxSize = maxSize
+	if parser.maxSize < 1 {
+		parser.maxSize = 5 << 20
+	}
+	return parser
+}
+
+// PacketHandler is the handler to be passed to Listener.Listen
+func (parser *WebSocketParser) PacketHandler(pckt *tcp.Packet) {
+	parser.Lock()
+	defer parser.Unlock()
+
+	key := pckt.Flow
+	v, ok := parser.lookup(key, pckt.Timestamp)
+	flow, _ := v.(*wsFlow)
+	if pckt.FIN || pckt.RST {
+		if !ok {
+			return
+		}
+		if flow.upgraded {
+			parser.parse(flow, pckt, pckt.Payload)
+		}
+		dir := 1
+		if pckt.Reversed == flow.client {
+			dir = 0
+		}
+		parser.closed(key, dir, pckt)
+		return
+	}
+	if !ok {
+		if !isWebSocketUpgrade(pckt.Payload, true) {
+			return
+		}
+		flow = &wsFlow{client: pckt.Reversed}
+		parser.store(key, flow, pckt.Timestamp)
+	}
+	if flow.upgraded {
+		parser.parse(flow, pckt, pckt.Payload)
+		return
+	}
+	if pckt.Reversed != flow.client && isWebSocketUpgrade(pckt.Payload, false) {
+		flow.upgraded = true
+		if end := proto.MIMEHeadersEndPos(pckt.Payload); end != -1 && end < len(pckt.Payload) {
+			parser.parse(flow, pckt, pckt.Payload[end:])
+		}
+	}
+}
+
+func (parser *WebSocketParser) parse(flow *wsFlow, pckt *tcp.Packet, data []byte) {
+	fromClient := pckt.Reversed == flow.client
+	dir := &flow.dirs[1]
+	if fromClient {
+		dir = &flow.dirs[0]
+	}
+	dir.buf = append(dir.buf, data...)
+	for {
+		frame, n, err := ParseWebSocketFrame(dir.buf)
+		if err != nil || n == 0 {
+			if err != nil || len(dir.buf) > parser.maxSize {
+				// can't recover the frame boundaries anymore
+				dir.buf = nil
+				dir.msg = nil
+			}
+			break
+		}
+		dir.buf = dir.buf[n:]
+		if frame.Opcode >= WSClose {
+			// control frames can be injected in the middle of a fragmented message
+			parser.emit(&WebSocketMessage{
+				Flow:       pckt.Flow,
+				SrcAddr:    pckt.Src(),
+				DstAddr:    pckt.Dst(),
+				FromClient: fromClient,
+				Opcode:     frame.Opcode,
+				Payload:    frame.Payload,
+				Frames:     []WebSocketFrame{frame},
+				Timestamp:  pckt.Timestamp,
+			})
+			continue
+		}
+		if dir.msg == nil {
+			if frame.Opcode == WSContinuation {
+				// we missed the beginning of this message
+				continue
+			}
+			dir.msg = &WebSocketMessage{
+				Flow:       pckt.Flow,
+				SrcAddr:    pckt.Src(),
+				DstAddr:    pckt.Dst(),
+				FromClient: fromClient,
+				Opcode:     frame.Opcode,
+			}
+		}
+		dir.msg.Payload = append(dir.msg.Payload, frame.Payload...)
+		dir.msg.Frames = append(dir.msg.Frames, frame)
+		if len(dir.msg.Payload) > parser.maxSize {
+			dir.msg = nil
+			continue
+		}
+		if frame.Fin {
+			dir.msg.Timestamp = pckt.Timestamp
+			parser.emit(dir.msg)
+			dir.msg = nil
+		}
+	}
+	if len(dir.buf) == 0 {
+		dir.buf = nil
+	}
+}
+
+// ParseWebSocketFrame parses a single frame from data, n is the length of the frame
+// and is 0 when data doesn't hold a complete frame yet
+func ParseWebSocketFrame(data []byte) (frame WebSocketFrame, n int, err error) {
+	if len(data) < 2 {
+		return
+	}
+	frame.Fin = data[0]&0x80 != 0
+	frame.Opcode = data[0] & 0x0F
+	if data[0]&0x70 != 0 {
+		return frame, 0, fmt.Errorf("websocket: unexpected reserved bits %#x", data[0]&0x70)
+	}
+	frame.Masked = data[1]&0x80 != 0
+	length := uint64(data[1] & 0x7F)
+	n = 2
+	switch length {
+	case 126:
+		if len(data) < n+2 {
+			return frame, 0, nil
+		}
+		length = uint64(binary.BigEndian.Uint16(data[n:]))
+		n += 2
+	case 127:
+		if len(data) < n+8 {
+			return frame, 0, nil
+		}
+		length = binary.BigEndian.Uint64(data[n:])
+		n += 8
+	}
+	if frame.Opcode >= WSClose && (length > 125 || !frame.Fin) {
+		return frame, 0, fmt.Errorf("websocket: invalid control frame")
+	}
+	if frame.Masked {
+		if len(data) < n+4 {
+			return frame, 0, nil
+		}
+		copy(frame.MaskKey[:], data[n:])
+		n += 4
+	}
+	if uint64(len(data)-n) < length {
+		return frame, 0, nil
+	}
+	frame.Payload = make([]byte, length)
+	copy(frame.Payload, data[n:])
+	if frame.Masked {
+		for i := range frame.Payload {
+			frame.Payload[i] ^= frame.MaskKey[i%4]
+		}
+	}
+	n += int(length)
+	return
+}
+
+// isWebSocketUpgrade reports whether payload is the opening handshake request or its accepting response
+func isWebSocketUpgrade(payload []byte, request bool) bool {
+	if request && !proto.HasRequestTitle(payload) {
+		return false
+	}
+	if !request && !bytes.Equal(proto.Status(payload), []byte("101")) {
+		return false
+	}
+	return bytes.EqualFold(proto.Header(payload, []byte("Upgrade")), []byte("websocket"))
+}
@@ -0,0 +1,153 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket/layers"
+)
+
+func wsFrame(fin bool, opcode byte, mask []byte, payload []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0, 0}
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	default:
+		frame[1] = 126
+		frame = append(frame, byte(len(payload)>>8), byte(len(payload)))
+	}
+	if mask != nil {
+		frame[1] |= 0x80
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+		return frame
+	}
+	return append(frame, payload...)
+}
+
+func wsPacket(fromClient bool, payload []byte) *tcp.Packet {
+	pckt := &tcp.Packet{
+		SrcIP:     net.IP{127, 0, 0, 1},
+		DstIP:     net.IP{127, 0, 0, 1},
+		SrcPort:   5535,
+		DstPort:   8000,
+		Timestamp: time.Now(),
+		Payload:   payload,
+	}
+	if !fromClient {
+		pckt.SrcPort, pckt.DstPort = pckt.DstPort, pckt.SrcPort
+	}
+	pckt.Flow, pckt.Reversed = tcp.NewFlowKey(pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort)
+	return pckt
+}
+
+func TestWebSocketParser(t *testing.T) {
+	var msgs []*WebSocketMessage
+	parser := NewWebSocketParser(time.Minute, 0, func(m *WebSocketMessage) { msgs = append(msgs, m) })
+
+	// frames before the handshake are not parsed
+	parser.PacketHandler(wsPacket(true, wsFrame(true, WSText, nil, []byte("ignored"))))
+	if parser.Flows() != 0 {
+		t.Fatalf("expected no flows, got %d", parser.Flows())
+	}
+	parser.PacketHandler(wsPacket(true, []byte("GET /chat HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")))
+	parser.PacketHandler(wsPacket(false, []byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")))
+
+	// masked client frame split across two segments
+	frame := wsFrame(true, WSText, []byte{1, 2, 3, 4}, []byte("hello server"))
+	parser.PacketHandler(wsPacket(true, frame[:5]))
+	parser.PacketHandler(wsPacket(true, frame[5:]))
+
+	// fragmented server message with a ping in between
+	data := append(wsFrame(false, WSBinary, nil, bytes.Repeat([]byte("a"), 200)), wsFrame(true, WSPing, nil, []byte("ping"))...)
+	data = append(data, wsFrame(true, WSContinuation, nil, []byte("bc"))...)
+	parser.PacketHandler(wsPacket(false, data))
+
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	if !msgs[0].FromClient || msgs[0].Opcode != WSText || string(msgs[0].Payload) != "hello server" || !msgs[0].Frames[0].Masked {
+		t.Errorf("wrong client message %+v", msgs[0])
+	}
+	if msgs[1].FromClient || msgs[1].Opcode != WSPing || string(msgs[1].Payload) != "ping" {
+		t.Errorf("wrong ping message %+v", msgs[1])
+	}
+	if msgs[2].Opcode != WSBinary || len(msgs[2].Frames) != 2 || len(msgs[2].Payload) != 202 || msgs[2].Frames[0].Fin {
+		t.Errorf("wrong reassembled message %+v", msgs[2])
+	}
+
+	fin := wsPacket(true, wsFrame(true, WSClose, []byte{1, 2, 3, 4}, nil))
+	fin.FIN = true
+	parser.PacketHandler(fin)
+	if parser.Flows() != 1 {
+		t.Fatalf("expected the flow to be kept after a half-close, got %d flows", parser.Flows())
+	}
+	fin = wsPacket(false, wsFrame(true, WSClose, nil, nil))
+	fin.FIN = true
+	parser.PacketHandler(fin)
+	if len(msgs) != 5 || msgs[4].FromClient || msgs[4].Opcode != WSClose {
+		t.Errorf("expected the close frame of the server to be parsed, got %d messages", len(msgs))
+	}
+	if parser.Flows() != 0 {
+		t.Errorf("expected the flow to be evicted once both sides closed, got %d flows", parser.Flows())
+	}
+}
+
+func TestWebSocketParserReset(t *testing.T) {
+	parser := NewWebSocketParser(time.Minute, 0, func(m *WebSocketMessage) {})
+	parser.PacketHandler(wsPacket(true, []byte("GET /chat HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")))
+	rst := wsPacket(false, nil)
+	rst.RST = true
+	parser.PacketHandler(rst)
+	if parser.Flows() != 0 {
+		t.Errorf("expected the flow to be evicted on reset, got %d flows", parser.Flows())
+	}
+}
+
+func TestWebSocketParserCloseHandler(t *testing.T) {
+	parser := NewWebSocketParser(time.Minute, 0, func(m *WebSocketMessage) {})
+	h := newFakeHandle(layers.LinkTypeLoop)
+	l := newFakeListener(h)
+	l.CloseHandler = parser.CloseHandler
+	// the FIN packets without payload only reach the CloseHandler
+	h.packets <- tcpSegment(true, 0x18, []byte("GET /chat HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	h.packets <- tcpSegment(true, 0x11, nil)
+	h.packets <- tcpSegment(false, 0x11, nil)
+	close(h.packets)
+	var flows int
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) {
+		parser.PacketHandler(pckt)
+		flows = parser.Flows()
+	})
+	if flows != 1 || parser.Flows() != 0 {
+		t.Errorf("expected the flow to be removed once closed, got %d flows tracked and %d left", flows, parser.Flows())
+	}
+}
+
+func TestParseWebSocketFrame(t *testing.T) {
+	frame := wsFrame(true, WSBinary, []byte{9, 8, 7, 6}, bytes.Repeat([]byte("x"), 300))
+	if _, n, err := ParseWebSocketFrame(frame[:100]); n != 0 || err != nil {
+		t.Errorf("expected an incomplete frame, got %d %v", n, err)
+	}
+	f, n, err := ParseWebSocketFrame(frame)
+	if err != nil || n != len(frame) {
+		t.Fatalf("expected %d bytes frame, got %d %v", len(frame), n, err)
+	}
+	if !bytes.Equal(f.Payload, bytes.Repeat([]byte("x"), 300)) {
+		t.Error("wrong unmasked payload")
+	}
+	if _, _, err = ParseWebSocketFrame(wsFrame(false, WSPing, nil, nil)); err == nil {
+		t.Error("fragmented control frames should be rejected")
+	}
+}
@@ -0,0 +1,99 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/gopacket/layers"
+)
+
+// radiotap fields preceding the flags field, https://www.radiotap.org/fields/defined
+const (
+	radiotapTSFT  = 1 << 0
+	radiotapFlags = 1 << 1
+	radiotapExt   = 1 << 31
+
+	radiotapFlagFCS = 0x10 // the frame includes its FCS
+)
+
+// radiotapHeaders returns the length of the radiotap header and the 802.11 headers following it,
+// the trailer is the FCS of the frame when radiotap reports it
+func radiotapHeaders(data []byte) (header, trailer int, err error) {
+	if len(data) < 8 || data[0] != 0 {
+		return 0, 0, errors.New("invalid radiotap header")
+	}
+	itLen := int(binary.LittleEndian.Uint16(data[2:4]))
+	if itLen < 8 || len(data) < itLen {
+		return 0, 0, errors.New("invalid radiotap header length")
+	}
+	// the fields follow the present words, the first of them tells whether there is a flags field
+	present := binary.LittleEndian.Uint32(data[4:8])
+	off := 8
+	for word := present; word&radiotapExt != 0; off += 4 {
+		if off+4 > itLen {
+			return 0, 0, errors.New("invalid radiotap present words")
+		}
+		word = binary.LittleEndian.Uint32(data[off:])
+	}
+	if present&radiotapFlags != 0 {
+		if present&radiotapTSFT != 0 {
+			off = (off+7)&^7 + 8 // 8 bytes aligned on 8 bytes
+		}
+		if off < itLen && data[off]&radiotapFlagFCS != 0 {
+			trailer = 4
+		}
+	}
+	n, err := dot11Header(data[itLen : len(data)-trailer])
+	if err != nil {
+		return 0, 0, err
+	}
+	return itLen + n, trailer, nil
+}
+
+// 802.11 frame control fields
+const (
+	dot11TypeData   = 2
+	dot11ToFromDS   = 0x03
+	dot11Protected  = 0x40
+	dot11Order      = 0x80
+	dot11SubtypeQoS = 0x08
+	dot11SubtypeNul = 0x04 // data frames without a body
+)
+
+// dot11Header returns the length of the 802.11 MAC header of a data frame, along with its LLC/SNAP header
+func dot11Header(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, errors.New("invalid 802.11 header")
+	}
+	fc0, fc1 := data[0], data[1]
+	subtype := fc0 >> 4
+	if (fc0>>2)&0x03 != dot11TypeData || subtype&dot11SubtypeNul != 0 {
+		return 0, errNotIP
+	}
+	if fc1&dot11Protected != 0 {
+		return 0, errNotIP // encrypted
+	}
+	n := 24
+	if fc1&dot11ToFromDS == dot11ToFromDS {
+		n += 6 // 4th address of the frames between access points
+	}
+	if subtype&dot11SubtypeQoS != 0 {
+		n += 2
+		if fc1&dot11Order != 0 {
+			n += 4 // HT control
+		}
+	}
+	// LLC/SNAP header: AA AA 03, OUI 00 00 00 and the ether type
+	if len(data) < n+8 {
+		return 0, errors.New("invalid 802.11 header length")
+	}
+	snap := data[n : n+8]
+	if snap[0] != 0xAA || snap[1] != 0xAA || snap[2] != 0x03 {
+		return 0, errNotIP
+	}
+	switch layers.EthernetType(binary.BigEndian.Uint16(snap[6:])) {
+	case layers.EthernetTypeIPv4, layers.EthernetTypeIPv6:
+		return n + 8, nil
+	}
+	return 0, errNotIP
+}
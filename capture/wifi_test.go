@@ -0,0 +1,92 @@
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/buger/goreplay/tcp"
+
+	"github.com/google/gopacket/layers"
+)
+
+// dot11Frame returns a QoS data frame from the distribution system carrying ip
+func dot11Frame(ip []byte) []byte {
+	frame := make([]byte, 26)
+	frame[0] = dot11TypeData<<2 | (dot11SubtypeQoS << 4)
+	frame[1] = 0x02 // from DS
+	frame = append(frame, 0xAA, 0xAA, 0x03, 0, 0, 0, 0x08, 0x00)
+	return append(frame, ip...)
+}
+
+// radiotapFrame returns frame behind a radiotap header with TSFT and flags fields
+func radiotapFrame(frame []byte, fcs bool) []byte {
+	hdr := make([]byte, 8, 32)
+	binary.LittleEndian.PutUint32(hdr[4:], radiotapTSFT|radiotapFlags|radiotapExt)
+	hdr = append(hdr, 0, 0, 0, 0) // second present word
+	hdr = append(hdr, make([]byte, 4)...)
+	hdr = append(hdr, make([]byte, 8)...) // TSFT aligned on 8 bytes
+	flags := byte(0)
+	if fcs {
+		flags = radiotapFlagFCS
+	}
+	hdr = append(hdr, flags, 0)
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(len(hdr)))
+	frame = append(hdr, frame...)
+	if fcs {
+		frame = append(frame, 0xde, 0xad, 0xbe, 0xef)
+	}
+	return frame
+}
+
+func TestRadiotapHeaders(t *testing.T) {
+	ip := rawPackets(1, 1, 5, 4)[0][4:]
+	data := radiotapFrame(dot11Frame(ip), true)
+	header, trailer, err := linkHeaders(layers.LinkTypeIEEE80211Radio, data)
+	if err != nil || header != len(data)-len(ip)-4 || trailer != 4 {
+		t.Errorf("wrong headers %d %d %v", header, trailer, err)
+	}
+	beacon := radiotapFrame(append([]byte{0x80, 0}, make([]byte, 40)...), false)
+	if _, _, err = linkHeaders(layers.LinkTypeIEEE80211Radio, beacon); err != errNotIP {
+		t.Errorf("expected management frames to be skipped, got %v", err)
+	}
+	data = radiotapFrame(dot11Frame(ip), false)
+	binary.LittleEndian.PutUint16(data[2:], uint16(len(data)+1))
+	if _, _, err = linkHeaders(layers.LinkTypeIEEE80211Radio, data); err == nil || err == errNotIP {
+		t.Errorf("expected an invalid radiotap length, got %v", err)
+	}
+}
+
+func TestDot11Header(t *testing.T) {
+	ip := rawPackets(1, 1, 5, 4)[0][4:]
+	frame := dot11Frame(ip)
+	if n, err := dot11Header(frame); err != nil || n != 34 {
+		t.Errorf("expected a 34 bytes header, got %d %v", n, err)
+	}
+	frame[1] |= dot11ToFromDS | dot11Order
+	frame = append(frame[:24], append(make([]byte, 10), frame[24:]...)...)
+	if n, err := dot11Header(frame); err != nil || n != 44 {
+		t.Errorf("expected a 44 bytes header with the 4th address and HT control, got %d %v", n, err)
+	}
+	frame[1] |= dot11Protected
+	if _, err := dot11Header(frame); err != errNotIP {
+		t.Errorf("expected encrypted frames to be skipped, got %v", err)
+	}
+}
+
+func TestListenRadiotap(t *testing.T) {
+	h := newFakeHandle(layers.LinkTypeIEEE80211Radio)
+	l := newFakeListener(h)
+	ip := rawPackets(1, 1, 5, 4)[0][4:]
+	h.packets <- radiotapFrame(dot11Frame(ip), true)
+	h.packets <- radiotapFrame(append([]byte{0x80, 0}, make([]byte, 40)...), false) // beacon
+	close(h.packets)
+	var payloads [][]byte
+	_ = l.Listen(context.Background(), func(pckt *tcp.Packet) { payloads = append(payloads, append([]byte{}, pckt.Payload...)) })
+	if len(payloads) != 1 || len(payloads[0]) != 5 {
+		t.Errorf("expected a packet of 5 bytes without the FCS, got %v", payloads)
+	}
+	if l.ParseErrors() != 0 {
+		t.Errorf("expected the beacon not to be a parse error, got %d", l.ParseErrors())
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/buger/goreplay/capture"
@@ -53,16 +56,24 @@ func (protocol *TCPProtocol) String() string {
 // RAWInputConfig represents configuration that can be applied on raw input
 type RAWInputConfig struct {
 	capture.PcapOptions
-	Expire         time.Duration      `json:"input-raw-expire"`
-	CopyBufferSize size.Size          `json:"copy-buffer-size"`
-	Engine         capture.EngineType `json:"input-raw-engine"`
-	TrackResponse  bool               `json:"input-raw-track-response"`
-	Protocol       TCPProtocol        `json:"input-raw-protocol"`
-	RealIPHeader   string             `json:"input-raw-realip-header"`
-	Stats          bool               `json:"input-raw-stats"`
-	quit           chan bool          // Channel used only to indicate goroutine should shutdown
+	Expire         time.Duration        `json:"input-raw-expire"`
+	CopyBufferSize size.Size            `json:"copy-buffer-size"`
+	Engine         capture.EngineType   `json:"input-raw-engine"`
+	Transport      string               `json:"input-raw-transport"`
+	TrackResponse  bool                 `json:"input-raw-track-response"`
+	Protocol       TCPProtocol          `json:"input-raw-protocol"`
+	RealIPHeader   string               `json:"input-raw-realip-header"`
+	Stats          bool                 `json:"input-raw-stats"`
+	TLSKeyLog      string               `json:"input-raw-tls-keylog"`
+	Dump           string               `json:"input-raw-dump"`
+	DumpInterfaces bool                 `json:"input-raw-dump-per-interface"`
+	DumpFlows      bool                 `json:"input-raw-dump-per-flow"`
+	DumpRotation   capture.DumpRotation `json:"input-raw-dump-rotation"`
+	Validate       bool                 `json:"input-raw-validate"`
+	quit           chan bool            // Channel used only to indicate goroutine should shutdown
 	host           string
 	ports          []uint16
+	portRanges     []string
 }
 
 // RAWInput used for intercepting traffic for given address
@@ -73,6 +84,7 @@ type RAWInput struct {
 	listener       *capture.Listener
 	message        chan *tcp.Message
 	cancelListener context.CancelFunc
+	stopped        chan struct{} // closed once the listener and its dump are closed
 	closed         bool
 }
 
@@ -89,10 +101,15 @@ func NewRAWInput(address string, config RAWInputConfig) (i *RAWInput) {
 	}
 
 	var ports []uint16
+	var portRanges []string
 	if _ports != "" {
 		portsStr := strings.Split(_ports, ",")
 
 		for _, portStr := range portsStr {
+			if strings.Contains(portStr, "-") {
+				portRanges = append(portRanges, strings.TrimSpace(portStr))
+				continue
+			}
 			port, err := strconv.Atoi(strings.TrimSpace(portStr))
 			if err != nil {
 				log.Fatalf("parsing port error: %v", err)
@@ -104,6 +121,7 @@ func NewRAWInput(address string, config RAWInputConfig) (i *RAWInput) {
 
 	i.host = host
 	i.ports = ports
+	i.portRanges = portRanges
 
 	i.listen(address)
 
@@ -146,13 +164,57 @@ func (i *RAWInput) PluginRead() (*Message, error) {
 	return &msg, nil
 }
 
+// validate reports whether the interfaces can be captured and exits, with an error status if one of them can't
+func (i *RAWInput) validate() {
+	results, err := i.listener.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	status := 0
+	for _, r := range results {
+		if !r.Ready() {
+			log.Printf("input-raw: %s is not ready: %v", r.Interface, r.Err)
+			status = 1
+			continue
+		}
+		if r.Down {
+			log.Printf("input-raw: %s is down, link type %s, filter %q", r.Interface, r.LinkType, r.Filter)
+			continue
+		}
+		log.Printf("input-raw: %s is ready, link type %s, filter %q", r.Interface, r.LinkType, r.Filter)
+	}
+	os.Exit(status)
+}
+
 func (i *RAWInput) listen(address string) {
 	var err error
-	i.listener, err = capture.NewListener(i.host, i.ports, "", i.Engine, i.TrackResponse)
+	i.listener, err = capture.NewListener(i.host, i.ports, i.Transport, i.Engine, i.TrackResponse)
 	if err != nil {
 		log.Fatal(err)
 	}
-	i.listener.SetPcapOptions(i.PcapOptions)
+	if err = i.listener.AddPortRanges(i.portRanges...); err != nil {
+		log.Fatal(err)
+	}
+	if err = i.listener.SetPcapOptions(i.PcapOptions); err != nil {
+		log.Fatal(err)
+	}
+	if i.Mode == capture.ModeConnectionEvents {
+		i.listener.ConnectionHandler = i.connectionEmitter
+	}
+	i.listener.EventHandler = func(e capture.CaptureEvent) {
+		if e.Type == capture.CaptureStarted {
+			Debug(1, "[INPUT-RAW] capture of", e.Interface, "started, link type", e.Options.LinkType, "snaplen", e.Options.Snaplen, "filter", e.Options.BPFFilter)
+			return
+		}
+		if e.Err != nil {
+			Debug(1, "[INPUT-RAW] capture of", e.Interface, "stopped:", e.Err)
+			return
+		}
+		Debug(1, "[INPUT-RAW] capture of", e.Interface, "stopped:", e.Reason)
+	}
+	if i.Validate {
+		i.validate()
+	}
 	err = i.listener.Activate()
 	if err != nil {
 		log.Fatal(err)
@@ -163,23 +225,138 @@ func (i *RAWInput) listen(address string) {
 		parser.Start = http1StartHint
 		parser.End = http1EndHint
 	}
+	if i.Transport == "sctp" && parser.End == nil {
+		parser.End = sctpEndHint
+	}
+	handler := parser.PacketHandler
+	if i.TLSKeyLog != "" {
+		keys, err := capture.LoadKeyLog(i.TLSKeyLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("input-raw: decrypting TLS traffic with the key log %s, this is meant for staging environments only", i.TLSKeyLog)
+		decrypter := capture.NewTLSDecrypter(keys, 0, handler)
+		i.listener.CloseHandler = decrypter.CloseHandler
+		handler = decrypter.PacketHandler
+	}
+	var dump interface {
+		Handler() capture.DumpHandler
+		Close() error
+	}
+	if i.Dump != "" {
+		switch {
+		case i.DumpFlows:
+			dump = capture.NewFlowDump(i.Dump)
+		case i.DumpInterfaces:
+			dump = capture.NewInterfaceDump(i.Dump, i.DumpRotation)
+		default:
+			dump = capture.NewRotatingDump(i.Dump, i.DumpRotation)
+		}
+		i.listener.DumpHandler = dump.Handler()
+		i.listener.DumpCloser = dump
+	}
+	if i.Heartbeat > 0 {
+		stopped := make(map[string]bool)
+		i.listener.HeartbeatHandler = func(hbs []capture.Heartbeat) {
+			for _, hb := range hbs {
+				if !hb.Alive && !stopped[hb.Interface] {
+					stopped[hb.Interface] = true
+					log.Printf("input-raw: the capture of %s stopped, last packet at %s", hb.Interface, hb.LastPacket)
+				}
+				Debug(2, "[INPUT-RAW] interface", hb.Interface, "alive", hb.Alive, "packets", hb.Packets, "last packet", hb.LastPacket)
+			}
+		}
+	}
+	if i.HealthInterval > 0 {
+		i.listener.TCPHealthHandler = func(health []capture.TCPHealth) {
+			for _, h := range health {
+				Debug(1, "[INPUT-RAW] connection", h.Flow, "handshake rtt", h.HandshakeRTT, "closed", h.Closed,
+					"rtt", h.A.RTT, h.B.RTT, "window", h.A.Window, h.B.Window, "retransmissions", h.A.Retransmissions, h.B.Retransmissions)
+			}
+		}
+	}
+	if i.ProgressEvery > 0 {
+		i.listener.ProgressHandler = func(p capture.Progress) {
+			log.Println("input-raw: read", p)
+		}
+	}
 	var ctx context.Context
 	ctx, i.cancelListener = context.WithCancel(context.Background())
-	errCh := i.listener.ListenBackground(ctx, parser.PacketHandler)
-	<-i.listener.Reading
+	errCh := i.listener.ListenBackground(ctx, handler)
+	<-i.listener.Ready()
+	if err := i.listener.StartErr(); err != nil {
+		log.Println("input-raw:", err)
+	}
 	Debug(1, i)
+	for name, opts := range i.listener.EffectiveOptions() {
+		Debug(1, "[INPUT-RAW] interface", name, "effective options", fmt.Sprintf("%+v", opts))
+	}
+	if i.BPFFilterFile != "" {
+		go i.reloadFilterOnHUP()
+	}
+	stopped := make(chan struct{})
+	i.Lock()
+	i.stopped = stopped
+	i.Unlock()
 	go func() {
-		<-errCh // the listener closed voluntarily
+		<-errCh // the listener closed, the dump is flushed
+		close(stopped)
+		if i.listener.LimitReached() {
+			log.Println("input-raw: the capture limit is reached")
+		}
+		if n := i.listener.Evicted(); n != 0 {
+			log.Printf("input-raw: %d flows or datagrams were evicted to stay within --input-raw-max-flows and --input-raw-max-reassembly", n)
+		}
+		if n := i.listener.BadChecksums(); n != 0 {
+			log.Printf("input-raw: %d packets with an invalid checksum were dropped", n)
+		}
+		if n := i.listener.Untransformed(); n != 0 {
+			log.Printf("input-raw: %d packets that could not be anonymized or redacted were dropped", n)
+		}
+		for label, n := range i.listener.Overflows() {
+			log.Printf("input-raw: %d packets overflowed %s", n, label)
+		}
 		i.Close()
 	}()
 }
 
+// reloadFilterOnHUP reloads the filter file on SIGHUP until the input is closed
+func (i *RAWInput) reloadFilterOnHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			if err := i.listener.ReloadBPFFilterFile(); err != nil {
+				log.Println("input-raw:", err)
+				continue
+			}
+			log.Printf("input-raw: reloaded the BPF filter file %s", i.BPFFilterFile)
+		case <-i.quit:
+			return
+		}
+	}
+}
+
 func (i *RAWInput) messageEmitter(m *tcp.Message) {
 	i.message <- m
 }
 
+func (i *RAWInput) connectionEmitter(ev capture.ConnectionEvent) {
+	kind := "SYN"
+	if ev.ACK {
+		kind = "SYN-ACK"
+	}
+	log.Printf("[INPUT-RAW] %s %s -> %s at %s", kind,
+		net.JoinHostPort(ev.SrcIP.String(), strconv.Itoa(int(ev.SrcPort))),
+		net.JoinHostPort(ev.DstIP.String(), strconv.Itoa(int(ev.DstPort))),
+		ev.Timestamp.Format(time.RFC3339Nano))
+}
+
 func (i *RAWInput) String() string {
-	return fmt.Sprintf("Intercepting traffic from: %s:%s", i.host, strings.Join(strings.Fields(fmt.Sprint(i.ports)), ","))
+	ports := strings.Fields(strings.Trim(fmt.Sprint(i.ports), "[]"))
+	return fmt.Sprintf("Intercepting traffic from: %s:[%s]", i.host, strings.Join(append(ports, i.portRanges...), ","))
 }
 
 // GetStats returns the stats so far and reset the stats
@@ -192,16 +369,21 @@ func (i *RAWInput) GetStats() []tcp.Stats {
 	return i.messageStats
 }
 
-// Close closes the input raw listener
+// Close closes the input raw listener, it returns once the packets dumped are flushed
 func (i *RAWInput) Close() error {
 	i.Lock()
-	defer i.Unlock()
 	if i.closed {
+		i.Unlock()
 		return nil
 	}
 	i.cancelListener()
 	close(i.quit)
 	i.closed = true
+	stopped := i.stopped
+	i.Unlock()
+	if stopped != nil {
+		<-stopped
+	}
 	return nil
 }
 
@@ -234,3 +416,9 @@ func http1EndHint(m *tcp.Message) bool {
 
 	return proto.HasFullPayload(m, m.PacketData()...)
 }
+
+// sctpEndHint ends a message with the last fragment of an SCTP user message
+func sctpEndHint(m *tcp.Message) bool {
+	pckts := m.Packets()
+	return pckts[len(pckts)-1].ChunkFlags&tcp.SCTPEnd != 0
+}
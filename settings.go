@@ -4,8 +4,12 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/buger/goreplay/capture"
 )
 
 // DEMO indicates that goreplay is running in demo mode
@@ -24,6 +28,81 @@ func (h *MultiOption) Set(value string) error {
 	return nil
 }
 
+// MultiPortOption collects ports given as comma separated lists, the flag can be repeated
+type MultiPortOption []uint16
+
+func (h *MultiPortOption) String() string {
+	return fmt.Sprint(*h)
+}
+
+// Set gets called multiple times for each flag with same name
+func (h *MultiPortOption) Set(value string) error {
+	for _, p := range strings.Split(value, ",") {
+		port, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", p)
+		}
+		*h = append(*h, uint16(port))
+	}
+	return nil
+}
+
+// PortRangesOption collects ports and port ranges(e.g 30000-31000) given as comma separated lists, the flag can be repeated
+type PortRangesOption []capture.PortRange
+
+func (h *PortRangesOption) String() string {
+	return fmt.Sprint(*h)
+}
+
+// Set gets called multiple times for each flag with same name
+func (h *PortRangesOption) Set(value string) error {
+	for _, s := range strings.Split(value, ",") {
+		r, err := capture.ParsePortRange(s)
+		if err != nil {
+			return err
+		}
+		*h = append(*h, r)
+	}
+	return nil
+}
+
+// fanoutGroupOption is the ID of a PACKET_FANOUT group
+type fanoutGroupOption uint16
+
+func (g *fanoutGroupOption) String() string {
+	return strconv.Itoa(int(*g))
+}
+
+// Set parses the group ID
+func (g *fanoutGroupOption) Set(value string) error {
+	id, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid fanout group %q", value)
+	}
+	*g = fanoutGroupOption(id)
+	return nil
+}
+
+// TimeOption is a time given in the RFC 3339 format, e.g 2020-01-02T15:04:05Z
+type TimeOption time.Time
+
+func (t *TimeOption) String() string {
+	if time.Time(*t).IsZero() {
+		return ""
+	}
+	return time.Time(*t).Format(time.RFC3339)
+}
+
+// Set parses the time
+func (t *TimeOption) Set(value string) error {
+	v, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return fmt.Errorf("invalid time %q, expected the RFC 3339 format e.g 2020-01-02T15:04:05Z", value)
+	}
+	*t = TimeOption(v)
+	return nil
+}
+
 // AppSettings is the struct of main configuration
 type AppSettings struct {
 	Verbose   int           `json:"verbose"`
@@ -129,18 +208,81 @@ func init() {
 	flag.Var(&Settings.InputRAW, "input-raw", "Capture traffic from given port (use RAW sockets and require *sudo* access):\n\t# Capture traffic from 8080 port\n\tgor --input-raw :8080 --output-http staging.com")
 	flag.BoolVar(&Settings.TrackResponse, "input-raw-track-response", false, "If turned on Gor will track responses in addition to requests, and they will be available to middleware and file output.")
 	flag.Var(&Settings.Engine, "input-raw-engine", "Intercept traffic using `libpcap` (default), `raw_socket` or `pcap_file`")
+	flag.StringVar(&Settings.Transport, "input-raw-transport", "tcp", "Transport protocol of the intercepted traffic: tcp, udp or sctp. The UDP datagrams of a socket pair are grouped into a message until input-raw-expire, the SCTP DATA chunks until the end of their user message")
+	flag.Var((*MultiPortOption)(&Settings.QUICPorts), "input-raw-quic-ports", "UDP ports carrying QUIC, their datagrams are grouped by QUIC connection ID instead of socket pair so that connections can be followed across address changes. Requires --input-raw-transport udp")
 	flag.Var(&Settings.Protocol, "input-raw-protocol", "Specify application protocol of intercepted traffic. Possible values: http, binary")
 	flag.StringVar(&Settings.RealIPHeader, "input-raw-realip-header", "", "If not blank, injects header with given name and real IP value to the request payload. Usually this header should be named: X-Real-IP")
 	flag.DurationVar(&Settings.Expire, "input-raw-expire", time.Second*2, "How much it should wait for the last TCP packet, till consider that TCP message complete.")
 	flag.StringVar(&Settings.BPFFilter, "input-raw-bpf-filter", "", "BPF filter to write custom expressions. Can be useful in case of non standard network interfaces like tunneling or SPAN port. Example: --input-raw-bpf-filter 'dst port 80'")
+	flag.BoolVar(&Settings.DumpBPF, "input-raw-bpf-dump", false, "Log the compiled BPF program of every captured interface, the way tcpdump -d does. Useful to check what a filter compiles to")
+	flag.BoolVar(&Settings.NoFilter, "input-raw-no-filter", false, "Capture every packet of the interfaces, without any BPF filter, when no port and host are given. Meant for diagnostics: the kernel copies all the traffic to GoReplay, which can drop packets on busy interfaces:\n\tgor --input-raw :0 --input-raw-no-filter --output-stdout")
+	flag.DurationVar(&Settings.MaxDuration, "input-raw-max-duration", 0, "Stop capturing after the given duration, e.g 10s. Useful for scripted diagnostic captures")
+	flag.Uint64Var(&Settings.MaxPackets, "input-raw-max-packets", 0, "Stop capturing after reading the given number of packets. Useful for scripted diagnostic captures")
+	flag.StringVar(&Settings.Dump, "input-raw-dump", "", "Write the captured packets to PCAP files named after this prefix, the time and an index:\n\tgor --input-raw :80 --input-raw-dump /tmp/capture --input-raw-dump-size 100mb --input-raw-dump-files 10 --output-stdout")
+	flag.BoolVar(&Settings.DumpInterfaces, "input-raw-dump-per-interface", false, "Write the packets of every interface to their own dump files, with the link type of the interface")
+	flag.BoolVar(&Settings.DumpFlows, "input-raw-dump-per-flow", false, "Write the packets of every TCP connection or UDP flow to its own dump file, named after its addresses and ports. The files are not rotated")
+	flag.Var(&Settings.DumpRotation.MaxSize, "input-raw-dump-size", "Roll over to a new dump file before the current one exceeds this size, like tcpdump -C")
+	flag.DurationVar(&Settings.DumpRotation.MaxAge, "input-raw-dump-rotate", 0, "Roll over to a new dump file once the current one is older than this duration, like tcpdump -G")
+	flag.IntVar(&Settings.DumpRotation.MaxFiles, "input-raw-dump-files", 0, "Number of dump files kept, the oldest ones are deleted, like tcpdump -W")
+	flag.DurationVar(&Settings.DumpRotation.Retention, "input-raw-dump-retention", 0, "Delete the dump files opened before this duration")
+	flag.BoolVar(&Settings.Validate, "input-raw-validate", false, "Check the configuration without capturing: the filter of every interface is compiled and a handle is opened and closed, then gor exits with status 1 if an interface can't be captured")
+	flag.BoolVar(&Settings.IncludeDown, "input-raw-include-down", false, "Also select the interfaces that are down, they are captured once they come up. By default they are skipped")
+	flag.IntVar(&Settings.ParseWorkers, "input-raw-parse-workers", 0, "Number of goroutines parsing the packets of a pcap file read with the pcap_file engine, they are still handled in order")
+	flag.BoolVar(&Settings.Unordered, "input-raw-unordered", false, "Handle the packets parsed by --input-raw-parse-workers as soon as they are parsed, without keeping the order of the pcap file")
+	flag.DurationVar(&Settings.ProgressEvery, "input-raw-progress", 0, "Log the progress of reading a pcap file with the pcap_file engine at this interval, e.g 1m")
+	flag.Var((*TimeOption)(&Settings.StartTime), "input-raw-start-time", "Skip the packets of a pcap file read with the pcap_file engine older than this time, e.g 2020-01-02T15:04:05Z")
+	flag.Var((*TimeOption)(&Settings.EndTime), "input-raw-end-time", "Stop reading a pcap file with the pcap_file engine once its packets reach this time, e.g 2020-01-02T15:09:05Z")
+	flag.IntVar(&Settings.MaxFlows, "input-raw-max-flows", 0, "Maximum number of flows tracked to reassemble fragments and detect connection closes, the least recently seen flows are evicted first")
+	flag.Var(&Settings.MaxReassemblyBytes, "input-raw-max-reassembly", "Maximum bytes buffered to reassemble the IP fragments, e.g 64mb. The oldest datagrams are evicted first")
+	flag.DurationVar(&Settings.Heartbeat, "input-raw-heartbeat", 0, "Check the liveness of the captured interfaces at this interval, e.g 1m. The interfaces whose capture stopped are logged, the others are logged with --verbose 2")
+	flag.StringVar(&Settings.BPFFilterFile, "input-raw-filter-file", "", "File of a BPF filter ANDed with the generated filter of every interface. The comments from # to the end of the lines are ignored, and the filter can span several lines. It is reloaded on SIGHUP")
+	flag.Var((*fanoutGroupOption)(&Settings.FanoutGroup), "input-raw-fanout-group", "With the raw_socket engine, split the traffic of the interfaces between the gor processes given the same group, from 1 to 65535. Both directions of a connection go to the same process")
+	flag.BoolVar(&Settings.ValidateChecksums, "input-raw-validate-checksums", false, "Drop the packets with an invalid IP, TCP or UDP checksum, e.g the corrupt frames of a SPAN port. The packets sent by the host, whose checksums are usually left to the NIC, are not validated")
+	flag.BoolVar(&Settings.PinReaders, "input-raw-pin-readers", false, "Lock the goroutine reading every interface to its own CPU, round-robin over the CPUs of the process")
+	flag.IntVar(&Settings.ReadBatch, "input-raw-read-batch", 0, "Number of packets an interface reads in a row before yielding the CPU to the other interfaces, 0 never yields")
+	flag.IntVar(&Settings.ProcessID, "input-raw-pid", 0, "Only capture the packets of the TCP connections and listening sockets of this process, linux only. The sockets are resolved from /proc and the BPF filter is refreshed every --input-raw-pid-refresh")
+	flag.DurationVar(&Settings.ProcessRefresh, "input-raw-pid-refresh", time.Second, "Interval the sockets of --input-raw-pid are resolved at. The packets of the connections opened and closed between two refreshes are missed, except the ones accepted by a listening socket")
+	flag.StringVar(&Settings.AnonymizeKey, "input-raw-anonymize-key", "", "Pseudonymize the IP addresses of the captured packets with this secret, prefix-preserving like Crypto-PAn. The same secret gives the same addresses across captures. The packets whose addresses can't be found are dropped")
+	flag.Var(&Settings.Redact, "input-raw-redact", "Mask the parts of the TCP and UDP payloads matching this regular expression with '*', before the packets are dumped and parsed. Only the groups of an expression with groups are masked, e.g. 'Authorization: Bearer (\\S+)'. Every packet is scrubbed on its own, a match split across two packets is missed. Can be repeated")
+	flag.BoolVar(&Settings.MonotonicTime, "input-raw-monotonic-time", false, "Time the captured packets on a monotonic clock too, which doesn't jump with the adjustments of the wall clock. The packets of a pcap file are timed from the timestamps of the file")
+	flag.BoolVar(&Settings.NoHostFilter, "input-raw-no-host-filter", false, "Only filter the ports of --input-raw, whatever the addresses of the interfaces, e.g. when floating addresses are added to them while capturing:\n\tgor --input-raw :8080 --input-raw-no-host-filter --output-stdout")
+	flag.DurationVar(&Settings.HealthInterval, "input-raw-tcp-health", 0, "Interval of the reports of the round trip times, windows and retransmissions of the TCP connections, derived from the headers of their packets. They are logged with --verbose:\n\tgor --input-raw :8080 --input-raw-tcp-health 10s --verbose 1 --output-stdout")
+	flag.BoolVar(&Settings.BondMembers, "input-raw-bond-members", false, "Capture the bond and team interfaces on each of their members, linux only. Depending on the driver, capturing a bond may only see the traffic of some of its members:\n\tsudo gor --input-raw bond0:80 --input-raw-bond-members --output-stdout")
+	flag.BoolVar(&Settings.StrictHostMatch, "input-raw-strict-host", false, "Fail to start when no interface matches the host of --input-raw, instead of capturing every interface with an address:\n\tsudo gor --input-raw 10.0.0.5:80 --input-raw-strict-host --output-stdout")
+	flag.BoolVar(&Settings.DecapGTP, "input-raw-decap-gtp", false, "Capture the packets carried by GTP-U, the user plane of the mobile networks. The ports of --input-raw are those of the packets carried:\n\tsudo gor --input-raw :80 --input-raw-decap-gtp --output-stdout")
+	flag.DurationVar(&Settings.DedupWindow, "input-raw-dedup", 0, "Drop the copies of the packets seen within this duration on any captured interface, e.g when the same traffic is mirrored to two SPAN ports:\n\tsudo gor --input-raw eth1:80 --input-raw-dedup 10ms --output-stdout")
+	flag.Var(&Settings.FlowByteBudget, "input-raw-flow-budget", "Forward only the first bytes of payload of every connection or UDP flow, e.g its handshake and first request, the rest is dropped until the connection is closed or idle for 2 minutes:\n\tsudo gor --input-raw :443 --input-raw-flow-budget 4kb --output-stdout")
+	flag.Var((*PortRangesOption)(&Settings.ResponsePorts), "input-raw-response-ports", "Ports or port ranges the responses are sent from, instead of the captured ports, with --input-raw-track-response. Comma separated, can be repeated, e.g for the passive FTP data connections:\n\tsudo gor --input-raw :21 --input-raw-track-response --input-raw-response-ports 20,30000-31000 --output-stdout")
+	flag.Var((*MultiOption)(&Settings.LocalhostAddresses), "input-raw-localhost", "Address captured when the host is localhost, 127.0.0.1 and ::1 by default, can be repeated")
+	flag.Var(&Settings.AttachPoint, "input-raw-attach-point", "Where the packets are captured: `default` captures the packets received and sent, `egress` only the packets sent, once the tc qdisc released them on linux, to time them after the traffic shaping")
+	flag.BoolVar(&Settings.LinkLocal, "input-raw-link-local", false, "Also match the IPv6 link-local addresses, fe80::/10, of the captured interfaces. They are left out of the filter by default, unless an interface has no other address")
+	flag.BoolVar(&Settings.Multicast, "input-raw-multicast", false, "Also capture the packets sent to the multicast groups and to the broadcast addresses of the captured interfaces:\n\tsudo gor --input-raw :5353 --input-raw-transport udp --input-raw-multicast --output-stdout")
+	flag.Var(&Settings.PayloadMatch, "input-raw-match", "Only forward the TCP and UDP packets whose payload matches this regular expression. Every packet is matched on its own. Can be repeated, a packet matching any of them is forwarded")
+	flag.BoolVar(&Settings.MatchOnce, "input-raw-match-once", false, "Only forward the first packet of every connection matching --input-raw-match, its next packets are dropped until it is closed, to catch a rare event:\n\tsudo gor --input-raw :80 --input-raw-match 'HTTP/1.1 5[0-9][0-9]' --input-raw-track-response --input-raw-match-once --output-stdout")
+	flag.Var((*MultiOption)(&Settings.ResponseHosts), "input-raw-response-hosts", "Address or network the responses are sent from, instead of the captured host, with --input-raw-track-response, e.g the virtual address of a load balancer. Can be repeated:\n\tsudo gor --input-raw 10.0.0.5:8080 --input-raw-track-response --input-raw-response-hosts 10.0.1.100 --input-raw-response-ports 443 --output-stdout")
+	flag.Var(&Settings.Segmentation, "input-raw-segmentation", "Normalize the captured TCP segments: `split` splits the segments aggregated by GSO/TSO or GRO on the capturing host into segments of the MSS of the interface, `coalesce` merges the consecutive segments captured back to back, like GRO, `off` by default")
+	flag.IntVar(&Settings.SegmentSize, "input-raw-segment-size", 0, "MSS of the segments split by --input-raw-segmentation split, derived from the MTU of the interface by default, e.g 1448 for the connections with TCP timestamps on a 1500 bytes MTU")
+	flag.Var((*MultiPortOption)(&Settings.ExcludePorts), "input-raw-exclude-ports", "Ports that are never captured, even if they are part of the captured ports. Comma separated, can be repeated:\n\tgor --input-raw :1-10000 --input-raw-exclude-ports 22,9000 --output-stdout")
+	flag.Var((*MultiOption)(&Settings.ExcludeHosts), "input-raw-exclude-hosts", "Host that is never captured, can be repeated:\n\tgor --input-raw :80 --input-raw-exclude-hosts 10.0.0.5 --output-stdout")
+	flag.Var(&Settings.Mode, "input-raw-mode", "`packets` (default) captures the traffic, `connection_events` only captures SYN packets and logs the new connections instead of replaying them")
+	flag.BoolVar(&Settings.SynAck, "input-raw-syn-ack", false, "In connection_events mode, also log the SYN-ACK packets of the captured ports")
 	flag.StringVar(&Settings.TimestampType, "input-raw-timestamp-type", "", "Possible values: PCAP_TSTAMP_HOST, PCAP_TSTAMP_HOST_LOWPREC, PCAP_TSTAMP_HOST_HIPREC, PCAP_TSTAMP_ADAPTER, PCAP_TSTAMP_ADAPTER_UNSYNCED. This values not supported on all systems, GoReplay will tell you available values of you put wrong one.")
 	flag.Var(&Settings.CopyBufferSize, "copy-buffer-size", "Set the buffer size for an individual request (default 5MB)")
 	flag.BoolVar(&Settings.Snaplen, "input-raw-override-snaplen", false, "Override the capture snaplen to be 64k. Required for some Virtualized environments")
-	flag.DurationVar(&Settings.BufferTimeout, "input-raw-buffer-timeout", 0, "set the pcap timeout. for immediate mode don't set this flag")
-	flag.Var(&Settings.BufferSize, "input-raw-buffer-size", "Controls size of the OS buffer which holds packets until they dispatched. Default value depends by system: in Linux around 2MB. If you see big package drop, increase this value.")
-	flag.BoolVar(&Settings.Promiscuous, "input-raw-promisc", false, "enable promiscuous mode")
-	flag.BoolVar(&Settings.Monitor, "input-raw-monitor", false, "enable RF monitor mode")
+	flag.DurationVar(&Settings.BufferTimeout, "input-raw-buffer-timeout", 0, "set the pcap timeout, at least 1ms. A short timeout lowers the latency but wakes up the capture of quiet interfaces. for immediate mode don't set this flag")
+	flag.Var(&Settings.BufferSize, "input-raw-buffer-size", "Controls size of the OS buffer which holds packets until they dispatched. Default value depends by system: in Linux around 2MB. If you see big package drop, increase this value. With the raw_socket engine it sets the size of the ring buffer and SO_RCVBUF of the sockets.")
+	flag.Var(&Settings.InterfaceBufferSize, "input-raw-buffer-size-iface", "Overrides input-raw-buffer-size for an interface, can be repeated. Example: --input-raw-buffer-size-iface eth0=64mb")
+	flag.Var(&Settings.InterfaceSnaplen, "input-raw-snaplen-iface", "Overrides the snapshot length of an interface, from 96 to 262144 bytes, can be repeated. By default it is the MTU of the interface with room for the headers. Example: --input-raw-snaplen-iface eth1=128")
+	flag.BoolVar(&Settings.Promiscuous, "input-raw-promisc", false, "Enable promiscuous mode, the traffic sent to and from the addresses of the interface is captured without it")
+	flag.BoolVar(&Settings.Monitor, "input-raw-monitor", false, "Enable RF monitor mode, libpcap engine only. It doesn't enable promiscuous mode")
+	flag.BoolVar(&Settings.RelativeSeq, "input-raw-relative-seq", false, "Track the sequence numbers of the captured connections to make them relative to their start, like tcpdump does. The connections already open when the capture starts are relative to their first packet captured")
+	flag.BoolVar(&Settings.Immediate, "input-raw-immediate", false, "Deliver packets as soon as they are captured instead of buffering them, lowers latency at the cost of throughput")
+	flag.BoolVar(&Settings.Defragment, "input-raw-defragment", false, "Reassemble the fragmented IP datagrams before parsing them, the fragments of any port are captured and buffered until their datagram is complete")
 	flag.BoolVar(&Settings.Stats, "input-raw-stats", false, "enable stats generator on raw TCP messages")
+	flag.IntVar(&Settings.MaxPPS, "input-raw-max-pps", 0, "Maximum number of captured packets per second, what happens to the packets above the limit is set by --input-raw-overflow")
+	flag.Var(&Settings.MaxBPS, "input-raw-max-bps", "Maximum number of captured payload bytes per second, e.g 10mb. what happens to the packets above the limit is set by --input-raw-overflow")
+	flag.Var(&Settings.Overflow, "input-raw-overflow", "What the capture does with the packets above --input-raw-max-pps or --input-raw-max-bps: `drop-flow` (default) drops the packet along with the packets of its connection captured within the next second, `drop-newest` drops the packet, `drop-oldest` drops the oldest packet queued, `block` waits, it stalls the capture and the kernel drops the packets once its buffer is full")
+	flag.StringVar(&Settings.TLSKeyLog, "input-raw-tls-keylog", "", "Decrypt captured TLS traffic using a NSS key log file, as written by clients honoring SSLKEYLOGFILE. Meant for staging environments only:\n\tgor --input-raw :443 --input-raw-tls-keylog /tmp/sslkeys.log --output-stdout")
 
 	flag.StringVar(&Settings.Middleware, "middleware", "", "Used for modifying traffic using external command")
 
@@ -12,3 +12,20 @@ func TestAppSettings(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestMultiPortOption(t *testing.T) {
+	var ports MultiPortOption
+	for _, v := range []string{"22, 9000", "8080"} {
+		if err := ports.Set(v); err != nil {
+			t.Errorf("%s: expected error to be nil, got %v", v, err)
+		}
+	}
+	if len(ports) != 3 || ports[0] != 22 || ports[1] != 9000 || ports[2] != 8080 {
+		t.Errorf("unexpected ports %v", ports)
+	}
+	for _, v := range []string{"ssh", "70000", ""} {
+		if err := ports.Set(v); err == nil {
+			t.Errorf("%q: expected an error", v)
+		}
+	}
+}
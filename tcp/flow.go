@@ -0,0 +1,229 @@
+package tcp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// FlowKey identifies a TCP connection, both directions of a connection have the same key.
+// endpoints are ordered, A is the endpoint with the lowest address and port, so A is not
+// necessarily the client of the connection.
+// IPv4 addresses are stored in their IPv6-mapped form, FlowKey is comparable and can be used as a map key.
+type FlowKey struct {
+	AddrA, AddrB [16]byte
+	PortA, PortB uint16
+	ConnID       string // QUIC connection ID, the addresses and ports are empty when it is set
+}
+
+// NewFlowKey returns the key of the connection of a packet sent from src to dst,
+// reversed is true when the packet was sent from B to A
+func NewFlowKey(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16) (key FlowKey, reversed bool) {
+	copy(key.AddrA[:], srcIP.To16())
+	copy(key.AddrB[:], dstIP.To16())
+	key.PortA, key.PortB = srcPort, dstPort
+	if c := bytes.Compare(key.AddrA[:], key.AddrB[:]); c > 0 || c == 0 && srcPort > dstPort {
+		key.AddrA, key.AddrB = key.AddrB, key.AddrA
+		key.PortA, key.PortB = key.PortB, key.PortA
+		reversed = true
+	}
+	return
+}
+
+// Hash returns a hash of the key, the same for both directions of the connection since the key is,
+// e.g to dispatch the flows to several workers
+func (key FlowKey) Hash() uint32 {
+	// FNV-1a
+	h := uint32(2166136261)
+	add := func(b byte) {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	for _, b := range key.AddrA {
+		add(b)
+	}
+	for _, b := range key.AddrB {
+		add(b)
+	}
+	add(byte(key.PortA >> 8))
+	add(byte(key.PortA))
+	add(byte(key.PortB >> 8))
+	add(byte(key.PortB))
+	for i := 0; i < len(key.ConnID); i++ {
+		add(key.ConnID[i])
+	}
+	// the low bits of FNV are poorly mixed, they select the worker
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// NewQUICFlowKey returns the key of a QUIC connection identified by connID, it doesn't hold
+// addresses since QUIC connections can migrate to other addresses and ports
+func NewQUICFlowKey(connID []byte) FlowKey {
+	return FlowKey{ConnID: string(connID)}
+}
+
+// A returns the socket address of endpoint A
+func (key FlowKey) A() string {
+	return fmt.Sprintf("%s:%d", net.IP(key.AddrA[:]), key.PortA)
+}
+
+// B returns the socket address of endpoint B
+func (key FlowKey) B() string {
+	return fmt.Sprintf("%s:%d", net.IP(key.AddrB[:]), key.PortB)
+}
+
+func (key FlowKey) String() string {
+	if key.ConnID != "" {
+		return fmt.Sprintf("quic-%x", key.ConnID)
+	}
+	return key.A() + "-" + key.B()
+}
+
+// CloseReason tells how a connection was closed
+type CloseReason uint8
+
+// Reasons of a connection close
+const (
+	// CloseHalf is when only one side has sent a FIN, the other side can still send data
+	CloseHalf CloseReason = iota
+	// CloseFIN is when both sides have sent a FIN
+	CloseFIN
+	// CloseRST is when the connection is reset
+	CloseRST
+)
+
+func (reason CloseReason) String() string {
+	switch reason {
+	case CloseHalf:
+		return "half-close"
+	case CloseFIN:
+		return "fin"
+	case CloseRST:
+		return "rst"
+	default:
+		return ""
+	}
+}
+
+// SeqTracker sets the relative sequence numbers of packets, they are relative to the
+// initial sequence number when the SYN was seen, or else to the first packet seen in that direction,
+// the packets of such a mid-stream direction have MidStream set.
+// packets received out of order before the first one wrap around.
+type SeqTracker struct {
+	sync.Mutex
+	expire    time.Duration
+	flows     map[FlowKey]*seqBase
+	last      time.Time
+	midStream uint64 // flows first seen without their handshake
+}
+
+type seqBase struct {
+	seq  [2]uint32 // base of packets from A, from B
+	set  [2]bool
+	syn  [2]bool // the base is the initial sequence number
+	seen time.Time
+}
+
+// NewSeqTracker returns a new tracker, a flow is forgotten after being idle for expire, default is 2 minutes
+func NewSeqTracker(expire time.Duration) *SeqTracker {
+	t := new(SeqTracker)
+	t.expire = expire
+	if t.expire <= 0 {
+		t.expire = 2 * time.Minute
+	}
+	t.flows = make(map[FlowKey]*seqBase)
+	return t
+}
+
+// Track sets pckt.RelSeq, pckt.Flow must have been set by ParsePacket
+func (t *SeqTracker) Track(pckt *Packet) {
+	t.Lock()
+	defer t.Unlock()
+	t.evict(pckt.Timestamp)
+	base, ok := t.flows[pckt.Flow]
+	if pckt.RST {
+		delete(t.flows, pckt.Flow)
+		if ok {
+			i := dirIndex(pckt.Reversed)
+			pckt.RelSeq, pckt.MidStream = pckt.Seq-base.seq[i], !base.syn[i]
+		}
+		return
+	}
+	if !ok {
+		base = new(seqBase)
+		t.flows[pckt.Flow] = base
+		if !pckt.SYN {
+			t.midStream++
+		}
+	}
+	base.seen = pckt.Timestamp
+	i := dirIndex(pckt.Reversed)
+	if pckt.SYN {
+		// the SYN consumes one sequence number
+		base.seq[i], base.set[i], base.syn[i] = pckt.Seq+1, true, true
+		if pckt.ACK && !base.set[1-i] {
+			// the SYN-ACK acknowledges the SYN that was missed
+			base.seq[1-i], base.set[1-i], base.syn[1-i] = pckt.Ack, true, true
+		}
+		pckt.RelSeq = 0
+		return
+	}
+	if !base.set[i] {
+		base.seq[i], base.set[i] = pckt.Seq, true
+	}
+	pckt.RelSeq, pckt.MidStream = pckt.Seq-base.seq[i], !base.syn[i]
+}
+
+// ISN returns the initial sequence number of a direction of a flow, the one of B when reversed is true,
+// it reports false when the handshake of the flow wasn't seen
+func (t *SeqTracker) ISN(flow FlowKey, reversed bool) (uint32, bool) {
+	t.Lock()
+	defer t.Unlock()
+	base, ok := t.flows[flow]
+	if !ok || !base.syn[dirIndex(reversed)] {
+		return 0, false
+	}
+	return base.seq[dirIndex(reversed)] - 1, true
+}
+
+// MidStreamFlows returns the number of flows whose first packet seen was not a SYN, their sequence numbers
+// are relative to the first packet seen. a connection opened again on the same addresses and ports
+// is counted again
+func (t *SeqTracker) MidStreamFlows() uint64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.midStream
+}
+
+// Flows returns the number of flows being tracked
+func (t *SeqTracker) Flows() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.flows)
+}
+
+func (t *SeqTracker) evict(now time.Time) {
+	if now.Sub(t.last) < t.expire {
+		return
+	}
+	t.last = now
+	for key, base := range t.flows {
+		if now.Sub(base.seen) > t.expire {
+			delete(t.flows, key)
+		}
+	}
+}
+
+func dirIndex(reversed bool) int {
+	if reversed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,145 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func generateIPv6Packet(src, dst net.IP, srcPort, dstPort uint16, seq uint32, payload []byte) []byte {
+	data := make([]byte, 4+40+20, 4+40+20+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(layers.ProtocolFamilyIPv6Linux))
+	ip := data[4:]
+	ip[0] = 6 << 4
+	binary.BigEndian.PutUint16(ip[4:], uint16(20+len(payload)))
+	ip[6] = uint8(layers.IPProtocolTCP)
+	copy(ip[8:24], src)
+	copy(ip[24:40], dst)
+	tcp := ip[40:]
+	binary.BigEndian.PutUint16(tcp, srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	return append(data, payload...)
+}
+
+func TestFlowKeyIPv4(t *testing.T) {
+	req := GetPackets(true, 100, 1, []byte("GET / HTTP/1.1\r\n\r\n"))[0]
+	resp := GetPackets(false, 500, 1, []byte("HTTP/1.1 200 OK\r\n\r\n"))[0]
+	if req.Flow != resp.Flow {
+		t.Errorf("expected the same flow key for both directions, got %s and %s", req.Flow, resp.Flow)
+	}
+	if req.Reversed == resp.Reversed {
+		t.Error("expected the request and the response to have opposite directions")
+	}
+	// 127.0.0.1:5535 is lower than 127.0.0.1:8000
+	if req.Reversed || req.Flow.A() != "127.0.0.1:5535" || req.Flow.B() != "127.0.0.1:8000" {
+		t.Errorf("wrong flow key %s, reversed %v", req.Flow, req.Reversed)
+	}
+	flows := map[FlowKey]int{req.Flow: 1}
+	if flows[resp.Flow] != 1 {
+		t.Error("expected the flow key to be usable as a map key")
+	}
+}
+
+func TestFlowKeyIPv6(t *testing.T) {
+	client, server := net.ParseIP("fe80::2"), net.ParseIP("fe80::1")
+	ci := &gopacket.CaptureInfo{Timestamp: time.Now()}
+	data := generateIPv6Packet(client, server, 40000, 80, 1, []byte("GET / HTTP/1.1\r\n\r\n"))
+	ci.Length, ci.CaptureLength = len(data), len(data)
+	req, err := ParsePacket(data, int(layers.LinkTypeLoop), 4, ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = generateIPv6Packet(server, client, 80, 40000, 1, []byte("HTTP/1.1 200 OK\r\n\r\n"))
+	ci.Length, ci.CaptureLength = len(data), len(data)
+	resp, err := ParsePacket(data, int(layers.LinkTypeLoop), 4, ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Flow != resp.Flow || req.Flow.String() != "fe80::1:80-fe80::2:40000" {
+		t.Errorf("wrong flow keys %s and %s", req.Flow, resp.Flow)
+	}
+	if !req.Reversed || resp.Reversed {
+		t.Errorf("expected the request to be reversed, got %v and %v", req.Reversed, resp.Reversed)
+	}
+
+	// an IPv4 address and its IPv6-mapped form are the same endpoint
+	key4, _ := NewFlowKey(net.IP{10, 0, 0, 1}, 1, net.IP{10, 0, 0, 2}, 2)
+	key6, _ := NewFlowKey(net.ParseIP("::ffff:10.0.0.1"), 1, net.ParseIP("::ffff:10.0.0.2"), 2)
+	if key4 != key6 {
+		t.Errorf("expected %s to equal %s", key4, key6)
+	}
+}
+
+func TestSeqTracker(t *testing.T) {
+	tracker := NewSeqTracker(0)
+	syn := GetPackets(true, 1000, 1, []byte{0})[0]
+	syn.SYN, syn.Payload = true, nil
+	tracker.Track(syn)
+	for i, seq := range []uint32{1001, 1011} {
+		p := GetPackets(true, seq, 1, []byte("0123456789"))[0]
+		tracker.Track(p)
+		if p.RelSeq != uint32(i*10) || p.MidStream {
+			t.Errorf("expected relative seq %d, got %d mid-stream %t", i*10, p.RelSeq, p.MidStream)
+		}
+	}
+	if isn, ok := tracker.ISN(syn.Flow, syn.Reversed); !ok || isn != 1000 {
+		t.Errorf("expected the initial sequence number 1000, got %d", isn)
+	}
+	// no SYN seen for the responses, the first packet is the base
+	for i, seq := range []uint32{7000, 7010} {
+		p := GetPackets(false, seq, 1, []byte("0123456789"))[0]
+		tracker.Track(p)
+		if p.RelSeq != uint32(i*10) || !p.MidStream {
+			t.Errorf("expected relative seq %d mid-stream, got %d", i*10, p.RelSeq)
+		}
+	}
+	if _, ok := tracker.ISN(syn.Flow, !syn.Reversed); ok {
+		t.Error("expected no initial sequence number of the responses")
+	}
+	if tracker.MidStreamFlows() != 0 {
+		t.Errorf("expected the flow not to be mid-stream, got %d", tracker.MidStreamFlows())
+	}
+	if tracker.Flows() != 1 {
+		t.Errorf("expected 1 flow, got %d", tracker.Flows())
+	}
+	rst := GetPackets(false, 7020, 1, []byte{0})[0]
+	rst.RST = true
+	tracker.Track(rst)
+	if tracker.Flows() != 0 || rst.RelSeq != 20 {
+		t.Errorf("expected the flow to be forgotten on reset, got %d flows, relative seq %d", tracker.Flows(), rst.RelSeq)
+	}
+
+	// the SYN-ACK tells the initial sequence number of the SYN that was missed
+	synAck := GetPackets(false, 5000, 1, []byte{0})[0]
+	synAck.SYN, synAck.ACK, synAck.Ack, synAck.Payload = true, true, 1001, nil
+	tracker.Track(synAck)
+	p := GetPackets(true, 1001, 1, []byte("0123456789"))[0]
+	tracker.Track(p)
+	if p.RelSeq != 0 || p.MidStream {
+		t.Errorf("expected relative seq 0, got %d mid-stream %t", p.RelSeq, p.MidStream)
+	}
+	// a flow first seen without its handshake is mid-stream
+	p = GetPackets(true, 3000, 1, []byte("0123456789"))[0]
+	p.SrcPort++
+	p.Flow, p.Reversed = NewFlowKey(p.SrcIP, p.SrcPort, p.DstIP, p.DstPort)
+	tracker.Track(p)
+	if !p.MidStream || tracker.MidStreamFlows() != 1 {
+		t.Errorf("expected 1 mid-stream flow, got %d", tracker.MidStreamFlows())
+	}
+}
+
+func TestQUICFlowKey(t *testing.T) {
+	key := NewQUICFlowKey([]byte{0xca, 0xfe})
+	if key != NewQUICFlowKey([]byte{0xca, 0xfe}) || key == NewQUICFlowKey([]byte{0xca}) {
+		t.Error("expected the keys of the same connection id to be equal")
+	}
+	if key.String() != "quic-cafe" {
+		t.Errorf("wrong key string %s", key)
+	}
+}
@@ -0,0 +1,88 @@
+package tcp
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+)
+
+// ProtoSCTP is the protocol number of SCTP
+const ProtoSCTP = 132
+
+// sctpData is the type of the DATA chunks, see RFC 4960 section 3.3.1
+const sctpData = 0
+
+// Flags of the SCTP DATA chunks, set in Packet.ChunkFlags
+const (
+	SCTPEnd       = 1 << 0 // last fragment of a user message
+	SCTPBegin     = 1 << 1 // first fragment of a user message
+	SCTPUnordered = 1 << 2 // the message is delivered regardless of its stream sequence number
+)
+
+// ParseSCTPPacket parses the DATA chunks of an SCTP packet, every chunk is returned as a Packet, in the
+// order they are bundled. the chunks of the other types are skipped, ErrNoPayload is returned when the
+// packet has no DATA chunk. the user data of the chunks is in their Payload, Seq is their TSN.
+// the last chunk of a truncated packet carries the part of its data that was captured
+func ParseSCTPPacket(data []byte, lType, lTypeLen int, cp *gopacket.CaptureInfo) (pckts []*Packet, err error) {
+	pckt, ndata, err := parseNetwork(data, lTypeLen, cp, ProtoSCTP)
+	if err != nil {
+		return nil, err
+	}
+	// common header
+	if len(ndata) < 12 {
+		packetPool.Put(pckt)
+		return nil, ErrHdrLength("SCTP")
+	}
+	pckt.SrcPort = binary.BigEndian.Uint16(ndata[0:2])
+	pckt.DstPort = binary.BigEndian.Uint16(ndata[2:4])
+	pckt.Flow, pckt.Reversed = NewFlowKey(pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort)
+	pckt.RelSeq, pckt.Ack, pckt.MidStream = 0, 0, false
+	pckt.ACK, pckt.SYN, pckt.FIN, pckt.RST = false, false, false, false
+	template := *pckt
+	template.Payload = nil
+	packetPool.Put(pckt)
+
+	for chunks := ndata[12:]; len(chunks) >= 4; {
+		kind, flags := chunks[0], chunks[1]
+		length := int(binary.BigEndian.Uint16(chunks[2:4]))
+		if length < 4 {
+			return nil, ErrHdrInvalid("SCTP chunk's length")
+		}
+		chunk := chunks
+		if length < len(chunks) {
+			chunk = chunks[:length]
+		}
+		// chunks are padded to 4 bytes
+		if padded := (length + 3) &^ 3; padded < len(chunks) {
+			chunks = chunks[padded:]
+		} else {
+			chunks = nil
+		}
+		if kind != sctpData {
+			continue
+		}
+		if len(chunk) < 16 {
+			if len(chunks) == 0 {
+				break // truncated
+			}
+			return nil, ErrHdrInvalid("SCTP DATA chunk's length")
+		}
+		if len(chunk) == 16 {
+			continue
+		}
+		p := packetPool.Get().(*Packet)
+		payload := p.Payload
+		*p = template
+		p.ChunkFlags = flags
+		p.Seq = binary.BigEndian.Uint32(chunk[4:8])
+		p.StreamID = binary.BigEndian.Uint16(chunk[8:10])
+		p.StreamSeq = binary.BigEndian.Uint16(chunk[10:12])
+		p.PPID = binary.BigEndian.Uint32(chunk[12:16])
+		p.Payload = copySlice(payload, chunk[16:])
+		pckts = append(pckts, p)
+	}
+	if len(pckts) == 0 {
+		return nil, ErrNoPayload
+	}
+	return pckts, nil
+}
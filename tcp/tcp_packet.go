@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -34,96 +35,203 @@ type Packet struct {
 	messageID          uint64
 	SrcIP, DstIP       net.IP
 	Version            uint8
+	Proto              uint8 // transport protocol, ProtoTCP, ProtoUDP or ProtoSCTP
 	SrcPort, DstPort   uint16
 	Ack, Seq           uint32
 	ACK, SYN, FIN, RST bool
-	Lost               uint32
+	Window             uint16 // receive window advertised by the sender, before it is scaled
+	WindowScale        int8   // shift of the window scale option of a SYN packet, -1 when there is none
+	Lost               uint32 // bytes of the packet that were not captured, see Truncated
 	Retry              int
 	Timestamp          time.Time
 	Payload            []byte
+	Flow               FlowKey // same for both directions of the connection
+	Reversed           bool    // the packet was sent from Flow.B to Flow.A, A and B are ordered by address, not by role
+	RelSeq             uint32  // Seq relative to the start of this direction of the flow, set by SeqTracker
+	MidStream          bool    // the SYN of this direction was missed, RelSeq is relative to the first packet seen
+	// Monotonic is the time the packet was read since the start of the capture, on a monotonic clock.
+	// unlike Timestamp it doesn't jump with the adjustments of the wall clock, it is only set on demand
+	Monotonic time.Duration
+	// the SCTP DATA chunk of the packet, see ParseSCTPPacket
+	StreamID, StreamSeq uint16
+	PPID                uint32 // payload protocol identifier
+	ChunkFlags          uint8  // SCTPBegin, SCTPEnd and SCTPUnordered
 }
 
 // ParsePacket parse raw packets
 func ParsePacket(data []byte, lType, lTypeLen int, cp *gopacket.CaptureInfo) (pckt *Packet, err error) {
-	pckt = packetPool.Get().(*Packet)
-	pckt.Retry = 0
-	pckt.messageID = 0
+	return parsePacket(data, lType, lTypeLen, cp, false)
+}
 
-	// TODO: check resolution
-	pckt.Timestamp = cp.Timestamp
+// ParsePacketHeaders is like ParsePacket but accepts packets without payload, e.g SYN or pure ACK packets
+func ParsePacketHeaders(data []byte, lType, lTypeLen int, cp *gopacket.CaptureInfo) (pckt *Packet, err error) {
+	return parsePacket(data, lType, lTypeLen, cp, true)
+}
+
+func parsePacket(data []byte, lType, lTypeLen int, cp *gopacket.CaptureInfo, allowEmpty bool) (pckt *Packet, err error) {
+	pckt, ndata, err := parseNetwork(data, lTypeLen, cp, ProtoTCP)
+	if err != nil {
+		return nil, err
+	}
+	// TCP header
+	if len(ndata) < 20 {
+		return nil, ErrHdrLength("TCP")
+	}
+	dOf := int(ndata[12]>>4) * 4
+	if dOf < 20 {
+		return nil, ErrHdrInvalid("TCP's data offset")
+	}
+	if len(ndata) < dOf {
+		return nil, ErrHdrLength("TCP opts")
+	}
+
+	if len(ndata[dOf:]) == 0 && !allowEmpty {
+		return nil, ErrNoPayload
+	}
+
+	transLayer := ndata[:dOf]
+
+	pckt.SrcPort = binary.BigEndian.Uint16(transLayer[0:2])
+	pckt.DstPort = binary.BigEndian.Uint16(transLayer[2:4])
+	pckt.Flow, pckt.Reversed = NewFlowKey(pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort)
+	pckt.RelSeq, pckt.MidStream = 0, false
+	pckt.Seq = binary.BigEndian.Uint32(transLayer[4:8])
+	pckt.Ack = binary.BigEndian.Uint32(transLayer[8:12])
+	pckt.FIN = transLayer[13]&0x01 != 0
+	pckt.SYN = transLayer[13]&0x02 != 0
+	pckt.RST = transLayer[13]&0x04 != 0
+	pckt.ACK = transLayer[13]&0x10 != 0
+	pckt.Window = binary.BigEndian.Uint16(transLayer[14:16])
+	if pckt.SYN {
+		pckt.WindowScale = windowScale(transLayer[20:])
+	}
+	pckt.Payload = copySlice(pckt.Payload, ndata[dOf:])
+	return
+}
+
+// windowScale returns the shift of the window scale option, see RFC 7323 section 2
+func windowScale(opts []byte) int8 {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0: // end of the options
+			return -1
+		case 1: // no-operation
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return -1
+		}
+		if opts[0] == 3 && opts[1] == 3 {
+			if opts[2] > 14 {
+				return 14
+			}
+			return int8(opts[2])
+		}
+		opts = opts[opts[1]:]
+	}
+	return -1
+}
+
+// ParseUDPPacket parses a raw UDP datagram, the TCP fields of the packet are left empty
+func ParseUDPPacket(data []byte, lType, lTypeLen int, cp *gopacket.CaptureInfo) (pckt *Packet, err error) {
+	pckt, ndata, err := parseNetwork(data, lTypeLen, cp, ProtoUDP)
+	if err != nil {
+		return nil, err
+	}
+	// UDP header
+	if len(ndata) < 8 {
+		return nil, ErrHdrLength("UDP")
+	}
+	end := int(binary.BigEndian.Uint16(ndata[4:6]))
+	if end < 8 {
+		return nil, ErrHdrInvalid("UDP's length")
+	}
+	if end > len(ndata) { // truncated by the snaplen
+		end = len(ndata)
+	}
+	if end == 8 {
+		return nil, ErrNoPayload
+	}
 
+	pckt.SrcPort = binary.BigEndian.Uint16(ndata[0:2])
+	pckt.DstPort = binary.BigEndian.Uint16(ndata[2:4])
+	pckt.Flow, pckt.Reversed = NewFlowKey(pckt.SrcIP, pckt.SrcPort, pckt.DstIP, pckt.DstPort)
+	pckt.RelSeq, pckt.Seq, pckt.Ack, pckt.MidStream = 0, 0, 0, false
+	pckt.ACK, pckt.SYN, pckt.FIN, pckt.RST = false, false, false, false
+	pckt.Payload = copySlice(pckt.Payload, ndata[8:end])
+	return
+}
+
+// parseNetwork parses the IP header of the packet, it returns the data following the header
+// when the packet carries the transport protocol proto
+func parseNetwork(data []byte, lTypeLen int, cp *gopacket.CaptureInfo, proto byte) (pckt *Packet, ndata []byte, err error) {
 	if len(data) < lTypeLen {
-		return nil, ErrHdrLength("Link")
+		return nil, nil, ErrHdrLength("Link")
 	}
 	if len(data) <= lTypeLen {
-		return nil, ErrHdrMissing("IPv4 or IPv6")
+		return nil, nil, ErrHdrMissing("IPv4 or IPv6")
 	}
 
 	ldata := data[lTypeLen:]
-	var proto byte
-	var netLayer, transLayer []byte
+	var nextProto byte
+	var netLayer []byte
 
 	if ldata[0]>>4 == 4 {
 		// IPv4 header
 		if len(ldata) < 20 {
-			return nil, ErrHdrLength("IPv4")
+			return nil, nil, ErrHdrLength("IPv4")
 		}
-		proto = ldata[9]
+		nextProto = ldata[9]
 		ihl := int(ldata[0]&0x0F) * 4
 		if ihl < 20 {
-			return nil, ErrHdrInvalid("IPv4's IHL")
+			return nil, nil, ErrHdrInvalid("IPv4's IHL")
 		}
 		if len(ldata) < ihl {
-			return nil, ErrHdrLength("IPv4 opts")
+			return nil, nil, ErrHdrLength("IPv4 opts")
 		}
 		netLayer = ldata[:ihl]
 	} else if ldata[0]>>4 == 6 {
 		if len(ldata) < 40 {
-			return nil, ErrHdrLength("IPv6")
+			return nil, nil, ErrHdrLength("IPv6")
 		}
-		proto = ldata[6]
+		nextProto = ldata[6]
 		totalLen := 40
-		for ipv6ExtensionHdr(proto) {
+		for ipv6ExtensionHdr(nextProto) {
 			hdr := len(ldata) - totalLen
 			if hdr < 8 {
-				return nil, ErrHdrExpected("IPv6 opts")
+				return nil, nil, ErrHdrExpected("IPv6 opts")
 			}
 			extLen := 8
-			if proto != 44 {
+			if nextProto != 44 {
 				extLen = int(ldata[totalLen+1]+1) * 8
 			}
 			if hdr < extLen {
-				return nil, ErrHdrLength("IPv6 opts")
+				return nil, nil, ErrHdrLength("IPv6 opts")
 			}
-			proto = ldata[totalLen]
+			nextProto = ldata[totalLen]
 			totalLen += extLen
 		}
 		netLayer = ldata[:totalLen]
 	} else {
-		return nil, ErrHdrExpected("IPv4 or IPv6")
-	}
-	if proto != 6 {
-		return nil, ErrHdrExpected("TCP")
-	}
-	if len(data) <= len(netLayer) {
-		return nil, ErrHdrMissing("TCP")
-	}
-	ndata := ldata[len(netLayer):]
-	// TCP header
-	if len(ndata) < 20 {
-		return nil, ErrHdrLength("TCP")
+		return nil, nil, ErrHdrExpected("IPv4 or IPv6")
 	}
-	dOf := int(ndata[12]>>4) * 4
-	if dOf < 20 {
-		return nil, ErrHdrInvalid("TCP's ndata offset")
+	if nextProto != proto {
+		return nil, nil, ErrHdrExpected(protoName(proto))
 	}
-	if len(ndata) < dOf {
-		return nil, ErrHdrLength("TCP opts")
+	if len(ldata) <= len(netLayer) {
+		return nil, nil, ErrHdrMissing(protoName(proto))
 	}
 
-	if len(ndata[dOf:]) == 0 {
-		return nil, fmt.Errorf("Packet without Data")
-	}
+	pckt = packetPool.Get().(*Packet)
+	pckt.Retry = 0
+	pckt.messageID = 0
+	pckt.Proto = proto
+	pckt.Window, pckt.WindowScale = 0, -1
+	pckt.StreamID, pckt.StreamSeq, pckt.PPID, pckt.ChunkFlags = 0, 0, 0, 0
+
+	// TODO: check resolution
+	pckt.Timestamp = cp.Timestamp
 
 	if (netLayer[0] >> 4) == 4 {
 		// IPv4 header
@@ -136,20 +244,24 @@ func ParsePacket(data []byte, lType, lTypeLen int, cp *gopacket.CaptureInfo) (pc
 		pckt.SrcIP = netLayer[8:24]
 		pckt.DstIP = netLayer[24:40]
 	}
+	pckt.Lost = uint32(cp.Length - cp.CaptureLength)
+	return pckt, ldata[len(netLayer):], nil
+}
 
-	transLayer = ndata[:dOf]
+// Transport protocol numbers of the packets
+const (
+	ProtoTCP = 6
+	ProtoUDP = 17
+)
 
-	pckt.SrcPort = binary.BigEndian.Uint16(transLayer[0:2])
-	pckt.DstPort = binary.BigEndian.Uint16(transLayer[2:4])
-	pckt.Seq = binary.BigEndian.Uint32(transLayer[4:8])
-	pckt.Ack = binary.BigEndian.Uint32(transLayer[8:12])
-	pckt.FIN = transLayer[13]&0x01 != 0
-	pckt.SYN = transLayer[13]&0x02 != 0
-	pckt.RST = transLayer[13]&0x04 != 0
-	pckt.ACK = transLayer[13]&0x10 != 0
-	pckt.Lost = uint32(cp.Length - cp.CaptureLength)
-	pckt.Payload = copySlice(pckt.Payload, ndata[dOf:])
-	return
+func protoName(proto byte) string {
+	switch proto {
+	case ProtoUDP:
+		return "UDP"
+	case ProtoSCTP:
+		return "SCTP"
+	}
+	return "TCP"
 }
 
 func (pckt *Packet) MessageID() uint64 {
@@ -162,6 +274,12 @@ func (pckt *Packet) MessageID() uint64 {
 	return pckt.messageID
 }
 
+// Truncated reports whether the packet was cut by the snapshot length of the capture,
+// its payload is then incomplete
+func (pckt *Packet) Truncated() bool {
+	return pckt.Lost != 0
+}
+
 // Src returns the source socket of a packet
 func (pckt *Packet) Src() string {
 	return fmt.Sprintf("%s:%d", pckt.SrcIP, pckt.SrcPort)
@@ -172,6 +290,9 @@ func (pckt *Packet) Dst() string {
 	return fmt.Sprintf("%s:%d", pckt.DstIP, pckt.DstPort)
 }
 
+// ErrNoPayload is returned when a packet doesn't carry data
+var ErrNoPayload = errors.New("Packet without Data")
+
 // ErrHdrLength returned on short header length
 type ErrHdrLength string
 
@@ -41,6 +41,25 @@ func generateHeader(request bool, seq uint32, length uint16) []byte {
 	return hdr
 }
 
+func generateUDPDatagram(payload []byte, length uint16) []byte {
+	d := make([]byte, 4+20+8, 4+20+8+len(payload))
+	binary.BigEndian.PutUint32(d, uint32(layers.ProtocolFamilyIPv4))
+
+	ip := d[4:]
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:4], 20+length)
+	ip[9] = uint8(layers.IPProtocolUDP)
+	copy(ip[12:16], []byte{127, 0, 0, 1})
+	copy(ip[16:], []byte{127, 0, 0, 2})
+
+	// set udp header
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp, 5535)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], length)
+	return append(d, payload...)
+}
+
 func GetPackets(request bool, start uint32, _len int, payload []byte) []*Packet {
 	var packets = make([]*Packet, _len)
 	for i := start; i < start+uint32(_len); i++ {
@@ -56,6 +75,41 @@ func GetPackets(request bool, start uint32, _len int, payload []byte) []*Packet
 	return packets
 }
 
+func TestParseUDPPacket(t *testing.T) {
+	parse := func(d []byte) (*Packet, error) {
+		ci := &gopacket.CaptureInfo{Length: len(d), CaptureLength: len(d), Timestamp: time.Now()}
+		return ParseUDPPacket(d, int(layers.LinkTypeLoop), 4, ci)
+	}
+	pckt, err := parse(generateUDPDatagram([]byte("query"), 8+5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pckt.Proto != ProtoUDP || pckt.Src() != "127.0.0.1:5535" || pckt.Dst() != "127.0.0.2:53" || string(pckt.Payload) != "query" {
+		t.Errorf("wrong UDP packet %+v", pckt)
+	}
+	if pckt.Seq != 0 || pckt.Ack != 0 || pckt.SYN || pckt.FIN {
+		t.Errorf("expected the TCP fields to be empty, got %+v", pckt)
+	}
+
+	// the ethernet padding after the datagram is not part of the payload
+	if pckt, err = parse(generateUDPDatagram([]byte("query\x00\x00"), 8+5)); err != nil || string(pckt.Payload) != "query" {
+		t.Errorf("expected the payload to end at the UDP length, got %q %v", pckt.Payload, err)
+	}
+	if _, err = parse(generateUDPDatagram(nil, 8)); err == nil {
+		t.Error("expected an error for a datagram without payload")
+	}
+	if _, err = parse(generateUDPDatagram([]byte("query"), 4)); err == nil {
+		t.Error("expected an error for an invalid UDP length")
+	}
+	d := append(generateHeader(true, 1, 5), "hello"...)
+	if _, err = parse(d); err == nil {
+		t.Error("expected an error for a TCP packet")
+	}
+	if _, err = ParsePacket(generateUDPDatagram([]byte("query"), 8+5), int(layers.LinkTypeLoop), 4, &gopacket.CaptureInfo{}); err == nil {
+		t.Error("expected ParsePacket to reject a UDP datagram")
+	}
+}
+
 func TestRequestResponseMapping(t *testing.T) {
 	packets := []*Packet{
 		{SrcPort: 60000, DstPort: 80, Ack: 1, Seq: 1, Timestamp: time.Unix(1, 0), Payload: []byte("GET / HTTP/1.1\r\n")},